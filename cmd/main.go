@@ -16,28 +16,52 @@ import (
 )
 
 func main() {
-	// Create Kubernetes clientset
-	clientset, err := kubernetes.NewClientset()
+	// Load server configuration
+	serverConfig := server.NewConfig()
+
+	// Load every configured cluster
+	registry, err := kubernetes.LoadRegistry(kubernetes.KubeconfigPaths(), serverConfig.CacheResync)
+	if err != nil {
+		panic("Error loading cluster configuration: " + err.Error())
+	}
+	for _, info := range registry.Infos() {
+		if info.Status == kubernetes.StatusDegraded {
+			println("Cluster " + info.Name + " is degraded: " + info.Error)
+		}
+	}
+
+	// Open the local store, audit sinks and revision history
+	services, err := server.NewServices(serverConfig)
 	if err != nil {
-		panic("Error creating Kubernetes clientset: " + err.Error())
+		panic("Error opening local services: " + err.Error())
+	}
+	defer services.Close()
+	if err := services.WatchHistory(registry); err != nil {
+		panic("Error watching revision history: " + err.Error())
 	}
 
+	// Start the RBAC caches of every cluster
+	cacheCtx, stopCache := context.WithCancel(context.Background())
+	defer stopCache()
+	registry.Start(cacheCtx)
+
 	// Create Echo instance
 	e := echo.New()
 
 	// CORS
 	e.Use(echo.WrapMiddleware(cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
+		ExposedHeaders:   []string{echo.HeaderXRequestID, "ETag"},
 		AllowCredentials: true,
 	}).Handler))
 
-	// Load server configuration
-	serverConfig := server.NewConfig()
+	// Request IDs and error responses
+	server.RegisterMiddleware(e)
 
 	// Register routes
-	server.RegisterRoutes(e, clientset, serverConfig)
+	server.RegisterRoutes(e, registry, services, serverConfig)
 
 	// Start server
 	go func() {
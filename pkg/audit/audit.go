@@ -0,0 +1,157 @@
+// Package audit records the changes made through Kuberus and lets them be queried.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Actions that are audited.
+const (
+	ActionCreate   = "create"
+	ActionUpdate   = "update"
+	ActionPatch    = "patch"
+	ActionDelete   = "delete"
+	ActionRollback = "rollback"
+)
+
+// Outcomes of an audited action.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// defaultQueryLimit is the number of records a query returns when it sets no limit.
+const defaultQueryLimit = 100
+
+// ErrNotQueryable is returned by Query when no configured sink can be queried.
+var ErrNotQueryable = errors.New("no queryable audit sink is configured")
+
+// Record is one audited change.
+type Record struct {
+	ID        string          `json:"id"`
+	Time      time.Time       `json:"time"`
+	Actor     string          `json:"actor"`
+	SourceIP  string          `json:"sourceIP,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+	Cluster   string          `json:"cluster,omitempty"`
+	Action    string          `json:"action"`
+	Kind      string          `json:"kind"`
+	Namespace string          `json:"namespace,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	DryRun    bool            `json:"dryRun,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Outcome   string          `json:"outcome"`
+	Code      int             `json:"code"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// Filter selects records. Zero values do not filter.
+type Filter struct {
+	Since     time.Time
+	Until     time.Time
+	Actor     string
+	Kind      string
+	Namespace string
+	// Limit bounds the number of records returned, newest first.
+	Limit int
+}
+
+// Matches reports whether the record passes the filter.
+func (f Filter) Matches(record Record) bool {
+	if !f.Since.IsZero() && record.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !record.Time.Before(f.Until) {
+		return false
+	}
+	if f.Actor != "" && record.Actor != f.Actor {
+		return false
+	}
+	if f.Kind != "" && record.Kind != f.Kind {
+		return false
+	}
+	if f.Namespace != "" && record.Namespace != f.Namespace {
+		return false
+	}
+	return true
+}
+
+// Sink receives audit records.
+type Sink interface {
+	Write(record Record) error
+}
+
+// Querier is a sink whose records can be queried back.
+type Querier interface {
+	Query(filter Filter) ([]Record, error)
+}
+
+// Logger writes audit records to every configured sink.
+type Logger struct {
+	sinks []Sink
+
+	mu       sync.Mutex
+	sequence uint64
+}
+
+// NewLogger creates a logger writing to sinks. Queries are answered by the first sink that
+// implements Querier.
+func NewLogger(sinks ...Sink) *Logger {
+	return &Logger{sinks: sinks}
+}
+
+// Log assigns the record an ID and time, if unset, and writes it to every sink. Every sink is
+// attempted; the errors are joined.
+func (l *Logger) Log(record Record) error {
+	l.mu.Lock()
+	l.sequence++
+	sequence := l.sequence
+	l.mu.Unlock()
+
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	if record.ID == "" {
+		record.ID = strconv.FormatInt(record.Time.UnixNano(), 36) + "-" + strconv.FormatUint(sequence, 36)
+	}
+
+	var errs []error
+	for _, sink := range l.sinks {
+		if err := sink.Write(record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Query returns the records matching the filter, newest first.
+func (l *Logger) Query(filter Filter) ([]Record, error) {
+	for _, sink := range l.sinks {
+		if querier, ok := sink.(Querier); ok {
+			records, err := querier.Query(filter)
+			if err != nil {
+				return nil, err
+			}
+			return newestFirst(records, filter.Limit), nil
+		}
+	}
+	return nil, ErrNotQueryable
+}
+
+// newestFirst sorts records from newest to oldest and keeps at most limit of them.
+func newestFirst(records []Record, limit int) []Record {
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.After(records[j].Time) })
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
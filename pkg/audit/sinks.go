@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"rbac/pkg/store"
+)
+
+// storeBucket is the store bucket that audit records are kept in.
+const storeBucket = "audit"
+
+// WriterSink writes records as JSON lines to a writer, such as stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink creates a sink writing to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write writes the record as one JSON line.
+func (s *WriterSink) Write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// FileSink appends records as JSON lines to a file, and answers queries by reading it back.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewFileSink opens the JSONL file at path for appending, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{path: path, file: file}, nil
+}
+
+// Write appends the record as one JSON line.
+func (s *FileSink) Write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+// Query reads the file and returns the records matching the filter.
+func (s *FileSink) Query(filter Filter) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if filter.Matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// StoreSink keeps records in the embedded store, keyed by time so that time range queries
+// only read the records in range.
+type StoreSink struct {
+	store *store.Store
+}
+
+// NewStoreSink creates a sink keeping records in st.
+func NewStoreSink(st *store.Store) *StoreSink {
+	return &StoreSink{store: st}
+}
+
+// Write stores the record.
+func (s *StoreSink) Write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sequence, err := s.store.NextSequence(storeBucket)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(storeBucket, recordKey(record, sequence), data)
+}
+
+// Query returns the stored records matching the filter.
+func (s *StoreSink) Query(filter Filter) ([]Record, error) {
+	var start []byte
+	if !filter.Since.IsZero() {
+		start = binary.BigEndian.AppendUint64(nil, uint64(filter.Since.UnixNano()))
+	}
+
+	var records []Record
+	err := s.store.Scan(storeBucket, start, func(_, value []byte) error {
+		var record Record
+		if err := json.Unmarshal(value, &record); err != nil {
+			return nil
+		}
+		if !filter.Until.IsZero() && !record.Time.Before(filter.Until) {
+			return store.ErrStop
+		}
+		if filter.Matches(record) {
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// recordKey orders records by time, then by write order.
+func recordKey(record Record, sequence uint64) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(record.Time.UnixNano()))
+	return binary.BigEndian.AppendUint64(key, sequence)
+}
@@ -0,0 +1,385 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+const (
+	// SubjectIndex indexes bindings by the "<kind>/<name>" key of each of their subjects.
+	SubjectIndex = "subject"
+	// RoleRefIndex indexes bindings by the "<kind>/<name>" key of their roleRef.
+	RoleRefIndex = "roleRef"
+	// NamespaceIndex indexes namespaced objects by their namespace.
+	NamespaceIndex = toolscache.NamespaceIndex
+)
+
+// RBACCache is an informer-backed, in-memory view of the RBAC objects in a cluster, along with
+// the service accounts they can bind.
+type RBACCache struct {
+	factory informers.SharedInformerFactory
+
+	roles               toolscache.SharedIndexInformer
+	roleBindings        toolscache.SharedIndexInformer
+	clusterRoles        toolscache.SharedIndexInformer
+	clusterRoleBindings toolscache.SharedIndexInformer
+	serviceAccounts     toolscache.SharedIndexInformer
+
+	roleLister               rbaclisters.RoleLister
+	roleBindingLister        rbaclisters.RoleBindingLister
+	clusterRoleLister        rbaclisters.ClusterRoleLister
+	clusterRoleBindingLister rbaclisters.ClusterRoleBindingLister
+	serviceAccountLister     corelisters.ServiceAccountLister
+
+	trackers []*tracker
+}
+
+// NewRBACCache creates a new RBAC cache for the given clientset. The cache does not
+// start watching the cluster until Start is called.
+func NewRBACCache(clientset kubernetes.Interface, resync time.Duration) (*RBACCache, error) {
+	factory := informers.NewSharedInformerFactory(clientset, resync)
+	rbacInformers := factory.Rbac().V1()
+	coreInformers := factory.Core().V1()
+
+	c := &RBACCache{
+		factory:                  factory,
+		roles:                    rbacInformers.Roles().Informer(),
+		roleBindings:             rbacInformers.RoleBindings().Informer(),
+		clusterRoles:             rbacInformers.ClusterRoles().Informer(),
+		clusterRoleBindings:      rbacInformers.ClusterRoleBindings().Informer(),
+		serviceAccounts:          coreInformers.ServiceAccounts().Informer(),
+		roleLister:               rbacInformers.Roles().Lister(),
+		roleBindingLister:        rbacInformers.RoleBindings().Lister(),
+		clusterRoleLister:        rbacInformers.ClusterRoles().Lister(),
+		clusterRoleBindingLister: rbacInformers.ClusterRoleBindings().Lister(),
+		serviceAccountLister:     coreInformers.ServiceAccounts().Lister(),
+	}
+
+	bindingIndexers := toolscache.Indexers{
+		SubjectIndex: subjectIndexFunc,
+		RoleRefIndex: roleRefIndexFunc,
+	}
+	if err := c.roleBindings.AddIndexers(bindingIndexers); err != nil {
+		return nil, err
+	}
+	if err := c.clusterRoleBindings.AddIndexers(bindingIndexers); err != nil {
+		return nil, err
+	}
+
+	for resource, informer := range map[string]toolscache.SharedIndexInformer{
+		"roles":               c.roles,
+		"rolebindings":        c.roleBindings,
+		"clusterroles":        c.clusterRoles,
+		"clusterrolebindings": c.clusterRoleBindings,
+		"serviceaccounts":     c.serviceAccounts,
+	} {
+		t, err := newTracker(resource, informer)
+		if err != nil {
+			return nil, err
+		}
+		c.trackers = append(c.trackers, t)
+	}
+	sort.Slice(c.trackers, func(i, j int) bool { return c.trackers[i].resource < c.trackers[j].resource })
+
+	return c, nil
+}
+
+// Start starts the informers. They run until the context is cancelled.
+func (c *RBACCache) Start(ctx context.Context) {
+	c.factory.Start(ctx.Done())
+}
+
+// AddEventHandler registers a handler for changes to roles, role bindings, cluster roles and
+// cluster role bindings. Objects already in the cache are delivered as additions.
+func (c *RBACCache) AddEventHandler(handler toolscache.ResourceEventHandler) error {
+	for _, informer := range []toolscache.SharedIndexInformer{c.roles, c.roleBindings, c.clusterRoles, c.clusterRoleBindings} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForSync blocks until every informer has synced or the context is cancelled.
+func (c *RBACCache) WaitForSync(ctx context.Context) bool {
+	return toolscache.WaitForCacheSync(ctx.Done(), c.roles.HasSynced, c.roleBindings.HasSynced, c.clusterRoles.HasSynced, c.clusterRoleBindings.HasSynced, c.serviceAccounts.HasSynced)
+}
+
+// HasSynced reports whether every informer has completed its initial list.
+func (c *RBACCache) HasSynced() bool {
+	return c.roles.HasSynced() && c.roleBindings.HasSynced() && c.clusterRoles.HasSynced() && c.clusterRoleBindings.HasSynced() && c.serviceAccounts.HasSynced()
+}
+
+// ListRoles lists the cached roles in a namespace, or in all namespaces if namespace is empty.
+func (c *RBACCache) ListRoles(namespace string) ([]*rbacv1.Role, error) {
+	if namespace == "" {
+		return c.roleLister.List(labels.Everything())
+	}
+	return c.roleLister.Roles(namespace).List(labels.Everything())
+}
+
+// GetRole returns a cached role.
+func (c *RBACCache) GetRole(namespace, name string) (*rbacv1.Role, error) {
+	return c.roleLister.Roles(namespace).Get(name)
+}
+
+// ListRoleBindings lists the cached role bindings in a namespace, or in all namespaces if namespace is empty.
+func (c *RBACCache) ListRoleBindings(namespace string) ([]*rbacv1.RoleBinding, error) {
+	if namespace == "" {
+		return c.roleBindingLister.List(labels.Everything())
+	}
+	return c.roleBindingLister.RoleBindings(namespace).List(labels.Everything())
+}
+
+// ListClusterRoles lists the cached cluster roles.
+func (c *RBACCache) ListClusterRoles() ([]*rbacv1.ClusterRole, error) {
+	return c.clusterRoleLister.List(labels.Everything())
+}
+
+// GetClusterRole returns a cached cluster role.
+func (c *RBACCache) GetClusterRole(name string) (*rbacv1.ClusterRole, error) {
+	return c.clusterRoleLister.Get(name)
+}
+
+// ListClusterRoleBindings lists the cached cluster role bindings.
+func (c *RBACCache) ListClusterRoleBindings() ([]*rbacv1.ClusterRoleBinding, error) {
+	return c.clusterRoleBindingLister.List(labels.Everything())
+}
+
+// ListServiceAccounts lists the cached service accounts in a namespace, or in all namespaces if namespace is empty.
+func (c *RBACCache) ListServiceAccounts(namespace string) ([]*corev1.ServiceAccount, error) {
+	if namespace == "" {
+		return c.serviceAccountLister.List(labels.Everything())
+	}
+	return c.serviceAccountLister.ServiceAccounts(namespace).List(labels.Everything())
+}
+
+// RoleBindingsForSubject returns the role bindings that have the given subject.
+func (c *RBACCache) RoleBindingsForSubject(kind, name string) ([]*rbacv1.RoleBinding, error) {
+	objs, err := c.roleBindings.GetIndexer().ByIndex(SubjectIndex, indexKey(kind, name))
+	if err != nil {
+		return nil, err
+	}
+	return toRoleBindings(objs, ""), nil
+}
+
+// ClusterRoleBindingsForSubject returns the cluster role bindings that have the given subject.
+func (c *RBACCache) ClusterRoleBindingsForSubject(kind, name string) ([]*rbacv1.ClusterRoleBinding, error) {
+	objs, err := c.clusterRoleBindings.GetIndexer().ByIndex(SubjectIndex, indexKey(kind, name))
+	if err != nil {
+		return nil, err
+	}
+	return toClusterRoleBindings(objs), nil
+}
+
+// RoleBindingsForRoleRef returns the role bindings that reference the given role. If namespace
+// is empty, bindings in every namespace are returned.
+func (c *RBACCache) RoleBindingsForRoleRef(namespace, kind, name string) ([]*rbacv1.RoleBinding, error) {
+	objs, err := c.roleBindings.GetIndexer().ByIndex(RoleRefIndex, indexKey(kind, name))
+	if err != nil {
+		return nil, err
+	}
+	return toRoleBindings(objs, namespace), nil
+}
+
+// ClusterRoleBindingsForRoleRef returns the cluster role bindings that reference the given cluster role.
+func (c *RBACCache) ClusterRoleBindingsForRoleRef(name string) ([]*rbacv1.ClusterRoleBinding, error) {
+	objs, err := c.clusterRoleBindings.GetIndexer().ByIndex(RoleRefIndex, indexKey("ClusterRole", name))
+	if err != nil {
+		return nil, err
+	}
+	return toClusterRoleBindings(objs), nil
+}
+
+// SubjectNames returns the sorted, unique names of all subjects of the given kind that appear
+// in any role binding or cluster role binding.
+func (c *RBACCache) SubjectNames(kind string) []string {
+	prefix := kind + "/"
+	nameSet := make(map[string]struct{})
+	for _, informer := range []toolscache.SharedIndexInformer{c.roleBindings, c.clusterRoleBindings} {
+		for _, key := range informer.GetIndexer().ListIndexFuncValues(SubjectIndex) {
+			if strings.HasPrefix(key, prefix) {
+				nameSet[strings.TrimPrefix(key, prefix)] = struct{}{}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(nameSet))
+	for name := range nameSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// indexKey builds the "<kind>/<name>" key used by SubjectIndex and RoleRefIndex.
+func indexKey(kind, name string) string {
+	return kind + "/" + name
+}
+
+// subjectIndexFunc indexes a binding by each of its subjects.
+func subjectIndexFunc(obj interface{}) ([]string, error) {
+	var subjects []rbacv1.Subject
+	switch binding := obj.(type) {
+	case *rbacv1.RoleBinding:
+		subjects = binding.Subjects
+	case *rbacv1.ClusterRoleBinding:
+		subjects = binding.Subjects
+	default:
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(subjects))
+	seen := make(map[string]struct{}, len(subjects))
+	for _, subject := range subjects {
+		key := indexKey(subject.Kind, subject.Name)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// roleRefIndexFunc indexes a binding by its roleRef.
+func roleRefIndexFunc(obj interface{}) ([]string, error) {
+	switch binding := obj.(type) {
+	case *rbacv1.RoleBinding:
+		return []string{indexKey(binding.RoleRef.Kind, binding.RoleRef.Name)}, nil
+	case *rbacv1.ClusterRoleBinding:
+		return []string{indexKey(binding.RoleRef.Kind, binding.RoleRef.Name)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// toRoleBindings converts indexer results to role bindings, optionally restricted to a namespace.
+func toRoleBindings(objs []interface{}, namespace string) []*rbacv1.RoleBinding {
+	roleBindings := make([]*rbacv1.RoleBinding, 0, len(objs))
+	for _, obj := range objs {
+		rb, ok := obj.(*rbacv1.RoleBinding)
+		if !ok || (namespace != "" && rb.Namespace != namespace) {
+			continue
+		}
+		roleBindings = append(roleBindings, rb)
+	}
+	sort.Slice(roleBindings, func(i, j int) bool {
+		if roleBindings[i].Namespace != roleBindings[j].Namespace {
+			return roleBindings[i].Namespace < roleBindings[j].Namespace
+		}
+		return roleBindings[i].Name < roleBindings[j].Name
+	})
+	return roleBindings
+}
+
+// toClusterRoleBindings converts indexer results to cluster role bindings.
+func toClusterRoleBindings(objs []interface{}) []*rbacv1.ClusterRoleBinding {
+	clusterRoleBindings := make([]*rbacv1.ClusterRoleBinding, 0, len(objs))
+	for _, obj := range objs {
+		if crb, ok := obj.(*rbacv1.ClusterRoleBinding); ok {
+			clusterRoleBindings = append(clusterRoleBindings, crb)
+		}
+	}
+	sort.Slice(clusterRoleBindings, func(i, j int) bool {
+		return clusterRoleBindings[i].Name < clusterRoleBindings[j].Name
+	})
+	return clusterRoleBindings
+}
+
+// ResourceStatus describes how fresh the cached copy of one resource type is.
+type ResourceStatus struct {
+	Resource           string     `json:"resource"`
+	Synced             bool       `json:"synced"`
+	ResourceVersion    string     `json:"resourceVersion"`
+	LastEventTime      *time.Time `json:"lastEventTime,omitempty"`
+	LastWatchError     string     `json:"lastWatchError,omitempty"`
+	LastWatchErrorTime *time.Time `json:"lastWatchErrorTime,omitempty"`
+	Stale              bool       `json:"stale"`
+}
+
+// Status reports the sync state and staleness of every cached resource type. A resource is
+// stale if it has not synced yet, or if its watch failed and has not delivered an event since.
+func (c *RBACCache) Status() []ResourceStatus {
+	statuses := make([]ResourceStatus, 0, len(c.trackers))
+	for _, t := range c.trackers {
+		statuses = append(statuses, t.status())
+	}
+	return statuses
+}
+
+// tracker records informer activity so that cache staleness can be reported.
+type tracker struct {
+	resource string
+	informer toolscache.SharedIndexInformer
+
+	mu                 sync.Mutex
+	lastEventTime      time.Time
+	lastWatchError     error
+	lastWatchErrorTime time.Time
+}
+
+// newTracker registers event and watch error handlers on the informer.
+func newTracker(resource string, informer toolscache.SharedIndexInformer) (*tracker, error) {
+	t := &tracker{resource: resource, informer: informer}
+
+	if err := informer.SetWatchErrorHandler(func(r *toolscache.Reflector, err error) {
+		t.mu.Lock()
+		t.lastWatchError = err
+		t.lastWatchErrorTime = time.Now()
+		t.mu.Unlock()
+		toolscache.DefaultWatchErrorHandler(r, err)
+	}); err != nil {
+		return nil, err
+	}
+
+	record := func() {
+		t.mu.Lock()
+		t.lastEventTime = time.Now()
+		t.mu.Unlock()
+	}
+	if _, err := informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { record() },
+		UpdateFunc: func(interface{}, interface{}) { record() },
+		DeleteFunc: func(interface{}) { record() },
+	}); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// status returns a snapshot of the tracker state.
+func (t *tracker) status() ResourceStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := ResourceStatus{
+		Resource:        t.resource,
+		Synced:          t.informer.HasSynced(),
+		ResourceVersion: t.informer.LastSyncResourceVersion(),
+	}
+	if !t.lastEventTime.IsZero() {
+		lastEventTime := t.lastEventTime
+		status.LastEventTime = &lastEventTime
+	}
+	if t.lastWatchError != nil {
+		lastWatchErrorTime := t.lastWatchErrorTime
+		status.LastWatchError = t.lastWatchError.Error()
+		status.LastWatchErrorTime = &lastWatchErrorTime
+	}
+	status.Stale = !status.Synced || (t.lastWatchError != nil && t.lastWatchErrorTime.After(t.lastEventTime))
+	return status
+}
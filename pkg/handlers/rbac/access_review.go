@@ -0,0 +1,238 @@
+package rbac
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// maxAccessChecks bounds the number of SubjectAccessReviews a single request may trigger.
+	maxAccessChecks = 500
+	// accessReviewWorkers bounds the number of SubjectAccessReviews sent concurrently.
+	accessReviewWorkers = 8
+)
+
+// AccessReviewSubject identifies who the access review is for. A service account is
+// expanded to its username and service account groups.
+type AccessReviewSubject struct {
+	User           string             `json:"user,omitempty"`
+	Groups         []string           `json:"groups,omitempty"`
+	ServiceAccount *ServiceAccountRef `json:"serviceAccount,omitempty"`
+}
+
+// ServiceAccountRef identifies a service account.
+type ServiceAccountRef struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// AccessCheck is a single resource or non-resource request to review.
+type AccessCheck struct {
+	ResourceAttributes    *authorizationv1.ResourceAttributes    `json:"resourceAttributes,omitempty"`
+	NonResourceAttributes *authorizationv1.NonResourceAttributes `json:"nonResourceAttributes,omitempty"`
+}
+
+// AccessMatrixResource is a row of an access matrix.
+type AccessMatrixResource struct {
+	Group       string `json:"group"`
+	Resource    string `json:"resource"`
+	Subresource string `json:"subresource,omitempty"`
+}
+
+// AccessMatrixRequest asks for every combination of verbs and resources in a namespace.
+type AccessMatrixRequest struct {
+	Namespace string                 `json:"namespace,omitempty"`
+	Verbs     []string               `json:"verbs"`
+	Resources []AccessMatrixResource `json:"resources"`
+}
+
+// AccessReviewRequest represents the body of an access review request.
+type AccessReviewRequest struct {
+	Subject AccessReviewSubject  `json:"subject"`
+	Checks  []AccessCheck        `json:"checks"`
+	Matrix  *AccessMatrixRequest `json:"matrix,omitempty"`
+}
+
+// AccessDecision is the API server's decision for one request.
+type AccessDecision struct {
+	Allowed         bool   `json:"allowed"`
+	Denied          bool   `json:"denied,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+	EvaluationError string `json:"evaluationError,omitempty"`
+}
+
+// AccessCheckResult is the decision for one access check.
+type AccessCheckResult struct {
+	AccessCheck
+	AccessDecision
+}
+
+// AccessMatrix holds the decisions for a verbs × resources matrix. Decisions is indexed by
+// resource, then verb.
+type AccessMatrix struct {
+	Namespace string                 `json:"namespace,omitempty"`
+	Verbs     []string               `json:"verbs"`
+	Resources []AccessMatrixResource `json:"resources"`
+	Decisions [][]AccessDecision     `json:"decisions"`
+}
+
+// AccessReviewResponse represents the result of an access review request.
+type AccessReviewResponse struct {
+	Results []AccessCheckResult `json:"results"`
+	Matrix  *AccessMatrix       `json:"matrix,omitempty"`
+}
+
+// AccessReviewHandler handles requests to check a subject's access with SubjectAccessReviews.
+func AccessReviewHandler(clientset kubernetes.Interface) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var request AccessReviewRequest
+		if err := c.Bind(&request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Failed to decode request body: "+err.Error())
+		}
+
+		spec, err := subjectAccessReviewSpec(request.Subject)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid subject: "+err.Error())
+		}
+
+		checks := request.Checks
+		for i, check := range checks {
+			if (check.ResourceAttributes == nil) == (check.NonResourceAttributes == nil) {
+				return echo.NewHTTPError(http.StatusBadRequest, "Check "+strconv.Itoa(i)+" must set exactly one of resourceAttributes and nonResourceAttributes")
+			}
+		}
+		if request.Matrix != nil {
+			checks = append(checks, matrixChecks(request.Matrix)...)
+		}
+		if len(checks) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "At least one check or a matrix is required")
+		}
+		if len(checks) > maxAccessChecks {
+			return echo.NewHTTPError(http.StatusBadRequest, "Too many checks, the limit is "+strconv.Itoa(maxAccessChecks))
+		}
+
+		decisions, err := reviewAccess(c.Request().Context(), clientset, spec, checks)
+		if err != nil {
+			return utils.KubernetesError(err, "Error creating subject access review")
+		}
+
+		response := AccessReviewResponse{Results: make([]AccessCheckResult, 0, len(request.Checks))}
+		for i, check := range request.Checks {
+			response.Results = append(response.Results, AccessCheckResult{AccessCheck: check, AccessDecision: decisions[i]})
+		}
+		if request.Matrix != nil {
+			response.Matrix = buildAccessMatrix(request.Matrix, decisions[len(request.Checks):])
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// subjectAccessReviewSpec builds the user and groups of a SubjectAccessReview for the subject.
+func subjectAccessReviewSpec(subject AccessReviewSubject) (authorizationv1.SubjectAccessReviewSpec, error) {
+	spec := authorizationv1.SubjectAccessReviewSpec{User: subject.User, Groups: subject.Groups}
+
+	if sa := subject.ServiceAccount; sa != nil {
+		if spec.User != "" {
+			return spec, errors.New("user and serviceAccount are mutually exclusive")
+		}
+		if sa.Name == "" || sa.Namespace == "" {
+			return spec, errors.New("service account name and namespace are required")
+		}
+		spec.User = policy.ServiceAccountUsername(sa.Namespace, sa.Name)
+		spec.Groups = append(spec.Groups,
+			policy.AllServiceAccountsGroup,
+			policy.AllServiceAccountsGroup+":"+sa.Namespace,
+			policy.AllAuthenticatedGroup,
+		)
+	}
+
+	if spec.User == "" && len(spec.Groups) == 0 {
+		return spec, errors.New("a user, groups or a service account is required")
+	}
+	return spec, nil
+}
+
+// matrixChecks expands a matrix request into checks, row by row.
+func matrixChecks(matrix *AccessMatrixRequest) []AccessCheck {
+	checks := make([]AccessCheck, 0, len(matrix.Resources)*len(matrix.Verbs))
+	for _, resource := range matrix.Resources {
+		for _, verb := range matrix.Verbs {
+			checks = append(checks, AccessCheck{ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   matrix.Namespace,
+				Verb:        verb,
+				Group:       resource.Group,
+				Resource:    resource.Resource,
+				Subresource: resource.Subresource,
+			}})
+		}
+	}
+	return checks
+}
+
+// buildAccessMatrix arranges the matrix decisions by resource and verb.
+func buildAccessMatrix(matrix *AccessMatrixRequest, decisions []AccessDecision) *AccessMatrix {
+	result := &AccessMatrix{
+		Namespace: matrix.Namespace,
+		Verbs:     matrix.Verbs,
+		Resources: matrix.Resources,
+		Decisions: make([][]AccessDecision, len(matrix.Resources)),
+	}
+	for i := range matrix.Resources {
+		result.Decisions[i] = decisions[i*len(matrix.Verbs) : (i+1)*len(matrix.Verbs)]
+	}
+	return result
+}
+
+// reviewAccess sends a SubjectAccessReview for every check, a few at a time, and returns
+// the decisions in the order of the checks.
+func reviewAccess(ctx context.Context, clientset kubernetes.Interface, spec authorizationv1.SubjectAccessReviewSpec, checks []AccessCheck) ([]AccessDecision, error) {
+	decisions := make([]AccessDecision, len(checks))
+	errs := make([]error, len(checks))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, accessReviewWorkers)
+	for i, check := range checks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, check AccessCheck) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			review := &authorizationv1.SubjectAccessReview{Spec: spec}
+			review.Spec.ResourceAttributes = check.ResourceAttributes
+			review.Spec.NonResourceAttributes = check.NonResourceAttributes
+
+			result, err := clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			decisions[i] = AccessDecision{
+				Allowed:         result.Status.Allowed,
+				Denied:          result.Status.Denied,
+				Reason:          result.Status.Reason,
+				EvaluationError: result.Status.EvaluationError,
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decisions, nil
+}
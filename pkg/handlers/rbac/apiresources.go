@@ -3,12 +3,14 @@ package rbac
 import (
 	"net/http"
 
+	"rbac/pkg/utils"
+
 	"github.com/labstack/echo/v4"
 	"k8s.io/client-go/kubernetes"
 )
 
 // APIResourcesHandler handles retrieving all Kubernetes API resources.
-func APIResourcesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func APIResourcesHandler(clientset kubernetes.Interface) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// Create a discovery client to list available API resources
 		discoveryClient := clientset.Discovery()
@@ -16,7 +18,7 @@ func APIResourcesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
 		// Retrieve the list of preferred API resources
 		apiResources, err := discoveryClient.ServerPreferredResources()
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error retrieving API resources: "+err.Error())
+			return utils.KubernetesError(err, "Error retrieving API resources")
 		}
 
 		// Collect the names of the API resources
@@ -0,0 +1,49 @@
+package rbac
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/audit"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AuditHandler handles querying the audit log by time range, actor, kind and namespace.
+// Records are returned newest first.
+func AuditHandler(logger *audit.Logger) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter := audit.Filter{
+			Actor:     c.QueryParam("actor"),
+			Kind:      c.QueryParam("kind"),
+			Namespace: c.QueryParam("namespace"),
+		}
+
+		var err error
+		if filter.Since, err = parseSearchTime(c.QueryParam("since")); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid since parameter: "+err.Error())
+		}
+		if filter.Until, err = parseSearchTime(c.QueryParam("until")); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid until parameter: "+err.Error())
+		}
+		if value := c.QueryParam("limit"); value != "" {
+			if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid limit parameter: "+value)
+			}
+		}
+
+		records, err := logger.Query(filter)
+		if errors.Is(err, audit.ErrNotQueryable) {
+			return echo.NewHTTPError(http.StatusNotImplemented, "The audit log cannot be queried: configure the file or store sink")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error querying audit log: "+err.Error())
+		}
+		if records == nil {
+			records = []audit.Record{}
+		}
+
+		return c.JSON(http.StatusOK, records)
+	}
+}
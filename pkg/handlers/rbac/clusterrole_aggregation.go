@@ -0,0 +1,134 @@
+package rbac
+
+import (
+	"net/http"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// previewClusterRoleName is used for the hypothetical cluster role when the preview request does not name one.
+const previewClusterRoleName = "kuberus-preview"
+
+// ClusterRoleAggregation describes how an aggregated cluster role is composed.
+type ClusterRoleAggregation struct {
+	Selectors           []metav1.LabelSelector `json:"selectors"`
+	MatchedClusterRoles []string               `json:"matchedClusterRoles"`
+	Rules               []policy.SourcedRule   `json:"rules"`
+}
+
+// AggregationPreview shows how an aggregated cluster role would change if the previewed cluster role existed.
+type AggregationPreview struct {
+	ClusterRole string                 `json:"clusterRole"`
+	Current     ClusterRoleAggregation `json:"current"`
+	Preview     ClusterRoleAggregation `json:"preview"`
+	AddedRules  []rbacv1.PolicyRule    `json:"addedRules"`
+}
+
+// ClusterRoleAggregationPreviewHandler handles requests to preview which aggregated cluster roles
+// would pick up a new cluster role with the given labels, and what they would contain.
+func ClusterRoleAggregationPreviewHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var candidate rbacv1.ClusterRole
+		if err := c.Bind(&candidate); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Failed to decode request body: "+err.Error())
+		}
+		if candidate.Name == "" {
+			candidate.Name = previewClusterRoleName
+		}
+
+		clusterRoles, err := rbacCache.ListClusterRoles()
+		if err != nil {
+			return utils.KubernetesError(err, "Error listing cluster roles")
+		}
+
+		return c.JSON(http.StatusOK, previewAggregation(&candidate, clusterRoles))
+	}
+}
+
+// previewAggregation computes the effect of adding the candidate cluster role on every aggregated
+// cluster role whose selectors match it. An existing cluster role with the candidate's name is replaced.
+func previewAggregation(candidate *rbacv1.ClusterRole, clusterRoles []*rbacv1.ClusterRole) []AggregationPreview {
+	withCandidate := []*rbacv1.ClusterRole{candidate}
+	for _, clusterRole := range clusterRoles {
+		if clusterRole.Name != candidate.Name {
+			withCandidate = append(withCandidate, clusterRole)
+		}
+	}
+
+	previews := []AggregationPreview{}
+	for _, clusterRole := range clusterRoles {
+		if clusterRole.AggregationRule == nil || clusterRole.Name == candidate.Name {
+			continue
+		}
+		if !selectsClusterRole(clusterRole.AggregationRule, candidate) {
+			continue
+		}
+
+		current := resolveAggregation(clusterRole, clusterRoles)
+		preview := resolveAggregation(clusterRole, withCandidate)
+
+		added := []rbacv1.PolicyRule{}
+		for _, sourced := range preview.Rules {
+			if !containsPolicyRule(current.Rules, sourced.Rule) {
+				added = append(added, sourced.Rule)
+			}
+		}
+
+		previews = append(previews, AggregationPreview{
+			ClusterRole: clusterRole.Name,
+			Current:     *current,
+			Preview:     *preview,
+			AddedRules:  added,
+		})
+	}
+	return previews
+}
+
+// resolveAggregation computes the selectors, matched cluster roles and rule origins of an aggregated cluster role.
+func resolveAggregation(clusterRole *rbacv1.ClusterRole, clusterRoles []*rbacv1.ClusterRole) *ClusterRoleAggregation {
+	aggregation := &ClusterRoleAggregation{
+		Selectors:           clusterRole.AggregationRule.ClusterRoleSelectors,
+		MatchedClusterRoles: []string{},
+		Rules:               policy.AggregatedRules(clusterRole, clusterRoles),
+	}
+	for _, matched := range policy.MatchingClusterRoles(clusterRole.AggregationRule, clusterRoles) {
+		if matched.Name != clusterRole.Name {
+			aggregation.MatchedClusterRoles = append(aggregation.MatchedClusterRoles, matched.Name)
+		}
+	}
+	if aggregation.Rules == nil {
+		aggregation.Rules = []policy.SourcedRule{}
+	}
+	return aggregation
+}
+
+// selectsClusterRole reports whether an aggregation rule selects the cluster role.
+func selectsClusterRole(aggregationRule *rbacv1.AggregationRule, clusterRole *rbacv1.ClusterRole) bool {
+	return len(policy.MatchingClusterRoles(aggregationRule, []*rbacv1.ClusterRole{clusterRole})) > 0
+}
+
+// containsPolicyRule reports whether an equivalent rule is already present.
+func containsPolicyRule(rules []policy.SourcedRule, rule rbacv1.PolicyRule) bool {
+	for _, existing := range rules {
+		if equality.Semantic.DeepEqual(existing.Rule, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// toClusterRolePointers converts listed cluster roles to the pointer form used by the cache.
+func toClusterRolePointers(clusterRoles []rbacv1.ClusterRole) []*rbacv1.ClusterRole {
+	pointers := make([]*rbacv1.ClusterRole, 0, len(clusterRoles))
+	for i := range clusterRoles {
+		pointers = append(pointers, &clusterRoles[i])
+	}
+	return pointers
+}
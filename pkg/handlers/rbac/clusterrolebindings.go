@@ -8,16 +8,18 @@ import (
 	"github.com/labstack/echo/v4"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
 // ClusterRoleBindingsHandler handles requests related to cluster role bindings.
-func ClusterRoleBindingsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func ClusterRoleBindingsHandler(clientset kubernetes.Interface) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		handlers := map[string]func(echo.Context, *kubernetes.Clientset, string) error{
+		handlers := map[string]func(echo.Context, kubernetes.Interface, string) error{
 			http.MethodGet:    handleListClusterRoleBindings,
 			http.MethodPost:   handleCreateClusterRoleBinding,
 			http.MethodPut:    handleUpdateClusterRoleBinding,
+			http.MethodPatch:  handlePatchClusterRoleBinding,
 			http.MethodDelete: handleDeleteClusterRoleBinding,
 		}
 
@@ -26,14 +28,14 @@ func ClusterRoleBindingsHandler(clientset *kubernetes.Clientset) echo.HandlerFun
 }
 
 // handleListClusterRoleBindings lists all cluster role bindings.
-func handleListClusterRoleBindings(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleListClusterRoleBindings(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	return utils.ListResources(c, clientset, "", func(namespace string, opts metav1.ListOptions) (interface{}, error) {
 		return clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), opts)
 	})
 }
 
 // handleCreateClusterRoleBinding creates a new cluster role binding.
-func handleCreateClusterRoleBinding(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleCreateClusterRoleBinding(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	var clusterRoleBinding rbacv1.ClusterRoleBinding
 	return utils.CreateResource(c, clientset, "", &clusterRoleBinding, func(namespace string, obj interface{}, opts metav1.CreateOptions) (interface{}, error) {
 		return clientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), obj.(*rbacv1.ClusterRoleBinding), opts)
@@ -41,23 +43,40 @@ func handleCreateClusterRoleBinding(c echo.Context, clientset *kubernetes.Client
 }
 
 // handleUpdateClusterRoleBinding updates an existing cluster role binding.
-func handleUpdateClusterRoleBinding(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleUpdateClusterRoleBinding(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	var clusterRoleBinding rbacv1.ClusterRoleBinding
-	return utils.UpdateResource(c, clientset, "", &clusterRoleBinding, func(namespace string, obj interface{}, opts metav1.UpdateOptions) (interface{}, error) {
+	getFunc := func(_, name string) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.UpdateResource(c, clientset, "", &clusterRoleBinding, getFunc, func(namespace string, obj interface{}, opts metav1.UpdateOptions) (interface{}, error) {
 		return clientset.RbacV1().ClusterRoleBindings().Update(context.TODO(), obj.(*rbacv1.ClusterRoleBinding), opts)
 	})
 }
 
+// handlePatchClusterRoleBinding patches a cluster role binding by name with a JSON patch, merge patch or server-side apply.
+func handlePatchClusterRoleBinding(c echo.Context, clientset kubernetes.Interface, _ string) error {
+	name := c.QueryParam("name")
+	getFunc := func(_, name string) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.PatchResource(c, "", name, getFunc, func(namespace, name string, patchType types.PatchType, data []byte, opts metav1.PatchOptions) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoleBindings().Patch(context.TODO(), name, patchType, data, opts)
+	})
+}
+
 // handleDeleteClusterRoleBinding deletes a cluster role binding by name.
-func handleDeleteClusterRoleBinding(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleDeleteClusterRoleBinding(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	name := c.QueryParam("name")
-	return utils.DeleteResource(c, clientset, "", name, func(namespace, name string, opts metav1.DeleteOptions) error {
+	getFunc := func(_, name string) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.DeleteResource(c, clientset, "", name, getFunc, func(namespace, name string, opts metav1.DeleteOptions) error {
 		return clientset.RbacV1().ClusterRoleBindings().Delete(context.TODO(), name, opts)
 	})
 }
 
 // ClusterRoleBindingDetailsHandler handles fetching detailed information about a specific cluster role binding.
-func ClusterRoleBindingDetailsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func ClusterRoleBindingDetailsHandler(clientset kubernetes.Interface) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		clusterRoleBindingName := c.QueryParam("name")
 		if clusterRoleBindingName == "" {
@@ -66,9 +85,10 @@ func ClusterRoleBindingDetailsHandler(clientset *kubernetes.Clientset) echo.Hand
 
 		clusterRoleBinding, err := clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), clusterRoleBindingName, metav1.GetOptions{})
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching cluster role binding details: "+err.Error())
+			return utils.KubernetesError(err, "Error fetching cluster role binding details")
 		}
 
+		utils.SetETag(c, clusterRoleBinding)
 		return c.JSON(http.StatusOK, clusterRoleBinding)
 	}
 }
\ No newline at end of file
@@ -3,21 +3,30 @@ package rbac
 import (
 	"context"
 	"net/http"
+	"rbac/pkg/cache"
+	"rbac/pkg/policy"
+	"rbac/pkg/risk"
+	"rbac/pkg/usage"
 	"rbac/pkg/utils"
 
 	"github.com/labstack/echo/v4"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
-// ClusterRolesHandler handles requests related to cluster roles.
-func ClusterRolesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+// ClusterRolesHandler handles requests related to cluster roles. Lists tell whether each cluster
+// role is bound from the bindings in the RBAC cache.
+func ClusterRolesHandler(clientset kubernetes.Interface, rbacCache *cache.RBACCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		handlers := map[string]func(echo.Context, *kubernetes.Clientset, string) error{
-			http.MethodGet:    handleListClusterRoles,
+		handlers := map[string]func(echo.Context, kubernetes.Interface, string) error{
+			http.MethodGet: func(c echo.Context, clientset kubernetes.Interface, _ string) error {
+				return handleListClusterRoles(c, clientset, rbacCache)
+			},
 			http.MethodPost:   handleCreateClusterRole,
 			http.MethodPut:    handleUpdateClusterRole,
+			http.MethodPatch:  handlePatchClusterRole,
 			http.MethodDelete: handleDeleteClusterRole,
 		}
 
@@ -25,15 +34,44 @@ func ClusterRolesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
 	}
 }
 
-// handleListClusterRoles lists all cluster roles.
-func handleListClusterRoles(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
-	return utils.ListResources(c, clientset, "", func(namespace string, opts metav1.ListOptions) (interface{}, error) {
-		return clientset.RbacV1().ClusterRoles().List(context.TODO(), opts)
-	})
+// handleListClusterRoles lists all cluster roles with their active status and risks. A cluster
+// role is active when a cluster role binding, or a role binding in any namespace, refers to it.
+func handleListClusterRoles(c echo.Context, clientset kubernetes.Interface, rbacCache *cache.RBACCache) error {
+	opts, err := utils.ListOptions(c)
+	if err != nil {
+		return err
+	}
+	if !rbacCache.HasSynced() {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "RBAC cache is not synced yet")
+	}
+
+	clusterRoles, err := clientset.RbacV1().ClusterRoles().List(context.TODO(), opts)
+	if err != nil {
+		return utils.KubernetesError(err, "Error listing cluster roles")
+	}
+
+	clusterRolesWithStatus := []ClusterRoleWithStatus{}
+	for _, clusterRole := range clusterRoles.Items {
+		clusterRoleBindings, err := rbacCache.ClusterRoleBindingsForRoleRef(clusterRole.Name)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error checking if cluster roles are active: "+err.Error())
+		}
+		roleBindings, err := rbacCache.RoleBindingsForRoleRef("", "ClusterRole", clusterRole.Name)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error checking if cluster roles are active: "+err.Error())
+		}
+		clusterRolesWithStatus = append(clusterRolesWithStatus, ClusterRoleWithStatus{
+			ClusterRole: clusterRole,
+			Active:      len(clusterRoleBindings) > 0 || len(roleBindings) > 0,
+			Risks:       risk.Scan(clusterRole.Rules),
+		})
+	}
+
+	return c.JSON(http.StatusOK, utils.NewListResponse(clusterRoles, clusterRolesWithStatus))
 }
 
 // handleCreateClusterRole creates a new cluster role.
-func handleCreateClusterRole(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleCreateClusterRole(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	var clusterRole rbacv1.ClusterRole
 	return utils.CreateResource(c, clientset, "", &clusterRole, func(namespace string, obj interface{}, opts metav1.CreateOptions) (interface{}, error) {
 		return clientset.RbacV1().ClusterRoles().Create(context.TODO(), obj.(*rbacv1.ClusterRole), opts)
@@ -41,30 +79,49 @@ func handleCreateClusterRole(c echo.Context, clientset *kubernetes.Clientset, _
 }
 
 // handleUpdateClusterRole updates an existing cluster role.
-func handleUpdateClusterRole(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleUpdateClusterRole(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	var clusterRole rbacv1.ClusterRole
-	return utils.UpdateResource(c, clientset, "", &clusterRole, func(namespace string, obj interface{}, opts metav1.UpdateOptions) (interface{}, error) {
+	getFunc := func(_, name string) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoles().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.UpdateResource(c, clientset, "", &clusterRole, getFunc, func(namespace string, obj interface{}, opts metav1.UpdateOptions) (interface{}, error) {
 		return clientset.RbacV1().ClusterRoles().Update(context.TODO(), obj.(*rbacv1.ClusterRole), opts)
 	})
 }
 
+// handlePatchClusterRole patches a cluster role by name with a JSON patch, merge patch or server-side apply.
+func handlePatchClusterRole(c echo.Context, clientset kubernetes.Interface, _ string) error {
+	name := c.QueryParam("name")
+	getFunc := func(_, name string) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoles().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.PatchResource(c, "", name, getFunc, func(namespace, name string, patchType types.PatchType, data []byte, opts metav1.PatchOptions) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoles().Patch(context.TODO(), name, patchType, data, opts)
+	})
+}
+
 // handleDeleteClusterRole deletes a cluster role by name.
-func handleDeleteClusterRole(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleDeleteClusterRole(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	name := c.QueryParam("name")
-	return utils.DeleteResource(c, clientset, "", name, func(namespace, name string, opts metav1.DeleteOptions) error {
+	getFunc := func(_, name string) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoles().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.DeleteResource(c, clientset, "", name, getFunc, func(namespace, name string, opts metav1.DeleteOptions) error {
 		return clientset.RbacV1().ClusterRoles().Delete(context.TODO(), name, opts)
 	})
 }
 
 // ClusterRoleDetailsHandler handles fetching detailed information about a specific cluster role.
-func ClusterRoleDetailsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+// Once audit logs of the cluster were ingested, the details include the use of every rule, with
+// rules unused for unusedDays flagged.
+func ClusterRoleDetailsHandler(clientset kubernetes.Interface, usageStore *usage.Store, cluster string) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		return handleGetClusterRoleDetails(c, clientset)
+		return handleGetClusterRoleDetails(c, clientset, usageStore, cluster)
 	}
 }
 
 // handleGetClusterRoleDetails fetches detailed information about a specific cluster role.
-func handleGetClusterRoleDetails(c echo.Context, clientset *kubernetes.Clientset) error {
+func handleGetClusterRoleDetails(c echo.Context, clientset kubernetes.Interface, usageStore *usage.Store, cluster string) error {
 	clusterRoleName := c.QueryParam("clusterRoleName")
 	if clusterRoleName == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "Cluster role name is required")
@@ -72,27 +129,54 @@ func handleGetClusterRoleDetails(c echo.Context, clientset *kubernetes.Clientset
 
 	clusterRole, err := clientset.RbacV1().ClusterRoles().Get(context.TODO(), clusterRoleName, metav1.GetOptions{})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching cluster role details: "+err.Error())
+		return utils.KubernetesError(err, "Error fetching cluster role details")
 	}
 
 	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error listing cluster role bindings: "+err.Error())
+		return utils.KubernetesError(err, "Error listing cluster role bindings")
 	}
 
 	associatedBindings := filterClusterRoleBindings(clusterRoleBindings.Items, clusterRoleName)
 
-	active, err := IsClusterRoleActive(clientset, clusterRoleName)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error checking if cluster role is active: "+err.Error())
-	}
-
 	response := ClusterRoleDetailsResponse{
 		ClusterRole:         clusterRole,
 		ClusterRoleBindings: associatedBindings,
-		Active:              active,
 	}
 
+	objects := policy.ObjectSet{
+		ClusterRoles:        []*rbacv1.ClusterRole{clusterRole},
+		ClusterRoleBindings: clusterRoleBindingPointers(associatedBindings),
+	}
+	if clusterRole.AggregationRule != nil {
+		clusterRoles, err := clientset.RbacV1().ClusterRoles().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return utils.KubernetesError(err, "Error listing cluster roles")
+		}
+		objects.ClusterRoles = toClusterRolePointers(clusterRoles.Items)
+		response.Aggregation = resolveAggregation(clusterRole, objects.ClusterRoles)
+	}
+
+	// Role bindings may grant a cluster role within their namespace.
+	roleBindings, err := clientset.RbacV1().RoleBindings("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return utils.KubernetesError(err, "Error listing role bindings")
+	}
+	objects.RoleBindings = roleBindingPointers(roleBindings.Items)
+	// The cluster role is active when a cluster role binding or a role binding refers to it.
+	response.Active = len(associatedBindings) > 0
+	for _, rb := range roleBindings.Items {
+		if rb.RoleRef.Kind == "ClusterRole" && rb.RoleRef.Name == clusterRoleName {
+			response.Active = true
+			break
+		}
+	}
+	response.Risks = risk.AnalyzeRole(objects, "ClusterRole", "", clusterRoleName)
+	if response.Usage, err = ruleUsage(c, usageStore, cluster, objects, "ClusterRole", "", clusterRoleName); err != nil {
+		return err
+	}
+
+	utils.SetETag(c, clusterRole)
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -107,10 +191,12 @@ func filterClusterRoleBindings(clusterRoleBindings []rbacv1.ClusterRoleBinding,
 	return associatedBindings
 }
 
-// ClusterRoleWithStatus represents a cluster role with its active status.
+// ClusterRoleWithStatus represents a cluster role with its active status and the dangerous
+// permissions it grants. Risks leave out subjects; cluster role details include them.
 type ClusterRoleWithStatus struct {
 	rbacv1.ClusterRole
-	Active bool `json:"active"`
+	Active bool           `json:"active"`
+	Risks  []risk.Finding `json:"risks"`
 }
 
 // ClusterRoleDetailsResponse represents the detailed information about a cluster role.
@@ -118,19 +204,7 @@ type ClusterRoleDetailsResponse struct {
 	ClusterRole         *rbacv1.ClusterRole         `json:"clusterRole"`
 	ClusterRoleBindings []rbacv1.ClusterRoleBinding `json:"clusterRoleBindings"`
 	Active              bool                        `json:"active"`
-}
-
-// IsClusterRoleActive checks if a cluster role is active by looking for any cluster role bindings that reference it.
-func IsClusterRoleActive(clientset *kubernetes.Clientset, clusterRoleName string) (bool, error) {
-	// Check ClusterRoleBindings
-	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return false, err
-	}
-	for _, crb := range clusterRoleBindings.Items {
-		if crb.RoleRef.Name == clusterRoleName {
-			return true, nil
-		}
-	}
-	return false, nil
+	Aggregation         *ClusterRoleAggregation     `json:"aggregation,omitempty"`
+	Risks               []risk.Finding              `json:"risks"`
+	Usage               *usage.RoleUsage            `json:"usage,omitempty"`
 }
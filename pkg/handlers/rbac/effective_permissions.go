@@ -0,0 +1,45 @@
+package rbac
+
+import (
+	"net/http"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// EffectivePermissionsResponse represents every rule a subject holds, grouped by namespace.
+// Rules granted cluster-wide are listed under the empty namespace.
+type EffectivePermissionsResponse struct {
+	Subject    rbacv1.Subject                `json:"subject"`
+	Namespaces []policy.NamespacePermissions `json:"namespaces"`
+	Unresolved []policy.Grant                `json:"unresolved"`
+}
+
+// EffectivePermissionsHandler handles requests for the effective permissions of a user, group or service account.
+func EffectivePermissionsHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		subject, err := policy.NewSubject(c.QueryParam("kind"), c.QueryParam("name"), c.QueryParam("namespace"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid subject: "+err.Error())
+		}
+
+		granted, unresolved, err := policy.NewResolver(rbacCache).GrantedRules(policy.ImpliedSubjects(subject))
+		if err != nil {
+			return utils.KubernetesError(err, "Error resolving permissions")
+		}
+
+		response := EffectivePermissionsResponse{
+			Subject:    subject,
+			Namespaces: policy.MergeGrantedRules(granted),
+			Unresolved: unresolved,
+		}
+		if response.Unresolved == nil {
+			response.Unresolved = []policy.Grant{}
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,63 @@
+package rbac
+
+import (
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/policy"
+	"rbac/pkg/risk"
+
+	"github.com/labstack/echo/v4"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+const (
+	// defaultEscalationPathLimit is the number of paths returned when the request sets no limit.
+	defaultEscalationPathLimit = 10
+	// maxEscalationPathLimit bounds the number of paths of a request.
+	maxEscalationPathLimit = 100
+)
+
+// EscalationPathsResponse represents the shortest paths from a subject to
+// cluster-admin-equivalent access. ClusterAdmin reports that the subject already holds it.
+type EscalationPathsResponse struct {
+	Subject      rbacv1.Subject `json:"subject"`
+	ClusterAdmin bool           `json:"clusterAdmin"`
+	Paths        []risk.Path    `json:"paths"`
+}
+
+// EscalationPathsHandler handles requests for the shortest chains of steps by which a subject
+// can reach cluster-admin-equivalent access: creating pods as service accounts, impersonation,
+// bind and escalate, and reading service account tokens. The subject is written as Kind:name
+// or ServiceAccount:namespace:name; limit bounds the number of paths.
+func EscalationPathsHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		subject, err := policy.ParseSubject(c.QueryParam("subject"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid subject: "+err.Error())
+		}
+		limit := defaultEscalationPathLimit
+		if value := c.QueryParam("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxEscalationPathLimit {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxEscalationPathLimit))
+			}
+		}
+
+		objects, err := policy.CachedObjects(rbacCache)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing RBAC objects: "+err.Error())
+		}
+		serviceAccounts, err := rbacCache.ListServiceAccounts("")
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing service accounts: "+err.Error())
+		}
+
+		graph := risk.NewGraph(objects, serviceAccounts)
+		return c.JSON(http.StatusOK, EscalationPathsResponse{
+			Subject:      subject,
+			ClusterAdmin: graph.IsClusterAdmin(subject),
+			Paths:        graph.ShortestPaths(subject, limit),
+		})
+	}
+}
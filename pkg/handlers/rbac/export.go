@@ -0,0 +1,82 @@
+package rbac
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/manifest"
+
+	"github.com/labstack/echo/v4"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Export formats.
+const (
+	ExportFormatYAML    = "yaml"
+	ExportFormatTarball = "tar.gz"
+)
+
+// ExportHandler handles requests to export roles, cluster roles and bindings without their
+// server-managed fields, as multi-document YAML or, with format=tar.gz, a tarball with one file
+// per object. The namespace, labelSelector and excludeSystem parameters filter the objects.
+func ExportHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter, err := parseManifestFilter(c)
+		if err != nil {
+			return err
+		}
+		format := c.QueryParam("format")
+		if format == "" {
+			format = ExportFormatYAML
+		}
+		if format != ExportFormatYAML && format != ExportFormatTarball {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid format: "+format+", must be "+ExportFormatYAML+" or "+ExportFormatTarball)
+		}
+
+		objs, err := manifest.Collect(rbacCache, filter)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing RBAC objects: "+err.Error())
+		}
+
+		if format == ExportFormatTarball {
+			var buf bytes.Buffer
+			if err := manifest.WriteTarball(&buf, objs); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to write tarball: "+err.Error())
+			}
+			c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="rbac-export.tar.gz"`)
+			return c.Blob(http.StatusOK, "application/gzip", buf.Bytes())
+		}
+
+		data, err := manifest.EncodeYAML(objs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to encode YAML: "+err.Error())
+		}
+		return c.Blob(http.StatusOK, "application/yaml", data)
+	}
+}
+
+// parseManifestFilter builds a manifest filter from the namespace, labelSelector and
+// excludeSystem query parameters.
+func parseManifestFilter(c echo.Context) (manifest.Filter, error) {
+	filter := manifest.Filter{Namespace: c.QueryParam("namespace")}
+
+	if value := c.QueryParam("labelSelector"); value != "" {
+		selector, err := labels.Parse(value)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid labelSelector parameter: "+err.Error())
+		}
+		filter.Labels = selector
+	}
+
+	if value := c.QueryParam("excludeSystem"); value != "" {
+		excludeSystem, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid excludeSystem parameter: "+value)
+		}
+		filter.ExcludeSystem = excludeSystem
+	}
+
+	return filter, nil
+}
@@ -1,13 +1,14 @@
 package rbac
 
 import (
-	"context"
 	"net/http"
 
+	"rbac/pkg/cache"
+	"rbac/pkg/utils"
+
 	"github.com/labstack/echo/v4"
 	rbacv1 "k8s.io/api/rbac/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
 // GroupDetailsResponse represents the detailed information about a group.
@@ -19,68 +20,77 @@ type GroupDetailsResponse struct {
 }
 
 // GroupDetailsHandler handles requests for detailed information about a specific group.
-func GroupDetailsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func GroupDetailsHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		groupName := c.QueryParam("groupName")
 		if groupName == "" {
 			return echo.NewHTTPError(http.StatusBadRequest, "Group name is required")
 		}
 
-		roleBindings, err := clientset.RbacV1().RoleBindings("").List(context.TODO(), metav1.ListOptions{})
+		roleBindings, err := rbacCache.RoleBindingsForSubject(rbacv1.GroupKind, groupName)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing role bindings: "+err.Error())
+			return utils.KubernetesError(err, "Error listing role bindings")
 		}
 
-		clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
+		clusterRoleBindings, err := rbacCache.ClusterRoleBindingsForSubject(rbacv1.GroupKind, groupName)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing cluster role bindings: "+err.Error())
+			return utils.KubernetesError(err, "Error listing cluster role bindings")
 		}
 
-		clusterRoles, err := clientset.RbacV1().ClusterRoles().List(context.TODO(), metav1.ListOptions{})
+		clusterRoles, err := boundClusterRoles(rbacCache, clusterRoleBindings)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing cluster roles: "+err.Error())
+			return utils.KubernetesError(err, "Error fetching cluster roles")
 		}
 
-		groupDetails := extractGroupDetails(groupName, roleBindings.Items, clusterRoleBindings.Items, clusterRoles.Items)
+		groupDetails := GroupDetailsResponse{
+			GroupName:           groupName,
+			RoleBindings:        derefRoleBindings(roleBindings),
+			ClusterRoleBindings: derefClusterRoleBindings(clusterRoleBindings),
+			ClusterRoles:        clusterRoles,
+		}
 		return c.JSON(http.StatusOK, groupDetails)
 	}
 }
 
-// extractGroupDetails extracts detailed information about a specific group.
-func extractGroupDetails(groupName string, roleBindings []rbacv1.RoleBinding, clusterRoleBindings []rbacv1.ClusterRoleBinding, clusterRoles []rbacv1.ClusterRole) GroupDetailsResponse {
-	var groupRoleBindings []rbacv1.RoleBinding
-	var groupClusterRoleBindings []rbacv1.ClusterRoleBinding
-	var groupClusterRoles []rbacv1.ClusterRole
+// boundClusterRoles collects the ClusterRoles referenced by the given ClusterRoleBindings.
+// Bindings that reference a missing ClusterRole are skipped.
+func boundClusterRoles(rbacCache *cache.RBACCache, clusterRoleBindings []*rbacv1.ClusterRoleBinding) ([]rbacv1.ClusterRole, error) {
+	var clusterRoles []rbacv1.ClusterRole
+	seen := make(map[string]struct{})
 
-	for _, rb := range roleBindings {
-		for _, subject := range rb.Subjects {
-			if subject.Kind == rbacv1.GroupKind && subject.Name == groupName {
-				groupRoleBindings = append(groupRoleBindings, rb)
-			}
+	for _, crb := range clusterRoleBindings {
+		if _, ok := seen[crb.RoleRef.Name]; ok {
+			continue
 		}
-	}
+		seen[crb.RoleRef.Name] = struct{}{}
 
-	for _, crb := range clusterRoleBindings {
-		for _, subject := range crb.Subjects {
-			if subject.Kind == rbacv1.GroupKind && subject.Name == groupName {
-				groupClusterRoleBindings = append(groupClusterRoleBindings, crb)
-			}
+		cr, err := rbacCache.GetClusterRole(crb.RoleRef.Name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+		clusterRoles = append(clusterRoles, *cr)
 	}
 
-	// Collect ClusterRoles associated with the group's ClusterRoleBindings
-	for _, crb := range groupClusterRoleBindings {
-		for _, cr := range clusterRoles {
-			if cr.Name == crb.RoleRef.Name {
-				groupClusterRoles = append(groupClusterRoles, cr)
-			}
-		}
+	return clusterRoles, nil
+}
+
+// derefRoleBindings copies cached role bindings into a value slice for the response.
+func derefRoleBindings(roleBindings []*rbacv1.RoleBinding) []rbacv1.RoleBinding {
+	result := make([]rbacv1.RoleBinding, 0, len(roleBindings))
+	for _, rb := range roleBindings {
+		result = append(result, *rb)
 	}
+	return result
+}
 
-	return GroupDetailsResponse{
-		GroupName:           groupName,
-		RoleBindings:        groupRoleBindings,
-		ClusterRoleBindings: groupClusterRoleBindings,
-		ClusterRoles:        groupClusterRoles,
+// derefClusterRoleBindings copies cached cluster role bindings into a value slice for the response.
+func derefClusterRoleBindings(clusterRoleBindings []*rbacv1.ClusterRoleBinding) []rbacv1.ClusterRoleBinding {
+	result := make([]rbacv1.ClusterRoleBinding, 0, len(clusterRoleBindings))
+	for _, crb := range clusterRoleBindings {
+		result = append(result, *crb)
 	}
-}
\ No newline at end of file
+	return result
+}
@@ -0,0 +1,182 @@
+package rbac
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/history"
+	"rbac/pkg/manifest"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// HistoryDiff is the field-level diff between two revisions of an object.
+type HistoryDiff struct {
+	From    uint64            `json:"from"`
+	To      uint64            `json:"to"`
+	Changes []utils.FieldDiff `json:"changes"`
+}
+
+// HistoryResponse represents the revisions of an object, oldest first.
+type HistoryResponse struct {
+	Revisions []history.Revision `json:"revisions"`
+	Diff      *HistoryDiff       `json:"diff,omitempty"`
+}
+
+// RollbackRequest represents the body of a rollback request.
+type RollbackRequest struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Revision  uint64 `json:"revision"`
+}
+
+// HistoryHandler handles requests for the revisions of an object in a cluster. With from and
+// to, the response also holds the diff between those revisions; to defaults to the latest.
+func HistoryHandler(revisions *history.History, cluster string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ref, err := historyRef(cluster, c.QueryParam("kind"), c.QueryParam("namespace"), c.QueryParam("name"))
+		if err != nil {
+			return err
+		}
+
+		list, err := revisions.List(ref)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error reading history: "+err.Error())
+		}
+		response := HistoryResponse{Revisions: list}
+		if response.Revisions == nil {
+			response.Revisions = []history.Revision{}
+		}
+
+		if from := c.QueryParam("from"); from != "" {
+			diff, err := historyDiff(revisions, ref, list, from, c.QueryParam("to"))
+			if err != nil {
+				return err
+			}
+			response.Diff = diff
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// RollbackHandler handles requests to restore an object to one of its revisions. An object
+// that still exists is updated only if it matches the If-Match header, as with PUT; a deleted
+// object is created again.
+func RollbackHandler(revisions *history.History, cluster string, clientset kubernetes.Interface) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var request RollbackRequest
+		if err := c.Bind(&request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Failed to decode request body: "+err.Error())
+		}
+		ref, err := historyRef(cluster, request.Kind, request.Namespace, request.Name)
+		if err != nil {
+			return err
+		}
+		if request.Revision == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Revision is required")
+		}
+
+		revision, err := revisions.Get(ref, request.Revision)
+		if errors.Is(err, history.ErrRevisionNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Revision "+strconv.FormatUint(request.Revision, 10)+" not found")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error reading history: "+err.Error())
+		}
+
+		kind := manifest.LookupKind(ref.Kind)
+		obj := kind.New()
+		if err := json.Unmarshal(revision.Object, obj); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Invalid revision: "+err.Error())
+		}
+		obj.SetResourceVersion("")
+		obj.SetUID("")
+		obj.SetCreationTimestamp(metav1.Time{})
+		obj.SetDeletionTimestamp(nil)
+		obj.SetGeneration(0)
+		obj.SetManagedFields(nil)
+
+		getFunc := func(namespace, name string) (interface{}, error) {
+			return kind.Get(clientset, namespace, name)
+		}
+		if _, err := getFunc(ref.Namespace, ref.Name); apierrors.IsNotFound(err) {
+			dryRun, err := utils.DryRun(c)
+			if err != nil {
+				return err
+			}
+			created, err := kind.Create(clientset, obj, metav1.CreateOptions{DryRun: dryRun})
+			if err != nil {
+				return utils.KubernetesError(err, "Failed to restore resource")
+			}
+			if dryRun != nil {
+				return utils.DryRunResult(c, nil, created)
+			}
+			return c.JSON(http.StatusOK, created)
+		}
+
+		return utils.UpdateIfMatch(c, ref.Namespace, obj, getFunc, func(_ string, resource interface{}, opts metav1.UpdateOptions) (interface{}, error) {
+			return kind.Update(clientset, resource.(manifest.Object), opts)
+		})
+	}
+}
+
+// historyRef validates the object named by a history request.
+func historyRef(cluster, kind, namespace, name string) (history.Ref, error) {
+	historyKind := manifest.LookupKind(kind)
+	if historyKind == nil || !history.IsKind(kind) {
+		return history.Ref{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid kind: "+kind+", must be one of Role, ClusterRole, RoleBinding, ClusterRoleBinding")
+	}
+	if name == "" {
+		return history.Ref{}, echo.NewHTTPError(http.StatusBadRequest, "Resource name is required")
+	}
+	if !historyKind.Namespaced {
+		namespace = ""
+	} else if namespace == "" {
+		namespace = "default"
+	}
+	return history.Ref{Cluster: cluster, Kind: kind, Namespace: namespace, Name: name}, nil
+}
+
+// historyDiff diffs the from revision against the to revision, or the latest if to is empty.
+func historyDiff(revisions *history.History, ref history.Ref, list []history.Revision, from, to string) (*HistoryDiff, error) {
+	diff := &HistoryDiff{}
+	var err error
+	if diff.From, err = strconv.ParseUint(from, 10, 64); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid from parameter: "+from)
+	}
+	if to != "" {
+		if diff.To, err = strconv.ParseUint(to, 10, 64); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid to parameter: "+to)
+		}
+	} else if len(list) > 0 {
+		diff.To = list[len(list)-1].Revision
+	}
+
+	var objects [2]json.RawMessage
+	for i, number := range []uint64{diff.From, diff.To} {
+		revision, err := revisions.Get(ref, number)
+		if errors.Is(err, history.ErrRevisionNotFound) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Revision "+strconv.FormatUint(number, 10)+" not found")
+		}
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Error reading history: "+err.Error())
+		}
+		objects[i] = revision.Object
+	}
+
+	if diff.Changes, err = utils.DiffObjects(objects[0], objects[1]); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to diff revisions: "+err.Error())
+	}
+	if diff.Changes == nil {
+		diff.Changes = []utils.FieldDiff{}
+	}
+	return diff, nil
+}
@@ -0,0 +1,210 @@
+package rbac
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/hygiene"
+	"rbac/pkg/policy"
+	"rbac/pkg/search"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// HygieneSummary counts the items of a hygiene report by issue.
+type HygieneSummary struct {
+	UnboundRoles           int `json:"unboundRoles"`
+	MissingRoleRefs        int `json:"missingRoleRefs"`
+	MissingServiceAccounts int `json:"missingServiceAccounts"`
+	MissingNamespaces      int `json:"missingNamespaces"`
+	EmptyBindings          int `json:"emptyBindings"`
+}
+
+// HygieneResponse represents the roles and bindings that grant nothing or refer to objects
+// that do not exist.
+type HygieneResponse struct {
+	Items   []hygiene.Item `json:"items"`
+	Summary HygieneSummary `json:"summary"`
+}
+
+// HygieneCleanupRequest selects the items of the hygiene report to clean up, by ID.
+type HygieneCleanupRequest struct {
+	Items []string `json:"items"`
+}
+
+// HygieneCleanupResponse represents the result of the cleanup of every selected item.
+type HygieneCleanupResponse struct {
+	DryRun  bool             `json:"dryRun"`
+	Results []hygiene.Result `json:"results"`
+}
+
+// HygieneHandler handles requests for the hygiene report of a cluster: roles and cluster roles
+// that are never bound, bindings whose role does not exist, bindings without subjects, and
+// bindings to service accounts or namespaces that were deleted. The issue, namespace and
+// excludeSystem parameters filter the items.
+func HygieneHandler(clientset kubernetes.Interface, rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		issue := c.QueryParam("issue")
+		switch issue {
+		case "", hygiene.IssueUnboundRole, hygiene.IssueMissingRoleRef, hygiene.IssueMissingServiceAccount, hygiene.IssueMissingNamespace, hygiene.IssueEmptyBinding:
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid issue: "+issue+", must be one of unbound-role, missing-role-ref, missing-service-account, missing-namespace, empty-binding")
+		}
+		namespace := c.QueryParam("namespace")
+		excludeSystem := false
+		if value := c.QueryParam("excludeSystem"); value != "" {
+			var err error
+			if excludeSystem, err = strconv.ParseBool(value); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid excludeSystem parameter: "+value)
+			}
+		}
+
+		objects, items, err := hygieneItems(clientset, rbacCache)
+		if err != nil {
+			return err
+		}
+
+		response := HygieneResponse{Items: []hygiene.Item{}}
+		for _, item := range items {
+			if issue != "" && item.Issue != issue {
+				continue
+			}
+			if namespace != "" && item.Namespace != namespace {
+				continue
+			}
+			if excludeSystem && isSystemHygieneItem(objects, item) {
+				continue
+			}
+
+			switch item.Issue {
+			case hygiene.IssueUnboundRole:
+				response.Summary.UnboundRoles++
+			case hygiene.IssueMissingRoleRef:
+				response.Summary.MissingRoleRefs++
+			case hygiene.IssueMissingServiceAccount:
+				response.Summary.MissingServiceAccounts++
+			case hygiene.IssueMissingNamespace:
+				response.Summary.MissingNamespaces++
+			case hygiene.IssueEmptyBinding:
+				response.Summary.EmptyBindings++
+			}
+			response.Items = append(response.Items, item)
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// HygieneCleanupHandler handles requests to clean up the items of the hygiene report selected
+// by ID: unbound roles and broken or empty bindings are deleted, and subjects that were deleted
+// are removed from their bindings. The report is computed again, so an item that was fixed in
+// the meantime reports an error instead of being applied. With dryRun=true nothing is changed.
+func HygieneCleanupHandler(clientset kubernetes.Interface, rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		dryRun, err := utils.DryRun(c)
+		if err != nil {
+			return err
+		}
+		var request HygieneCleanupRequest
+		if err := c.Bind(&request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body: "+err.Error())
+		}
+		if len(request.Items) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "At least one item is required")
+		}
+
+		_, items, err := hygieneItems(clientset, rbacCache)
+		if err != nil {
+			return err
+		}
+		byID := make(map[string]hygiene.Item, len(items))
+		for _, item := range items {
+			byID[item.ID] = item
+		}
+
+		var selected []hygiene.Item
+		seen := make(map[string]bool, len(request.Items))
+		for _, id := range request.Items {
+			if item, ok := byID[id]; ok && !seen[id] {
+				selected = append(selected, item)
+			}
+			seen[id] = true
+		}
+		applied := make(map[string]hygiene.Result, len(selected))
+		for _, result := range hygiene.Cleanup(clientset, selected, dryRun, utils.Changes(c)) {
+			applied[result.ID] = result
+		}
+
+		response := HygieneCleanupResponse{DryRun: len(dryRun) > 0, Results: []hygiene.Result{}}
+		for _, id := range request.Items {
+			result, ok := applied[id]
+			if !ok {
+				result = hygiene.Result{ID: id, Error: "No such item in the hygiene report"}
+			}
+			response.Results = append(response.Results, result)
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// hygieneItems computes the hygiene report from the RBAC cache and the namespaces of the
+// cluster.
+func hygieneItems(clientset kubernetes.Interface, rbacCache *cache.RBACCache) (policy.ObjectSet, []hygiene.Item, error) {
+	if !rbacCache.HasSynced() {
+		return policy.ObjectSet{}, nil, echo.NewHTTPError(http.StatusServiceUnavailable, "RBAC cache is not synced yet")
+	}
+	objects, err := policy.CachedObjects(rbacCache)
+	if err != nil {
+		return policy.ObjectSet{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "Error listing RBAC objects: "+err.Error())
+	}
+	serviceAccounts, err := rbacCache.ListServiceAccounts("")
+	if err != nil {
+		return policy.ObjectSet{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "Error listing service accounts: "+err.Error())
+	}
+	namespaceList, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return policy.ObjectSet{}, nil, utils.KubernetesError(err, "Error listing namespaces")
+	}
+	namespaces := make([]string, 0, len(namespaceList.Items))
+	for _, namespace := range namespaceList.Items {
+		namespaces = append(namespaces, namespace.Name)
+	}
+	return objects, hygiene.Analyze(objects, serviceAccounts, namespaces), nil
+}
+
+// isSystemHygieneItem reports whether the object of an item is a system object.
+func isSystemHygieneItem(objects policy.ObjectSet, item hygiene.Item) bool {
+	var meta *metav1.ObjectMeta
+	switch item.Kind {
+	case "Role":
+		for _, role := range objects.Roles {
+			if role.Namespace == item.Namespace && role.Name == item.Name {
+				meta = &role.ObjectMeta
+			}
+		}
+	case "ClusterRole":
+		for _, clusterRole := range objects.ClusterRoles {
+			if clusterRole.Name == item.Name {
+				meta = &clusterRole.ObjectMeta
+			}
+		}
+	case "RoleBinding":
+		for _, rb := range objects.RoleBindings {
+			if rb.Namespace == item.Namespace && rb.Name == item.Name {
+				meta = &rb.ObjectMeta
+			}
+		}
+	case "ClusterRoleBinding":
+		for _, crb := range objects.ClusterRoleBindings {
+			if crb.Name == item.Name {
+				meta = &crb.ObjectMeta
+			}
+		}
+	}
+	return meta != nil && search.IsSystem(*meta)
+}
@@ -0,0 +1,281 @@
+package rbac
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/audit"
+	"rbac/pkg/manifest"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxImportBody bounds the size of an imported bundle.
+const maxImportBody = 10 << 20
+
+// Planned import actions.
+const (
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+	ImportInvalid   = "invalid"
+)
+
+// ImportItem is the plan, and once applied the result, for one object of a bundle.
+type ImportItem struct {
+	Kind      string            `json:"kind"`
+	Namespace string            `json:"namespace,omitempty"`
+	Name      string            `json:"name"`
+	Action    string            `json:"action"`
+	Diff      []utils.FieldDiff `json:"diff,omitempty"`
+	Applied   bool              `json:"applied,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// ImportSummary counts the objects of a bundle by planned action, and the failed ones.
+type ImportSummary struct {
+	Create    int `json:"create"`
+	Update    int `json:"update"`
+	Unchanged int `json:"unchanged"`
+	Invalid   int `json:"invalid"`
+	Failed    int `json:"failed"`
+}
+
+// plannedObject is the object to create for an item of an import, or the merged object to
+// update along with the current one.
+type plannedObject struct {
+	obj     manifest.Object
+	current manifest.Object
+}
+
+// ImportResponse represents the plan of an import, in apply order, and whether it was applied,
+// for real or as a dry run.
+type ImportResponse struct {
+	Confirmed bool          `json:"confirmed"`
+	DryRun    bool          `json:"dryRun"`
+	Items     []ImportItem  `json:"items"`
+	Summary   ImportSummary `json:"summary"`
+}
+
+// ImportHandler handles requests to import a bundle of namespaces, service accounts, roles and
+// bindings as multi-document YAML or a JSON list. Without confirm=true it only returns the plan;
+// with it, the plan is applied in order and each item reports its result. With dryRun=true as
+// well, the API server checks every item but nothing is changed. Namespaced objects without a
+// namespace go to the namespace parameter, or default.
+func ImportHandler(clientset kubernetes.Interface) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		confirm := false
+		if value := c.QueryParam("confirm"); value != "" {
+			var err error
+			if confirm, err = strconv.ParseBool(value); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid confirm parameter: "+value)
+			}
+		}
+		dryRun, err := utils.DryRun(c)
+		if err != nil {
+			return err
+		}
+		namespace := c.QueryParam("namespace")
+		if namespace == "" {
+			namespace = "default"
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxImportBody+1))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Failed to read request body: "+err.Error())
+		}
+		if len(body) > maxImportBody {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "The bundle is larger than "+strconv.Itoa(maxImportBody)+" bytes")
+		}
+
+		objs, err := manifest.Decode(body)
+		if err != nil {
+			return invalidBundle(err)
+		}
+		if len(objs) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "The bundle has no objects")
+		}
+		manifest.SortForApply(objs)
+
+		items, planned, err := planImport(clientset, objs, namespace)
+		if err != nil {
+			return err
+		}
+		response := ImportResponse{Confirmed: confirm, DryRun: len(dryRun) > 0, Items: items}
+
+		if confirm {
+			var causes []utils.ErrorCause
+			for _, item := range items {
+				if item.Action == ImportInvalid {
+					causes = append(causes, utils.ErrorCause{Type: string(metav1.CauseTypeFieldValueInvalid), Message: item.Error, Field: importItemRef(item)})
+				}
+			}
+			if len(causes) > 0 {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, utils.ErrorResponse{
+					Code:    http.StatusUnprocessableEntity,
+					Reason:  string(metav1.StatusReasonInvalid),
+					Message: "The bundle has invalid objects; fix them and retry",
+					Causes:  causes,
+				})
+			}
+			applyImport(clientset, response.Items, planned, dryRun, utils.Changes(c))
+		}
+
+		for _, item := range response.Items {
+			switch item.Action {
+			case ImportCreate:
+				response.Summary.Create++
+			case ImportUpdate:
+				response.Summary.Update++
+			case ImportUnchanged:
+				response.Summary.Unchanged++
+			case ImportInvalid:
+				response.Summary.Invalid++
+			}
+			if item.Error != "" && item.Action != ImportInvalid {
+				response.Summary.Failed++
+			}
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// planImport compares every object with the cluster. It returns the plan items and, for
+// each, the object to create or the merged object to update.
+func planImport(clientset kubernetes.Interface, objs []manifest.Object, namespace string) ([]ImportItem, []plannedObject, error) {
+	items := make([]ImportItem, 0, len(objs))
+	planned := make([]plannedObject, 0, len(objs))
+	seen := make(map[string]bool, len(objs))
+
+	for _, obj := range objs {
+		kind := manifest.KindOf(obj)
+		if !kind.Namespaced {
+			obj.SetNamespace("")
+		} else if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+		obj.SetResourceVersion("")
+		obj.SetUID("")
+		obj.SetCreationTimestamp(metav1.Time{})
+		obj.SetGeneration(0)
+		obj.SetManagedFields(nil)
+
+		item := ImportItem{Kind: kind.Name, Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		items = append(items, item)
+		planned = append(planned, plannedObject{obj: obj})
+		current := &items[len(items)-1]
+
+		if err := kind.Validate(obj); err != nil {
+			current.Action, current.Error = ImportInvalid, err.Error()
+			continue
+		}
+		ref := importItemRef(item)
+		if seen[ref] {
+			current.Action, current.Error = ImportInvalid, "duplicate object in the bundle"
+			continue
+		}
+		seen[ref] = true
+
+		existing, err := kind.Get(clientset, obj.GetNamespace(), obj.GetName())
+		if apierrors.IsNotFound(err) {
+			current.Action = ImportCreate
+			continue
+		}
+		if err != nil {
+			return nil, nil, utils.KubernetesError(err, "Error fetching "+kind.Name+" "+obj.GetName())
+		}
+
+		merged, err := kind.Merge(existing, obj)
+		if err != nil {
+			current.Action, current.Error = ImportInvalid, err.Error()
+			continue
+		}
+		diff, err := utils.DiffObjects(existing, merged)
+		if err != nil {
+			return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to diff resource: "+err.Error())
+		}
+		if len(diff) == 0 {
+			current.Action = ImportUnchanged
+			continue
+		}
+		current.Action, current.Diff = ImportUpdate, diff
+		planned[len(planned)-1] = plannedObject{obj: merged, current: existing}
+	}
+	return items, planned, nil
+}
+
+// applyImport creates and updates the planned objects in order, with the dry-run mode of
+// dryRun, recording the result of each in its item and reporting each change to record. A
+// failure does not stop the objects that follow.
+func applyImport(clientset kubernetes.Interface, items []ImportItem, planned []plannedObject, dryRun []string, record utils.ChangeRecorder) {
+	for i, plan := range planned {
+		kind := manifest.KindOf(plan.obj)
+		change := utils.Change{Kind: kind.Name, Namespace: plan.obj.GetNamespace(), Name: plan.obj.GetName()}
+		var applied manifest.Object
+		var err error
+		switch items[i].Action {
+		case ImportCreate:
+			change.Action = audit.ActionCreate
+			applied, err = kind.Create(clientset, plan.obj, metav1.CreateOptions{DryRun: dryRun, FieldManager: utils.FieldManager})
+		case ImportUpdate:
+			change.Action, change.Before = audit.ActionUpdate, plan.current
+			applied, err = kind.Update(clientset, plan.obj, metav1.UpdateOptions{DryRun: dryRun, FieldManager: utils.FieldManager})
+		default:
+			continue
+		}
+		if err == nil {
+			change.After = applied
+		}
+		change.Err = err
+		record(change)
+		if err != nil {
+			var apiStatus apierrors.APIStatus
+			if errors.As(err, &apiStatus) && apiStatus.Status().Message != "" {
+				items[i].Error = apiStatus.Status().Message
+			} else {
+				items[i].Error = err.Error()
+			}
+			continue
+		}
+		items[i].Applied = true
+	}
+}
+
+// invalidBundle builds the 400 response for a bundle with unreadable documents.
+func invalidBundle(err error) error {
+	response := utils.ErrorResponse{
+		Code:    http.StatusBadRequest,
+		Reason:  string(metav1.StatusReasonBadRequest),
+		Message: "Invalid bundle: " + err.Error(),
+	}
+	var joined interface{ Unwrap() []error }
+	errs := []error{err}
+	if errors.As(err, &joined) {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		cause := utils.ErrorCause{Type: string(metav1.CauseTypeFieldValueInvalid), Message: err.Error()}
+		var documentError *manifest.DocumentError
+		if errors.As(err, &documentError) {
+			cause.Field = "document " + strconv.Itoa(documentError.Document)
+			cause.Message = documentError.Err.Error()
+		}
+		response.Causes = append(response.Causes, cause)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, response)
+}
+
+// importItemRef names the object of an item as kind namespace/name, or kind name.
+func importItemRef(item ImportItem) string {
+	if item.Namespace == "" {
+		return item.Kind + " " + item.Name
+	}
+	return item.Kind + " " + item.Namespace + "/" + item.Name
+}
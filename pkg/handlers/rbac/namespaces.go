@@ -8,15 +8,17 @@ import (
 	"github.com/labstack/echo/v4"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
 // NamespacesHandler handles requests related to namespaces.
-func NamespacesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func NamespacesHandler(clientset kubernetes.Interface) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		handlers := map[string]func(echo.Context, *kubernetes.Clientset, string) error{
+		handlers := map[string]func(echo.Context, kubernetes.Interface, string) error{
 			http.MethodGet:    handleListNamespaces,
 			http.MethodPost:   handleCreateNamespace,
+			http.MethodPatch:  handlePatchNamespace,
 			http.MethodDelete: handleDeleteNamespace,
 		}
 
@@ -25,24 +27,38 @@ func NamespacesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
 }
 
 // handleListNamespaces lists all namespaces.
-func handleListNamespaces(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleListNamespaces(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	return utils.ListResources(c, clientset, "", func(namespace string, opts metav1.ListOptions) (interface{}, error) {
 		return clientset.CoreV1().Namespaces().List(context.TODO(), opts)
 	})
 }
 
 // handleCreateNamespace creates a new namespace.
-func handleCreateNamespace(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleCreateNamespace(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	var namespace corev1.Namespace
 	return utils.CreateResource(c, clientset, "", &namespace, func(namespace string, obj interface{}, opts metav1.CreateOptions) (interface{}, error) {
 		return clientset.CoreV1().Namespaces().Create(context.TODO(), obj.(*corev1.Namespace), opts)
 	})
 }
 
+// handlePatchNamespace patches a namespace by name with a JSON patch, merge patch or server-side apply.
+func handlePatchNamespace(c echo.Context, clientset kubernetes.Interface, _ string) error {
+	name := c.QueryParam("name")
+	getFunc := func(_, name string) (interface{}, error) {
+		return clientset.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.PatchResource(c, "", name, getFunc, func(namespace, name string, patchType types.PatchType, data []byte, opts metav1.PatchOptions) (interface{}, error) {
+		return clientset.CoreV1().Namespaces().Patch(context.TODO(), name, patchType, data, opts)
+	})
+}
+
 // handleDeleteNamespace deletes a namespace by name.
-func handleDeleteNamespace(c echo.Context, clientset *kubernetes.Clientset, _ string) error {
+func handleDeleteNamespace(c echo.Context, clientset kubernetes.Interface, _ string) error {
 	name := c.QueryParam("name")
-	return utils.DeleteResource(c, clientset, "", name, func(namespace, name string, opts metav1.DeleteOptions) error {
+	getFunc := func(_, name string) (interface{}, error) {
+		return clientset.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.DeleteResource(c, clientset, "", name, getFunc, func(namespace, name string, opts metav1.DeleteOptions) error {
 		return clientset.CoreV1().Namespaces().Delete(context.TODO(), name, opts)
 	})
 }
\ No newline at end of file
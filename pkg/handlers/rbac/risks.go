@@ -0,0 +1,132 @@
+package rbac
+
+import (
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/policy"
+	"rbac/pkg/risk"
+	"rbac/pkg/search"
+
+	"github.com/labstack/echo/v4"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// RiskSummary counts findings by severity.
+type RiskSummary struct {
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	Medium   int `json:"medium"`
+}
+
+// RisksResponse represents the roles and cluster roles with dangerous permissions.
+type RisksResponse struct {
+	Roles   []risk.RoleRisk `json:"roles"`
+	Summary RiskSummary     `json:"summary"`
+}
+
+// RisksHandler handles requests for the dangerous permissions of every role and cluster role,
+// with the subjects that hold them. The kind, namespace, severity (the minimum to report) and
+// excludeSystem parameters filter the results.
+func RisksHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		kind := c.QueryParam("kind")
+		if kind != "" && kind != "Role" && kind != "ClusterRole" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid kind: "+kind+", must be Role or ClusterRole")
+		}
+		namespace := c.QueryParam("namespace")
+		minimum := c.QueryParam("severity")
+		if minimum != "" && risk.Rank(minimum) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid severity: "+minimum+", must be one of critical, high, medium")
+		}
+		excludeSystem := false
+		if value := c.QueryParam("excludeSystem"); value != "" {
+			var err error
+			if excludeSystem, err = strconv.ParseBool(value); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid excludeSystem parameter: "+value)
+			}
+		}
+
+		objects, err := policy.CachedObjects(rbacCache)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing RBAC objects: "+err.Error())
+		}
+
+		response := RisksResponse{Roles: []risk.RoleRisk{}}
+		for _, roleRisk := range risk.Analyze(objects) {
+			if kind != "" && roleRisk.Kind != kind {
+				continue
+			}
+			if namespace != "" && roleRisk.Namespace != namespace {
+				continue
+			}
+			if excludeSystem && isSystemRole(objects, roleRisk) {
+				continue
+			}
+
+			findings := roleRisk.Findings[:0]
+			for _, finding := range roleRisk.Findings {
+				if risk.Rank(finding.Severity) >= risk.Rank(minimum) {
+					findings = append(findings, finding)
+				}
+			}
+			if len(findings) == 0 {
+				continue
+			}
+			roleRisk.Findings = findings
+
+			for _, finding := range findings {
+				switch finding.Severity {
+				case risk.SeverityCritical:
+					response.Summary.Critical++
+				case risk.SeverityHigh:
+					response.Summary.High++
+				case risk.SeverityMedium:
+					response.Summary.Medium++
+				}
+			}
+			response.Roles = append(response.Roles, roleRisk)
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// isSystemRole reports whether the role of a result is a system: role or one of the API
+// server's default roles.
+func isSystemRole(objects policy.ObjectSet, roleRisk risk.RoleRisk) bool {
+	switch roleRisk.Kind {
+	case "Role":
+		for _, role := range objects.Roles {
+			if role.Namespace == roleRisk.Namespace && role.Name == roleRisk.Name {
+				return search.IsSystem(role.ObjectMeta)
+			}
+		}
+	case "ClusterRole":
+		for _, clusterRole := range objects.ClusterRoles {
+			if clusterRole.Name == roleRisk.Name {
+				return search.IsSystem(clusterRole.ObjectMeta)
+			}
+		}
+	}
+	return false
+}
+
+// roleBindingPointers returns pointers to the role bindings.
+func roleBindingPointers(roleBindings []rbacv1.RoleBinding) []*rbacv1.RoleBinding {
+	pointers := make([]*rbacv1.RoleBinding, 0, len(roleBindings))
+	for i := range roleBindings {
+		pointers = append(pointers, &roleBindings[i])
+	}
+	return pointers
+}
+
+// clusterRoleBindingPointers returns pointers to the cluster role bindings.
+func clusterRoleBindingPointers(clusterRoleBindings []rbacv1.ClusterRoleBinding) []*rbacv1.ClusterRoleBinding {
+	pointers := make([]*rbacv1.ClusterRoleBinding, 0, len(clusterRoleBindings))
+	for i := range clusterRoleBindings {
+		pointers = append(pointers, &clusterRoleBindings[i])
+	}
+	return pointers
+}
@@ -8,21 +8,23 @@ import (
 	"github.com/labstack/echo/v4"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
 // RoleBindingsHandler handles role binding-related requests.
-func RoleBindingsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func RoleBindingsHandler(clientset kubernetes.Interface) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		namespace := c.QueryParam("namespace")
 		if namespace == "" {
 			namespace = "default"
 		}
 
-		handlers := map[string]func(echo.Context, *kubernetes.Clientset, string) error{
+		handlers := map[string]func(echo.Context, kubernetes.Interface, string) error{
 			http.MethodGet:    handleListRoleBindings,
 			http.MethodPost:   handleCreateRoleBinding,
 			http.MethodPut:    handleUpdateRoleBinding,
+			http.MethodPatch:  handlePatchRoleBinding,
 			http.MethodDelete: handleDeleteRoleBinding,
 		}
 
@@ -31,14 +33,14 @@ func RoleBindingsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
 }
 
 // handleListRoleBindings lists all role bindings in a specific namespace.
-func handleListRoleBindings(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleListRoleBindings(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	return utils.ListResources(c, clientset, namespace, func(namespace string, opts metav1.ListOptions) (interface{}, error) {
 		return clientset.RbacV1().RoleBindings(namespace).List(context.TODO(), opts)
 	})
 }
 
 // handleCreateRoleBinding creates a new role binding in a specific namespace.
-func handleCreateRoleBinding(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleCreateRoleBinding(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	var roleBinding rbacv1.RoleBinding
 	return utils.CreateResource(c, clientset, namespace, &roleBinding, func(namespace string, obj interface{}, opts metav1.CreateOptions) (interface{}, error) {
 		return clientset.RbacV1().RoleBindings(namespace).Create(context.TODO(), obj.(*rbacv1.RoleBinding), opts)
@@ -46,23 +48,40 @@ func handleCreateRoleBinding(c echo.Context, clientset *kubernetes.Clientset, na
 }
 
 // handleUpdateRoleBinding updates an existing role binding in a specific namespace.
-func handleUpdateRoleBinding(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleUpdateRoleBinding(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	var roleBinding rbacv1.RoleBinding
-	return utils.UpdateResource(c, clientset, namespace, &roleBinding, func(namespace string, obj interface{}, opts metav1.UpdateOptions) (interface{}, error) {
+	getFunc := func(namespace, name string) (interface{}, error) {
+		return clientset.RbacV1().RoleBindings(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.UpdateResource(c, clientset, namespace, &roleBinding, getFunc, func(namespace string, obj interface{}, opts metav1.UpdateOptions) (interface{}, error) {
 		return clientset.RbacV1().RoleBindings(namespace).Update(context.TODO(), obj.(*rbacv1.RoleBinding), opts)
 	})
 }
 
+// handlePatchRoleBinding patches a role binding in a specific namespace with a JSON patch, merge patch or server-side apply.
+func handlePatchRoleBinding(c echo.Context, clientset kubernetes.Interface, namespace string) error {
+	name := c.QueryParam("name")
+	getFunc := func(namespace, name string) (interface{}, error) {
+		return clientset.RbacV1().RoleBindings(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.PatchResource(c, namespace, name, getFunc, func(namespace, name string, patchType types.PatchType, data []byte, opts metav1.PatchOptions) (interface{}, error) {
+		return clientset.RbacV1().RoleBindings(namespace).Patch(context.TODO(), name, patchType, data, opts)
+	})
+}
+
 // handleDeleteRoleBinding deletes a role binding in a specific namespace.
-func handleDeleteRoleBinding(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleDeleteRoleBinding(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	name := c.QueryParam("name")
-	return utils.DeleteResource(c, clientset, namespace, name, func(namespace, name string, opts metav1.DeleteOptions) error {
+	getFunc := func(namespace, name string) (interface{}, error) {
+		return clientset.RbacV1().RoleBindings(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.DeleteResource(c, clientset, namespace, name, getFunc, func(namespace, name string, opts metav1.DeleteOptions) error {
 		return clientset.RbacV1().RoleBindings(namespace).Delete(context.TODO(), name, opts)
 	})
 }
 
 // RoleBindingDetailsHandler handles fetching detailed information about a specific role binding.
-func RoleBindingDetailsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func RoleBindingDetailsHandler(clientset kubernetes.Interface) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		roleBindingName := c.QueryParam("name")
 		namespace := c.QueryParam("namespace")
@@ -72,9 +91,10 @@ func RoleBindingDetailsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc
 
 		roleBinding, err := clientset.RbacV1().RoleBindings(namespace).Get(context.TODO(), roleBindingName, metav1.GetOptions{})
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching role binding details: "+err.Error())
+			return utils.KubernetesError(err, "Error fetching role binding details")
 		}
 
+		utils.SetETag(c, roleBinding)
 		return c.JSON(http.StatusOK, roleBinding)
 	}
 }
@@ -3,26 +3,35 @@ package rbac
 import (
 	"context"
 	"net/http"
+	"rbac/pkg/cache"
+	"rbac/pkg/policy"
+	"rbac/pkg/risk"
+	"rbac/pkg/usage"
 	"rbac/pkg/utils"
 
 	"github.com/labstack/echo/v4"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
-// RolesHandler handles role-related requests.
-func RolesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+// RolesHandler handles role-related requests. Lists tell whether each role is bound from the
+// bindings in the RBAC cache.
+func RolesHandler(clientset kubernetes.Interface, rbacCache *cache.RBACCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		namespace := c.QueryParam("namespace")
 		if namespace == "" {
 			namespace = "default"
 		}
 
-		handlers := map[string]func(echo.Context, *kubernetes.Clientset, string) error{
-			http.MethodGet:    handleGetRoles,
+		handlers := map[string]func(echo.Context, kubernetes.Interface, string) error{
+			http.MethodGet: func(c echo.Context, clientset kubernetes.Interface, namespace string) error {
+				return handleGetRoles(c, clientset, rbacCache, namespace)
+			},
 			http.MethodPost:   handleCreateRole,
 			http.MethodPut:    handleUpdateRole,
+			http.MethodPatch:  handlePatchRole,
 			http.MethodDelete: handleDeleteRole,
 		}
 
@@ -30,54 +39,41 @@ func RolesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
 	}
 }
 
-// handleGetRoles handles listing roles in a specific namespace or across all namespaces.
-func handleGetRoles(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
-	if namespace == "all" {
-		return listAllNamespacesRoles(c, clientset)
-	}
-	return listNamespaceRoles(c, clientset, namespace)
-}
-
-// listNamespaceRoles lists roles in a specific namespace.
-func listNamespaceRoles(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
-	roles, err := clientset.RbacV1().Roles(namespace).List(context.TODO(), metav1.ListOptions{})
+// handleGetRoles handles listing roles in a specific namespace or across all namespaces, with
+// their active status and risks. A role is active when a role binding in its namespace refers
+// to it; role bindings to a cluster role of the same name do not count.
+func handleGetRoles(c echo.Context, clientset kubernetes.Interface, rbacCache *cache.RBACCache, namespace string) error {
+	opts, err := utils.ListOptions(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error listing roles: "+err.Error())
+		return err
 	}
-
-	var rolesWithStatus []RoleWithStatus
-	for _, role := range roles.Items {
-		active, err := IsRoleActive(clientset, role.Name, namespace)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error checking if role is active: "+err.Error())
-		}
-		rolesWithStatus = append(rolesWithStatus, RoleWithStatus{Role: role, Active: active})
+	if !rbacCache.HasSynced() {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "RBAC cache is not synced yet")
 	}
 
-	return c.JSON(http.StatusOK, rolesWithStatus)
-}
-
-// listAllNamespacesRoles lists roles across all namespaces.
-func listAllNamespacesRoles(c echo.Context, clientset *kubernetes.Clientset) error {
-	roles, err := clientset.RbacV1().Roles("").List(context.TODO(), metav1.ListOptions{})
+	message := "Error listing roles"
+	if namespace == "all" {
+		namespace, message = "", "Error listing roles across all namespaces"
+	}
+	roles, err := clientset.RbacV1().Roles(namespace).List(context.TODO(), opts)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error listing roles across all namespaces: "+err.Error())
+		return utils.KubernetesError(err, message)
 	}
 
-	var rolesWithStatus []RoleWithStatus
+	rolesWithStatus := []RoleWithStatus{}
 	for _, role := range roles.Items {
-		active, err := IsRoleActive(clientset, role.Name, role.Namespace)
+		roleBindings, err := rbacCache.RoleBindingsForRoleRef(role.Namespace, "Role", role.Name)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error checking if role is active: "+err.Error())
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error checking if roles are active: "+err.Error())
 		}
-		rolesWithStatus = append(rolesWithStatus, RoleWithStatus{Role: role, Active: active})
+		rolesWithStatus = append(rolesWithStatus, RoleWithStatus{Role: role, Active: len(roleBindings) > 0, Risks: risk.Scan(role.Rules)})
 	}
 
-	return c.JSON(http.StatusOK, rolesWithStatus)
+	return c.JSON(http.StatusOK, utils.NewListResponse(roles, rolesWithStatus))
 }
 
 // handleCreateRole handles creating a new role in a specific namespace.
-func handleCreateRole(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleCreateRole(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	var role rbacv1.Role
 	if err := c.Bind(&role); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Failed to decode request body: "+err.Error())
@@ -87,16 +83,24 @@ func handleCreateRole(c echo.Context, clientset *kubernetes.Clientset, namespace
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid role: "+err.Error())
 	}
 
-	createdRole, err := clientset.RbacV1().Roles(namespace).Create(context.TODO(), &role, metav1.CreateOptions{})
+	dryRun, err := utils.DryRun(c)
+	if err != nil {
+		return err
+	}
+
+	createdRole, err := clientset.RbacV1().Roles(namespace).Create(context.TODO(), &role, metav1.CreateOptions{DryRun: dryRun})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create role: "+err.Error())
+		return utils.KubernetesError(err, "Failed to create role")
 	}
 
+	if dryRun != nil {
+		return utils.DryRunResult(c, nil, createdRole)
+	}
 	return c.JSON(http.StatusOK, createdRole)
 }
 
 // handleUpdateRole handles updating an existing role in a specific namespace.
-func handleUpdateRole(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleUpdateRole(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	var role rbacv1.Role
 	if err := c.Bind(&role); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Failed to decode request body: "+err.Error())
@@ -106,48 +110,60 @@ func handleUpdateRole(c echo.Context, clientset *kubernetes.Clientset, namespace
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid role: "+err.Error())
 	}
 
-	updatedRole, err := clientset.RbacV1().Roles(namespace).Update(context.TODO(), &role, metav1.UpdateOptions{})
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update role: "+err.Error())
-	}
+	return utils.UpdateIfMatch(c, namespace, &role, func(namespace, name string) (interface{}, error) {
+		return clientset.RbacV1().Roles(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}, func(namespace string, obj interface{}, opts metav1.UpdateOptions) (interface{}, error) {
+		return clientset.RbacV1().Roles(namespace).Update(context.TODO(), obj.(*rbacv1.Role), opts)
+	})
+}
 
-	return c.JSON(http.StatusOK, updatedRole)
+// handlePatchRole patches a role in a specific namespace with a JSON patch, merge patch or server-side apply.
+func handlePatchRole(c echo.Context, clientset kubernetes.Interface, namespace string) error {
+	name := c.QueryParam("name")
+	getFunc := func(namespace, name string) (interface{}, error) {
+		return clientset.RbacV1().Roles(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return utils.PatchResource(c, namespace, name, getFunc, func(namespace, name string, patchType types.PatchType, data []byte, opts metav1.PatchOptions) (interface{}, error) {
+		return clientset.RbacV1().Roles(namespace).Patch(context.TODO(), name, patchType, data, opts)
+	})
 }
 
 // handleDeleteRole handles deleting a role in a specific namespace.
-func handleDeleteRole(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleDeleteRole(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	name := c.QueryParam("name")
 	if name == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "Role name is required")
 	}
 
-	err := clientset.RbacV1().Roles(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	dryRun, err := utils.DryRun(c)
+	if err != nil {
+		return err
+	}
+
+	var current *rbacv1.Role
+	if dryRun != nil {
+		if current, err = clientset.RbacV1().Roles(namespace).Get(context.TODO(), name, metav1.GetOptions{}); err != nil {
+			return utils.KubernetesError(err, "Failed to fetch role")
+		}
+	}
+
+	err = clientset.RbacV1().Roles(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{DryRun: dryRun})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete role: "+err.Error())
+		return utils.KubernetesError(err, "Failed to delete role")
 	}
 
+	if dryRun != nil {
+		return utils.DryRunResult(c, current, nil)
+	}
 	return c.JSON(http.StatusOK, map[string]string{"message": "Role deleted successfully"})
 }
 
-// RoleWithStatus represents a role with its active status.
+// RoleWithStatus represents a role with its active status and the dangerous permissions it
+// grants. Risks leave out subjects; role details include them.
 type RoleWithStatus struct {
 	rbacv1.Role
-	Active bool `json:"active"`
-}
-
-// IsRoleActive checks if a role is active by looking for any role bindings that reference it.
-func IsRoleActive(clientset *kubernetes.Clientset, roleName, namespace string) (bool, error) {
-	// Check RoleBindings in the namespace
-	roleBindings, err := clientset.RbacV1().RoleBindings(namespace).List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return false, err
-	}
-	for _, rb := range roleBindings.Items {
-		if rb.RoleRef.Name == roleName {
-			return true, nil
-		}
-	}
-	return false, nil
+	Active bool           `json:"active"`
+	Risks  []risk.Finding `json:"risks"`
 }
 
 // RoleDetailsResponse represents the detailed information about a role.
@@ -155,17 +171,21 @@ type RoleDetailsResponse struct {
 	Role         *rbacv1.Role         `json:"role"`
 	RoleBindings []rbacv1.RoleBinding `json:"roleBindings"`
 	Active       bool                 `json:"active"`
+	Risks        []risk.Finding       `json:"risks"`
+	Usage        *usage.RoleUsage     `json:"usage,omitempty"`
 }
 
-// RoleDetailsHandler handles fetching detailed information about a specific role.
-func RoleDetailsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+// RoleDetailsHandler handles fetching detailed information about a specific role. Once audit
+// logs of the cluster were ingested, the details include the use of every rule, with rules
+// unused for unusedDays flagged.
+func RoleDetailsHandler(clientset kubernetes.Interface, usageStore *usage.Store, cluster string) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		return getRoleDetails(c, clientset)
+		return getRoleDetails(c, clientset, usageStore, cluster)
 	}
 }
 
 // getRoleDetails fetches detailed information about a specific role.
-func getRoleDetails(c echo.Context, clientset *kubernetes.Clientset) error {
+func getRoleDetails(c echo.Context, clientset kubernetes.Interface, usageStore *usage.Store, cluster string) error {
 	roleName := c.QueryParam("roleName")
 	namespace := c.QueryParam("namespace")
 	if namespace == "" {
@@ -174,27 +194,31 @@ func getRoleDetails(c echo.Context, clientset *kubernetes.Clientset) error {
 
 	role, err := clientset.RbacV1().Roles(namespace).Get(context.TODO(), roleName, metav1.GetOptions{})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error fetching role details: "+err.Error())
+		return utils.KubernetesError(err, "Error fetching role details")
 	}
 
 	roleBindings, err := clientset.RbacV1().RoleBindings(namespace).List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error listing role bindings: "+err.Error())
+		return utils.KubernetesError(err, "Error listing role bindings")
 	}
 
 	associatedBindings := filterRoleBindings(roleBindings.Items, roleName)
 
-	active, err := IsRoleActive(clientset, roleName, namespace)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error checking if role is active: "+err.Error())
+	objects := policy.ObjectSet{
+		Roles:        []*rbacv1.Role{role},
+		RoleBindings: roleBindingPointers(associatedBindings),
 	}
-
 	response := RoleDetailsResponse{
 		Role:         role,
 		RoleBindings: associatedBindings,
-		Active:       active,
+		Active:       len(associatedBindings) > 0,
+		Risks:        risk.AnalyzeRole(objects, "Role", namespace, roleName),
+	}
+	if response.Usage, err = ruleUsage(c, usageStore, cluster, objects, "Role", namespace, roleName); err != nil {
+		return err
 	}
 
+	utils.SetETag(c, role)
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -202,7 +226,7 @@ func getRoleDetails(c echo.Context, clientset *kubernetes.Clientset) error {
 func filterRoleBindings(roleBindings []rbacv1.RoleBinding, roleName string) []rbacv1.RoleBinding {
 	var associatedBindings []rbacv1.RoleBinding
 	for _, rb := range roleBindings {
-		if rb.RoleRef.Name == roleName {
+		if rb.RoleRef.Kind == "Role" && rb.RoleRef.Name == roleName {
 			associatedBindings = append(associatedBindings, rb)
 		}
 	}
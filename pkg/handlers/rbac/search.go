@@ -0,0 +1,150 @@
+package rbac
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/search"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// defaultSearchLimit is the page size used when the search request sets no limit.
+	defaultSearchLimit = 100
+	// maxSearchLimit bounds the page size of a search request.
+	maxSearchLimit = 1000
+)
+
+// SearchHandler handles searching roles, cluster roles, bindings and service accounts together.
+// Results are paged with limit and continue, like the list routes.
+func SearchHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		query, err := parseSearchQuery(c)
+		if err != nil {
+			return err
+		}
+
+		limit := defaultSearchLimit
+		if value := c.QueryParam("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxSearchLimit {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxSearchLimit))
+			}
+		}
+		offset := 0
+		if value := c.QueryParam("continue"); value != "" {
+			if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid continue token")
+			}
+		}
+
+		results, err := search.Search(rbacCache, query)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error searching RBAC objects: "+err.Error())
+		}
+
+		response := utils.ListResponse{Items: []search.Result{}}
+		if offset < len(results) {
+			end := offset + limit
+			if end > len(results) {
+				end = len(results)
+			}
+			response.Items = results[offset:end]
+			if remaining := int64(len(results) - end); remaining > 0 {
+				response.Continue = strconv.Itoa(end)
+				response.RemainingItemCount = &remaining
+			}
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// parseSearchQuery builds a search query from the request's query parameters.
+func parseSearchQuery(c echo.Context) (search.Query, error) {
+	query := search.Query{
+		Text:        c.QueryParam("q"),
+		Namespace:   c.QueryParam("namespace"),
+		SubjectKind: c.QueryParam("subjectKind"),
+		Verb:        c.QueryParam("verb"),
+		Resource:    c.QueryParam("resource"),
+	}
+
+	if value := c.QueryParam("kind"); value != "" {
+		for _, kind := range strings.Split(value, ",") {
+			if !isSearchKind(kind) {
+				return query, echo.NewHTTPError(http.StatusBadRequest, "Unknown kind "+kind+", must be one of "+strings.Join(search.Kinds, ", "))
+			}
+			query.Kinds = append(query.Kinds, kind)
+		}
+	}
+
+	if value := c.QueryParam("subject"); value != "" {
+		subject, err := regexp.Compile(value)
+		if err != nil {
+			return query, echo.NewHTTPError(http.StatusBadRequest, "Invalid subject pattern: "+err.Error())
+		}
+		query.Subject = subject
+	}
+
+	if value := c.QueryParam("labelSelector"); value != "" {
+		selector, err := labels.Parse(value)
+		if err != nil {
+			return query, echo.NewHTTPError(http.StatusBadRequest, "Invalid labelSelector parameter: "+err.Error())
+		}
+		query.Labels = selector
+	}
+
+	var err error
+	if query.CreatedAfter, err = parseSearchTime(c.QueryParam("createdAfter")); err != nil {
+		return query, echo.NewHTTPError(http.StatusBadRequest, "Invalid createdAfter parameter: "+err.Error())
+	}
+	if query.CreatedBefore, err = parseSearchTime(c.QueryParam("createdBefore")); err != nil {
+		return query, echo.NewHTTPError(http.StatusBadRequest, "Invalid createdBefore parameter: "+err.Error())
+	}
+
+	if value := c.QueryParam("excludeSystem"); value != "" {
+		if query.ExcludeSystem, err = strconv.ParseBool(value); err != nil {
+			return query, echo.NewHTTPError(http.StatusBadRequest, "Invalid excludeSystem parameter: "+value)
+		}
+	}
+
+	if value := c.QueryParam("sort"); value != "" {
+		query.Descending = strings.HasPrefix(value, "-")
+		query.Sort = strings.TrimPrefix(value, "-")
+		switch query.Sort {
+		case search.SortKind, search.SortNamespace, search.SortName, search.SortCreated:
+		default:
+			return query, echo.NewHTTPError(http.StatusBadRequest, "Unknown sort field "+query.Sort)
+		}
+	}
+
+	return query, nil
+}
+
+// isSearchKind reports whether kind can be searched.
+func isSearchKind(kind string) bool {
+	for _, k := range search.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSearchTime parses an RFC 3339 timestamp or a date. An empty value is the zero time.
+func parseSearchTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
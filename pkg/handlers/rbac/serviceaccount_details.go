@@ -1,13 +1,13 @@
 package rbac
 
 import (
-	"context"
 	"net/http"
 
+	"rbac/pkg/cache"
+	"rbac/pkg/utils"
+
 	"github.com/labstack/echo/v4"
 	rbacv1 "k8s.io/api/rbac/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
 )
 
 // ServiceAccountDetailsResponse represents the detailed information about a service account.
@@ -19,68 +19,34 @@ type ServiceAccountDetailsResponse struct {
 }
 
 // ServiceAccountDetailsHandler handles requests for detailed information about a specific service account.
-func ServiceAccountDetailsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func ServiceAccountDetailsHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		serviceAccountName := c.QueryParam("serviceAccountName")
 		if serviceAccountName == "" {
 			return echo.NewHTTPError(http.StatusBadRequest, "Service account name is required")
 		}
 
-		roleBindings, err := clientset.RbacV1().RoleBindings("").List(context.TODO(), metav1.ListOptions{})
+		roleBindings, err := rbacCache.RoleBindingsForSubject(rbacv1.ServiceAccountKind, serviceAccountName)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing role bindings: "+err.Error())
+			return utils.KubernetesError(err, "Error listing role bindings")
 		}
 
-		clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
+		clusterRoleBindings, err := rbacCache.ClusterRoleBindingsForSubject(rbacv1.ServiceAccountKind, serviceAccountName)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing cluster role bindings: "+err.Error())
+			return utils.KubernetesError(err, "Error listing cluster role bindings")
 		}
 
-		clusterRoles, err := clientset.RbacV1().ClusterRoles().List(context.TODO(), metav1.ListOptions{})
+		clusterRoles, err := boundClusterRoles(rbacCache, clusterRoleBindings)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing cluster roles: "+err.Error())
+			return utils.KubernetesError(err, "Error fetching cluster roles")
 		}
 
-		serviceAccountDetails := extractServiceAccountDetails(serviceAccountName, roleBindings.Items, clusterRoleBindings.Items, clusterRoles.Items)
-		return c.JSON(http.StatusOK, serviceAccountDetails)
-	}
-}
-
-// extractServiceAccountDetails extracts detailed information about a specific service account.
-func extractServiceAccountDetails(serviceAccountName string, roleBindings []rbacv1.RoleBinding, clusterRoleBindings []rbacv1.ClusterRoleBinding, clusterRoles []rbacv1.ClusterRole) ServiceAccountDetailsResponse {
-	var serviceAccountRoleBindings []rbacv1.RoleBinding
-	var serviceAccountClusterRoleBindings []rbacv1.ClusterRoleBinding
-	var serviceAccountClusterRoles []rbacv1.ClusterRole
-
-	for _, rb := range roleBindings {
-		for _, subject := range rb.Subjects {
-			if subject.Kind == rbacv1.ServiceAccountKind && subject.Name == serviceAccountName {
-				serviceAccountRoleBindings = append(serviceAccountRoleBindings, rb)
-			}
+		serviceAccountDetails := ServiceAccountDetailsResponse{
+			ServiceAccountName:  serviceAccountName,
+			RoleBindings:        derefRoleBindings(roleBindings),
+			ClusterRoleBindings: derefClusterRoleBindings(clusterRoleBindings),
+			ClusterRoles:        clusterRoles,
 		}
-	}
-
-	for _, crb := range clusterRoleBindings {
-		for _, subject := range crb.Subjects {
-			if subject.Kind == rbacv1.ServiceAccountKind && subject.Name == serviceAccountName {
-				serviceAccountClusterRoleBindings = append(serviceAccountClusterRoleBindings, crb)
-			}
-		}
-	}
-
-	// Collect ClusterRoles associated with the service account's ClusterRoleBindings
-	for _, crb := range serviceAccountClusterRoleBindings {
-		for _, cr := range clusterRoles {
-			if cr.Name == crb.RoleRef.Name {
-				serviceAccountClusterRoles = append(serviceAccountClusterRoles, cr)
-			}
-		}
-	}
-
-	return ServiceAccountDetailsResponse{
-		ServiceAccountName:  serviceAccountName,
-		RoleBindings:        serviceAccountRoleBindings,
-		ClusterRoleBindings: serviceAccountClusterRoleBindings,
-		ClusterRoles:        serviceAccountClusterRoles,
+		return c.JSON(http.StatusOK, serviceAccountDetails)
 	}
 }
@@ -8,20 +8,22 @@ import (
 	"github.com/labstack/echo/v4"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
 // ServiceAccountsHandler handles requests related to service accounts.
-func ServiceAccountsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func ServiceAccountsHandler(clientset kubernetes.Interface) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		namespace := c.QueryParam("namespace")
 		if namespace == "" {
 			namespace = "default"
 		}
 
-		handlers := map[string]func(echo.Context, *kubernetes.Clientset, string) error{
+		handlers := map[string]func(echo.Context, kubernetes.Interface, string) error{
 			http.MethodGet:    handleListServiceAccounts,
 			http.MethodPost:   handleCreateServiceAccount,
+			http.MethodPatch:  handlePatchServiceAccount,
 			http.MethodDelete: handleDeleteServiceAccount,
 		}
 
@@ -30,7 +32,7 @@ func ServiceAccountsHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
 }
 
 // handleListServiceAccounts lists all service accounts in a specific namespace.
-func handleListServiceAccounts(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleListServiceAccounts(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	listFunc := func(namespace string, opts metav1.ListOptions) (interface{}, error) {
 		return clientset.CoreV1().ServiceAccounts(namespace).List(context.TODO(), opts)
 	}
@@ -38,7 +40,7 @@ func handleListServiceAccounts(c echo.Context, clientset *kubernetes.Clientset,
 }
 
 // handleCreateServiceAccount creates a new service account in a specific namespace.
-func handleCreateServiceAccount(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleCreateServiceAccount(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	var serviceAccount corev1.ServiceAccount
 	createFunc := func(namespace string, obj interface{}, opts metav1.CreateOptions) (interface{}, error) {
 		return clientset.CoreV1().ServiceAccounts(namespace).Create(context.TODO(), obj.(*corev1.ServiceAccount), opts)
@@ -46,11 +48,26 @@ func handleCreateServiceAccount(c echo.Context, clientset *kubernetes.Clientset,
 	return utils.CreateResource(c, clientset, namespace, &serviceAccount, createFunc)
 }
 
+// handlePatchServiceAccount patches a service account in a specific namespace with a JSON patch, merge patch or server-side apply.
+func handlePatchServiceAccount(c echo.Context, clientset kubernetes.Interface, namespace string) error {
+	name := c.QueryParam("name")
+	getFunc := func(namespace, name string) (interface{}, error) {
+		return clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	patchFunc := func(namespace, name string, patchType types.PatchType, data []byte, opts metav1.PatchOptions) (interface{}, error) {
+		return clientset.CoreV1().ServiceAccounts(namespace).Patch(context.TODO(), name, patchType, data, opts)
+	}
+	return utils.PatchResource(c, namespace, name, getFunc, patchFunc)
+}
+
 // handleDeleteServiceAccount deletes a service account in a specific namespace.
-func handleDeleteServiceAccount(c echo.Context, clientset *kubernetes.Clientset, namespace string) error {
+func handleDeleteServiceAccount(c echo.Context, clientset kubernetes.Interface, namespace string) error {
 	name := c.QueryParam("name")
+	getFunc := func(namespace, name string) (interface{}, error) {
+		return clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
 	deleteFunc := func(namespace, name string, opts metav1.DeleteOptions) error {
 		return clientset.CoreV1().ServiceAccounts(namespace).Delete(context.TODO(), name, opts)
 	}
-	return utils.DeleteResource(c, clientset, namespace, name, deleteFunc)
+	return utils.DeleteResource(c, clientset, namespace, name, getFunc, deleteFunc)
 }
\ No newline at end of file
@@ -0,0 +1,223 @@
+package rbac
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/manifest"
+	"rbac/pkg/snapshot"
+
+	"github.com/labstack/echo/v4"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// SnapshotDriftResponse represents the drift of a cluster from a snapshot. CrossCluster is set
+// when the cluster is not the one the snapshot was taken in.
+type SnapshotDriftResponse struct {
+	Snapshot     snapshot.Snapshot `json:"snapshot"`
+	Cluster      string            `json:"cluster"`
+	CrossCluster bool              `json:"crossCluster"`
+	*snapshot.Report
+}
+
+// ClusterCache returns the name and RBAC cache of the named cluster.
+type ClusterCache func(name string) (string, *cache.RBACCache, error)
+
+// CreateSnapshotHandler handles requests to save a snapshot of the roles, cluster roles and
+// bindings of a cluster, filtered by the namespace, labelSelector and excludeSystem
+// parameters. A request with a body saves that body, multi-document YAML or a JSON list, as an
+// uploaded baseline instead; namespaced objects without a namespace go to the namespace
+// parameter, or default, and the objects the parameters filter out are dropped.
+func CreateSnapshotHandler(snapshots *snapshot.Store, cluster string, rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter, err := parseManifestFilter(c)
+		if err != nil {
+			return err
+		}
+		scope := snapshot.Scope{Namespace: filter.Namespace, ExcludeSystem: filter.ExcludeSystem}
+		if filter.Labels != nil {
+			scope.LabelSelector = filter.Labels.String()
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxImportBody+1))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Failed to read request body: "+err.Error())
+		}
+		if len(body) > maxImportBody {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "The baseline is larger than "+strconv.Itoa(maxImportBody)+" bytes")
+		}
+
+		source := snapshot.SourceCluster
+		var objs []manifest.Object
+		if len(body) > 0 {
+			source = snapshot.SourceUpload
+			if objs, err = decodeBaseline(body, filter); err != nil {
+				return err
+			}
+		} else {
+			if !rbacCache.HasSynced() {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "RBAC cache is not synced yet")
+			}
+			if objs, err = manifest.Collect(rbacCache, filter); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Error listing RBAC objects: "+err.Error())
+			}
+		}
+
+		snap, err := snapshot.New(cluster, source, scope, objs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create snapshot: "+err.Error())
+		}
+		snap.Description = c.QueryParam("description")
+		if err := snapshots.Save(snap); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save snapshot: "+err.Error())
+		}
+		snap.Objects = nil
+		return c.JSON(http.StatusCreated, snap)
+	}
+}
+
+// SnapshotsHandler handles requests to list the saved snapshots, newest first.
+func SnapshotsHandler(snapshots *snapshot.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		list, err := snapshots.List()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing snapshots: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// SnapshotHandler handles requests for a snapshot with its objects, as JSON or, with
+// format=yaml, as multi-document YAML.
+func SnapshotHandler(snapshots *snapshot.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		snap, err := getSnapshot(snapshots, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		switch format := c.QueryParam("format"); format {
+		case "", "json":
+			return c.JSON(http.StatusOK, snap)
+		case ExportFormatYAML:
+			objs, err := snap.Decode()
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Invalid snapshot: "+err.Error())
+			}
+			data, err := manifest.EncodeYAML(objs)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to encode YAML: "+err.Error())
+			}
+			return c.Blob(http.StatusOK, "application/yaml", data)
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid format: "+format+", must be json or "+ExportFormatYAML)
+		}
+	}
+}
+
+// DeleteSnapshotHandler handles requests to delete a snapshot.
+func DeleteSnapshotHandler(snapshots *snapshot.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		err := snapshots.Delete(id)
+		if errors.Is(err, snapshot.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Snapshot "+id+" not found")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete snapshot: "+err.Error())
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// SnapshotDriftHandler handles requests to compare a snapshot with the live objects of a
+// cluster, selected with the scope the snapshot was taken with. The cluster is the one the
+// snapshot was taken in, unless the cluster parameter names another one to compare with.
+func SnapshotDriftHandler(snapshots *snapshot.Store, clusterCache ClusterCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		snap, err := getSnapshot(snapshots, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		name := c.QueryParam("cluster")
+		if name == "" {
+			name = snap.Cluster
+		}
+		cluster, rbacCache, err := clusterCache(name)
+		if err != nil {
+			return err
+		}
+		if !rbacCache.HasSynced() {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "RBAC cache is not synced yet")
+		}
+
+		filter := manifest.Filter{Namespace: snap.Scope.Namespace, ExcludeSystem: snap.Scope.ExcludeSystem}
+		if snap.Scope.LabelSelector != "" {
+			if filter.Labels, err = labels.Parse(snap.Scope.LabelSelector); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Invalid snapshot label selector: "+err.Error())
+			}
+		}
+		live, err := manifest.Collect(rbacCache, filter)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing RBAC objects: "+err.Error())
+		}
+		baseline, err := snap.Decode()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Invalid snapshot: "+err.Error())
+		}
+
+		report, err := snapshot.Drift(baseline, live)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to compare snapshot: "+err.Error())
+		}
+		snap.Objects = nil
+		return c.JSON(http.StatusOK, SnapshotDriftResponse{Snapshot: *snap, Cluster: cluster, CrossCluster: cluster != snap.Cluster, Report: report})
+	}
+}
+
+// getSnapshot reads a snapshot, with a 404 if it does not exist.
+func getSnapshot(snapshots *snapshot.Store, id string) (*snapshot.Snapshot, error) {
+	snap, err := snapshots.Get(id)
+	if errors.Is(err, snapshot.ErrNotFound) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Snapshot "+id+" not found")
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Error reading snapshot: "+err.Error())
+	}
+	return snap, nil
+}
+
+// decodeBaseline reads an uploaded baseline, which may only hold roles, cluster roles and
+// bindings, and keeps the objects the filter selects, as drift only compares those of the
+// cluster.
+func decodeBaseline(body []byte, filter manifest.Filter) ([]manifest.Object, error) {
+	objs, err := manifest.Decode(body)
+	if err != nil {
+		return nil, invalidBundle(err)
+	}
+	namespace := filter.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	selected := make([]manifest.Object, 0, len(objs))
+	for _, obj := range objs {
+		kind := manifest.KindOf(obj)
+		switch kind.Name {
+		case manifest.KindRole, manifest.KindClusterRole, manifest.KindRoleBinding, manifest.KindClusterRoleBinding:
+		default:
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Unsupported kind in baseline: "+kind.Name+", must be one of Role, ClusterRole, RoleBinding, ClusterRoleBinding")
+		}
+		if !kind.Namespaced {
+			obj.SetNamespace("")
+		} else if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+		if filter.Matches(obj) {
+			selected = append(selected, obj)
+		}
+	}
+	return selected, nil
+}
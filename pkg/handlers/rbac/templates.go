@@ -0,0 +1,117 @@
+package rbac
+
+import (
+	"errors"
+	"net/http"
+
+	"rbac/pkg/manifest"
+	"rbac/pkg/templates"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Template render modes.
+const (
+	TemplatePreview = "preview"
+	TemplateApply   = "apply"
+)
+
+// TemplatesResponse represents the template catalog, with the errors of the custom template
+// sources that could not be read.
+type TemplatesResponse struct {
+	Templates []templates.Template `json:"templates"`
+	Errors    []string             `json:"errors,omitempty"`
+}
+
+// RenderTemplateResponse represents a rendered template: the role it builds, and the plan, or
+// once applied the result, of storing it in the cluster.
+type RenderTemplateResponse struct {
+	Mode     string          `json:"mode"`
+	Template string          `json:"template"`
+	Object   manifest.Object `json:"object"`
+	Item     ImportItem      `json:"item"`
+	DryRun   bool            `json:"dryRun"`
+}
+
+// TemplatesHandler handles requests for the template catalog: the built-in templates and the
+// custom ones of the YAML files in dir and of the ConfigMap named namespace/name.
+func TemplatesHandler(clientset kubernetes.Interface, dir, configMap string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		catalog, err := templates.Load(clientset, dir, configMap)
+		response := TemplatesResponse{Templates: catalog}
+		var joined interface{ Unwrap() []error }
+		if errors.As(err, &joined) {
+			for _, err := range joined.Unwrap() {
+				response.Errors = append(response.Errors, err.Error())
+			}
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// RenderTemplateHandler handles requests to render a template of the catalog into a role with
+// the parameters of the request body: a Role in their namespace, or a ClusterRole without one.
+// With mode=preview, the default, it returns the role and whether it would be created or
+// update an existing one; with mode=apply, the role is also created or updated, or only
+// validated by the API server with dryRun=true. An apply only updates a role rendered from the
+// same template, so that it never overwrites the rules of an unrelated role of the same name.
+func RenderTemplateHandler(clientset kubernetes.Interface, dir, configMap string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		mode := c.QueryParam("mode")
+		switch mode {
+		case "":
+			mode = TemplatePreview
+		case TemplatePreview, TemplateApply:
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid mode: "+mode+", must be preview or apply")
+		}
+		dryRun, err := utils.DryRun(c)
+		if err != nil {
+			return err
+		}
+		var params templates.Params
+		if err = c.Bind(&params); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body: "+err.Error())
+		}
+
+		// A broken custom source does not hide the templates of the others.
+		catalog, _ := templates.Load(clientset, dir, configMap)
+		template := templates.Find(catalog, c.Param("name"))
+		if template == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Template "+c.Param("name")+" not found")
+		}
+		obj, err := templates.Render(template, params)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid template parameters: "+err.Error())
+		}
+
+		items, planned, err := planImport(clientset, []manifest.Object{obj}, params.Namespace)
+		if err != nil {
+			return err
+		}
+		item := items[0]
+		if mode == TemplateApply {
+			if item.Action == ImportInvalid {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, utils.ErrorResponse{
+					Code:    http.StatusUnprocessableEntity,
+					Reason:  string(metav1.StatusReasonInvalid),
+					Message: "The rendered role is invalid: " + item.Error,
+				})
+			}
+			if item.Action == ImportUpdate && planned[0].current.GetLabels()[templates.TemplateLabel] != template.Name {
+				return echo.NewHTTPError(http.StatusConflict, utils.ErrorResponse{
+					Code:    http.StatusConflict,
+					Reason:  string(metav1.StatusReasonConflict),
+					Message: importItemRef(item) + " exists and was not rendered from template " + template.Name,
+				})
+			}
+			applyImport(clientset, items, planned, dryRun, utils.Changes(c))
+			item = items[0]
+		}
+
+		return c.JSON(http.StatusOK, RenderTemplateResponse{Mode: mode, Template: template.Name, Object: obj, Item: item, DryRun: dryRun != nil})
+	}
+}
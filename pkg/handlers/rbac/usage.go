@@ -0,0 +1,296 @@
+package rbac
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/policy"
+	"rbac/pkg/usage"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// maxAuditLogBody bounds the size of an uploaded audit log.
+	maxAuditLogBody = 100 << 20
+	// defaultUnusedDays is the number of days without use after which rules are flagged, when
+	// the request sets no unusedDays.
+	defaultUnusedDays = 90
+)
+
+// SubjectUsageResponse represents the permissions a subject used, according to the ingested
+// audit logs.
+type SubjectUsageResponse struct {
+	Subject rbacv1.Subject `json:"subject"`
+	Records []usage.Record `json:"records"`
+}
+
+// RoleUsageResponse represents the use of every rule of a role or cluster role.
+type RoleUsageResponse struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	*usage.RoleUsage
+}
+
+// ApplyUsageProposalResponse represents an applied least-privilege proposal, with the result
+// of each step.
+type ApplyUsageProposalResponse struct {
+	DryRun   bool            `json:"dryRun"`
+	Proposal *usage.Proposal `json:"proposal"`
+	Steps    []usage.Step    `json:"steps"`
+}
+
+// IngestUsageHandler handles requests to ingest a Kubernetes audit log of a cluster, as JSON
+// lines, and record the permissions each subject used. The log is the request body, or the
+// file named by the path parameter inside logDir. Gzipped logs are read when the body has a
+// gzip Content-Encoding or the file name ends in .gz.
+func IngestUsageHandler(usageStore *usage.Store, cluster, logDir string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var reader io.Reader
+		gzipped := false
+		if path := c.QueryParam("path"); path != "" {
+			file, err := openAuditLog(logDir, path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			reader, gzipped = file, strings.HasSuffix(path, ".gz")
+		} else {
+			if c.Request().ContentLength == 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "An audit log is required, as the request body or the path parameter")
+			}
+			reader = http.MaxBytesReader(c.Response(), c.Request().Body, maxAuditLogBody)
+			gzipped = c.Request().Header.Get(echo.HeaderContentEncoding) == "gzip"
+		}
+		if gzipped {
+			gzipReader, err := gzip.NewReader(reader)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid gzip audit log: "+err.Error())
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		}
+
+		result, err := usageStore.Ingest(cluster, reader)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "The audit log is larger than "+strconv.Itoa(maxAuditLogBody)+" bytes")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to ingest audit log: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+// UsageHandler handles requests for the usage recorded in a cluster: a summary of every
+// subject, or with the subject parameter, written as Kind:name or
+// ServiceAccount:namespace:name, every permission that subject used.
+func UsageHandler(usageStore *usage.Store, cluster string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.QueryParam("subject") == "" {
+			subjects, err := usageStore.Subjects(cluster)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Error reading usage: "+err.Error())
+			}
+			return c.JSON(http.StatusOK, subjects)
+		}
+
+		subject, err := policy.ParseSubject(c.QueryParam("subject"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid subject: "+err.Error())
+		}
+		records, err := usageStore.Records(cluster, subject)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error reading usage: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, SubjectUsageResponse{Subject: subject, Records: records})
+	}
+}
+
+// UsageProposalHandler handles requests for the least-privilege roles of a subject, built
+// from the permissions it used, with the permissions it would gain and lose.
+func UsageProposalHandler(usageStore *usage.Store, cluster string, rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		proposal, err := proposeUsage(c, usageStore, cluster, rbacCache)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, proposal)
+	}
+}
+
+// ApplyUsageProposalHandler handles requests to create the least-privilege roles and bindings
+// of a subject and rebind it: the subject is removed from its other bindings once every new
+// object is applied. With dryRun=true nothing is changed.
+func ApplyUsageProposalHandler(usageStore *usage.Store, cluster string, clientset kubernetes.Interface, rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		dryRun, err := utils.DryRun(c)
+		if err != nil {
+			return err
+		}
+		proposal, err := proposeUsage(c, usageStore, cluster, rbacCache)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, ApplyUsageProposalResponse{
+			DryRun:   len(dryRun) > 0,
+			Proposal: proposal,
+			Steps:    usage.Apply(clientset, proposal, dryRun, utils.Changes(c)),
+		})
+	}
+}
+
+// RoleUsageHandler handles requests for when each rule of a role was last exercised and by
+// whom, from the ingested audit logs. The role is named by the namespace and name parameters;
+// without a namespace, or with kind=ClusterRole, it is a cluster role. Rules unused for
+// unusedDays (90 by default) are flagged once the audit logs reach back that far.
+func RoleUsageHandler(usageStore *usage.Store, cluster string, rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		namespace, name := c.QueryParam("namespace"), c.QueryParam("name")
+		if name == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Role name is required")
+		}
+		kind := c.QueryParam("kind")
+		switch {
+		case kind == "" && namespace == "", kind == "ClusterRole":
+			kind, namespace = "ClusterRole", ""
+		case kind == "", kind == "Role":
+			kind = "Role"
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid kind: "+kind+", must be Role or ClusterRole")
+		}
+		if kind == "Role" && namespace == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Namespace is required for a Role")
+		}
+		if !rbacCache.HasSynced() {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "RBAC cache is not synced yet")
+		}
+
+		var err error
+		if kind == "Role" {
+			_, err = rbacCache.GetRole(namespace, name)
+		} else {
+			_, err = rbacCache.GetClusterRole(name)
+		}
+		if err != nil {
+			return utils.KubernetesError(err, "Error fetching "+kind+" "+name)
+		}
+		objects, err := policy.CachedObjects(rbacCache)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing RBAC objects: "+err.Error())
+		}
+
+		roleUsage, err := ruleUsage(c, usageStore, cluster, objects, kind, namespace, name)
+		if err != nil {
+			return err
+		}
+		if roleUsage == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "No audit logs were ingested for cluster "+cluster)
+		}
+		return c.JSON(http.StatusOK, RoleUsageResponse{Kind: kind, Namespace: namespace, Name: name, RoleUsage: roleUsage})
+	}
+}
+
+// ruleUsage returns the use of every rule of a role of the set, with the unusedDays parameter,
+// or nil if no audit logs were ingested for the cluster.
+func ruleUsage(c echo.Context, usageStore *usage.Store, cluster string, objects policy.ObjectSet, kind, namespace, name string) (*usage.RoleUsage, error) {
+	unusedDays := defaultUnusedDays
+	if value := c.QueryParam("unusedDays"); value != "" {
+		var err error
+		if unusedDays, err = strconv.Atoi(value); err != nil || unusedDays <= 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "unusedDays must be a positive number of days")
+		}
+	}
+	if usageStore == nil {
+		return nil, nil
+	}
+
+	coverage, err := usageStore.Coverage(cluster)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Error reading usage: "+err.Error())
+	}
+	if coverage == nil {
+		return nil, nil
+	}
+	records, err := usageStore.All(cluster)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Error reading usage: "+err.Error())
+	}
+	return usage.Usage(objects, kind, namespace, name, records, coverage, unusedDays, time.Now()), nil
+}
+
+// proposeUsage builds the least-privilege proposal for the subject parameter, with a 404 if
+// no usage was recorded for it.
+func proposeUsage(c echo.Context, usageStore *usage.Store, cluster string, rbacCache *cache.RBACCache) (*usage.Proposal, error) {
+	subject, err := policy.ParseSubject(c.QueryParam("subject"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid subject: "+err.Error())
+	}
+	if !rbacCache.HasSynced() {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "RBAC cache is not synced yet")
+	}
+	records, err := usageStore.Records(cluster, subject)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Error reading usage: "+err.Error())
+	}
+	if len(records) == 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "No usage recorded for "+policy.SubjectKey(subject))
+	}
+	objects, err := policy.CachedObjects(rbacCache)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Error listing RBAC objects: "+err.Error())
+	}
+	return usage.Propose(objects, subject, records), nil
+}
+
+// openAuditLog opens the audit log at path, relative to logDir, refusing files outside it.
+func openAuditLog(logDir, path string) (*os.File, error) {
+	if logDir == "" {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Ingesting audit logs by path is disabled, set USAGE_LOG_DIR to allow it")
+	}
+	dir, err := filepath.EvalSymlinks(logDir)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Invalid audit log directory: "+err.Error())
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	if !insideDir(dir, filepath.Clean(path)) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Audit log "+path+" is outside the audit log directory")
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Audit log "+path+" not found")
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid audit log path: "+err.Error())
+	}
+	// A symbolic link inside the directory may still point outside it.
+	if !insideDir(dir, resolved) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Audit log "+path+" is outside the audit log directory")
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Failed to open audit log: "+err.Error())
+	}
+	return file, nil
+}
+
+// insideDir reports whether path is inside dir.
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -1,103 +1,57 @@
 package rbac
 
 import (
-	"context"
 	"net/http"
 
+	"rbac/pkg/cache"
+	"rbac/pkg/utils"
+
 	"github.com/labstack/echo/v4"
 	rbacv1 "k8s.io/api/rbac/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
 )
 
 // UserRolesHandler handles requests to show the roles or cluster roles a user has access to.
-func UserRolesHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func UserRolesHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userName := c.QueryParam("userName")
 		if userName == "" {
 			return echo.NewHTTPError(http.StatusBadRequest, "User name is required")
 		}
 
-		roleBindings, err := clientset.RbacV1().RoleBindings("").List(context.TODO(), metav1.ListOptions{})
+		roleBindings, err := rbacCache.RoleBindingsForSubject(rbacv1.UserKind, userName)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing role bindings: "+err.Error())
+			return utils.KubernetesError(err, "Error listing role bindings")
 		}
 
-		clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
+		clusterRoleBindings, err := rbacCache.ClusterRoleBindingsForSubject(rbacv1.UserKind, userName)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing cluster role bindings: "+err.Error())
+			return utils.KubernetesError(err, "Error listing cluster role bindings")
 		}
 
-		userRoles := extractUserRoles(userName, roleBindings.Items, clusterRoleBindings.Items)
+		userRoles := extractUserRoles(roleBindings, clusterRoleBindings)
 		return c.JSON(http.StatusOK, userRoles)
 	}
 }
 
-// extractUserRoles extracts the roles and cluster roles a user has access to.
-func extractUserRoles(username string, roleBindings []rbacv1.RoleBinding, clusterRoleBindings []rbacv1.ClusterRoleBinding) []string {
-	var roles []string
+// extractUserRoles extracts the roles and cluster roles referenced by a user's bindings.
+func extractUserRoles(roleBindings []*rbacv1.RoleBinding, clusterRoleBindings []*rbacv1.ClusterRoleBinding) []string {
+	roles := make([]string, 0, len(roleBindings)+len(clusterRoleBindings))
 
 	for _, rb := range roleBindings {
-		for _, subject := range rb.Subjects {
-			if subject.Kind == rbacv1.UserKind && subject.Name == username {
-				roles = append(roles, rb.RoleRef.Name)
-			}
-		}
+		roles = append(roles, rb.RoleRef.Name)
 	}
 
 	for _, crb := range clusterRoleBindings {
-		for _, subject := range crb.Subjects {
-			if subject.Kind == rbacv1.UserKind && subject.Name == username {
-				roles = append(roles, crb.RoleRef.Name)
-			}
-		}
+		roles = append(roles, crb.RoleRef.Name)
 	}
 
 	return roles
 }
 
 // UsersHandler handles requests to list all users from role bindings and cluster role bindings.
-func UsersHandler(clientset *kubernetes.Clientset) echo.HandlerFunc {
+func UsersHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		roleBindings, err := clientset.RbacV1().RoleBindings("").List(context.TODO(), metav1.ListOptions{})
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing role bindings: "+err.Error())
-		}
-
-		clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Error listing cluster role bindings: "+err.Error())
-		}
-
-		users := extractUsers(roleBindings.Items, clusterRoleBindings.Items)
+		users := rbacCache.SubjectNames(rbacv1.UserKind)
 		return c.JSON(http.StatusOK, users)
 	}
 }
-
-// extractUsers extracts unique users from RoleBindings and ClusterRoleBindings.
-func extractUsers(roleBindings []rbacv1.RoleBinding, clusterRoleBindings []rbacv1.ClusterRoleBinding) []string {
-	userSet := make(map[string]struct{})
-
-	for _, rb := range roleBindings {
-		for _, subject := range rb.Subjects {
-			if subject.Kind == rbacv1.UserKind {
-				userSet[subject.Name] = struct{}{}
-			}
-		}
-	}
-
-	for _, crb := range clusterRoleBindings {
-		for _, subject := range crb.Subjects {
-			if subject.Kind == rbacv1.UserKind {
-				userSet[subject.Name] = struct{}{}
-			}
-		}
-	}
-
-	users := make([]string, 0, len(userSet))
-	for user := range userSet {
-		users = append(users, user)
-	}
-
-	return users
-}
\ No newline at end of file
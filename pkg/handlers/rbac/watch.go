@@ -0,0 +1,375 @@
+package rbac
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// defaultWatchHeartbeat is the interval between heartbeat comments when none is configured.
+	defaultWatchHeartbeat = 15 * time.Second
+	// watchRetryDelay is the pause before a failed watch is reopened.
+	watchRetryDelay = time.Second
+)
+
+// Watch stream event types, in addition to the ADDED, MODIFIED, DELETED and BOOKMARK watch events.
+const (
+	// WatchEventResync tells the client that events for a kind were missed and it must list it again.
+	WatchEventResync = "RESYNC"
+	// WatchEventError reports a watch failure. The watch is retried.
+	WatchEventError = "ERROR"
+)
+
+// WatchEvent is the data of one event of the watch stream.
+type WatchEvent struct {
+	Type            string         `json:"type"`
+	Kind            string         `json:"kind"`
+	Namespace       string         `json:"namespace,omitempty"`
+	Name            string         `json:"name,omitempty"`
+	ResourceVersion string         `json:"resourceVersion,omitempty"`
+	Object          runtime.Object `json:"object,omitempty"`
+	Message         string         `json:"message,omitempty"`
+}
+
+// watchSource opens list and watch calls for one kind.
+type watchSource struct {
+	kind       string
+	namespaced bool
+	list       func(ctx context.Context, namespace string, opts metav1.ListOptions) (runtime.Object, error)
+	watch      func(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error)
+}
+
+// watchSources returns the watchable kinds in stream order.
+func watchSources(clientset kubernetes.Interface) []watchSource {
+	return []watchSource{
+		{
+			kind: "Namespace",
+			list: func(ctx context.Context, _ string, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().Namespaces().List(ctx, opts)
+			},
+			watch: func(ctx context.Context, _ string, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().Namespaces().Watch(ctx, opts)
+			},
+		},
+		{
+			kind: "Role", namespaced: true,
+			list: func(ctx context.Context, namespace string, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.RbacV1().Roles(namespace).List(ctx, opts)
+			},
+			watch: func(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.RbacV1().Roles(namespace).Watch(ctx, opts)
+			},
+		},
+		{
+			kind: "ClusterRole",
+			list: func(ctx context.Context, _ string, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.RbacV1().ClusterRoles().List(ctx, opts)
+			},
+			watch: func(ctx context.Context, _ string, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.RbacV1().ClusterRoles().Watch(ctx, opts)
+			},
+		},
+		{
+			kind: "RoleBinding", namespaced: true,
+			list: func(ctx context.Context, namespace string, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.RbacV1().RoleBindings(namespace).List(ctx, opts)
+			},
+			watch: func(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.RbacV1().RoleBindings(namespace).Watch(ctx, opts)
+			},
+		},
+		{
+			kind: "ClusterRoleBinding",
+			list: func(ctx context.Context, _ string, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.RbacV1().ClusterRoleBindings().List(ctx, opts)
+			},
+			watch: func(ctx context.Context, _ string, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.RbacV1().ClusterRoleBindings().Watch(ctx, opts)
+			},
+		},
+		{
+			kind: "ServiceAccount", namespaced: true,
+			list: func(ctx context.Context, namespace string, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().ServiceAccounts(namespace).List(ctx, opts)
+			},
+			watch: func(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().ServiceAccounts(namespace).Watch(ctx, opts)
+			},
+		},
+	}
+}
+
+// WatchHandler streams changes to namespaces, roles, cluster roles, bindings and service
+// accounts as Server-Sent Events. The kind and namespace query parameters filter the stream;
+// with a namespace, only namespaced kinds and that namespace itself are watched. Every event
+// id is a resume token: sending it back as the Last-Event-ID header, or the since query
+// parameter, resumes each watch from the last resourceVersion seen. A comment is sent every
+// heartbeat interval to keep the connection open.
+func WatchHandler(clientset kubernetes.Interface, heartbeat time.Duration) echo.HandlerFunc {
+	if heartbeat <= 0 {
+		heartbeat = defaultWatchHeartbeat
+	}
+
+	return func(c echo.Context) error {
+		sources, err := selectWatchSources(watchSources(clientset), c.QueryParam("kind"))
+		if err != nil {
+			return err
+		}
+		namespace := c.QueryParam("namespace")
+
+		token := c.Request().Header.Get("Last-Event-ID")
+		if token == "" {
+			token = c.QueryParam("since")
+		}
+		resourceVersions, err := decodeWatchToken(token)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid resume token: "+err.Error())
+		}
+
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		defer cancel()
+
+		// Resolve a starting resourceVersion for every kind before streaming, so that the
+		// stream only carries changes made after it was opened.
+		for _, source := range sources {
+			if resourceVersions[source.kind] != "" {
+				continue
+			}
+			resourceVersion, err := currentResourceVersion(ctx, source, namespace)
+			if err != nil {
+				return utils.KubernetesError(err, "Error listing "+source.kind)
+			}
+			resourceVersions[source.kind] = resourceVersion
+		}
+
+		events := make(chan WatchEvent)
+		for _, source := range sources {
+			go runWatch(ctx, source, namespace, resourceVersions[source.kind], events)
+		}
+
+		response := c.Response()
+		response.Header().Set(echo.HeaderContentType, "text/event-stream")
+		response.Header().Set(echo.HeaderCacheControl, "no-cache")
+		response.Header().Set(echo.HeaderConnection, "keep-alive")
+		response.Header().Set("X-Accel-Buffering", "no")
+		response.WriteHeader(http.StatusOK)
+		fmt.Fprintf(response, "retry: %d\n: watching %d kinds\n\n", watchRetryDelay.Milliseconds(), len(sources))
+		response.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				fmt.Fprint(response, ": heartbeat\n\n")
+				response.Flush()
+			case event := <-events:
+				if event.ResourceVersion != "" && event.Type != WatchEventError {
+					resourceVersions[event.Kind] = event.ResourceVersion
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(response, "id: %s\nevent: %s\ndata: %s\n\n", encodeWatchToken(resourceVersions), event.Type, data)
+				response.Flush()
+			}
+		}
+	}
+}
+
+// selectWatchSources returns the sources for a comma-separated list of kinds, or all of them.
+func selectWatchSources(sources []watchSource, kinds string) ([]watchSource, error) {
+	if kinds == "" {
+		return sources, nil
+	}
+
+	var selected []watchSource
+	for _, kind := range strings.Split(kinds, ",") {
+		found := false
+		for _, source := range sources {
+			if source.kind == kind {
+				selected = append(selected, source)
+				found = true
+			}
+		}
+		if !found {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Unknown kind "+kind)
+		}
+	}
+	return selected, nil
+}
+
+// watchOptions returns the list options that scope a source to the namespace filter. Cluster
+// scoped kinds other than Namespace are not watched when a namespace is set.
+func watchOptions(source watchSource, namespace string) (string, metav1.ListOptions, bool) {
+	if namespace == "" || source.namespaced {
+		return namespace, metav1.ListOptions{}, true
+	}
+	if source.kind == "Namespace" {
+		return "", metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", namespace).String()}, true
+	}
+	return "", metav1.ListOptions{}, false
+}
+
+// currentResourceVersion returns the resourceVersion to start watching a source from.
+func currentResourceVersion(ctx context.Context, source watchSource, namespace string) (string, error) {
+	namespace, opts, ok := watchOptions(source, namespace)
+	if !ok {
+		return "", nil
+	}
+	opts.Limit = 1
+	list, err := source.list(ctx, namespace, opts)
+	if err != nil {
+		return "", err
+	}
+	listMeta, err := meta.ListAccessor(list)
+	if err != nil {
+		return "", err
+	}
+	return listMeta.GetResourceVersion(), nil
+}
+
+// runWatch watches a source from resourceVersion and sends its events until the context is
+// cancelled. Closed watches are reopened from the last resourceVersion seen, and expired ones
+// from the current resourceVersion after a RESYNC event.
+func runWatch(ctx context.Context, source watchSource, namespace, resourceVersion string, events chan<- WatchEvent) {
+	namespace, opts, ok := watchOptions(source, namespace)
+	if !ok {
+		return
+	}
+
+	send := func(event WatchEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	retry := func(message string) bool {
+		if !send(WatchEvent{Type: WatchEventError, Kind: source.kind, Message: message}) {
+			return false
+		}
+		select {
+		case <-time.After(watchRetryDelay):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for ctx.Err() == nil {
+		opts.ResourceVersion = resourceVersion
+		opts.AllowWatchBookmarks = true
+		watcher, err := source.watch(ctx, namespace, opts)
+		if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			if resourceVersion, ok = resync(ctx, source, namespace, send); !ok {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if !retry(err.Error()) {
+				return
+			}
+			continue
+		}
+
+		expired := false
+		for event := range watcher.ResultChan() {
+			if event.Type == watch.Error {
+				err := apierrors.FromObject(event.Object)
+				if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+					expired = true
+					break
+				}
+				if !send(WatchEvent{Type: WatchEventError, Kind: source.kind, Message: err.Error()}) {
+					break
+				}
+				continue
+			}
+
+			object, err := meta.Accessor(event.Object)
+			if err != nil {
+				continue
+			}
+			resourceVersion = object.GetResourceVersion()
+			watchEvent := WatchEvent{Type: string(event.Type), Kind: source.kind, ResourceVersion: resourceVersion}
+			if event.Type != watch.Bookmark {
+				watchEvent.Namespace = object.GetNamespace()
+				watchEvent.Name = object.GetName()
+				watchEvent.Object = event.Object
+			}
+			if !send(watchEvent) {
+				break
+			}
+		}
+		watcher.Stop()
+
+		if expired {
+			if resourceVersion, ok = resync(ctx, source, namespace, send); !ok {
+				return
+			}
+		}
+	}
+}
+
+// resync tells the client that a kind must be listed again and returns the current
+// resourceVersion to resume watching from.
+func resync(ctx context.Context, source watchSource, namespace string, send func(WatchEvent) bool) (string, bool) {
+	for ctx.Err() == nil {
+		resourceVersion, err := currentResourceVersion(ctx, source, namespace)
+		if err == nil {
+			return resourceVersion, send(WatchEvent{Type: WatchEventResync, Kind: source.kind, ResourceVersion: resourceVersion})
+		}
+		if !send(WatchEvent{Type: WatchEventError, Kind: source.kind, Message: err.Error()}) {
+			return "", false
+		}
+		select {
+		case <-time.After(watchRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+	return "", false
+}
+
+// encodeWatchToken encodes the last resourceVersion of every kind as a resume token.
+func encodeWatchToken(resourceVersions map[string]string) string {
+	data, _ := json.Marshal(resourceVersions)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeWatchToken decodes a resume token. An empty token resumes nothing.
+func decodeWatchToken(token string) (map[string]string, error) {
+	resourceVersions := map[string]string{}
+	if token == "" {
+		return resourceVersions, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &resourceVersions); err != nil {
+		return nil, err
+	}
+	return resourceVersions, nil
+}
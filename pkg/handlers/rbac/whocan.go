@@ -0,0 +1,41 @@
+package rbac
+
+import (
+	"net/http"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+)
+
+// WhoCanResponse represents the subjects allowed to perform a request.
+type WhoCanResponse struct {
+	Request  policy.ResourceAttributes `json:"request"`
+	Subjects []policy.SubjectGrants    `json:"subjects"`
+}
+
+// WhoCanHandler handles requests to find every subject allowed a verb on a resource.
+func WhoCanHandler(rbacCache *cache.RBACCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		attrs := policy.ResourceAttributes{
+			Verb:        c.QueryParam("verb"),
+			APIGroup:    c.QueryParam("apiGroup"),
+			Resource:    c.QueryParam("resource"),
+			Subresource: c.QueryParam("subresource"),
+			Namespace:   c.QueryParam("namespace"),
+			Name:        c.QueryParam("resourceName"),
+		}
+		if attrs.Verb == "" || attrs.Resource == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Verb and resource are required")
+		}
+
+		subjects, err := policy.NewResolver(rbacCache).WhoCan(attrs)
+		if err != nil {
+			return utils.KubernetesError(err, "Error resolving subjects")
+		}
+
+		return c.JSON(http.StatusOK, WhoCanResponse{Request: attrs, Subjects: subjects})
+	}
+}
@@ -0,0 +1,209 @@
+// Package history keeps the revisions of RBAC objects in the embedded store.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"rbac/pkg/store"
+)
+
+// Sources of a revision.
+const (
+	// SourceKuberus marks revisions made through Kuberus.
+	SourceKuberus = "kuberus"
+	// SourceWatch marks revisions observed in the cluster, made by other clients.
+	SourceWatch = "watch"
+)
+
+// storeBucket is the store bucket that revisions are kept in.
+const storeBucket = "history"
+
+// ErrRevisionNotFound is returned when a revision does not exist.
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Kinds whose history is kept.
+var Kinds = []string{"Role", "ClusterRole", "RoleBinding", "ClusterRoleBinding"}
+
+// Ref identifies an object in a cluster.
+type Ref struct {
+	Cluster   string `json:"cluster"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// Revision is one recorded state of an object. A deleted revision holds the last state of
+// the object before it was deleted.
+type Revision struct {
+	Ref
+	Revision        uint64          `json:"revision"`
+	Time            time.Time       `json:"time"`
+	ResourceVersion string          `json:"resourceVersion"`
+	Source          string          `json:"source"`
+	Actor           string          `json:"actor,omitempty"`
+	Deleted         bool            `json:"deleted,omitempty"`
+	Object          json.RawMessage `json:"object"`
+}
+
+// History records and reads object revisions.
+type History struct {
+	store        *store.Store
+	maxRevisions int
+
+	mu sync.Mutex
+}
+
+// New creates a history kept in st. At most maxRevisions are kept per object, if positive.
+func New(st *store.Store, maxRevisions int) *History {
+	return &History{store: st, maxRevisions: maxRevisions}
+}
+
+// Record stores a revision of an object, numbered after the latest one. A change is often
+// seen twice, from the Kuberus mutation and from the watch, so a revision is not stored again
+// when one with the same resourceVersion exists, or when it is a deletion and the latest
+// revision is one too; when the mutation comes second, its actor is added to the stored
+// revision. Record reports whether a revision was stored or updated.
+func (h *History) Record(revision Revision) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revisions, err := h.list(revision.Ref)
+	if err != nil {
+		return false, err
+	}
+
+	if n := len(revisions); n > 0 {
+		if existing, ok := duplicateOf(revisions, revision); ok {
+			if revision.Source != SourceKuberus || existing.Source == SourceKuberus {
+				return false, nil
+			}
+			existing.Source = SourceKuberus
+			existing.Actor = revision.Actor
+			return true, h.put(existing)
+		}
+		revision.Revision = revisions[n-1].Revision + 1
+	} else {
+		revision.Revision = 1
+	}
+	if revision.Time.IsZero() {
+		revision.Time = time.Now().UTC()
+	}
+	if err := h.put(revision); err != nil {
+		return false, err
+	}
+
+	if h.maxRevisions > 0 && len(revisions)+1 > h.maxRevisions {
+		for _, old := range revisions[:len(revisions)+1-h.maxRevisions] {
+			if err := h.store.Delete(storeBucket, revisionKey(old.Ref, old.Revision)); err != nil {
+				return true, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// List returns the revisions of an object, oldest first.
+func (h *History) List(ref Ref) ([]Revision, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.list(ref)
+}
+
+// Get returns one revision of an object.
+func (h *History) Get(ref Ref, revision uint64) (Revision, error) {
+	data, err := h.store.Get(storeBucket, revisionKey(ref, revision))
+	if err != nil {
+		return Revision{}, err
+	}
+	if data == nil {
+		return Revision{}, ErrRevisionNotFound
+	}
+	var stored Revision
+	err = json.Unmarshal(data, &stored)
+	return stored, err
+}
+
+// duplicateOf returns the stored revision that records the same change as revision.
+func duplicateOf(revisions []Revision, revision Revision) (Revision, bool) {
+	if latest := revisions[len(revisions)-1]; revision.Deleted && latest.Deleted {
+		return latest, true
+	}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if revisions[i].ResourceVersion == revision.ResourceVersion && !revisions[i].Deleted && !revision.Deleted {
+			return revisions[i], true
+		}
+	}
+	return Revision{}, false
+}
+
+// NewRevision builds an unnumbered revision of an object of the given kind from its JSON form.
+func NewRevision(cluster, kind string, object json.RawMessage) (Revision, error) {
+	var meta struct {
+		Metadata struct {
+			Namespace       string `json:"namespace"`
+			Name            string `json:"name"`
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(object, &meta); err != nil {
+		return Revision{}, err
+	}
+	if meta.Metadata.Name == "" {
+		return Revision{}, errors.New("object has no name")
+	}
+	return Revision{
+		Ref:             Ref{Cluster: cluster, Kind: kind, Namespace: meta.Metadata.Namespace, Name: meta.Metadata.Name},
+		ResourceVersion: meta.Metadata.ResourceVersion,
+		Object:          object,
+	}, nil
+}
+
+// IsKind reports whether the history of kind is kept.
+func IsKind(kind string) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// list reads the revisions of an object. The caller holds h.mu.
+func (h *History) list(ref Ref) ([]Revision, error) {
+	var revisions []Revision
+	err := h.store.ScanPrefix(storeBucket, refPrefix(ref), func(_, value []byte) error {
+		var revision Revision
+		if err := json.Unmarshal(value, &revision); err != nil {
+			return err
+		}
+		revisions = append(revisions, revision)
+		return nil
+	})
+	return revisions, err
+}
+
+// put writes a revision.
+func (h *History) put(revision Revision) error {
+	data, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+	return h.store.Put(storeBucket, revisionKey(revision.Ref, revision.Revision), data)
+}
+
+// refPrefix is the key prefix of every revision of an object. Parts are separated by NUL,
+// which cannot appear in cluster, kind or object names.
+func refPrefix(ref Ref) []byte {
+	return []byte(strings.Join([]string{ref.Cluster, ref.Kind, ref.Namespace, ref.Name}, "\x00") + "\x00")
+}
+
+// revisionKey is the key of one revision. Revision numbers are big-endian so that keys sort
+// in revision order.
+func revisionKey(ref Ref, revision uint64) []byte {
+	return binary.BigEndian.AppendUint64(refPrefix(ref), revision)
+}
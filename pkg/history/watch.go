@@ -0,0 +1,60 @@
+package history
+
+import (
+	"encoding/json"
+
+	"rbac/pkg/cache"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// Watch records a revision for every RBAC object change the cluster's cache observes,
+// including the objects that exist when the cache first syncs.
+func (h *History) Watch(cluster string, rbacCache *cache.RBACCache) error {
+	record := func(obj interface{}, deleted bool) {
+		if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		revision, ok := revisionFor(cluster, obj)
+		if !ok {
+			return
+		}
+		revision.Source = SourceWatch
+		revision.Deleted = deleted
+		if _, err := h.Record(revision); err != nil {
+			klog.ErrorS(err, "Failed to record revision", "cluster", cluster, "kind", revision.Kind, "namespace", revision.Namespace, "name", revision.Name)
+		}
+	}
+
+	return rbacCache.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { record(obj, false) },
+		UpdateFunc: func(_, obj interface{}) { record(obj, false) },
+		DeleteFunc: func(obj interface{}) { record(obj, true) },
+	})
+}
+
+// revisionFor builds an unnumbered revision of an RBAC object.
+func revisionFor(cluster string, obj interface{}) (Revision, bool) {
+	var kind string
+	switch obj.(type) {
+	case *rbacv1.Role:
+		kind = "Role"
+	case *rbacv1.ClusterRole:
+		kind = "ClusterRole"
+	case *rbacv1.RoleBinding:
+		kind = "RoleBinding"
+	case *rbacv1.ClusterRoleBinding:
+		kind = "ClusterRoleBinding"
+	default:
+		return Revision{}, false
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return Revision{}, false
+	}
+	revision, err := NewRevision(cluster, kind, data)
+	return revision, err == nil
+}
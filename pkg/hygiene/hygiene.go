@@ -0,0 +1,327 @@
+// Package hygiene finds RBAC objects that grant nothing or refer to nothing: roles that are
+// never bound, bindings to missing roles, bindings without subjects and subjects that were
+// deleted. It also cleans them up.
+package hygiene
+
+import (
+	"errors"
+	"sort"
+
+	"rbac/pkg/audit"
+	"rbac/pkg/manifest"
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Issues reported by Analyze.
+const (
+	// IssueUnboundRole is a role or cluster role that no binding refers to. Cluster roles
+	// aggregated into another cluster role are not reported.
+	IssueUnboundRole = "unbound-role"
+	// IssueMissingRoleRef is a binding whose role or cluster role does not exist.
+	IssueMissingRoleRef = "missing-role-ref"
+	// IssueMissingServiceAccount is a binding with service account subjects that do not exist.
+	IssueMissingServiceAccount = "missing-service-account"
+	// IssueMissingNamespace is a binding with service account subjects in namespaces that do
+	// not exist.
+	IssueMissingNamespace = "missing-namespace"
+	// IssueEmptyBinding is a binding without subjects.
+	IssueEmptyBinding = "empty-binding"
+)
+
+// Cleanup actions of items.
+const (
+	// ActionDelete deletes the object.
+	ActionDelete = "delete"
+	// ActionRemoveSubjects removes the subjects of the item from the binding, and deletes the
+	// binding if none are left.
+	ActionRemoveSubjects = "remove-subjects"
+)
+
+// Item is an issue found on a role, cluster role or binding, with the action that cleans it up.
+// Subjects lists the subjects concerned for the missing-service-account and missing-namespace
+// issues.
+type Item struct {
+	ID        string           `json:"id"`
+	Issue     string           `json:"issue"`
+	Kind      string           `json:"kind"`
+	Namespace string           `json:"namespace,omitempty"`
+	Name      string           `json:"name"`
+	RoleRef   *rbacv1.RoleRef  `json:"roleRef,omitempty"`
+	Subjects  []rbacv1.Subject `json:"subjects,omitempty"`
+	Action    string           `json:"action"`
+	Message   string           `json:"message"`
+}
+
+// Result is the outcome of the cleanup of an item. Action is what was done, which is a
+// deletion when removing subjects leaves the binding empty.
+type Result struct {
+	ID      string `json:"id"`
+	Action  string `json:"action"`
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Analyze returns the issues of the roles, cluster roles and bindings of the set, given the
+// service accounts and namespace names of the cluster, sorted by issue, kind, namespace and
+// name. A binding to delete is reported once, as empty before missing its role; its subjects
+// are only checked when it is kept.
+func Analyze(objects policy.ObjectSet, serviceAccounts []*corev1.ServiceAccount, namespaces []string) []Item {
+	roles := make(map[string]bool, len(objects.Roles))
+	for _, role := range objects.Roles {
+		roles[role.Namespace+"/"+role.Name] = true
+	}
+	clusterRoles := make(map[string]bool, len(objects.ClusterRoles))
+	for _, clusterRole := range objects.ClusterRoles {
+		clusterRoles[clusterRole.Name] = true
+	}
+	existingNamespaces := make(map[string]bool, len(namespaces))
+	for _, namespace := range namespaces {
+		existingNamespaces[namespace] = true
+	}
+	existingServiceAccounts := make(map[string]bool, len(serviceAccounts))
+	for _, serviceAccount := range serviceAccounts {
+		existingServiceAccounts[serviceAccount.Namespace+"/"+serviceAccount.Name] = true
+	}
+
+	items := []Item{}
+	boundRoles := make(map[string]bool)
+	boundClusterRoles := make(map[string]bool)
+	checkBinding := func(kind, namespace, name string, roleRef rbacv1.RoleRef, subjects []rbacv1.Subject) {
+		exists := clusterRoles[roleRef.Name]
+		if roleRef.Kind == "Role" {
+			exists = roles[namespace+"/"+roleRef.Name]
+			boundRoles[namespace+"/"+roleRef.Name] = true
+		} else {
+			boundClusterRoles[roleRef.Name] = true
+		}
+		ref := roleRef
+
+		switch {
+		case len(subjects) == 0:
+			items = append(items, newItem(IssueEmptyBinding, kind, namespace, name, &ref, nil, ActionDelete, "The binding has no subjects"))
+			return
+		case !exists:
+			items = append(items, newItem(IssueMissingRoleRef, kind, namespace, name, &ref, nil, ActionDelete, "The "+roleRef.Kind+" "+roleRef.Name+" does not exist"))
+			return
+		}
+
+		var missingNamespaces, missingServiceAccounts []rbacv1.Subject
+		for _, subject := range subjects {
+			if subject.Kind != rbacv1.ServiceAccountKind {
+				continue
+			}
+			if subject.Namespace == "" {
+				subject.Namespace = namespace
+			}
+			if !existingNamespaces[subject.Namespace] {
+				missingNamespaces = append(missingNamespaces, subject)
+			} else if !existingServiceAccounts[subject.Namespace+"/"+subject.Name] {
+				missingServiceAccounts = append(missingServiceAccounts, subject)
+			}
+		}
+		if len(missingNamespaces) > 0 {
+			items = append(items, newItem(IssueMissingNamespace, kind, namespace, name, &ref, missingNamespaces, ActionRemoveSubjects, "Service account subjects are in namespaces that do not exist"))
+		}
+		if len(missingServiceAccounts) > 0 {
+			items = append(items, newItem(IssueMissingServiceAccount, kind, namespace, name, &ref, missingServiceAccounts, ActionRemoveSubjects, "Service account subjects do not exist"))
+		}
+	}
+
+	for _, rb := range objects.RoleBindings {
+		checkBinding(manifest.KindRoleBinding, rb.Namespace, rb.Name, rb.RoleRef, rb.Subjects)
+	}
+	for _, crb := range objects.ClusterRoleBindings {
+		checkBinding(manifest.KindClusterRoleBinding, "", crb.Name, crb.RoleRef, crb.Subjects)
+	}
+
+	aggregated := make(map[string]bool)
+	for _, clusterRole := range objects.ClusterRoles {
+		if clusterRole.AggregationRule == nil {
+			continue
+		}
+		for _, source := range policy.MatchingClusterRoles(clusterRole.AggregationRule, objects.ClusterRoles) {
+			if source.Name != clusterRole.Name {
+				aggregated[source.Name] = true
+			}
+		}
+	}
+	for _, role := range objects.Roles {
+		if !boundRoles[role.Namespace+"/"+role.Name] {
+			items = append(items, newItem(IssueUnboundRole, manifest.KindRole, role.Namespace, role.Name, nil, nil, ActionDelete, "No role binding refers to the role"))
+		}
+	}
+	for _, clusterRole := range objects.ClusterRoles {
+		if !boundClusterRoles[clusterRole.Name] && !aggregated[clusterRole.Name] {
+			items = append(items, newItem(IssueUnboundRole, manifest.KindClusterRole, "", clusterRole.Name, nil, nil, ActionDelete, "No binding refers to the cluster role and it is not aggregated"))
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.Issue != b.Issue {
+			return a.Issue < b.Issue
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return items
+}
+
+// Cleanup applies the actions of the items, in order, with the dry-run mode of dryRun, and
+// reports the change of every object to record. The items of an object are applied together:
+// it is deleted if any of them deletes it, otherwise the subjects of all of them are removed at
+// once. A failure does not stop the objects that follow.
+func Cleanup(clientset kubernetes.Interface, items []Item, dryRun []string, record utils.ChangeRecorder) []Result {
+	var order []string
+	byObject := make(map[string][]Item)
+	for _, item := range items {
+		ref := item.Kind + "/" + item.Namespace + "/" + item.Name
+		if _, ok := byObject[ref]; !ok {
+			order = append(order, ref)
+		}
+		byObject[ref] = append(byObject[ref], item)
+	}
+
+	results := make(map[string]Result, len(items))
+	for _, ref := range order {
+		objectItems := byObject[ref]
+		action, err := cleanupObject(clientset, objectItems, dryRun, record)
+		for _, item := range objectItems {
+			result := Result{ID: item.ID, Action: action, Applied: err == nil}
+			if err != nil {
+				result.Error = errorMessage(err)
+			}
+			results[item.ID] = result
+		}
+	}
+
+	ordered := make([]Result, 0, len(items))
+	for _, item := range items {
+		ordered = append(ordered, results[item.ID])
+	}
+	return ordered
+}
+
+// cleanupObject applies the items of one object, reports the change to record and returns the
+// action taken.
+func cleanupObject(clientset kubernetes.Interface, items []Item, dryRun []string, record utils.ChangeRecorder) (string, error) {
+	first := items[0]
+	kind := manifest.LookupKind(first.Kind)
+	if kind == nil {
+		return first.Action, errors.New("unsupported kind " + first.Kind)
+	}
+
+	action := ActionRemoveSubjects
+	var remove []rbacv1.Subject
+	for _, item := range items {
+		if item.Action == ActionDelete {
+			action = ActionDelete
+		}
+		remove = append(remove, item.Subjects...)
+	}
+
+	change := utils.Change{Action: audit.ActionUpdate, Kind: kind.Name, Namespace: first.Namespace, Name: first.Name}
+	if action == ActionDelete {
+		change.Action = audit.ActionDelete
+	}
+	current, err := kind.Get(clientset, first.Namespace, first.Name)
+	if err != nil {
+		change.Err = err
+		record(change)
+		return action, err
+	}
+	change.Before = current
+
+	var updated manifest.Object
+	if action == ActionRemoveSubjects {
+		updated = current.DeepCopyObject().(manifest.Object)
+		var left int
+		switch binding := updated.(type) {
+		case *rbacv1.RoleBinding:
+			binding.Subjects = removeSubjects(binding.Subjects, remove, binding.Namespace)
+			left = len(binding.Subjects)
+		case *rbacv1.ClusterRoleBinding:
+			binding.Subjects = removeSubjects(binding.Subjects, remove, "")
+			left = len(binding.Subjects)
+		default:
+			return action, errors.New(first.Kind + " has no subjects")
+		}
+		if left == 0 {
+			action, change.Action = ActionDelete, audit.ActionDelete
+		}
+	}
+
+	if action == ActionDelete {
+		err = kind.Delete(clientset, first.Namespace, first.Name, metav1.DeleteOptions{DryRun: dryRun})
+	} else if updated, err = kind.Update(clientset, updated, metav1.UpdateOptions{DryRun: dryRun, FieldManager: utils.FieldManager}); err == nil {
+		change.After = updated
+	}
+	change.Err = err
+	record(change)
+	return action, err
+}
+
+// removeSubjects returns the subjects that are not in remove. Service account subjects without
+// a namespace are in namespace.
+func removeSubjects(subjects, remove []rbacv1.Subject, namespace string) []rbacv1.Subject {
+	kept := []rbacv1.Subject{}
+	for _, subject := range subjects {
+		normalized := subject
+		if normalized.Kind == rbacv1.ServiceAccountKind && normalized.Namespace == "" {
+			normalized.Namespace = namespace
+		}
+		removed := false
+		for _, r := range remove {
+			if r.Kind == normalized.Kind && r.Namespace == normalized.Namespace && r.Name == normalized.Name {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, subject)
+		}
+	}
+	return kept
+}
+
+// newItem builds an item, with its ID.
+func newItem(issue, kind, namespace, name string, roleRef *rbacv1.RoleRef, subjects []rbacv1.Subject, action, message string) Item {
+	return Item{
+		ID:        ItemID(issue, kind, namespace, name),
+		Issue:     issue,
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		RoleRef:   roleRef,
+		Subjects:  subjects,
+		Action:    action,
+		Message:   message,
+	}
+}
+
+// ItemID returns the ID of the item for an issue of an object: issue:Kind/namespace/name, with
+// an empty namespace for cluster-scoped objects.
+func ItemID(issue, kind, namespace, name string) string {
+	return issue + ":" + kind + "/" + namespace + "/" + name
+}
+
+// errorMessage returns the message of an API status error, or the error text.
+func errorMessage(err error) string {
+	var apiStatus apierrors.APIStatus
+	if errors.As(err, &apiStatus) && apiStatus.Status().Message != "" {
+		return apiStatus.Status().Message
+	}
+	return err.Error()
+}
@@ -0,0 +1,184 @@
+package hygiene
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"rbac/pkg/audit"
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func roleBinding(name, roleKind, roleName string, subjects ...rbacv1.Subject) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a"},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: roleKind, Name: roleName},
+		Subjects:   subjects,
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	reader := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "reader", Namespace: "team-a"}}
+	source := &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "source", Labels: map[string]string{"aggregate": "true"}}}
+	aggregate := &rbacv1.ClusterRole{
+		ObjectMeta:      metav1.ObjectMeta{Name: "aggregate"},
+		AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: map[string]string{"aggregate": "true"}}}},
+	}
+	alice := rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"}
+	deployer := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "deployer", Namespace: "team-a"}}
+	namespaces := []string{"team-a"}
+
+	tests := []struct {
+		name            string
+		objects         policy.ObjectSet
+		serviceAccounts []*corev1.ServiceAccount
+		want            []string
+	}{
+		{
+			name: "aggregated cluster roles are not unbound",
+			objects: policy.ObjectSet{
+				ClusterRoles: []*rbacv1.ClusterRole{source, aggregate},
+				RoleBindings: []*rbacv1.RoleBinding{roleBinding("aggregate", "ClusterRole", "aggregate", alice)},
+			},
+		},
+		{
+			name:    "an unbound aggregate is reported without its sources",
+			objects: policy.ObjectSet{ClusterRoles: []*rbacv1.ClusterRole{source, aggregate}},
+			want:    []string{"unbound-role:ClusterRole//aggregate"},
+		},
+		{
+			name:    "a role bound by a cluster role binding of the same name is unbound",
+			objects: policy.ObjectSet{Roles: []*rbacv1.Role{reader}, ClusterRoles: []*rbacv1.ClusterRole{{ObjectMeta: metav1.ObjectMeta{Name: "reader"}}}, RoleBindings: []*rbacv1.RoleBinding{roleBinding("read", "ClusterRole", "reader", alice)}},
+			want:    []string{"unbound-role:Role/team-a/reader"},
+		},
+		{
+			name: "service account subjects without a namespace are in the binding's namespace",
+			objects: policy.ObjectSet{
+				Roles:        []*rbacv1.Role{reader},
+				RoleBindings: []*rbacv1.RoleBinding{roleBinding("read", "Role", "reader", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"})},
+			},
+			serviceAccounts: []*corev1.ServiceAccount{deployer},
+		},
+		{
+			name: "deleted service account subjects without a namespace",
+			objects: policy.ObjectSet{
+				Roles:        []*rbacv1.Role{reader},
+				RoleBindings: []*rbacv1.RoleBinding{roleBinding("read", "Role", "reader", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "builder"}, alice)},
+			},
+			serviceAccounts: []*corev1.ServiceAccount{deployer},
+			want:            []string{"missing-service-account:RoleBinding/team-a/read"},
+		},
+		{
+			name: "service accounts of deleted namespaces",
+			objects: policy.ObjectSet{
+				ClusterRoles: []*rbacv1.ClusterRole{{ObjectMeta: metav1.ObjectMeta{Name: "viewer"}}},
+				ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{{
+					ObjectMeta: metav1.ObjectMeta{Name: "view"},
+					RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "viewer"},
+					Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "builder", Namespace: "gone"}},
+				}},
+			},
+			want: []string{"missing-namespace:ClusterRoleBinding//view"},
+		},
+		{
+			name: "an empty binding to a missing role is only reported as empty",
+			objects: policy.ObjectSet{
+				RoleBindings: []*rbacv1.RoleBinding{roleBinding("empty", "Role", "missing"), roleBinding("ghost", "Role", "missing", alice)},
+			},
+			want: []string{"empty-binding:RoleBinding/team-a/empty", "missing-role-ref:RoleBinding/team-a/ghost"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, item := range Analyze(tt.objects, tt.serviceAccounts, namespaces) {
+			got = append(got, item.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got items %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	alice := rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"}
+	builder := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "builder"}
+	missing := func(name string) Item {
+		return newItem(IssueMissingServiceAccount, "RoleBinding", "team-a", name, nil, []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "builder", Namespace: "team-a"}}, ActionRemoveSubjects, "")
+	}
+
+	tests := []struct {
+		name     string
+		objects  []runtime.Object
+		items    []Item
+		want     []Result
+		changes  []string
+		subjects []rbacv1.Subject
+	}{
+		{
+			name:     "service account subjects without a namespace are removed",
+			objects:  []runtime.Object{roleBinding("read", "Role", "reader", builder, alice)},
+			items:    []Item{missing("read")},
+			want:     []Result{{ID: missing("read").ID, Action: ActionRemoveSubjects, Applied: true}},
+			changes:  []string{"update RoleBinding team-a/read"},
+			subjects: []rbacv1.Subject{alice},
+		},
+		{
+			name:    "a binding left without subjects is deleted",
+			objects: []runtime.Object{roleBinding("read", "Role", "reader", builder)},
+			items:   []Item{missing("read")},
+			want:    []Result{{ID: missing("read").ID, Action: ActionDelete, Applied: true}},
+			changes: []string{"delete RoleBinding team-a/read"},
+		},
+		{
+			name:    "a deletion wins over removing subjects",
+			objects: []runtime.Object{roleBinding("read", "Role", "missing", builder, alice)},
+			items:   []Item{missing("read"), newItem(IssueMissingRoleRef, "RoleBinding", "team-a", "read", nil, nil, ActionDelete, "")},
+			want: []Result{
+				{ID: missing("read").ID, Action: ActionDelete, Applied: true},
+				{ID: ItemID(IssueMissingRoleRef, "RoleBinding", "team-a", "read"), Action: ActionDelete, Applied: true},
+			},
+			changes: []string{"delete RoleBinding team-a/read"},
+		},
+		{
+			name:    "an object deleted in the meantime fails",
+			items:   []Item{missing("read")},
+			want:    []Result{{ID: missing("read").ID, Action: ActionRemoveSubjects, Error: `rolebindings.rbac.authorization.k8s.io "read" not found`}},
+			changes: []string{"update RoleBinding team-a/read failed"},
+		},
+	}
+	for _, tt := range tests {
+		clientset := fake.NewClientset(tt.objects...)
+		var changes []string
+		record := func(change utils.Change) {
+			summary := change.Action + " " + change.Kind + " " + change.Namespace + "/" + change.Name
+			if change.Err != nil {
+				summary += " failed"
+			} else if change.Before == nil || (change.Action == audit.ActionUpdate) != (change.After != nil) {
+				t.Errorf("%s: got change %+v", tt.name, change)
+			}
+			changes = append(changes, summary)
+		}
+
+		if got := Cleanup(clientset, tt.items, nil, record); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got results %+v, want %+v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(changes, tt.changes) {
+			t.Errorf("%s: got changes %v, want %v", tt.name, changes, tt.changes)
+		}
+		binding, err := clientset.RbacV1().RoleBindings("team-a").Get(context.TODO(), "read", metav1.GetOptions{})
+		switch {
+		case tt.subjects == nil && !apierrors.IsNotFound(err):
+			t.Errorf("%s: got binding %+v, %v, want it deleted", tt.name, binding, err)
+		case tt.subjects != nil && (err != nil || !reflect.DeepEqual(binding.Subjects, tt.subjects)):
+			t.Errorf("%s: got binding %+v, %v, want subjects %+v", tt.name, binding, err, tt.subjects)
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package kubernetes
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rbac/pkg/cache"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -10,27 +17,136 @@ import (
 	"k8s.io/client-go/util/homedir"
 )
 
-func NewClientset() (*kubernetes.Clientset, error) {
-	// Try in-cluster config first
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		// Fallback to kubeconfig
-		kubeconfig := os.Getenv("KUBECONFIG")
-		if kubeconfig == "" {
-			if home := homedir.HomeDir(); home != "" {
-				kubeconfig = filepath.Join(home, ".kube", "config")
+// InClusterName is the name under which the in-cluster configuration is registered.
+const InClusterName = "in-cluster"
+
+// probeTimeout bounds the reachability check made for each cluster at startup.
+const probeTimeout = 5 * time.Second
+
+// KubeconfigPaths returns the kubeconfig files to load, taken from the KUBECONFIG
+// environment variable or the default location in the home directory.
+func KubeconfigPaths() []string {
+	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+		var paths []string
+		for _, path := range filepath.SplitList(kubeconfig) {
+			if path = strings.TrimSpace(path); path != "" {
+				paths = append(paths, path)
 			}
 		}
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		return paths
+	}
+	if home := homedir.HomeDir(); home != "" {
+		return []string{filepath.Join(home, ".kube", "config")}
+	}
+	return nil
+}
+
+// LoadRegistry builds a registry with the in-cluster configuration, if running in a
+// pod, and every context of the given kubeconfig files. Contexts that cannot be
+// configured or reached are registered as degraded instead of failing the load.
+// The in-cluster configuration is the default, followed by the current context of the
+// first kubeconfig file that has one.
+func LoadRegistry(kubeconfigPaths []string, resync time.Duration) (*Registry, error) {
+	registry := NewRegistry()
+	defaultName := ""
+
+	if config, err := rest.InClusterConfig(); err == nil {
+		registry.Add(newClusterFromConfig(InClusterName, config, resync))
+		defaultName = InClusterName
+	}
+
+	for _, path := range kubeconfigPaths {
+		rawConfig, err := clientcmd.LoadFromFile(path)
 		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		contextNames := make([]string, 0, len(rawConfig.Contexts))
+		for contextName := range rawConfig.Contexts {
+			contextNames = append(contextNames, contextName)
+		}
+		sort.Strings(contextNames)
+
+		for _, contextName := range contextNames {
+			if _, err := registry.Get(contextName); err != ErrClusterNotFound {
+				// Earlier files take precedence, as with kubeconfig merging.
+				continue
+			}
+			config, err := clientcmd.NewNonInteractiveClientConfig(*rawConfig, contextName, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+			if err != nil {
+				registry.Add(NewDegradedCluster(contextName, "", err))
+				continue
+			}
+			registry.Add(newClusterFromConfig(contextName, config, resync))
+		}
+
+		if defaultName == "" {
+			if _, ok := rawConfig.Contexts[rawConfig.CurrentContext]; ok {
+				defaultName = rawConfig.CurrentContext
+			}
+		}
+	}
+
+	if len(registry.List()) == 0 {
+		return nil, ErrNoClusters
+	}
+	if defaultName != "" {
+		if err := registry.SetDefault(defaultName); err != nil {
 			return nil, err
 		}
 	}
 
+	probeClusters(registry.List())
+	return registry, nil
+}
+
+// newClusterFromConfig creates a clientset and RBAC cache for a REST config. Failures
+// are recorded on the returned cluster, which is then reported as degraded.
+func newClusterFromConfig(name string, config *rest.Config, resync time.Duration) *Cluster {
 	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return NewDegradedCluster(name, config.Host, err)
+	}
+
+	cluster, err := NewCluster(name, config.Host, clientset, resync)
+	if err != nil {
+		return NewDegradedCluster(name, config.Host, err)
+	}
+	return cluster
+}
+
+// probeClusters checks that every configured cluster answers a version request.
+func probeClusters(clusters []*Cluster) {
+	var wg sync.WaitGroup
+	for _, cluster := range clusters {
+		if cluster.Clientset == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(cluster *Cluster) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+			defer cancel()
+			_, err := cluster.Clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+			cluster.setProbeError(err)
+		}(cluster)
+	}
+	wg.Wait()
+}
+
+// NewCluster creates a cluster around an existing clientset, with its own RBAC cache.
+func NewCluster(name, server string, clientset kubernetes.Interface, resync time.Duration) (*Cluster, error) {
+	rbacCache, err := cache.NewRBACCache(clientset, resync)
 	if err != nil {
 		return nil, err
 	}
+	return &Cluster{Name: name, Server: server, Clientset: clientset, Cache: rbacCache}, nil
+}
 
-	return clientset, nil
+// NewDegradedCluster creates a cluster entry for a configuration that cannot be used.
+func NewDegradedCluster(name, server string, err error) *Cluster {
+	return &Cluster{Name: name, Server: server, err: err}
 }
@@ -0,0 +1,207 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"rbac/pkg/cache"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// ErrClusterNotFound is returned when a cluster name is not registered.
+	ErrClusterNotFound = errors.New("cluster not found")
+	// ErrNoClusters is returned when no cluster configuration could be found.
+	ErrNoClusters = errors.New("no cluster configuration found")
+)
+
+// Cluster status values reported by Cluster.Info.
+const (
+	StatusReady    = "ready"
+	StatusSyncing  = "syncing"
+	StatusDegraded = "degraded"
+)
+
+// Cluster is a Kubernetes cluster managed by Kuberus.
+type Cluster struct {
+	Name      string
+	Server    string
+	Clientset kubernetes.Interface
+	Cache     *cache.RBACCache
+
+	// err records why the cluster could not be configured; such clusters have no clientset.
+	err error
+
+	mu       sync.Mutex
+	probeErr error
+}
+
+// ClusterInfo describes a cluster and its health.
+type ClusterInfo struct {
+	Name    string                 `json:"name"`
+	Server  string                 `json:"server,omitempty"`
+	Default bool                   `json:"default"`
+	Status  string                 `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Cache   []cache.ResourceStatus `json:"cache,omitempty"`
+}
+
+// Err returns the error that makes the cluster unusable, if any.
+func (c *Cluster) Err() error {
+	return c.err
+}
+
+// setProbeError records the result of the startup reachability check.
+func (c *Cluster) setProbeError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probeErr = err
+}
+
+// Info reports the cluster's health. A cluster is degraded if it could not be configured,
+// if it was unreachable and its cache has not synced since, or if a cache watch is failing.
+func (c *Cluster) Info() ClusterInfo {
+	info := ClusterInfo{Name: c.Name, Server: c.Server}
+	if c.err != nil {
+		info.Status = StatusDegraded
+		info.Error = c.err.Error()
+		return info
+	}
+
+	info.Cache = c.Cache.Status()
+	if c.Cache.HasSynced() {
+		info.Status = StatusReady
+		for _, status := range info.Cache {
+			if status.Stale {
+				info.Status = StatusDegraded
+				info.Error = status.LastWatchError
+				break
+			}
+		}
+		return info
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.probeErr != nil {
+		info.Status = StatusDegraded
+		info.Error = c.probeErr.Error()
+		return info
+	}
+	info.Status = StatusSyncing
+	return info
+}
+
+// Registry holds every cluster Kuberus can manage, by name.
+type Registry struct {
+	mu          sync.RWMutex
+	clusters    map[string]*Cluster
+	order       []string
+	defaultName string
+}
+
+// NewRegistry creates an empty cluster registry.
+func NewRegistry() *Registry {
+	return &Registry{clusters: make(map[string]*Cluster)}
+}
+
+// Add registers a cluster, replacing any cluster with the same name. The first
+// cluster added becomes the default.
+func (r *Registry) Add(cluster *Cluster) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.clusters[cluster.Name]; !exists {
+		r.order = append(r.order, cluster.Name)
+	}
+	r.clusters[cluster.Name] = cluster
+	if r.defaultName == "" {
+		r.defaultName = cluster.Name
+	}
+}
+
+// SetDefault selects the cluster used when a request does not name one.
+func (r *Registry) SetDefault(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.clusters[name]; !exists {
+		return ErrClusterNotFound
+	}
+	r.defaultName = name
+	return nil
+}
+
+// DefaultName returns the name of the default cluster.
+func (r *Registry) DefaultName() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.defaultName
+}
+
+// Get returns the named cluster, or the default cluster if name is empty.
+func (r *Registry) Get(name string) (*Cluster, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name == "" {
+		name = r.defaultName
+	}
+	cluster, exists := r.clusters[name]
+	if !exists {
+		return nil, ErrClusterNotFound
+	}
+	return cluster, nil
+}
+
+// List returns every registered cluster in registration order.
+func (r *Registry) List() []*Cluster {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clusters := make([]*Cluster, 0, len(r.order))
+	for _, name := range r.order {
+		clusters = append(clusters, r.clusters[name])
+	}
+	return clusters
+}
+
+// Infos reports the health of every registered cluster.
+func (r *Registry) Infos() []ClusterInfo {
+	defaultName := r.DefaultName()
+	clusters := r.List()
+
+	infos := make([]ClusterInfo, 0, len(clusters))
+	for _, cluster := range clusters {
+		info := cluster.Info()
+		info.Default = cluster.Name == defaultName
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Start starts the RBAC cache of every usable cluster. The caches run until the context is cancelled.
+func (r *Registry) Start(ctx context.Context) {
+	for _, cluster := range r.List() {
+		if cluster.Cache != nil {
+			cluster.Cache.Start(ctx)
+		}
+	}
+}
+
+// Ready reports whether at least one cluster is usable and every cluster that is not
+// degraded has completed its initial cache sync.
+func (r *Registry) Ready() bool {
+	ready := false
+	for _, cluster := range r.List() {
+		switch cluster.Info().Status {
+		case StatusReady:
+			ready = true
+		case StatusSyncing:
+			return false
+		}
+	}
+	return ready
+}
@@ -0,0 +1,68 @@
+package kubernetes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+- name: staging
+  cluster:
+    server: https://127.0.0.1:1
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: admin
+- name: broken
+  context:
+    cluster: missing
+    user: admin
+users:
+- name: admin
+  user:
+    token: secret
+`
+
+func TestLoadRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := LoadRegistry([]string{path, filepath.Join(t.TempDir(), "missing")}, 0)
+	if err != nil {
+		t.Fatalf("loading registry: %v", err)
+	}
+
+	if got := registry.DefaultName(); got != "staging" {
+		t.Errorf("got default cluster %q, want %q", got, "staging")
+	}
+
+	infos := registry.Infos()
+	if len(infos) != 2 {
+		t.Fatalf("got %d clusters, want 2", len(infos))
+	}
+	for _, info := range infos {
+		if info.Status != StatusDegraded || info.Error == "" {
+			t.Errorf("cluster %s: got status %q error %q, want degraded with an error", info.Name, info.Status, info.Error)
+		}
+	}
+
+	if _, err := registry.Get("unknown"); err != ErrClusterNotFound {
+		t.Errorf("got error %v, want %v", err, ErrClusterNotFound)
+	}
+	if registry.Ready() {
+		t.Error("registry with only degraded clusters should not be ready")
+	}
+}
+
+func TestLoadRegistryWithoutClusters(t *testing.T) {
+	if _, err := LoadRegistry(nil, 0); err != ErrNoClusters {
+		t.Errorf("got error %v, want %v", err, ErrNoClusters)
+	}
+}
@@ -0,0 +1,140 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// DocumentError reports a document of a bundle that cannot be read.
+type DocumentError struct {
+	// Document is the position of the document in the bundle, starting at 1.
+	Document int
+	Err      error
+}
+
+// Error returns the message of the error, prefixed by the document position.
+func (e *DocumentError) Error() string {
+	return fmt.Sprintf("document %d: %v", e.Document, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DocumentError) Unwrap() error {
+	return e.Err
+}
+
+// Decode reads the objects of a bundle: multi-document YAML, a JSON array of objects, or
+// either holding List objects, whose items are expanded. Every object must be of a supported
+// kind. The errors of every unreadable document are returned together.
+func Decode(data []byte) ([]Object, error) {
+	documents, err := splitDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []Object
+	var errs []error
+	for i, document := range documents {
+		if document.err != nil {
+			errs = append(errs, &DocumentError{Document: i + 1, Err: document.err})
+			continue
+		}
+		decoded, err := decodeDocument(document.data)
+		if err != nil {
+			errs = append(errs, &DocumentError{Document: i + 1, Err: err})
+			continue
+		}
+		objs = append(objs, decoded...)
+	}
+	return objs, errors.Join(errs...)
+}
+
+// document is the JSON form of one document of a bundle, or the error converting it.
+type document struct {
+	data []byte
+	err  error
+}
+
+// splitDocuments returns every non-empty document of a bundle.
+func splitDocuments(data []byte) ([]document, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, fmt.Errorf("invalid JSON list: %w", err)
+		}
+		documents := make([]document, 0, len(items))
+		for _, item := range items {
+			documents = append(documents, document{data: item})
+		}
+		return documents, nil
+	}
+
+	var documents []document
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		data, err := reader.Read()
+		if err == io.EOF {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		jsonData, err := yaml.YAMLToJSON(data)
+		if err != nil {
+			documents = append(documents, document{err: err})
+			continue
+		}
+		if trimmed := bytes.TrimSpace(jsonData); len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+			continue
+		}
+		documents = append(documents, document{data: jsonData})
+	}
+}
+
+// decodeDocument decodes one document into typed objects, expanding a List.
+func decodeDocument(document []byte) ([]Object, error) {
+	var list struct {
+		Kind  string            `json:"kind"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(document, &list); err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(list.Kind, "List") {
+		objs := make([]Object, 0, len(list.Items))
+		for i, item := range list.Items {
+			obj, err := decodeObject(item)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %w", i, err)
+			}
+			objs = append(objs, obj)
+		}
+		return objs, nil
+	}
+
+	obj, err := decodeObject(document)
+	if err != nil {
+		return nil, err
+	}
+	return []Object{obj}, nil
+}
+
+// decodeObject decodes a single object of a supported kind.
+func decodeObject(data []byte) (Object, error) {
+	decoded, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(data, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if KindOf(decoded) == nil {
+		return nil, fmt.Errorf("unsupported kind %s", gvk.Kind)
+	}
+	return decoded.(Object), nil
+}
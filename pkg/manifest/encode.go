@@ -0,0 +1,200 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"rbac/pkg/cache"
+	"rbac/pkg/search"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// serverManagedFields are the metadata fields set by the API server, which an exported object
+// must not carry to be applied elsewhere.
+var serverManagedFields = []string{"managedFields", "resourceVersion", "uid", "creationTimestamp", "generation", "selfLink"}
+
+// Filter selects the objects to collect. Zero values do not filter.
+type Filter struct {
+	// Namespace restricts the objects to roles and role bindings in this namespace.
+	Namespace string
+	// Labels matches objects whose labels it selects.
+	Labels labels.Selector
+	// ExcludeSystem drops system: objects and the API server's default roles and bindings.
+	ExcludeSystem bool
+}
+
+// Matches reports whether the filter selects an object. Cluster-scoped objects are outside any
+// namespace.
+func (f Filter) Matches(obj Object) bool {
+	if f.Namespace != "" && obj.GetNamespace() != f.Namespace {
+		return false
+	}
+	if f.Labels != nil && !f.Labels.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+	return !f.ExcludeSystem || !search.IsSystem(metav1.ObjectMeta{Name: obj.GetName(), Labels: obj.GetLabels()})
+}
+
+// Collect returns copies of the cached roles, cluster roles and bindings that match the
+// filter, with their apiVersion and kind set, in apply order and then by namespace and name.
+func Collect(rbacCache *cache.RBACCache, filter Filter) ([]Object, error) {
+	var objs []Object
+
+	roles, err := rbacCache.ListRoles(filter.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		objs = append(objs, role)
+	}
+	roleBindings, err := rbacCache.ListRoleBindings(filter.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, roleBinding := range roleBindings {
+		objs = append(objs, roleBinding)
+	}
+	if filter.Namespace == "" {
+		clusterRoles, err := rbacCache.ListClusterRoles()
+		if err != nil {
+			return nil, err
+		}
+		for _, clusterRole := range clusterRoles {
+			objs = append(objs, clusterRole)
+		}
+		clusterRoleBindings, err := rbacCache.ListClusterRoleBindings()
+		if err != nil {
+			return nil, err
+		}
+		for _, clusterRoleBinding := range clusterRoleBindings {
+			objs = append(objs, clusterRoleBinding)
+		}
+	}
+
+	collected := make([]Object, 0, len(objs))
+	for _, obj := range objs {
+		if !filter.Matches(obj) {
+			continue
+		}
+		obj = obj.DeepCopyObject().(Object)
+		SetTypeMeta(obj)
+		collected = append(collected, obj)
+	}
+
+	sort.SliceStable(collected, func(i, j int) bool {
+		a, b := collected[i], collected[j]
+		if orderA, orderB := KindOf(a).Order, KindOf(b).Order; orderA != orderB {
+			return orderA < orderB
+		}
+		if kindA, kindB := KindOf(a).Name, KindOf(b).Name; kindA != kindB {
+			return kindA < kindB
+		}
+		if a.GetNamespace() != b.GetNamespace() {
+			return a.GetNamespace() < b.GetNamespace()
+		}
+		return a.GetName() < b.GetName()
+	})
+	return collected, nil
+}
+
+// SetTypeMeta sets the apiVersion and kind of an object, which typed clients leave empty.
+func SetTypeMeta(obj Object) {
+	if kind := KindOf(obj); kind != nil {
+		groupVersion, _ := schema.ParseGroupVersion(kind.APIVersion)
+		obj.GetObjectKind().SetGroupVersionKind(groupVersion.WithKind(kind.Name))
+	}
+}
+
+// Clean returns the JSON form of an object without its server-managed fields, ready to be
+// applied to another cluster.
+func Clean(obj Object) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		for _, field := range serverManagedFields {
+			delete(metadata, field)
+		}
+	}
+	delete(object, "status")
+	return object, nil
+}
+
+// EncodeYAML writes the objects, cleaned, as multi-document YAML.
+func EncodeYAML(objs []Object) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, obj := range objs {
+		data, err := encodeObject(obj)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// Path returns the path of an object in a tarball: kind/namespace/name.yaml, or
+// kind/name.yaml for cluster-scoped objects.
+func Path(obj Object) string {
+	return path.Join(KindOf(obj).Name, obj.GetNamespace(), obj.GetName()+".yaml")
+}
+
+// WriteTarball writes the objects, cleaned, as a gzipped tarball with one YAML file per
+// object at its Path.
+func WriteTarball(w io.Writer, objs []Object) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	now := time.Now()
+
+	for _, obj := range objs {
+		data, err := encodeObject(obj)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:    Path(obj),
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: now,
+			Format:  tar.FormatPAX,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// encodeObject returns the cleaned YAML form of an object.
+func encodeObject(obj Object) ([]byte, error) {
+	object, err := Clean(obj)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(object)
+}
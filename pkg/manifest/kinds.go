@@ -0,0 +1,333 @@
+// Package manifest reads and writes bundles of RBAC objects, the namespaces and service
+// accounts they refer to, and knows how to fetch and store each of these kinds.
+package manifest
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"rbac/pkg/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Supported kinds.
+const (
+	KindNamespace          = "Namespace"
+	KindServiceAccount     = "ServiceAccount"
+	KindRole               = "Role"
+	KindClusterRole        = "ClusterRole"
+	KindRoleBinding        = "RoleBinding"
+	KindClusterRoleBinding = "ClusterRoleBinding"
+)
+
+// ErrRoleRefChanged is returned when a binding would change its roleRef, which the API
+// server does not allow.
+var ErrRoleRefChanged = errors.New("roleRef cannot be changed, delete the binding first")
+
+// Object is a typed Kubernetes object of one of the supported kinds.
+type Object interface {
+	metav1.Object
+	runtime.Object
+}
+
+// Kind holds the operations on the objects of one supported kind.
+type Kind struct {
+	Name       string
+	APIVersion string
+	Namespaced bool
+	// Order is the position of the kind when objects are applied: namespaces first, then
+	// roles and service accounts, then the bindings that refer to them.
+	Order int
+
+	// New returns an empty object of the kind.
+	New func() Object
+	// Validate checks the object with the utils validators.
+	Validate func(obj Object) error
+	// merge returns a copy of current with the content of desired other than its metadata.
+	merge func(current, desired Object) (Object, error)
+
+	Get    func(clientset kubernetes.Interface, namespace, name string) (Object, error)
+	List   func(clientset kubernetes.Interface, namespace string) ([]Object, error)
+	Create func(clientset kubernetes.Interface, obj Object, opts metav1.CreateOptions) (Object, error)
+	Update func(clientset kubernetes.Interface, obj Object, opts metav1.UpdateOptions) (Object, error)
+	Delete func(clientset kubernetes.Interface, namespace, name string, opts metav1.DeleteOptions) error
+}
+
+// Kinds lists the supported kinds, in apply order.
+var Kinds = []*Kind{
+	{
+		Name: KindNamespace, APIVersion: "v1", Order: 0,
+		New:      func() Object { return &corev1.Namespace{} },
+		Validate: func(obj Object) error { return utils.ValidateNamespace(obj.(*corev1.Namespace)) },
+		merge: func(current, _ Object) (Object, error) {
+			return current.DeepCopyObject().(Object), nil
+		},
+		Get: func(clientset kubernetes.Interface, _, name string) (Object, error) {
+			return clientset.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+		},
+		List: func(clientset kubernetes.Interface, _ string) ([]Object, error) {
+			list, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			objs := make([]Object, 0, len(list.Items))
+			for i := range list.Items {
+				objs = append(objs, &list.Items[i])
+			}
+			return objs, nil
+		},
+		Create: func(clientset kubernetes.Interface, obj Object, opts metav1.CreateOptions) (Object, error) {
+			return clientset.CoreV1().Namespaces().Create(context.TODO(), obj.(*corev1.Namespace), opts)
+		},
+		Update: func(clientset kubernetes.Interface, obj Object, opts metav1.UpdateOptions) (Object, error) {
+			return clientset.CoreV1().Namespaces().Update(context.TODO(), obj.(*corev1.Namespace), opts)
+		},
+		Delete: func(clientset kubernetes.Interface, _, name string, opts metav1.DeleteOptions) error {
+			return clientset.CoreV1().Namespaces().Delete(context.TODO(), name, opts)
+		},
+	},
+	{
+		Name: KindClusterRole, APIVersion: rbacv1.SchemeGroupVersion.String(), Order: 1,
+		New:      func() Object { return &rbacv1.ClusterRole{} },
+		Validate: func(obj Object) error { return utils.ValidateClusterRole(obj.(*rbacv1.ClusterRole)) },
+		merge: func(current, desired Object) (Object, error) {
+			merged := current.DeepCopyObject().(*rbacv1.ClusterRole)
+			merged.Rules = desired.(*rbacv1.ClusterRole).Rules
+			merged.AggregationRule = desired.(*rbacv1.ClusterRole).AggregationRule
+			return merged, nil
+		},
+		Get: func(clientset kubernetes.Interface, _, name string) (Object, error) {
+			return clientset.RbacV1().ClusterRoles().Get(context.TODO(), name, metav1.GetOptions{})
+		},
+		List: func(clientset kubernetes.Interface, _ string) ([]Object, error) {
+			list, err := clientset.RbacV1().ClusterRoles().List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			objs := make([]Object, 0, len(list.Items))
+			for i := range list.Items {
+				objs = append(objs, &list.Items[i])
+			}
+			return objs, nil
+		},
+		Create: func(clientset kubernetes.Interface, obj Object, opts metav1.CreateOptions) (Object, error) {
+			return clientset.RbacV1().ClusterRoles().Create(context.TODO(), obj.(*rbacv1.ClusterRole), opts)
+		},
+		Update: func(clientset kubernetes.Interface, obj Object, opts metav1.UpdateOptions) (Object, error) {
+			return clientset.RbacV1().ClusterRoles().Update(context.TODO(), obj.(*rbacv1.ClusterRole), opts)
+		},
+		Delete: func(clientset kubernetes.Interface, _, name string, opts metav1.DeleteOptions) error {
+			return clientset.RbacV1().ClusterRoles().Delete(context.TODO(), name, opts)
+		},
+	},
+	{
+		Name: KindRole, APIVersion: rbacv1.SchemeGroupVersion.String(), Namespaced: true, Order: 1,
+		New:      func() Object { return &rbacv1.Role{} },
+		Validate: func(obj Object) error { return utils.ValidateRole(obj.(*rbacv1.Role)) },
+		merge: func(current, desired Object) (Object, error) {
+			merged := current.DeepCopyObject().(*rbacv1.Role)
+			merged.Rules = desired.(*rbacv1.Role).Rules
+			return merged, nil
+		},
+		Get: func(clientset kubernetes.Interface, namespace, name string) (Object, error) {
+			return clientset.RbacV1().Roles(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		},
+		List: func(clientset kubernetes.Interface, namespace string) ([]Object, error) {
+			list, err := clientset.RbacV1().Roles(namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			objs := make([]Object, 0, len(list.Items))
+			for i := range list.Items {
+				objs = append(objs, &list.Items[i])
+			}
+			return objs, nil
+		},
+		Create: func(clientset kubernetes.Interface, obj Object, opts metav1.CreateOptions) (Object, error) {
+			return clientset.RbacV1().Roles(obj.GetNamespace()).Create(context.TODO(), obj.(*rbacv1.Role), opts)
+		},
+		Update: func(clientset kubernetes.Interface, obj Object, opts metav1.UpdateOptions) (Object, error) {
+			return clientset.RbacV1().Roles(obj.GetNamespace()).Update(context.TODO(), obj.(*rbacv1.Role), opts)
+		},
+		Delete: func(clientset kubernetes.Interface, namespace, name string, opts metav1.DeleteOptions) error {
+			return clientset.RbacV1().Roles(namespace).Delete(context.TODO(), name, opts)
+		},
+	},
+	{
+		Name: KindServiceAccount, APIVersion: "v1", Namespaced: true, Order: 1,
+		New:      func() Object { return &corev1.ServiceAccount{} },
+		Validate: func(obj Object) error { return utils.ValidateServiceAccount(obj.(*corev1.ServiceAccount)) },
+		merge: func(current, desired Object) (Object, error) {
+			merged := current.DeepCopyObject().(*corev1.ServiceAccount)
+			merged.AutomountServiceAccountToken = desired.(*corev1.ServiceAccount).AutomountServiceAccountToken
+			merged.ImagePullSecrets = desired.(*corev1.ServiceAccount).ImagePullSecrets
+			return merged, nil
+		},
+		Get: func(clientset kubernetes.Interface, namespace, name string) (Object, error) {
+			return clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		},
+		List: func(clientset kubernetes.Interface, namespace string) ([]Object, error) {
+			list, err := clientset.CoreV1().ServiceAccounts(namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			objs := make([]Object, 0, len(list.Items))
+			for i := range list.Items {
+				objs = append(objs, &list.Items[i])
+			}
+			return objs, nil
+		},
+		Create: func(clientset kubernetes.Interface, obj Object, opts metav1.CreateOptions) (Object, error) {
+			return clientset.CoreV1().ServiceAccounts(obj.GetNamespace()).Create(context.TODO(), obj.(*corev1.ServiceAccount), opts)
+		},
+		Update: func(clientset kubernetes.Interface, obj Object, opts metav1.UpdateOptions) (Object, error) {
+			return clientset.CoreV1().ServiceAccounts(obj.GetNamespace()).Update(context.TODO(), obj.(*corev1.ServiceAccount), opts)
+		},
+		Delete: func(clientset kubernetes.Interface, namespace, name string, opts metav1.DeleteOptions) error {
+			return clientset.CoreV1().ServiceAccounts(namespace).Delete(context.TODO(), name, opts)
+		},
+	},
+	{
+		Name: KindClusterRoleBinding, APIVersion: rbacv1.SchemeGroupVersion.String(), Order: 2,
+		New:      func() Object { return &rbacv1.ClusterRoleBinding{} },
+		Validate: func(obj Object) error { return utils.ValidateClusterRoleBinding(obj.(*rbacv1.ClusterRoleBinding)) },
+		merge: func(current, desired Object) (Object, error) {
+			merged := current.DeepCopyObject().(*rbacv1.ClusterRoleBinding)
+			if merged.RoleRef != desired.(*rbacv1.ClusterRoleBinding).RoleRef {
+				return nil, ErrRoleRefChanged
+			}
+			merged.Subjects = desired.(*rbacv1.ClusterRoleBinding).Subjects
+			return merged, nil
+		},
+		Get: func(clientset kubernetes.Interface, _, name string) (Object, error) {
+			return clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), name, metav1.GetOptions{})
+		},
+		List: func(clientset kubernetes.Interface, _ string) ([]Object, error) {
+			list, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			objs := make([]Object, 0, len(list.Items))
+			for i := range list.Items {
+				objs = append(objs, &list.Items[i])
+			}
+			return objs, nil
+		},
+		Create: func(clientset kubernetes.Interface, obj Object, opts metav1.CreateOptions) (Object, error) {
+			return clientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), obj.(*rbacv1.ClusterRoleBinding), opts)
+		},
+		Update: func(clientset kubernetes.Interface, obj Object, opts metav1.UpdateOptions) (Object, error) {
+			return clientset.RbacV1().ClusterRoleBindings().Update(context.TODO(), obj.(*rbacv1.ClusterRoleBinding), opts)
+		},
+		Delete: func(clientset kubernetes.Interface, _, name string, opts metav1.DeleteOptions) error {
+			return clientset.RbacV1().ClusterRoleBindings().Delete(context.TODO(), name, opts)
+		},
+	},
+	{
+		Name: KindRoleBinding, APIVersion: rbacv1.SchemeGroupVersion.String(), Namespaced: true, Order: 2,
+		New:      func() Object { return &rbacv1.RoleBinding{} },
+		Validate: func(obj Object) error { return utils.ValidateRoleBinding(obj.(*rbacv1.RoleBinding)) },
+		merge: func(current, desired Object) (Object, error) {
+			merged := current.DeepCopyObject().(*rbacv1.RoleBinding)
+			if merged.RoleRef != desired.(*rbacv1.RoleBinding).RoleRef {
+				return nil, ErrRoleRefChanged
+			}
+			merged.Subjects = desired.(*rbacv1.RoleBinding).Subjects
+			return merged, nil
+		},
+		Get: func(clientset kubernetes.Interface, namespace, name string) (Object, error) {
+			return clientset.RbacV1().RoleBindings(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		},
+		List: func(clientset kubernetes.Interface, namespace string) ([]Object, error) {
+			list, err := clientset.RbacV1().RoleBindings(namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			objs := make([]Object, 0, len(list.Items))
+			for i := range list.Items {
+				objs = append(objs, &list.Items[i])
+			}
+			return objs, nil
+		},
+		Create: func(clientset kubernetes.Interface, obj Object, opts metav1.CreateOptions) (Object, error) {
+			return clientset.RbacV1().RoleBindings(obj.GetNamespace()).Create(context.TODO(), obj.(*rbacv1.RoleBinding), opts)
+		},
+		Update: func(clientset kubernetes.Interface, obj Object, opts metav1.UpdateOptions) (Object, error) {
+			return clientset.RbacV1().RoleBindings(obj.GetNamespace()).Update(context.TODO(), obj.(*rbacv1.RoleBinding), opts)
+		},
+		Delete: func(clientset kubernetes.Interface, namespace, name string, opts metav1.DeleteOptions) error {
+			return clientset.RbacV1().RoleBindings(namespace).Delete(context.TODO(), name, opts)
+		},
+	},
+}
+
+// LookupKind returns the supported kind with the given name, or nil.
+func LookupKind(name string) *Kind {
+	for _, kind := range Kinds {
+		if kind.Name == name {
+			return kind
+		}
+	}
+	return nil
+}
+
+// KindOf returns the supported kind of an object, or nil.
+func KindOf(obj runtime.Object) *Kind {
+	switch obj.(type) {
+	case *corev1.Namespace:
+		return LookupKind(KindNamespace)
+	case *corev1.ServiceAccount:
+		return LookupKind(KindServiceAccount)
+	case *rbacv1.Role:
+		return LookupKind(KindRole)
+	case *rbacv1.ClusterRole:
+		return LookupKind(KindClusterRole)
+	case *rbacv1.RoleBinding:
+		return LookupKind(KindRoleBinding)
+	case *rbacv1.ClusterRoleBinding:
+		return LookupKind(KindClusterRoleBinding)
+	}
+	return nil
+}
+
+// Merge returns a copy of current updated with the content of desired, ready to be stored.
+// The labels and annotations of desired are added to the current ones; the rest of its
+// content, such as rules or subjects, replaces that of current.
+func (k *Kind) Merge(current, desired Object) (Object, error) {
+	merged, err := k.merge(current, desired)
+	if err != nil {
+		return nil, err
+	}
+	merged.SetLabels(mergeMaps(merged.GetLabels(), desired.GetLabels()))
+	merged.SetAnnotations(mergeMaps(merged.GetAnnotations(), desired.GetAnnotations()))
+	return merged, nil
+}
+
+// mergeMaps returns base with the entries of overlay added.
+func mergeMaps(base, overlay map[string]string) map[string]string {
+	if len(overlay) == 0 {
+		return base
+	}
+	merged := make(map[string]string, len(base)+len(overlay))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overlay {
+		merged[key] = value
+	}
+	return merged
+}
+
+// SortForApply orders objects so that each kind comes after the kinds it may depend on,
+// keeping the order of objects of the same rank.
+func SortForApply(objs []Object) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		return KindOf(objs[i]).Order < KindOf(objs[j]).Order
+	})
+}
@@ -0,0 +1,87 @@
+package policy
+
+import (
+	"sort"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// SourcedRule is a policy rule together with the cluster role that defines it.
+type SourcedRule struct {
+	Rule   rbacv1.PolicyRule `json:"rule"`
+	Source string            `json:"source"`
+}
+
+// AggregatedRules returns the rules of a cluster role. For an aggregated cluster role the
+// rules are computed the way the aggregation controller does, from every other cluster role
+// matched by its selectors, and each rule is attributed to the cluster role it came from.
+// Matched cluster roles that are themselves aggregated are expanded recursively.
+func AggregatedRules(clusterRole *rbacv1.ClusterRole, clusterRoles []*rbacv1.ClusterRole) []SourcedRule {
+	return aggregatedRules(clusterRole, clusterRoles, map[string]struct{}{})
+}
+
+// aggregatedRules expands a cluster role, skipping cluster roles already on the visited path.
+func aggregatedRules(clusterRole *rbacv1.ClusterRole, clusterRoles []*rbacv1.ClusterRole, visited map[string]struct{}) []SourcedRule {
+	if clusterRole.AggregationRule == nil {
+		rules := make([]SourcedRule, 0, len(clusterRole.Rules))
+		for _, rule := range clusterRole.Rules {
+			rules = append(rules, SourcedRule{Rule: rule, Source: clusterRole.Name})
+		}
+		return rules
+	}
+
+	visited[clusterRole.Name] = struct{}{}
+	defer delete(visited, clusterRole.Name)
+
+	var rules []SourcedRule
+	for _, source := range MatchingClusterRoles(clusterRole.AggregationRule, clusterRoles) {
+		if _, ok := visited[source.Name]; ok {
+			continue
+		}
+		for _, sourced := range aggregatedRules(source, clusterRoles, visited) {
+			if !containsRule(rules, sourced.Rule) {
+				rules = append(rules, sourced)
+			}
+		}
+	}
+	return rules
+}
+
+// MatchingClusterRoles returns the cluster roles selected by an aggregation rule, sorted by name.
+// Selectors that cannot be parsed match nothing.
+func MatchingClusterRoles(aggregationRule *rbacv1.AggregationRule, clusterRoles []*rbacv1.ClusterRole) []*rbacv1.ClusterRole {
+	var matched []*rbacv1.ClusterRole
+	seen := make(map[string]struct{})
+
+	for i := range aggregationRule.ClusterRoleSelectors {
+		selector, err := metav1.LabelSelectorAsSelector(&aggregationRule.ClusterRoleSelectors[i])
+		if err != nil {
+			continue
+		}
+		for _, clusterRole := range clusterRoles {
+			if _, ok := seen[clusterRole.Name]; ok {
+				continue
+			}
+			if selector.Matches(labels.Set(clusterRole.Labels)) {
+				seen[clusterRole.Name] = struct{}{}
+				matched = append(matched, clusterRole)
+			}
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+	return matched
+}
+
+// containsRule reports whether an equivalent rule is already present.
+func containsRule(rules []SourcedRule, rule rbacv1.PolicyRule) bool {
+	for _, existing := range rules {
+		if equality.Semantic.DeepEqual(existing.Rule, rule) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// ResourceAttributes describes a resource request, as evaluated by the RBAC authorizer.
+// An empty namespace denotes a cluster-wide request.
+type ResourceAttributes struct {
+	Verb        string `json:"verb"`
+	APIGroup    string `json:"apiGroup"`
+	Resource    string `json:"resource"`
+	Subresource string `json:"subresource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name,omitempty"`
+}
+
+// RuleAllows reports whether a policy rule allows the resource request. Wildcards are
+// matched the way the Kubernetes RBAC authorizer matches them.
+func RuleAllows(attrs ResourceAttributes, rule rbacv1.PolicyRule) bool {
+	return verbMatches(rule, attrs.Verb) &&
+		apiGroupMatches(rule, attrs.APIGroup) &&
+		resourceMatches(rule, attrs.Resource, attrs.Subresource) &&
+		resourceNameMatches(rule, attrs.Name)
+}
+
+// NonResourceRuleAllows reports whether a policy rule allows a request for a non-resource URL.
+func NonResourceRuleAllows(verb, path string, rule rbacv1.PolicyRule) bool {
+	return verbMatches(rule, verb) && nonResourceURLMatches(rule, path)
+}
+
+// verbMatches reports whether the rule covers the verb.
+func verbMatches(rule rbacv1.PolicyRule, verb string) bool {
+	for _, ruleVerb := range rule.Verbs {
+		if ruleVerb == rbacv1.VerbAll || ruleVerb == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// apiGroupMatches reports whether the rule covers the API group.
+func apiGroupMatches(rule rbacv1.PolicyRule, apiGroup string) bool {
+	for _, ruleGroup := range rule.APIGroups {
+		if ruleGroup == rbacv1.APIGroupAll || ruleGroup == apiGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceMatches reports whether the rule covers the resource and subresource. A rule
+// resource "*/<subresource>" covers that subresource of every resource.
+func resourceMatches(rule rbacv1.PolicyRule, resource, subresource string) bool {
+	combined := resource
+	if subresource != "" {
+		combined = resource + "/" + subresource
+	}
+	for _, ruleResource := range rule.Resources {
+		if ruleResource == rbacv1.ResourceAll || ruleResource == combined {
+			return true
+		}
+		if subresource != "" && ruleResource == "*/"+subresource {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceNameMatches reports whether the rule covers the named object. Rules without
+// resource names cover every object; rules with resource names never cover unnamed requests.
+func resourceNameMatches(rule rbacv1.PolicyRule, name string) bool {
+	if len(rule.ResourceNames) == 0 {
+		return true
+	}
+	for _, ruleName := range rule.ResourceNames {
+		if ruleName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nonResourceURLMatches reports whether the rule covers the path. A trailing "*" matches any suffix.
+func nonResourceURLMatches(rule rbacv1.PolicyRule, path string) bool {
+	for _, ruleURL := range rule.NonResourceURLs {
+		if ruleURL == rbacv1.NonResourceAll || ruleURL == path {
+			return true
+		}
+		if strings.HasSuffix(ruleURL, "*") && strings.HasPrefix(path, strings.TrimSuffix(ruleURL, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// MergedRule is a de-duplicated rule with every grant that contributes to it.
+type MergedRule struct {
+	rbacv1.PolicyRule
+	Grants []Grant `json:"grants"`
+}
+
+// NamespacePermissions holds the merged rules that apply in one namespace. An empty
+// namespace holds the rules granted cluster-wide.
+type NamespacePermissions struct {
+	Namespace string       `json:"namespace"`
+	Rules     []MergedRule `json:"rules"`
+}
+
+// MergeGrantedRules groups granted rules by namespace and merges rules that cover the same
+// API groups, resources, resource names and non-resource URLs, combining their verbs.
+func MergeGrantedRules(granted []GrantedRule) []NamespacePermissions {
+	byNamespace := make(map[string]map[string]*MergedRule)
+
+	for _, g := range granted {
+		rule := normalizeRule(g.Rule)
+		key := ruleKey(rule)
+
+		rules, ok := byNamespace[g.Namespace]
+		if !ok {
+			rules = make(map[string]*MergedRule)
+			byNamespace[g.Namespace] = rules
+		}
+
+		merged, ok := rules[key]
+		if !ok {
+			merged = &MergedRule{PolicyRule: rule}
+			rules[key] = merged
+		} else {
+			merged.Verbs = normalizeVerbs(append(merged.Verbs, rule.Verbs...))
+		}
+		if !containsGrant(merged.Grants, g.Grant) {
+			merged.Grants = append(merged.Grants, g.Grant)
+		}
+	}
+
+	namespaces := make([]string, 0, len(byNamespace))
+	for namespace := range byNamespace {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	permissions := make([]NamespacePermissions, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		rules := byNamespace[namespace]
+		keys := make([]string, 0, len(rules))
+		for key := range rules {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		nsPermissions := NamespacePermissions{Namespace: namespace, Rules: make([]MergedRule, 0, len(keys))}
+		for _, key := range keys {
+			nsPermissions.Rules = append(nsPermissions.Rules, *rules[key])
+		}
+		permissions = append(permissions, nsPermissions)
+	}
+	return permissions
+}
+
+// normalizeRule returns a copy of the rule with every list sorted and de-duplicated.
+func normalizeRule(rule rbacv1.PolicyRule) rbacv1.PolicyRule {
+	return rbacv1.PolicyRule{
+		Verbs:           normalizeVerbs(rule.Verbs),
+		APIGroups:       uniqueSorted(rule.APIGroups),
+		Resources:       uniqueSorted(rule.Resources),
+		ResourceNames:   uniqueSorted(rule.ResourceNames),
+		NonResourceURLs: uniqueSorted(rule.NonResourceURLs),
+	}
+}
+
+// normalizeVerbs de-duplicates verbs, collapsing them to "*" when the wildcard is present.
+func normalizeVerbs(verbs []string) []string {
+	for _, verb := range verbs {
+		if verb == rbacv1.VerbAll {
+			return []string{rbacv1.VerbAll}
+		}
+	}
+	return uniqueSorted(verbs)
+}
+
+// ruleKey identifies what a normalized rule applies to, ignoring its verbs.
+func ruleKey(rule rbacv1.PolicyRule) string {
+	return fmt.Sprintf("%q|%q|%q|%q", rule.APIGroups, rule.Resources, rule.ResourceNames, rule.NonResourceURLs)
+}
+
+// uniqueSorted returns the sorted unique values, or nil for an empty list.
+func uniqueSorted(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if _, ok := set[value]; ok {
+			continue
+		}
+		set[value] = struct{}{}
+		unique = append(unique, value)
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// containsGrant reports whether the grant is already recorded.
+func containsGrant(grants []Grant, grant Grant) bool {
+	for _, existing := range grants {
+		if reflect.DeepEqual(existing, grant) {
+			return true
+		}
+	}
+	return false
+}
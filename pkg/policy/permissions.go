@@ -0,0 +1,214 @@
+package policy
+
+import (
+	"sort"
+	"strings"
+
+	"rbac/pkg/cache"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// ObjectSet is a set of RBAC objects evaluated on their own, such as a snapshot, rather than
+// through the RBAC cache.
+type ObjectSet struct {
+	Roles               []*rbacv1.Role
+	ClusterRoles        []*rbacv1.ClusterRole
+	RoleBindings        []*rbacv1.RoleBinding
+	ClusterRoleBindings []*rbacv1.ClusterRoleBinding
+}
+
+// CachedObjects returns every role, cluster role and binding in the RBAC cache as a set.
+func CachedObjects(rbacCache *cache.RBACCache) (ObjectSet, error) {
+	var objects ObjectSet
+	var err error
+	if objects.Roles, err = rbacCache.ListRoles(""); err != nil {
+		return objects, err
+	}
+	if objects.ClusterRoles, err = rbacCache.ListClusterRoles(); err != nil {
+		return objects, err
+	}
+	if objects.RoleBindings, err = rbacCache.ListRoleBindings(""); err != nil {
+		return objects, err
+	}
+	objects.ClusterRoleBindings, err = rbacCache.ListClusterRoleBindings()
+	return objects, err
+}
+
+// Permission is a single verb on a resource, or a non-resource URL, held in a namespace or
+// cluster-wide if Namespace is empty. Values may be wildcards, as in the rule granting it.
+type Permission struct {
+	Namespace      string `json:"namespace,omitempty"`
+	Verb           string `json:"verb"`
+	APIGroup       string `json:"apiGroup,omitempty"`
+	Resource       string `json:"resource,omitempty"`
+	ResourceName   string `json:"resourceName,omitempty"`
+	NonResourceURL string `json:"nonResourceURL,omitempty"`
+}
+
+// SubjectPermissions holds the permissions bound to one subject.
+type SubjectPermissions struct {
+	Subject     rbacv1.Subject `json:"subject"`
+	Permissions []Permission   `json:"permissions"`
+}
+
+// RulePermissions expands a rule held in a namespace into its single permissions. Rules held
+// in a namespace grant no non-resource URLs.
+func RulePermissions(namespace string, rule rbacv1.PolicyRule) []Permission {
+	var permissions []Permission
+	for _, verb := range rule.Verbs {
+		if namespace == "" {
+			for _, url := range rule.NonResourceURLs {
+				permissions = append(permissions, Permission{Verb: verb, NonResourceURL: url})
+			}
+		}
+		for _, group := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				if len(rule.ResourceNames) == 0 {
+					permissions = append(permissions, Permission{Namespace: namespace, Verb: verb, APIGroup: group, Resource: resource})
+					continue
+				}
+				for _, name := range rule.ResourceNames {
+					permissions = append(permissions, Permission{Namespace: namespace, Verb: verb, APIGroup: group, Resource: resource, ResourceName: name})
+				}
+			}
+		}
+	}
+	return permissions
+}
+
+// CoveredBy reports whether holding other also grants everything p grants, taking wildcards
+// and cluster-wide permissions into account.
+func (p Permission) CoveredBy(other Permission) bool {
+	if other.Namespace != "" && other.Namespace != p.Namespace {
+		return false
+	}
+	if other.Verb != rbacv1.VerbAll && other.Verb != p.Verb {
+		return false
+	}
+	if (p.NonResourceURL == "") != (other.NonResourceURL == "") {
+		return false
+	}
+	if p.NonResourceURL != "" {
+		return nonResourceURLMatches(rbacv1.PolicyRule{NonResourceURLs: []string{other.NonResourceURL}}, p.NonResourceURL)
+	}
+	if other.APIGroup != rbacv1.APIGroupAll && other.APIGroup != p.APIGroup {
+		return false
+	}
+	if other.Resource != rbacv1.ResourceAll && other.Resource != p.Resource {
+		if subresource, ok := strings.CutPrefix(other.Resource, "*/"); !ok || !strings.HasSuffix(p.Resource, "/"+subresource) {
+			return false
+		}
+	}
+	return other.ResourceName == "" || other.ResourceName == p.ResourceName
+}
+
+// Covered reports whether any of permissions covers p.
+func Covered(p Permission, permissions []Permission) bool {
+	for _, other := range permissions {
+		if p.CoveredBy(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// BoundPermissions returns the permissions that the bindings of the set grant to each subject
+// they name, keyed by SubjectKey. Bindings to roles missing from the set grant nothing, and
+// aggregated cluster roles are expanded from the cluster roles of the set. Service account
+// subjects without a namespace are in that of their role binding.
+func BoundPermissions(objects ObjectSet) map[string]*SubjectPermissions {
+	roles := make(map[string]*rbacv1.Role, len(objects.Roles))
+	for _, role := range objects.Roles {
+		roles[role.Namespace+"/"+role.Name] = role
+	}
+	clusterRoles := make(map[string]*rbacv1.ClusterRole, len(objects.ClusterRoles))
+	for _, clusterRole := range objects.ClusterRoles {
+		clusterRoles[clusterRole.Name] = clusterRole
+	}
+
+	roleRefRules := func(namespace string, roleRef rbacv1.RoleRef) []rbacv1.PolicyRule {
+		var rules []rbacv1.PolicyRule
+		switch roleRef.Kind {
+		case "Role":
+			if role, ok := roles[namespace+"/"+roleRef.Name]; ok {
+				rules = role.Rules
+			}
+		case "ClusterRole":
+			if clusterRole, ok := clusterRoles[roleRef.Name]; ok {
+				for _, sourced := range AggregatedRules(clusterRole, objects.ClusterRoles) {
+					rules = append(rules, sourced.Rule)
+				}
+			}
+		}
+		return rules
+	}
+
+	seen := make(map[string]map[Permission]struct{})
+	bound := make(map[string]*SubjectPermissions)
+	grant := func(namespace string, roleRef rbacv1.RoleRef, subjects []rbacv1.Subject) {
+		var permissions []Permission
+		for _, rule := range roleRefRules(namespace, roleRef) {
+			permissions = append(permissions, RulePermissions(namespace, rule)...)
+		}
+		for _, subject := range subjects {
+			if subject.Kind == rbacv1.ServiceAccountKind && subject.Namespace == "" {
+				subject.Namespace = namespace
+			}
+			key := SubjectKey(subject)
+			if bound[key] == nil {
+				bound[key] = &SubjectPermissions{Subject: subject, Permissions: []Permission{}}
+				seen[key] = make(map[Permission]struct{})
+			}
+			for _, permission := range permissions {
+				if _, ok := seen[key][permission]; !ok {
+					seen[key][permission] = struct{}{}
+					bound[key].Permissions = append(bound[key].Permissions, permission)
+				}
+			}
+		}
+	}
+
+	for _, roleBinding := range objects.RoleBindings {
+		grant(roleBinding.Namespace, roleBinding.RoleRef, roleBinding.Subjects)
+	}
+	for _, clusterRoleBinding := range objects.ClusterRoleBindings {
+		grant("", clusterRoleBinding.RoleRef, clusterRoleBinding.Subjects)
+	}
+
+	for _, subjectPermissions := range bound {
+		SortPermissions(subjectPermissions.Permissions)
+	}
+	return bound
+}
+
+// SubjectKey identifies a subject: its kind, its namespace for a service account, and its name.
+func SubjectKey(subject rbacv1.Subject) string {
+	if subject.Kind == rbacv1.ServiceAccountKind {
+		return subject.Kind + ":" + subject.Namespace + ":" + subject.Name
+	}
+	return subject.Kind + ":" + subject.Name
+}
+
+// SortPermissions sorts permissions by namespace, then what they apply to, then verb.
+func SortPermissions(permissions []Permission) {
+	sort.Slice(permissions, func(i, j int) bool {
+		a, b := permissions[i], permissions[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.NonResourceURL != b.NonResourceURL {
+			return a.NonResourceURL < b.NonResourceURL
+		}
+		if a.APIGroup != b.APIGroup {
+			return a.APIGroup < b.APIGroup
+		}
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		if a.ResourceName != b.ResourceName {
+			return a.ResourceName < b.ResourceName
+		}
+		return a.Verb < b.Verb
+	})
+}
@@ -0,0 +1,355 @@
+package policy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"rbac/pkg/cache"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAggregatedRules(t *testing.T) {
+	selector := metav1.LabelSelector{MatchLabels: map[string]string{"aggregate-to-view": "true"}}
+	view := &rbacv1.ClusterRole{
+		ObjectMeta:      metav1.ObjectMeta{Name: "view"},
+		AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{selector}},
+	}
+	pods := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods", Labels: map[string]string{"aggregate-to-view": "true"}},
+		Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+	}
+	duplicate := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods-again", Labels: map[string]string{"aggregate-to-view": "true"}},
+		Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+	}
+	unrelated := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "secrets"},
+		Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}}},
+	}
+	// A nested aggregated role that also selects the outer role must not loop.
+	nested := &rbacv1.ClusterRole{
+		ObjectMeta:      metav1.ObjectMeta{Name: "nested", Labels: map[string]string{"aggregate-to-view": "true"}},
+		AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{selector}},
+	}
+
+	rules := AggregatedRules(view, []*rbacv1.ClusterRole{view, pods, duplicate, unrelated, nested})
+
+	want := []SourcedRule{{Rule: pods.Rules[0], Source: "pods"}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got rules %+v, want %+v", rules, want)
+	}
+}
+
+func TestImpliedSubjects(t *testing.T) {
+	subject, err := NewSubject(rbacv1.ServiceAccountKind, "deployer", "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, implied := range ImpliedSubjects(subject) {
+		names = append(names, implied.Kind+":"+implied.Name)
+	}
+	want := []string{
+		"ServiceAccount:deployer",
+		"User:system:serviceaccount:team-a:deployer",
+		"Group:system:serviceaccounts",
+		"Group:system:serviceaccounts:team-a",
+		"Group:system:authenticated",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got implied subjects %v, want %v", names, want)
+	}
+
+	if _, err := NewSubject(rbacv1.ServiceAccountKind, "deployer", ""); err == nil {
+		t.Error("expected an error for a service account without a namespace")
+	}
+	if _, err := NewSubject("Robot", "r2", ""); err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+}
+
+func TestParseSubject(t *testing.T) {
+	tests := []struct {
+		value string
+		want  rbacv1.Subject
+		err   bool
+	}{
+		{value: "User:system:kube-scheduler", want: rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "system:kube-scheduler"}},
+		{value: "Group:developers", want: rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "developers"}},
+		{value: "ServiceAccount:team-a:deployer", want: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: "team-a", Name: "deployer"}},
+		{value: "ServiceAccount:deployer", err: true},
+		{value: "alice", err: true},
+		{value: "User:", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSubject(tt.value)
+		if (err != nil) != tt.err || (!tt.err && got != tt.want) {
+			t.Errorf("%s: got %+v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestMergeGrantedRules(t *testing.T) {
+	first := Grant{BindingKind: RoleBindingKind, BindingName: "a", BindingNamespace: "team-a", RoleKind: "Role", RoleName: "a"}
+	second := Grant{BindingKind: RoleBindingKind, BindingName: "b", BindingNamespace: "team-a", RoleKind: "Role", RoleName: "b"}
+	cluster := Grant{BindingKind: ClusterRoleBindingKind, BindingName: "c", RoleKind: "ClusterRole", RoleName: "c"}
+
+	granted := []GrantedRule{
+		{Namespace: "team-a", Rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list", "get"}}, Grant: first},
+		{Namespace: "team-a", Rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "watch"}}, Grant: second},
+		{Namespace: "team-a", Rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}, Grant: first},
+		{Namespace: "", Rule: rbacv1.PolicyRule{NonResourceURLs: []string{"/healthz"}, Verbs: []string{"get", "*"}}, Grant: cluster},
+	}
+
+	want := []NamespacePermissions{
+		{Namespace: "", Rules: []MergedRule{
+			{PolicyRule: rbacv1.PolicyRule{NonResourceURLs: []string{"/healthz"}, Verbs: []string{"*"}}, Grants: []Grant{cluster}},
+		}},
+		{Namespace: "team-a", Rules: []MergedRule{
+			{PolicyRule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list", "watch"}}, Grants: []Grant{first, second}},
+		}},
+	}
+	if got := MergeGrantedRules(granted); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestGrantedRules(t *testing.T) {
+	readPods := rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}
+	binding := func(namespace, name string, subject rbacv1.Subject) *rbacv1.RoleBinding {
+		return &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "pod-reader"},
+			Subjects:   []rbacv1.Subject{subject},
+		}
+	}
+	clientset := fake.NewClientset(
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "pod-reader"}, Rules: []rbacv1.PolicyRule{readPods}},
+		// Service account subjects without a namespace are in that of the binding.
+		binding("team-a", "implicit", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"}),
+		binding("team-b", "implicit", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"}),
+		binding("team-b", "explicit", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-a"}),
+		binding("team-a", "user", rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "deployer"}),
+	)
+	rbacCache, err := cache.NewRBACCache(clientset, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rbacCache.Start(ctx)
+	if !rbacCache.WaitForSync(ctx) {
+		t.Fatal("RBAC cache did not sync")
+	}
+
+	tests := []struct {
+		name    string
+		subject rbacv1.Subject
+		want    []string
+	}{
+		{
+			name:    "service account",
+			subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-a"},
+			want:    []string{"team-a/implicit", "team-b/explicit"},
+		},
+		{
+			name:    "service account of another namespace",
+			subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-b"},
+			want:    []string{"team-b/implicit"},
+		},
+		{
+			name:    "user of the same name",
+			subject: rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "deployer"},
+			want:    []string{"team-a/user"},
+		},
+	}
+	for _, tt := range tests {
+		granted, unresolved, err := NewResolver(rbacCache).GrantedRules([]rbacv1.Subject{tt.subject})
+		if err != nil || len(unresolved) > 0 {
+			t.Fatalf("%s: got %+v, %v", tt.name, unresolved, err)
+		}
+		got := make(map[string]bool)
+		for _, rule := range granted {
+			if rule.Namespace != rule.Grant.BindingNamespace || !reflect.DeepEqual(rule.Rule, readPods) {
+				t.Errorf("%s: got rule %+v", tt.name, rule)
+			}
+			got[rule.Grant.BindingNamespace+"/"+rule.Grant.BindingName] = true
+		}
+		want := make(map[string]bool)
+		for _, binding := range tt.want {
+			want[binding] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got bindings %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestRuleAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  rbacv1.PolicyRule
+		attrs ResourceAttributes
+		want  bool
+	}{
+		{
+			name:  "exact match",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"delete"}},
+			attrs: ResourceAttributes{Verb: "delete", Resource: "secrets"},
+			want:  true,
+		},
+		{
+			name:  "wrong verb",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}},
+			attrs: ResourceAttributes{Verb: "delete", Resource: "secrets"},
+		},
+		{
+			name:  "wrong api group",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{"apps"}, Resources: []string{"secrets"}, Verbs: []string{"delete"}},
+			attrs: ResourceAttributes{Verb: "delete", Resource: "secrets"},
+		},
+		{
+			name:  "wildcards",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}},
+			attrs: ResourceAttributes{Verb: "create", APIGroup: "apps", Resource: "deployments", Subresource: "scale"},
+			want:  true,
+		},
+		{
+			name:  "resource does not cover subresource",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"create"}},
+			attrs: ResourceAttributes{Verb: "create", Resource: "pods", Subresource: "exec"},
+		},
+		{
+			name:  "explicit subresource",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}},
+			attrs: ResourceAttributes{Verb: "create", Resource: "pods", Subresource: "exec"},
+			want:  true,
+		},
+		{
+			name:  "subresource of any resource",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"*/exec"}, Verbs: []string{"create"}},
+			attrs: ResourceAttributes{Verb: "create", Resource: "pods", Subresource: "exec"},
+			want:  true,
+		},
+		{
+			name:  "resource name",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"token"}, Verbs: []string{"get"}},
+			attrs: ResourceAttributes{Verb: "get", Resource: "secrets", Name: "token"},
+			want:  true,
+		},
+		{
+			name:  "resource names do not cover unnamed requests",
+			rule:  rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"token"}, Verbs: []string{"list"}},
+			attrs: ResourceAttributes{Verb: "list", Resource: "secrets"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := RuleAllows(tt.attrs, tt.rule); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNonResourceRuleAllows(t *testing.T) {
+	rule := rbacv1.PolicyRule{NonResourceURLs: []string{"/healthz", "/metrics/*"}, Verbs: []string{"get"}}
+
+	if !NonResourceRuleAllows("get", "/healthz", rule) {
+		t.Error("expected /healthz to be allowed")
+	}
+	if !NonResourceRuleAllows("get", "/metrics/cadvisor", rule) {
+		t.Error("expected /metrics/cadvisor to be allowed by prefix")
+	}
+	if NonResourceRuleAllows("get", "/livez", rule) {
+		t.Error("expected /livez to be denied")
+	}
+	if NonResourceRuleAllows("post", "/healthz", rule) {
+		t.Error("expected post to be denied")
+	}
+}
+
+func TestPermissionCoveredBy(t *testing.T) {
+	podsGet := Permission{Namespace: "team-a", Verb: "get", Resource: "pods"}
+	tests := []struct {
+		name  string
+		p     Permission
+		other Permission
+		want  bool
+	}{
+		{"same", podsGet, podsGet, true},
+		{"cluster-wide", podsGet, Permission{Verb: "get", Resource: "pods"}, true},
+		{"other namespace", podsGet, Permission{Namespace: "team-b", Verb: "get", Resource: "pods"}, false},
+		{"wildcards", podsGet, Permission{Verb: "*", APIGroup: "*", Resource: "*"}, true},
+		{"other verb", podsGet, Permission{Namespace: "team-a", Verb: "list", Resource: "pods"}, false},
+		{"subresource wildcard", Permission{Verb: "create", Resource: "pods/exec"}, Permission{Verb: "create", Resource: "*/exec"}, true},
+		{"named object", Permission{Verb: "get", Resource: "secrets", ResourceName: "token"}, Permission{Verb: "get", Resource: "secrets"}, true},
+		{"named object does not cover all", Permission{Verb: "get", Resource: "secrets"}, Permission{Verb: "get", Resource: "secrets", ResourceName: "token"}, false},
+		{"non-resource prefix", Permission{Verb: "get", NonResourceURL: "/metrics/cadvisor"}, Permission{Verb: "get", NonResourceURL: "/metrics/*"}, true},
+		{"non-resource does not cover resources", podsGet, Permission{Verb: "*", NonResourceURL: "*"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.p.CoveredBy(tt.other); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBoundPermissions(t *testing.T) {
+	alice := rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "alice"}
+	objects := ObjectSet{
+		Roles: []*rbacv1.Role{{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-reader", Namespace: "team-a"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}}},
+		}},
+		ClusterRoles: []*rbacv1.ClusterRole{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-reader"},
+				Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get"}}},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "metrics-reader"},
+				Rules:      []rbacv1.PolicyRule{{NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}}},
+			},
+		},
+		RoleBindings: []*rbacv1.RoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "read-pods", Namespace: "team-a"},
+				RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "pod-reader"},
+				Subjects:   []rbacv1.Subject{alice},
+			},
+			// Role bindings grant no non-resource URLs.
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "read-metrics", Namespace: "team-a"},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "metrics-reader"},
+				Subjects:   []rbacv1.Subject{alice},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "missing-role", Namespace: "team-a"},
+				RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "missing"},
+				Subjects:   []rbacv1.Subject{alice},
+			},
+		},
+		ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{{
+			ObjectMeta: metav1.ObjectMeta{Name: "read-nodes"},
+			RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "node-reader"},
+			Subjects:   []rbacv1.Subject{alice},
+		}},
+	}
+
+	bound := BoundPermissions(objects)
+	want := []Permission{
+		{Verb: "get", Resource: "nodes"},
+		{Namespace: "team-a", Verb: "get", Resource: "pods"},
+		{Namespace: "team-a", Verb: "list", Resource: "pods"},
+	}
+	if len(bound) != 1 || !reflect.DeepEqual(bound[SubjectKey(alice)].Permissions, want) {
+		t.Errorf("got %+v, want alice with %+v", bound[SubjectKey(alice)], want)
+	}
+}
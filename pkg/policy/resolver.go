@@ -0,0 +1,160 @@
+package policy
+
+import (
+	"rbac/pkg/cache"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Binding kinds reported in grants.
+const (
+	RoleBindingKind        = "RoleBinding"
+	ClusterRoleBindingKind = "ClusterRoleBinding"
+)
+
+// Grant identifies the binding and role through which a subject holds a rule.
+type Grant struct {
+	BindingKind      string         `json:"bindingKind"`
+	BindingName      string         `json:"bindingName"`
+	BindingNamespace string         `json:"bindingNamespace,omitempty"`
+	RoleKind         string         `json:"roleKind"`
+	RoleName         string         `json:"roleName"`
+	Source           string         `json:"source,omitempty"`
+	Subject          rbacv1.Subject `json:"subject"`
+}
+
+// GrantedRule is a rule held in a namespace, or cluster-wide if Namespace is empty.
+type GrantedRule struct {
+	Namespace string
+	Rule      rbacv1.PolicyRule
+	Grant     Grant
+}
+
+// Resolver resolves bindings to the rules they grant using the RBAC cache.
+type Resolver struct {
+	cache *cache.RBACCache
+}
+
+// NewResolver creates a resolver backed by the given RBAC cache.
+func NewResolver(rbacCache *cache.RBACCache) *Resolver {
+	return &Resolver{cache: rbacCache}
+}
+
+// RoleRules returns the rules of the role a binding refers to. namespace is the namespace of
+// a RoleBinding, or empty for a ClusterRoleBinding. Aggregated cluster roles are expanded,
+// and each rule is attributed to the cluster role that defines it.
+func (r *Resolver) RoleRules(namespace string, roleRef rbacv1.RoleRef) ([]SourcedRule, error) {
+	switch roleRef.Kind {
+	case "Role":
+		role, err := r.cache.GetRole(namespace, roleRef.Name)
+		if err != nil {
+			return nil, err
+		}
+		rules := make([]SourcedRule, 0, len(role.Rules))
+		for _, rule := range role.Rules {
+			rules = append(rules, SourcedRule{Rule: rule, Source: role.Name})
+		}
+		return rules, nil
+	case "ClusterRole":
+		clusterRole, err := r.cache.GetClusterRole(roleRef.Name)
+		if err != nil {
+			return nil, err
+		}
+		if clusterRole.AggregationRule == nil {
+			return AggregatedRules(clusterRole, nil), nil
+		}
+		clusterRoles, err := r.cache.ListClusterRoles()
+		if err != nil {
+			return nil, err
+		}
+		return AggregatedRules(clusterRole, clusterRoles), nil
+	default:
+		return nil, errors.NewBadRequest("unsupported roleRef kind " + roleRef.Kind)
+	}
+}
+
+// GrantedRules returns every rule granted to any of the subjects through role bindings and
+// cluster role bindings. Grants whose role does not exist are returned separately.
+func (r *Resolver) GrantedRules(subjects []rbacv1.Subject) ([]GrantedRule, []Grant, error) {
+	var granted []GrantedRule
+	var unresolved []Grant
+
+	collect := func(namespace string, grant Grant, roleRef rbacv1.RoleRef) error {
+		rules, err := r.RoleRules(namespace, roleRef)
+		if errors.IsNotFound(err) {
+			unresolved = append(unresolved, grant)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, sourced := range rules {
+			g := grant
+			if sourced.Source != roleRef.Name {
+				g.Source = sourced.Source
+			}
+			granted = append(granted, GrantedRule{Namespace: namespace, Rule: sourced.Rule, Grant: g})
+		}
+		return nil
+	}
+
+	for _, subject := range subjects {
+		roleBindings, err := r.cache.RoleBindingsForSubject(subject.Kind, subject.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, rb := range roleBindings {
+			if !bindingHasSubject(rb.Subjects, subject, rb.Namespace) {
+				continue
+			}
+			grant := Grant{
+				BindingKind:      RoleBindingKind,
+				BindingName:      rb.Name,
+				BindingNamespace: rb.Namespace,
+				RoleKind:         rb.RoleRef.Kind,
+				RoleName:         rb.RoleRef.Name,
+				Subject:          subject,
+			}
+			if err := collect(rb.Namespace, grant, rb.RoleRef); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		clusterRoleBindings, err := r.cache.ClusterRoleBindingsForSubject(subject.Kind, subject.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, crb := range clusterRoleBindings {
+			if !bindingHasSubject(crb.Subjects, subject, "") {
+				continue
+			}
+			grant := Grant{
+				BindingKind: ClusterRoleBindingKind,
+				BindingName: crb.Name,
+				RoleKind:    crb.RoleRef.Kind,
+				RoleName:    crb.RoleRef.Name,
+				Subject:     subject,
+			}
+			if err := collect("", grant, crb.RoleRef); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return granted, unresolved, nil
+}
+
+// bindingHasSubject reports whether any of the subjects of a binding in namespace refers to
+// the subject. Service account subjects without a namespace are in that of the binding.
+func bindingHasSubject(bindingSubjects []rbacv1.Subject, subject rbacv1.Subject, namespace string) bool {
+	for _, bindingSubject := range bindingSubjects {
+		if bindingSubject.Kind == rbacv1.ServiceAccountKind && bindingSubject.Namespace == "" {
+			bindingSubject.Namespace = namespace
+		}
+		if SubjectMatches(bindingSubject, subject) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// Well-known groups that every authenticated identity or service account belongs to.
+const (
+	AllAuthenticatedGroup   = "system:authenticated"
+	AllServiceAccountsGroup = "system:serviceaccounts"
+
+	serviceAccountUsernamePrefix = "system:serviceaccount:"
+)
+
+// ErrInvalidSubject is returned for subjects that cannot be evaluated.
+var ErrInvalidSubject = errors.New("subject kind must be User, Group or ServiceAccount, with a name, and a namespace for ServiceAccount")
+
+// NewSubject builds and validates the subject identified by kind, name and namespace.
+func NewSubject(kind, name, namespace string) (rbacv1.Subject, error) {
+	subject := rbacv1.Subject{Kind: kind, Name: name}
+	switch kind {
+	case rbacv1.UserKind, rbacv1.GroupKind:
+		subject.APIGroup = rbacv1.GroupName
+	case rbacv1.ServiceAccountKind:
+		if namespace == "" {
+			return subject, ErrInvalidSubject
+		}
+		subject.Namespace = namespace
+	default:
+		return subject, ErrInvalidSubject
+	}
+	if name == "" {
+		return subject, ErrInvalidSubject
+	}
+	return subject, nil
+}
+
+// ParseSubject builds and validates a subject written as Kind:name, or
+// ServiceAccount:namespace:name. User and group names may themselves contain colons.
+func ParseSubject(value string) (rbacv1.Subject, error) {
+	kind, name, ok := strings.Cut(value, ":")
+	if !ok {
+		return rbacv1.Subject{}, ErrInvalidSubject
+	}
+	namespace := ""
+	if kind == rbacv1.ServiceAccountKind {
+		namespace, name, _ = strings.Cut(name, ":")
+	}
+	return NewSubject(kind, name, namespace)
+}
+
+// ImpliedSubjects returns the subject together with the identities it implicitly holds:
+// users belong to system:authenticated, and a service account is also the user
+// system:serviceaccount:<namespace>:<name> and a member of the service account groups.
+func ImpliedSubjects(subject rbacv1.Subject) []rbacv1.Subject {
+	subjects := []rbacv1.Subject{subject}
+	switch subject.Kind {
+	case rbacv1.UserKind:
+		subjects = append(subjects, groupSubject(AllAuthenticatedGroup))
+	case rbacv1.ServiceAccountKind:
+		subjects = append(subjects,
+			rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: ServiceAccountUsername(subject.Namespace, subject.Name)},
+			groupSubject(AllServiceAccountsGroup),
+			groupSubject(AllServiceAccountsGroup+":"+subject.Namespace),
+			groupSubject(AllAuthenticatedGroup),
+		)
+	}
+	return subjects
+}
+
+// SubjectMatches reports whether a subject listed in a binding refers to the given subject.
+// Service account subjects must also match on namespace.
+func SubjectMatches(bindingSubject, subject rbacv1.Subject) bool {
+	if bindingSubject.Kind != subject.Kind || bindingSubject.Name != subject.Name {
+		return false
+	}
+	return subject.Kind != rbacv1.ServiceAccountKind || bindingSubject.Namespace == subject.Namespace
+}
+
+// ServiceAccountUsername returns the username a service account authenticates as.
+func ServiceAccountUsername(namespace, name string) string {
+	return serviceAccountUsernamePrefix + namespace + ":" + name
+}
+
+// groupSubject returns a Group subject.
+func groupSubject(name string) rbacv1.Subject {
+	return rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: name}
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"sort"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// SubjectGrants lists the grants through which one subject is allowed a request.
+type SubjectGrants struct {
+	Subject rbacv1.Subject `json:"subject"`
+	Grants  []Grant        `json:"grants"`
+}
+
+// WhoCan returns every subject allowed the resource request, with the bindings and roles
+// that allow it. Cluster role bindings are always considered; role bindings only for
+// requests in their namespace. Bindings whose role does not exist are ignored.
+func (r *Resolver) WhoCan(attrs ResourceAttributes) ([]SubjectGrants, error) {
+	bySubject := make(map[string]*SubjectGrants)
+
+	allow := func(namespace string, grant Grant, roleRef rbacv1.RoleRef, subjects []rbacv1.Subject) error {
+		rules, err := r.RoleRules(namespace, roleRef)
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, sourced := range rules {
+			if !RuleAllows(attrs, sourced.Rule) {
+				continue
+			}
+			if sourced.Source != roleRef.Name {
+				grant.Source = sourced.Source
+			}
+			for _, subject := range subjects {
+				if subject.Kind == rbacv1.ServiceAccountKind && subject.Namespace == "" {
+					subject.Namespace = namespace
+				}
+				g := grant
+				g.Subject = subject
+				key := subjectSortKey(subject)
+				entry, ok := bySubject[key]
+				if !ok {
+					entry = &SubjectGrants{Subject: subject}
+					bySubject[key] = entry
+				}
+				entry.Grants = append(entry.Grants, g)
+			}
+			return nil
+		}
+		return nil
+	}
+
+	clusterRoleBindings, err := r.cache.ListClusterRoleBindings()
+	if err != nil {
+		return nil, err
+	}
+	for _, crb := range clusterRoleBindings {
+		grant := Grant{
+			BindingKind: ClusterRoleBindingKind,
+			BindingName: crb.Name,
+			RoleKind:    crb.RoleRef.Kind,
+			RoleName:    crb.RoleRef.Name,
+		}
+		if err := allow("", grant, crb.RoleRef, crb.Subjects); err != nil {
+			return nil, err
+		}
+	}
+
+	if attrs.Namespace != "" {
+		roleBindings, err := r.cache.ListRoleBindings(attrs.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, rb := range roleBindings {
+			grant := Grant{
+				BindingKind:      RoleBindingKind,
+				BindingName:      rb.Name,
+				BindingNamespace: rb.Namespace,
+				RoleKind:         rb.RoleRef.Kind,
+				RoleName:         rb.RoleRef.Name,
+			}
+			if err := allow(rb.Namespace, grant, rb.RoleRef, rb.Subjects); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result := make([]SubjectGrants, 0, len(bySubject))
+	for _, entry := range bySubject {
+		sort.Slice(entry.Grants, func(i, j int) bool {
+			return grantSortKey(entry.Grants[i]) < grantSortKey(entry.Grants[j])
+		})
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return subjectSortKey(result[i].Subject) < subjectSortKey(result[j].Subject)
+	})
+	return result, nil
+}
+
+// subjectSortKey orders subjects by kind, namespace and name.
+func subjectSortKey(subject rbacv1.Subject) string {
+	return subject.Kind + "/" + subject.Namespace + "/" + subject.Name
+}
+
+// grantSortKey orders grants by binding.
+func grantSortKey(grant Grant) string {
+	return grant.BindingKind + "/" + grant.BindingNamespace + "/" + grant.BindingName
+}
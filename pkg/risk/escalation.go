@@ -0,0 +1,337 @@
+package risk
+
+import (
+	"sort"
+
+	"rbac/pkg/policy"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// Techniques by which a subject can become another subject, or reach cluster-admin access.
+const (
+	// TechniqueClusterAdmin ends a path: the subject already holds every verb on every resource.
+	TechniqueClusterAdmin = "cluster-admin"
+	// TechniqueCreatePods runs a pod, or a workload that creates pods, as a service account.
+	TechniqueCreatePods = "create-pods"
+	// TechniqueImpersonate acts as a user, group or service account.
+	TechniqueImpersonate = "impersonate"
+	// TechniqueBind binds a role to itself without holding its permissions.
+	TechniqueBind = "bind"
+	// TechniqueEscalate adds permissions it does not hold to a cluster role bound to it.
+	TechniqueEscalate = "escalate"
+	// TechniqueReadSecrets reads the token of a service account from its secret.
+	TechniqueReadSecrets = "read-secrets"
+)
+
+// systemMastersGroup is the group that the API server grants every permission to, without RBAC.
+const systemMastersGroup = "system:masters"
+
+// techniqueDescriptions describes the steps of each technique.
+var techniqueDescriptions = map[string]string{
+	TechniqueClusterAdmin: "Holds cluster-admin-equivalent access",
+	TechniqueCreatePods:   "Can create pods in the namespace of the service account and run them as it",
+	TechniqueImpersonate:  "Can impersonate the subject",
+	TechniqueBind:         "Can bind roles it does not hold, and so grant itself any permission",
+	TechniqueEscalate:     "Can add any permission to a cluster role bound to it",
+	TechniqueReadSecrets:  "Can read the token of the service account from a secret",
+}
+
+// workloadResources are the resources whose creation runs pods as any service account of
+// their namespace.
+var workloadResources = []policy.Permission{
+	{Verb: "create", Resource: "pods"},
+	{Verb: "create", APIGroup: "apps", Resource: "deployments"},
+	{Verb: "create", APIGroup: "apps", Resource: "replicasets"},
+	{Verb: "create", APIGroup: "apps", Resource: "statefulsets"},
+	{Verb: "create", APIGroup: "apps", Resource: "daemonsets"},
+	{Verb: "create", APIGroup: "batch", Resource: "jobs"},
+	{Verb: "create", APIGroup: "batch", Resource: "cronjobs"},
+}
+
+// clusterAdmin is the permission that cluster-admin-equivalent access must cover.
+var clusterAdmin = policy.Permission{Verb: rbacv1.VerbAll, APIGroup: rbacv1.APIGroupAll, Resource: rbacv1.ResourceAll}
+
+// Step is one edge of an escalation path: From can become To, or holds cluster-admin access
+// if To is empty. Permission is the permission of From that the step relies on.
+type Step struct {
+	From        rbacv1.Subject    `json:"from"`
+	To          *rbacv1.Subject   `json:"to,omitempty"`
+	Technique   string            `json:"technique"`
+	Permission  policy.Permission `json:"permission"`
+	Description string            `json:"description"`
+}
+
+// Path is a chain of steps from a subject to cluster-admin-equivalent access.
+type Path struct {
+	Steps []Step `json:"steps"`
+}
+
+// Graph models which subjects can become which other subjects, through the permissions that
+// roles and bindings grant them.
+type Graph struct {
+	objects         policy.ObjectSet
+	bound           map[string]*policy.SubjectPermissions
+	serviceAccounts map[string][]*corev1.ServiceAccount
+	namespaces      []string
+	users           []rbacv1.Subject
+	groups          []rbacv1.Subject
+	permissions     map[string][]policy.Permission
+}
+
+// NewGraph builds the graph of the set and the service accounts of the cluster. The users and
+// groups of the graph are those named in bindings.
+func NewGraph(objects policy.ObjectSet, serviceAccounts []*corev1.ServiceAccount) *Graph {
+	g := &Graph{
+		objects:         objects,
+		bound:           policy.BoundPermissions(objects),
+		serviceAccounts: make(map[string][]*corev1.ServiceAccount),
+		permissions:     make(map[string][]policy.Permission),
+	}
+
+	for _, serviceAccount := range serviceAccounts {
+		if _, ok := g.serviceAccounts[serviceAccount.Namespace]; !ok {
+			g.namespaces = append(g.namespaces, serviceAccount.Namespace)
+		}
+		g.serviceAccounts[serviceAccount.Namespace] = append(g.serviceAccounts[serviceAccount.Namespace], serviceAccount)
+	}
+	sort.Strings(g.namespaces)
+	for _, namespace := range g.namespaces {
+		accounts := g.serviceAccounts[namespace]
+		sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	}
+
+	keys := make([]string, 0, len(g.bound))
+	for key := range g.bound {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch subject := g.bound[key].Subject; subject.Kind {
+		case rbacv1.UserKind:
+			g.users = append(g.users, subject)
+		case rbacv1.GroupKind:
+			g.groups = append(g.groups, subject)
+		}
+	}
+	return g
+}
+
+// Permissions returns every permission a subject holds, including through the groups it
+// implicitly belongs to.
+func (g *Graph) Permissions(subject rbacv1.Subject) []policy.Permission {
+	key := policy.SubjectKey(subject)
+	if permissions, ok := g.permissions[key]; ok {
+		return permissions
+	}
+	var permissions []policy.Permission
+	for _, implied := range policy.ImpliedSubjects(subject) {
+		if bound, ok := g.bound[policy.SubjectKey(implied)]; ok {
+			permissions = append(permissions, bound.Permissions...)
+		}
+	}
+	g.permissions[key] = permissions
+	return permissions
+}
+
+// IsClusterAdmin reports whether a subject holds every verb on every resource cluster-wide.
+func (g *Graph) IsClusterAdmin(subject rbacv1.Subject) bool {
+	_, ok := covering(clusterAdmin, g.Permissions(subject))
+	return ok
+}
+
+// Edges returns the steps a subject can take: to cluster-admin access directly, or to the
+// subjects it can become. Each subject is reached by its first technique only.
+func (g *Graph) Edges(subject rbacv1.Subject) []Step {
+	permissions := g.Permissions(subject)
+	var steps []Step
+	seen := map[string]bool{policy.SubjectKey(subject): true}
+	add := func(to *rbacv1.Subject, technique string, permission policy.Permission) {
+		if to != nil {
+			key := policy.SubjectKey(*to)
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+		}
+		steps = append(steps, Step{From: subject, To: to, Technique: technique, Permission: permission, Description: techniqueDescriptions[technique]})
+	}
+	has := func(required policy.Permission) (policy.Permission, bool) {
+		return covering(required, permissions)
+	}
+
+	// Steps straight to cluster-admin access.
+	if permission, ok := has(clusterAdmin); ok {
+		add(nil, TechniqueClusterAdmin, permission)
+	} else if permission, ok := has(policy.Permission{Verb: "impersonate", Resource: "groups", ResourceName: systemMastersGroup}); ok {
+		add(nil, TechniqueImpersonate, permission)
+	} else if permission, ok := has(policy.Permission{Verb: "bind", APIGroup: rbacv1.GroupName, Resource: "clusterroles", ResourceName: "cluster-admin"}); ok && g.holds(permissions, policy.Permission{Verb: "create", APIGroup: rbacv1.GroupName, Resource: "clusterrolebindings"}) {
+		add(nil, TechniqueBind, permission)
+	} else if permission, ok := g.escalate(subject, permissions); ok {
+		add(nil, TechniqueEscalate, permission)
+	}
+
+	// Steps to service accounts, namespace by namespace.
+	for _, namespace := range g.namespaces {
+		accounts := g.serviceAccounts[namespace]
+		toAll := func(technique string, permission policy.Permission) {
+			for _, serviceAccount := range accounts {
+				add(serviceAccountSubject(serviceAccount), technique, permission)
+			}
+		}
+
+		for _, workload := range workloadResources {
+			workload.Namespace = namespace
+			if permission, ok := has(workload); ok {
+				toAll(TechniqueCreatePods, permission)
+				break
+			}
+		}
+		if permission, ok := has(policy.Permission{Namespace: namespace, Verb: "bind", APIGroup: rbacv1.GroupName, Resource: "clusterroles"}); ok && g.holds(permissions, policy.Permission{Namespace: namespace, Verb: "create", APIGroup: rbacv1.GroupName, Resource: "rolebindings"}) {
+			toAll(TechniqueBind, permission)
+		}
+		if permission, ok := has(policy.Permission{Namespace: namespace, Verb: "get", Resource: "secrets"}); ok {
+			// A token secret can be created for any service account and is filled in by the
+			// token controller; otherwise only existing token secrets can be read.
+			if g.holds(permissions, policy.Permission{Namespace: namespace, Verb: "create", Resource: "secrets"}) {
+				toAll(TechniqueReadSecrets, permission)
+			}
+			for _, serviceAccount := range accounts {
+				if len(serviceAccount.Secrets) > 0 {
+					add(serviceAccountSubject(serviceAccount), TechniqueReadSecrets, permission)
+				}
+			}
+		}
+		for _, serviceAccount := range accounts {
+			permission, ok := has(policy.Permission{Namespace: namespace, Verb: "impersonate", Resource: "serviceaccounts", ResourceName: serviceAccount.Name})
+			if !ok {
+				permission, ok = has(policy.Permission{Verb: "impersonate", Resource: "users", ResourceName: policy.ServiceAccountUsername(namespace, serviceAccount.Name)})
+			}
+			if ok {
+				add(serviceAccountSubject(serviceAccount), TechniqueImpersonate, permission)
+			}
+		}
+	}
+
+	// Steps to the users and groups named in bindings.
+	for _, user := range g.users {
+		if permission, ok := has(policy.Permission{Verb: "impersonate", Resource: "users", ResourceName: user.Name}); ok {
+			user := user
+			add(&user, TechniqueImpersonate, permission)
+		}
+	}
+	for _, group := range g.groups {
+		if permission, ok := has(policy.Permission{Verb: "impersonate", Resource: "groups", ResourceName: group.Name}); ok {
+			group := group
+			add(&group, TechniqueImpersonate, permission)
+		}
+	}
+	return steps
+}
+
+// ShortestPaths returns up to limit of the shortest paths from a subject to
+// cluster-admin-equivalent access, or none if there is no path.
+func (g *Graph) ShortestPaths(subject rbacv1.Subject, limit int) []Path {
+	// depth is the length of the shortest path to each subject reached, and to the target
+	// under the empty key; parents holds the steps that reach each at that length.
+	const target = ""
+	start := policy.SubjectKey(subject)
+	depth := map[string]int{start: 0}
+	parents := make(map[string][]Step)
+	frontier := []rbacv1.Subject{subject}
+
+	for length := 1; len(frontier) > 0; length++ {
+		var next []rbacv1.Subject
+		for _, from := range frontier {
+			for _, step := range g.Edges(from) {
+				key := target
+				if step.To != nil {
+					key = policy.SubjectKey(*step.To)
+				}
+				if reached, ok := depth[key]; ok && reached != length {
+					continue
+				}
+				if _, ok := depth[key]; !ok {
+					depth[key] = length
+					if step.To != nil {
+						next = append(next, *step.To)
+					}
+				}
+				parents[key] = append(parents[key], step)
+			}
+		}
+		if _, ok := depth[target]; ok {
+			break
+		}
+		frontier = next
+	}
+
+	paths := []Path{}
+	var walk func(key string, suffix []Step)
+	walk = func(key string, suffix []Step) {
+		if len(paths) >= limit {
+			return
+		}
+		if key == start {
+			paths = append(paths, Path{Steps: append([]Step(nil), suffix...)})
+			return
+		}
+		for _, step := range parents[key] {
+			walk(policy.SubjectKey(step.From), append([]Step{step}, suffix...))
+		}
+	}
+	if parents[target] != nil {
+		walk(target, nil)
+	}
+	return paths
+}
+
+// holds reports whether the permissions cover required.
+func (g *Graph) holds(permissions []policy.Permission, required policy.Permission) bool {
+	_, ok := covering(required, permissions)
+	return ok
+}
+
+// escalate reports whether a subject can escalate and update a cluster role bound to it
+// cluster-wide, and returns its escalate permission.
+func (g *Graph) escalate(subject rbacv1.Subject, permissions []policy.Permission) (policy.Permission, bool) {
+	implied := policy.ImpliedSubjects(subject)
+	for _, crb := range g.objects.ClusterRoleBindings {
+		if crb.RoleRef.Kind != "ClusterRole" || !bindsAny(crb.Subjects, implied) {
+			continue
+		}
+		permission, ok := covering(policy.Permission{Verb: "escalate", APIGroup: rbacv1.GroupName, Resource: "clusterroles", ResourceName: crb.RoleRef.Name}, permissions)
+		if ok && g.holds(permissions, policy.Permission{Verb: "update", APIGroup: rbacv1.GroupName, Resource: "clusterroles", ResourceName: crb.RoleRef.Name}) {
+			return permission, true
+		}
+	}
+	return policy.Permission{}, false
+}
+
+// covering returns the first of permissions that covers required.
+func covering(required policy.Permission, permissions []policy.Permission) (policy.Permission, bool) {
+	for _, permission := range permissions {
+		if required.CoveredBy(permission) {
+			return permission, true
+		}
+	}
+	return policy.Permission{}, false
+}
+
+// bindsAny reports whether a binding names any of the subjects.
+func bindsAny(bindingSubjects, subjects []rbacv1.Subject) bool {
+	for _, bindingSubject := range bindingSubjects {
+		for _, subject := range subjects {
+			if policy.SubjectMatches(bindingSubject, subject) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serviceAccountSubject returns the subject of a service account.
+func serviceAccountSubject(serviceAccount *corev1.ServiceAccount) *rbacv1.Subject {
+	return &rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount.Name, Namespace: serviceAccount.Namespace}
+}
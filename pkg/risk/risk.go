@@ -0,0 +1,337 @@
+// Package risk flags the rules of roles and cluster roles that grant dangerous permissions,
+// such as privilege escalation, reading secrets or running commands in pods.
+package risk
+
+import (
+	"sort"
+
+	"rbac/pkg/policy"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// Severities of findings, from the most to the least severe.
+const (
+	SeverityCritical = "critical"
+	SeverityHigh     = "high"
+	SeverityMedium   = "medium"
+)
+
+// Check is a kind of dangerous permission that the engine looks for in every rule.
+type Check struct {
+	ID          string
+	Severity    string
+	Description string
+	// matches reports whether a rule grants the permission. Resource names are ignored: a
+	// rule limited to some objects is still flagged, and reported so that it can be reviewed.
+	matches func(rule rbacv1.PolicyRule) bool
+}
+
+// Checks are the checks run on every rule, most severe first.
+var Checks = []Check{
+	{
+		ID:          "escalate",
+		Severity:    SeverityCritical,
+		Description: "Can grant any permission by creating or updating roles with permissions it does not hold",
+		matches:     allows(rbacResources("escalate")...),
+	},
+	{
+		ID:          "bind",
+		Severity:    SeverityCritical,
+		Description: "Can bind any role, including cluster-admin, to any subject",
+		matches:     allows(rbacResources("bind")...),
+	},
+	{
+		ID:          "impersonate",
+		Severity:    SeverityCritical,
+		Description: "Can act as other users, groups or service accounts and hold their permissions",
+		matches: allows(
+			policy.ResourceAttributes{Verb: "impersonate", Resource: "users"},
+			policy.ResourceAttributes{Verb: "impersonate", Resource: "groups"},
+			policy.ResourceAttributes{Verb: "impersonate", Resource: "serviceaccounts"},
+			policy.ResourceAttributes{Verb: "impersonate", APIGroup: "authentication.k8s.io", Resource: "uids"},
+		),
+	},
+	{
+		ID:          "nodes-proxy",
+		Severity:    SeverityCritical,
+		Description: "Can reach the kubelet API through nodes/proxy and run commands in any pod on a node",
+		matches: allows(
+			policy.ResourceAttributes{Verb: "get", Resource: "nodes", Subresource: "proxy"},
+			policy.ResourceAttributes{Verb: "create", Resource: "nodes", Subresource: "proxy"},
+		),
+	},
+	{
+		ID:          "wildcard-verbs",
+		Severity:    SeverityHigh,
+		Description: "Grants every verb, including ones added to the API later",
+		matches: func(rule rbacv1.PolicyRule) bool {
+			return contains(rule.Verbs, rbacv1.VerbAll)
+		},
+	},
+	{
+		ID:          "wildcard-resources",
+		Severity:    SeverityHigh,
+		Description: "Grants access to every resource of its API groups, including ones added later",
+		matches: func(rule rbacv1.PolicyRule) bool {
+			return contains(rule.Resources, rbacv1.ResourceAll)
+		},
+	},
+	{
+		ID:          "secrets-read",
+		Severity:    SeverityHigh,
+		Description: "Can read secrets, including service account tokens",
+		matches: allows(
+			policy.ResourceAttributes{Verb: "get", Resource: "secrets"},
+			policy.ResourceAttributes{Verb: "list", Resource: "secrets"},
+			policy.ResourceAttributes{Verb: "watch", Resource: "secrets"},
+		),
+	},
+	{
+		ID:          "pods-exec",
+		Severity:    SeverityHigh,
+		Description: "Can run commands in containers through pods/exec",
+		matches: allows(
+			policy.ResourceAttributes{Verb: "create", Resource: "pods", Subresource: "exec"},
+			policy.ResourceAttributes{Verb: "get", Resource: "pods", Subresource: "exec"},
+		),
+	},
+	{
+		ID:          "pods-attach",
+		Severity:    SeverityHigh,
+		Description: "Can attach to running containers through pods/attach",
+		matches: allows(
+			policy.ResourceAttributes{Verb: "create", Resource: "pods", Subresource: "attach"},
+			policy.ResourceAttributes{Verb: "get", Resource: "pods", Subresource: "attach"},
+		),
+	},
+	{
+		ID:          "csr-approval",
+		Severity:    SeverityHigh,
+		Description: "Can approve certificate signing requests and obtain client certificates for other identities",
+		matches: allows(
+			policy.ResourceAttributes{Verb: "update", APIGroup: "certificates.k8s.io", Resource: "certificatesigningrequests", Subresource: "approval"},
+			policy.ResourceAttributes{Verb: "patch", APIGroup: "certificates.k8s.io", Resource: "certificatesigningrequests", Subresource: "approval"},
+			policy.ResourceAttributes{Verb: "approve", APIGroup: "certificates.k8s.io", Resource: "signers"},
+		),
+	},
+	{
+		ID:          "webhook-config",
+		Severity:    SeverityHigh,
+		Description: "Can change admission webhooks, which see and may modify every matching API request",
+		matches:     allows(webhookResources()...),
+	},
+	{
+		ID:          "create-pods",
+		Severity:    SeverityMedium,
+		Description: "Can create pods, which may mount any service account, secret or config map of their namespace",
+		matches:     allows(policy.ResourceAttributes{Verb: "create", Resource: "pods"}),
+	},
+}
+
+// Finding is a rule that a check flagged, with the subjects that hold it through bindings to
+// the role. Source names the cluster role that the rule was aggregated from, if any.
+type Finding struct {
+	Check       string            `json:"check"`
+	Severity    string            `json:"severity"`
+	Description string            `json:"description"`
+	Rule        rbacv1.PolicyRule `json:"rule"`
+	Source      string            `json:"source,omitempty"`
+	Subjects    []policy.Grant    `json:"subjects,omitempty"`
+}
+
+// RoleRisk holds the findings of a role or cluster role. Severity is that of its most severe
+// finding.
+type RoleRisk struct {
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Severity  string    `json:"severity"`
+	Findings  []Finding `json:"findings"`
+}
+
+// Scan runs every check on the rules and returns a finding for each check that a rule
+// matches, most severe first, without subjects.
+func Scan(rules []rbacv1.PolicyRule) []Finding {
+	sourced := make([]policy.SourcedRule, 0, len(rules))
+	for _, rule := range rules {
+		sourced = append(sourced, policy.SourcedRule{Rule: rule})
+	}
+	return scan(sourced, "")
+}
+
+// Analyze scans every role and cluster role of the set, expanding aggregated cluster roles,
+// and returns those with findings, most severe first.
+func Analyze(objects policy.ObjectSet) []RoleRisk {
+	risks := []RoleRisk{}
+	add := func(kind, namespace, name string, findings []Finding) {
+		if len(findings) == 0 {
+			return
+		}
+		setSubjects(findings, Grants(objects, kind, namespace, name))
+		risks = append(risks, RoleRisk{Kind: kind, Namespace: namespace, Name: name, Severity: findings[0].Severity, Findings: findings})
+	}
+
+	for _, role := range objects.Roles {
+		add("Role", role.Namespace, role.Name, Scan(role.Rules))
+	}
+	for _, clusterRole := range objects.ClusterRoles {
+		add("ClusterRole", "", clusterRole.Name, scan(policy.AggregatedRules(clusterRole, objects.ClusterRoles), clusterRole.Name))
+	}
+
+	sort.Slice(risks, func(i, j int) bool {
+		a, b := risks[i], risks[j]
+		if Rank(a.Severity) != Rank(b.Severity) {
+			return Rank(a.Severity) > Rank(b.Severity)
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return risks
+}
+
+// AnalyzeRole returns the findings of one role or cluster role of the set, with their
+// subjects. It returns an empty list if the role has no findings or is not in the set.
+func AnalyzeRole(objects policy.ObjectSet, kind, namespace, name string) []Finding {
+	findings := []Finding{}
+	switch kind {
+	case "Role":
+		for _, role := range objects.Roles {
+			if role.Namespace == namespace && role.Name == name {
+				findings = Scan(role.Rules)
+			}
+		}
+	case "ClusterRole":
+		for _, clusterRole := range objects.ClusterRoles {
+			if clusterRole.Name == name {
+				findings = scan(policy.AggregatedRules(clusterRole, objects.ClusterRoles), name)
+			}
+		}
+	}
+	setSubjects(findings, Grants(objects, kind, namespace, name))
+	return findings
+}
+
+// Grants returns a grant for every subject of the bindings of the set that refer to a role:
+// role bindings in its namespace for a Role, and cluster role bindings and role bindings in
+// any namespace for a ClusterRole.
+func Grants(objects policy.ObjectSet, kind, namespace, name string) []policy.Grant {
+	var grants []policy.Grant
+	add := func(grant policy.Grant, subjects []rbacv1.Subject) {
+		for _, subject := range subjects {
+			if subject.Kind == rbacv1.ServiceAccountKind && subject.Namespace == "" {
+				subject.Namespace = grant.BindingNamespace
+			}
+			g := grant
+			g.Subject = subject
+			grants = append(grants, g)
+		}
+	}
+
+	for _, rb := range objects.RoleBindings {
+		if rb.RoleRef.Kind != kind || rb.RoleRef.Name != name || (kind == "Role" && rb.Namespace != namespace) {
+			continue
+		}
+		add(policy.Grant{BindingKind: policy.RoleBindingKind, BindingName: rb.Name, BindingNamespace: rb.Namespace, RoleKind: kind, RoleName: name}, rb.Subjects)
+	}
+	if kind == "ClusterRole" {
+		for _, crb := range objects.ClusterRoleBindings {
+			if crb.RoleRef.Kind != kind || crb.RoleRef.Name != name {
+				continue
+			}
+			add(policy.Grant{BindingKind: policy.ClusterRoleBindingKind, BindingName: crb.Name, RoleKind: kind, RoleName: name}, crb.Subjects)
+		}
+	}
+	return grants
+}
+
+// Rank orders severities: the more severe, the higher. Unknown severities rank 0.
+func Rank(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return 3
+	case SeverityHigh:
+		return 2
+	case SeverityMedium:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// scan runs every check on the rules of the role named name.
+func scan(rules []policy.SourcedRule, name string) []Finding {
+	findings := []Finding{}
+	for _, check := range Checks {
+		for _, sourced := range rules {
+			if !check.matches(sourced.Rule) {
+				continue
+			}
+			finding := Finding{Check: check.ID, Severity: check.Severity, Description: check.Description, Rule: sourced.Rule}
+			if sourced.Source != name {
+				finding.Source = sourced.Source
+			}
+			findings = append(findings, finding)
+			break
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return Rank(findings[i].Severity) > Rank(findings[j].Severity)
+	})
+	return findings
+}
+
+// setSubjects sets the subjects of every finding.
+func setSubjects(findings []Finding, grants []policy.Grant) {
+	for i := range findings {
+		findings[i].Subjects = grants
+	}
+}
+
+// allows returns a matcher for rules that allow any of the requests, whatever their
+// resource names.
+func allows(requests ...policy.ResourceAttributes) func(rbacv1.PolicyRule) bool {
+	return func(rule rbacv1.PolicyRule) bool {
+		rule.ResourceNames = nil
+		for _, attrs := range requests {
+			if policy.RuleAllows(attrs, rule) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// rbacResources returns the requests for verb on roles and cluster roles.
+func rbacResources(verb string) []policy.ResourceAttributes {
+	return []policy.ResourceAttributes{
+		{Verb: verb, APIGroup: rbacv1.GroupName, Resource: "roles"},
+		{Verb: verb, APIGroup: rbacv1.GroupName, Resource: "clusterroles"},
+	}
+}
+
+// webhookResources returns the write requests on admission webhook configurations.
+func webhookResources() []policy.ResourceAttributes {
+	var requests []policy.ResourceAttributes
+	for _, resource := range []string{"mutatingwebhookconfigurations", "validatingwebhookconfigurations"} {
+		for _, verb := range []string{"create", "update", "patch", "delete", "deletecollection"} {
+			requests = append(requests, policy.ResourceAttributes{Verb: verb, APIGroup: "admissionregistration.k8s.io", Resource: resource})
+		}
+	}
+	return requests
+}
+
+// contains reports whether values holds value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
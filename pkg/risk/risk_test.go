@@ -0,0 +1,218 @@
+package risk
+
+import (
+	"reflect"
+	"testing"
+
+	"rbac/pkg/policy"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestScan(t *testing.T) {
+	rule := func(groups, resources, verbs []string, names ...string) rbacv1.PolicyRule {
+		return rbacv1.PolicyRule{APIGroups: groups, Resources: resources, Verbs: verbs, ResourceNames: names}
+	}
+	core := []string{""}
+
+	tests := []struct {
+		name  string
+		rules []rbacv1.PolicyRule
+		want  []string
+	}{
+		{"harmless", []rbacv1.PolicyRule{rule(core, []string{"pods", "configmaps"}, []string{"get", "list"})}, nil},
+		{"escalate and bind", []rbacv1.PolicyRule{rule([]string{rbacv1.GroupName}, []string{"clusterroles"}, []string{"escalate", "bind"})}, []string{"escalate", "bind"}},
+		{"impersonate service accounts", []rbacv1.PolicyRule{rule(core, []string{"serviceaccounts"}, []string{"impersonate"})}, []string{"impersonate"}},
+		{"named secret", []rbacv1.PolicyRule{rule(core, []string{"secrets"}, []string{"get"}, "token")}, []string{"secrets-read"}},
+		{"exec and attach", []rbacv1.PolicyRule{rule(core, []string{"pods/exec", "pods/attach"}, []string{"create"})}, []string{"pods-exec", "pods-attach"}},
+		{"every subresource", []rbacv1.PolicyRule{rule(core, []string{"*/proxy"}, []string{"get"})}, []string{"nodes-proxy"}},
+		{"create pods", []rbacv1.PolicyRule{rule(core, []string{"pods"}, []string{"create"})}, []string{"create-pods"}},
+		{"csr approval", []rbacv1.PolicyRule{rule([]string{"certificates.k8s.io"}, []string{"certificatesigningrequests/approval"}, []string{"update"})}, []string{"csr-approval"}},
+		{"webhooks", []rbacv1.PolicyRule{rule([]string{"admissionregistration.k8s.io"}, []string{"validatingwebhookconfigurations"}, []string{"patch"})}, []string{"webhook-config"}},
+		{"read webhooks", []rbacv1.PolicyRule{rule([]string{"admissionregistration.k8s.io"}, []string{"validatingwebhookconfigurations"}, []string{"get"})}, nil},
+		{"wildcard verbs", []rbacv1.PolicyRule{rule(core, []string{"configmaps"}, []string{"*"})}, []string{"wildcard-verbs"}},
+		{"non-resource wildcard", []rbacv1.PolicyRule{{NonResourceURLs: []string{"*"}, Verbs: []string{"get"}}}, nil},
+		{
+			"cluster admin",
+			[]rbacv1.PolicyRule{rule([]string{"*"}, []string{"*"}, []string{"*"})},
+			[]string{"escalate", "bind", "impersonate", "nodes-proxy", "wildcard-verbs", "wildcard-resources", "secrets-read", "pods-exec", "pods-attach", "csr-approval", "webhook-config", "create-pods"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, finding := range Scan(tt.rules) {
+			got = append(got, finding.Check)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got checks %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	secrets := rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"list"}}
+	exec := rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}
+	objects := policy.ObjectSet{
+		Roles: []*rbacv1.Role{
+			{ObjectMeta: metav1.ObjectMeta{Name: "debugger", Namespace: "team-a"}, Rules: []rbacv1.PolicyRule{exec}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "reader", Namespace: "team-a"}, Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}}},
+		},
+		ClusterRoles: []*rbacv1.ClusterRole{
+			{ObjectMeta: metav1.ObjectMeta{Name: "secret-reader", Labels: map[string]string{"aggregate": "true"}}, Rules: []rbacv1.PolicyRule{secrets}},
+			{
+				ObjectMeta:      metav1.ObjectMeta{Name: "aggregate"},
+				AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: map[string]string{"aggregate": "true"}}}},
+			},
+		},
+		RoleBindings: []*rbacv1.RoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "debug", Namespace: "team-a"},
+				RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "debugger"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "ci"}},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "secrets", Namespace: "team-b"},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "secret-reader"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "alice"}},
+			},
+		},
+		ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{{
+			ObjectMeta: metav1.ObjectMeta{Name: "aggregate"},
+			RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "aggregate"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "auditors"}},
+		}},
+	}
+
+	risks := Analyze(objects)
+
+	want := []RoleRisk{
+		{Kind: "ClusterRole", Name: "aggregate", Severity: SeverityHigh, Findings: []Finding{{
+			Check: "secrets-read", Severity: SeverityHigh, Description: Checks[6].Description, Rule: secrets, Source: "secret-reader",
+			Subjects: []policy.Grant{{BindingKind: policy.ClusterRoleBindingKind, BindingName: "aggregate", RoleKind: "ClusterRole", RoleName: "aggregate", Subject: rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "auditors"}}},
+		}}},
+		{Kind: "ClusterRole", Name: "secret-reader", Severity: SeverityHigh, Findings: []Finding{{
+			Check: "secrets-read", Severity: SeverityHigh, Description: Checks[6].Description, Rule: secrets,
+			Subjects: []policy.Grant{{BindingKind: policy.RoleBindingKind, BindingName: "secrets", BindingNamespace: "team-b", RoleKind: "ClusterRole", RoleName: "secret-reader", Subject: rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"}}},
+		}}},
+		{Kind: "Role", Namespace: "team-a", Name: "debugger", Severity: SeverityHigh, Findings: []Finding{{
+			Check: "pods-exec", Severity: SeverityHigh, Description: Checks[7].Description, Rule: exec,
+			Subjects: []policy.Grant{{BindingKind: policy.RoleBindingKind, BindingName: "debug", BindingNamespace: "team-a", RoleKind: "Role", RoleName: "debugger", Subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "ci", Namespace: "team-a"}}},
+		}}},
+	}
+	if !reflect.DeepEqual(risks, want) {
+		t.Errorf("got risks %+v, want %+v", risks, want)
+	}
+
+	if findings := AnalyzeRole(objects, "Role", "team-a", "reader"); len(findings) != 0 {
+		t.Errorf("got findings for a harmless role: %+v", findings)
+	}
+	if findings := AnalyzeRole(objects, "Role", "team-a", "debugger"); len(findings) != 1 || len(findings[0].Subjects) != 1 {
+		t.Errorf("got findings for debugger: %+v", findings)
+	}
+}
+
+func TestShortestPaths(t *testing.T) {
+	user := func(name string) rbacv1.Subject {
+		return rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: name}
+	}
+	serviceAccount := func(namespace, name string) rbacv1.Subject {
+		return rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: namespace, Name: name}
+	}
+	clusterRole := func(name string, rules ...rbacv1.PolicyRule) *rbacv1.ClusterRole {
+		return &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: name}, Rules: rules}
+	}
+	clusterRoleBinding := func(role string, subjects ...rbacv1.Subject) *rbacv1.ClusterRoleBinding {
+		return &rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: role}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: role}, Subjects: subjects}
+	}
+
+	objects := policy.ObjectSet{
+		Roles: []*rbacv1.Role{{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-creator", Namespace: "kube-system"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"create"}}},
+		}},
+		ClusterRoles: []*rbacv1.ClusterRole{
+			clusterRole("cluster-admin", rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}),
+			clusterRole("impersonate-bob", rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"users"}, Verbs: []string{"impersonate"}, ResourceNames: []string{"bob"}}),
+			clusterRole("binder",
+				rbacv1.PolicyRule{APIGroups: []string{rbacv1.GroupName}, Resources: []string{"clusterroles"}, Verbs: []string{"bind"}},
+				rbacv1.PolicyRule{APIGroups: []string{rbacv1.GroupName}, Resources: []string{"clusterrolebindings"}, Verbs: []string{"create"}},
+			),
+			clusterRole("secret-reader", rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}}),
+		},
+		RoleBindings: []*rbacv1.RoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod-creators", Namespace: "kube-system"},
+				RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "pod-creator"},
+				Subjects:   []rbacv1.Subject{user("alice"), user("bob")},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "secret-readers", Namespace: "team-a"},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "secret-reader"},
+				Subjects:   []rbacv1.Subject{user("dave")},
+			},
+		},
+		ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{
+			clusterRoleBinding("cluster-admin", serviceAccount("kube-system", "admin"), serviceAccount("kube-system", "admin-2")),
+			clusterRoleBinding("impersonate-bob", user("carol")),
+			clusterRoleBinding("binder", serviceAccount("team-a", "legacy")),
+		},
+	}
+	serviceAccounts := []*corev1.ServiceAccount{
+		{ObjectMeta: metav1.ObjectMeta{Name: "admin", Namespace: "kube-system"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "admin-2", Namespace: "kube-system"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "kube-system"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "team-a"}, Secrets: []corev1.ObjectReference{{Name: "legacy-token"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "team-a"}},
+	}
+	graph := NewGraph(objects, serviceAccounts)
+
+	// describe writes a path as its subjects and techniques.
+	describe := func(path Path) []string {
+		var steps []string
+		for _, step := range path.Steps {
+			to := "*"
+			if step.To != nil {
+				to = policy.SubjectKey(*step.To)
+			}
+			steps = append(steps, policy.SubjectKey(step.From)+" -"+step.Technique+"-> "+to)
+		}
+		return steps
+	}
+
+	tests := []struct {
+		subject rbacv1.Subject
+		limit   int
+		want    [][]string
+	}{
+		{serviceAccount("kube-system", "admin"), 10, [][]string{{"ServiceAccount:kube-system:admin -cluster-admin-> *"}}},
+		{user("alice"), 10, [][]string{
+			{"User:alice -create-pods-> ServiceAccount:kube-system:admin", "ServiceAccount:kube-system:admin -cluster-admin-> *"},
+			{"User:alice -create-pods-> ServiceAccount:kube-system:admin-2", "ServiceAccount:kube-system:admin-2 -cluster-admin-> *"},
+		}},
+		{user("alice"), 1, [][]string{
+			{"User:alice -create-pods-> ServiceAccount:kube-system:admin", "ServiceAccount:kube-system:admin -cluster-admin-> *"},
+		}},
+		{user("carol"), 1, [][]string{
+			{"User:carol -impersonate-> User:bob", "User:bob -create-pods-> ServiceAccount:kube-system:admin", "ServiceAccount:kube-system:admin -cluster-admin-> *"},
+		}},
+		{user("dave"), 10, [][]string{
+			{"User:dave -read-secrets-> ServiceAccount:team-a:legacy", "ServiceAccount:team-a:legacy -bind-> *"},
+		}},
+		{user("eve"), 10, nil},
+	}
+	for _, tt := range tests {
+		var got [][]string
+		for _, path := range graph.ShortestPaths(tt.subject, tt.limit) {
+			got = append(got, describe(path))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s, limit %d: got paths %v, want %v", policy.SubjectKey(tt.subject), tt.limit, got, tt.want)
+		}
+	}
+
+	if !graph.IsClusterAdmin(serviceAccount("kube-system", "admin")) || graph.IsClusterAdmin(user("alice")) {
+		t.Error("IsClusterAdmin: got wrong result")
+	}
+}
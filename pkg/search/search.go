@@ -0,0 +1,314 @@
+// Package search finds RBAC objects and service accounts in the RBAC cache by structured filters.
+package search
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"rbac/pkg/cache"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Kinds that can be searched.
+const (
+	KindRole               = "Role"
+	KindClusterRole        = "ClusterRole"
+	KindRoleBinding        = "RoleBinding"
+	KindClusterRoleBinding = "ClusterRoleBinding"
+	KindServiceAccount     = "ServiceAccount"
+)
+
+// Kinds lists every searchable kind.
+var Kinds = []string{KindRole, KindClusterRole, KindRoleBinding, KindClusterRoleBinding, KindServiceAccount}
+
+// Sort fields.
+const (
+	SortKind      = "kind"
+	SortNamespace = "namespace"
+	SortName      = "name"
+	SortCreated   = "created"
+)
+
+// bootstrappingLabel marks the default roles and bindings created by the API server.
+const bootstrappingLabel = "kubernetes.io/bootstrapping"
+
+// Query holds the search filters. Zero values do not filter. Rule filters (Verb, Resource)
+// only match roles and cluster roles, and subject filters only match bindings.
+type Query struct {
+	// Text matches objects whose name contains it, ignoring case.
+	Text string
+	// Kinds restricts the search to these kinds.
+	Kinds []string
+	// Namespace restricts the search to namespaced objects in this namespace.
+	Namespace string
+	// Subject matches bindings with a subject whose name matches it.
+	Subject *regexp.Regexp
+	// SubjectKind matches bindings with a subject of this kind.
+	SubjectKind string
+	// Verb matches roles with a rule granting this verb.
+	Verb string
+	// Resource matches roles with a rule covering this resource.
+	Resource string
+	// Labels matches objects whose labels it selects.
+	Labels labels.Selector
+	// CreatedAfter and CreatedBefore bound the creation time.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// ExcludeSystem drops system: objects, the API server's default roles and bindings, and
+	// service accounts in kube- namespaces.
+	ExcludeSystem bool
+	// Sort is the field to sort by, and Descending reverses the order.
+	Sort       string
+	Descending bool
+}
+
+// Result is an object that matched a query. Matches points at the rules or subjects that
+// satisfied the rule and subject filters.
+type Result struct {
+	Kind              string            `json:"kind"`
+	Namespace         string            `json:"namespace,omitempty"`
+	Name              string            `json:"name"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	CreationTimestamp metav1.Time       `json:"creationTimestamp"`
+	Matches           []Match           `json:"matches,omitempty"`
+}
+
+// Match is a rule or subject of a result that satisfied the query.
+type Match struct {
+	Path    string             `json:"path"`
+	Rule    *rbacv1.PolicyRule `json:"rule,omitempty"`
+	Subject *rbacv1.Subject    `json:"subject,omitempty"`
+	RoleRef *rbacv1.RoleRef    `json:"roleRef,omitempty"`
+}
+
+// Search runs the query against the cache and returns the sorted results.
+func Search(rbacCache *cache.RBACCache, query Query) ([]Result, error) {
+	kinds := make(map[string]bool, len(Kinds))
+	for _, kind := range query.Kinds {
+		kinds[kind] = true
+	}
+	wants := func(kind string) bool { return len(kinds) == 0 || kinds[kind] }
+
+	hasRuleFilter := query.Verb != "" || query.Resource != ""
+	hasSubjectFilter := query.Subject != nil || query.SubjectKind != ""
+	results := []Result{}
+
+	if wants(KindRole) && !hasSubjectFilter {
+		roles, err := rbacCache.ListRoles(query.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range roles {
+			if result, ok := matchRules(query, KindRole, role.ObjectMeta, role.Rules); ok {
+				results = append(results, result)
+			}
+		}
+	}
+
+	if wants(KindClusterRole) && !hasSubjectFilter && query.Namespace == "" {
+		clusterRoles, err := rbacCache.ListClusterRoles()
+		if err != nil {
+			return nil, err
+		}
+		for _, clusterRole := range clusterRoles {
+			if result, ok := matchRules(query, KindClusterRole, clusterRole.ObjectMeta, clusterRole.Rules); ok {
+				results = append(results, result)
+			}
+		}
+	}
+
+	if wants(KindRoleBinding) && !hasRuleFilter {
+		roleBindings, err := rbacCache.ListRoleBindings(query.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, roleBinding := range roleBindings {
+			if result, ok := matchSubjects(query, KindRoleBinding, roleBinding.ObjectMeta, roleBinding.RoleRef, roleBinding.Subjects); ok {
+				results = append(results, result)
+			}
+		}
+	}
+
+	if wants(KindClusterRoleBinding) && !hasRuleFilter && query.Namespace == "" {
+		clusterRoleBindings, err := rbacCache.ListClusterRoleBindings()
+		if err != nil {
+			return nil, err
+		}
+		for _, clusterRoleBinding := range clusterRoleBindings {
+			if result, ok := matchSubjects(query, KindClusterRoleBinding, clusterRoleBinding.ObjectMeta, clusterRoleBinding.RoleRef, clusterRoleBinding.Subjects); ok {
+				results = append(results, result)
+			}
+		}
+	}
+
+	if wants(KindServiceAccount) && !hasRuleFilter && !hasSubjectFilter {
+		serviceAccounts, err := rbacCache.ListServiceAccounts(query.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, serviceAccount := range serviceAccounts {
+			if query.ExcludeSystem && IsSystemServiceAccount(serviceAccount) {
+				continue
+			}
+			if matchMeta(query, serviceAccount.ObjectMeta) {
+				results = append(results, newResult(KindServiceAccount, serviceAccount.ObjectMeta))
+			}
+		}
+	}
+
+	sortResults(results, query.Sort, query.Descending)
+	return results, nil
+}
+
+// matchRules matches a role or cluster role, recording the rules that satisfy the rule filters.
+func matchRules(query Query, kind string, meta metav1.ObjectMeta, rules []rbacv1.PolicyRule) (Result, bool) {
+	if !matchMeta(query, meta) {
+		return Result{}, false
+	}
+	result := newResult(kind, meta)
+	if query.Verb == "" && query.Resource == "" {
+		return result, true
+	}
+
+	for i := range rules {
+		rule := rules[i]
+		if query.Verb != "" && !containsOrWildcard(rule.Verbs, query.Verb) {
+			continue
+		}
+		if query.Resource != "" && !coversResource(rule.Resources, query.Resource) {
+			continue
+		}
+		result.Matches = append(result.Matches, Match{Path: "rules[" + strconv.Itoa(i) + "]", Rule: &rule})
+	}
+	return result, len(result.Matches) > 0
+}
+
+// matchSubjects matches a binding, recording the subjects that satisfy the subject filters.
+func matchSubjects(query Query, kind string, meta metav1.ObjectMeta, roleRef rbacv1.RoleRef, subjects []rbacv1.Subject) (Result, bool) {
+	if !matchMeta(query, meta) {
+		return Result{}, false
+	}
+	result := newResult(kind, meta)
+	if query.Subject == nil && query.SubjectKind == "" {
+		result.Matches = []Match{{Path: "roleRef", RoleRef: &roleRef}}
+		return result, true
+	}
+
+	for i := range subjects {
+		subject := subjects[i]
+		if query.SubjectKind != "" && subject.Kind != query.SubjectKind {
+			continue
+		}
+		if query.Subject != nil && !query.Subject.MatchString(subject.Name) {
+			continue
+		}
+		result.Matches = append(result.Matches, Match{Path: "subjects[" + strconv.Itoa(i) + "]", Subject: &subject})
+	}
+	return result, len(result.Matches) > 0
+}
+
+// matchMeta applies the filters that every kind shares.
+func matchMeta(query Query, meta metav1.ObjectMeta) bool {
+	if query.Text != "" && !strings.Contains(strings.ToLower(meta.Name), strings.ToLower(query.Text)) {
+		return false
+	}
+	if query.Labels != nil && !query.Labels.Matches(labels.Set(meta.Labels)) {
+		return false
+	}
+	if !query.CreatedAfter.IsZero() && !meta.CreationTimestamp.Time.After(query.CreatedAfter) {
+		return false
+	}
+	if !query.CreatedBefore.IsZero() && !meta.CreationTimestamp.Time.Before(query.CreatedBefore) {
+		return false
+	}
+	if query.ExcludeSystem && IsSystem(meta) {
+		return false
+	}
+	return true
+}
+
+// IsSystem reports whether an object is a system object: its name starts with "system:" or it
+// is one of the API server's default roles and bindings.
+func IsSystem(meta metav1.ObjectMeta) bool {
+	return strings.HasPrefix(meta.Name, "system:") || meta.Labels[bootstrappingLabel] == "rbac-defaults"
+}
+
+// IsSystemServiceAccount reports whether a service account belongs to a kube- namespace.
+func IsSystemServiceAccount(serviceAccount *corev1.ServiceAccount) bool {
+	return strings.HasPrefix(serviceAccount.Namespace, "kube-")
+}
+
+// containsOrWildcard reports whether values contains value or "*".
+func containsOrWildcard(values []string, value string) bool {
+	for _, v := range values {
+		if v == value || v == rbacv1.VerbAll {
+			return true
+		}
+	}
+	return false
+}
+
+// coversResource reports whether resources include resource, one of its subresources, or "*".
+func coversResource(resources []string, resource string) bool {
+	for _, r := range resources {
+		if r == resource || r == rbacv1.ResourceAll || strings.HasPrefix(r, resource+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newResult creates a result for an object.
+func newResult(kind string, meta metav1.ObjectMeta) Result {
+	return Result{
+		Kind:              kind,
+		Namespace:         meta.Namespace,
+		Name:              meta.Name,
+		Labels:            meta.Labels,
+		CreationTimestamp: meta.CreationTimestamp,
+	}
+}
+
+// sortResults sorts results by field, then by kind, namespace and name.
+func sortResults(results []Result, field string, descending bool) {
+	kindOrder := make(map[string]int, len(Kinds))
+	for i, kind := range Kinds {
+		kindOrder[kind] = i
+	}
+	compareDefault := func(a, b Result) int {
+		if a.Kind != b.Kind {
+			return kindOrder[a.Kind] - kindOrder[b.Kind]
+		}
+		if a.Namespace != b.Namespace {
+			return strings.Compare(a.Namespace, b.Namespace)
+		}
+		return strings.Compare(a.Name, b.Name)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		cmp := 0
+		switch field {
+		case SortName:
+			cmp = strings.Compare(a.Name, b.Name)
+		case SortNamespace:
+			cmp = strings.Compare(a.Namespace, b.Namespace)
+		case SortCreated:
+			cmp = a.CreationTimestamp.Time.Compare(b.CreationTimestamp.Time)
+		}
+		if cmp == 0 {
+			cmp = compareDefault(a, b)
+		}
+		if descending {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"rbac/pkg/audit"
+	"rbac/pkg/history"
+	"rbac/pkg/kubernetes"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgo "k8s.io/client-go/kubernetes"
+)
+
+// maxAuditBody bounds the request and response bodies kept for an audit record.
+const maxAuditBody = 1 << 20
+
+// actorHeaders are the headers that authenticating proxies use to pass the user, in order of preference.
+var actorHeaders = []string{"X-Forwarded-User", "X-Remote-User", "X-Auth-Request-User", "X-Forwarded-Email"}
+
+// auditActions maps the mutating HTTP methods to audit actions.
+var auditActions = map[string]string{
+	http.MethodPost:   audit.ActionCreate,
+	http.MethodPut:    audit.ActionUpdate,
+	http.MethodPatch:  audit.ActionPatch,
+	http.MethodDelete: audit.ActionDelete,
+}
+
+// auditedKind describes how to fetch the objects of an audited kind.
+type auditedKind struct {
+	namespaced bool
+	get        func(clientset clientgo.Interface, namespace, name string) (interface{}, error)
+}
+
+// auditedKinds lists the kinds whose mutations are audited.
+var auditedKinds = map[string]auditedKind{
+	"Namespace": {get: func(clientset clientgo.Interface, _, name string) (interface{}, error) {
+		return clientset.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+	}},
+	"Role": {namespaced: true, get: func(clientset clientgo.Interface, namespace, name string) (interface{}, error) {
+		return clientset.RbacV1().Roles(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}},
+	"RoleBinding": {namespaced: true, get: func(clientset clientgo.Interface, namespace, name string) (interface{}, error) {
+		return clientset.RbacV1().RoleBindings(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}},
+	"ClusterRole": {get: func(clientset clientgo.Interface, _, name string) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoles().Get(context.TODO(), name, metav1.GetOptions{})
+	}},
+	"ClusterRoleBinding": {get: func(clientset clientgo.Interface, _, name string) (interface{}, error) {
+		return clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), name, metav1.GetOptions{})
+	}},
+	"ServiceAccount": {namespaced: true, get: func(clientset clientgo.Interface, namespace, name string) (interface{}, error) {
+		return clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}},
+}
+
+// auditedRoute describes the objects that one route changes. A route without a kind names
+// the kind, namespace and name of its object in the kind, namespace and name fields of the
+// request body. A route with an action records it instead of the one of the HTTP method. A
+// route that changes several objects records each of them as its handler reports the change.
+type auditedRoute struct {
+	kind      string
+	action    string
+	perObject bool
+}
+
+// auditedRoutes lists the routes whose mutations are audited.
+var auditedRoutes = map[string]auditedRoute{
+	"/api/namespaces":             {kind: "Namespace"},
+	"/api/roles":                  {kind: "Role"},
+	"/api/rolebindings":           {kind: "RoleBinding"},
+	"/api/clusterroles":           {kind: "ClusterRole"},
+	"/api/clusterrolebindings":    {kind: "ClusterRoleBinding"},
+	"/api/serviceaccounts":        {kind: "ServiceAccount"},
+	"/api/history/rollback":       {action: audit.ActionRollback},
+	"/api/import":                 {perObject: true},
+	"/api/hygiene/cleanup":        {perObject: true},
+	"/api/usage/proposal/apply":   {perObject: true},
+	"/api/templates/:name/render": {perObject: true},
+}
+
+// auditMiddleware records every mutation made through the audited routes: who made it, from
+// where, the object before and after, and whether it succeeded. Successful changes to RBAC
+// objects are also recorded in the revision history, if there is one.
+func auditMiddleware(registry *kubernetes.Registry, logger *audit.Logger, revisions *history.History) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			route, audited := auditedRoutes[c.Path()]
+			action := auditActions[c.Request().Method]
+			if logger == nil || !audited || action == "" {
+				return next(c)
+			}
+			if route.action != "" {
+				action = route.action
+			}
+
+			record := audit.Record{
+				Actor:     requestActor(c),
+				SourceIP:  c.RealIP(),
+				RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+				Cluster:   c.QueryParam("cluster"),
+				Action:    action,
+				Kind:      route.kind,
+				Namespace: c.QueryParam("namespace"),
+				Name:      c.QueryParam("name"),
+			}
+			record.DryRun, _ = strconv.ParseBool(c.QueryParam("dryRun"))
+			if record.Cluster == "" {
+				record.Cluster = registry.DefaultName()
+			}
+			if route.perObject {
+				utils.SetChangeRecorder(c, func(change utils.Change) {
+					writeRecord(c, logger, revisions, changeRecord(record, change))
+				})
+				return next(c)
+			}
+
+			if action != audit.ActionPatch && action != audit.ActionDelete {
+				body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxAuditBody))
+				if err != nil {
+					return echo.NewHTTPError(http.StatusBadRequest, "Failed to read request body: "+err.Error())
+				}
+				c.Request().Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request().Body))
+				if route.kind == "" {
+					var ref struct {
+						Kind      string `json:"kind"`
+						Namespace string `json:"namespace"`
+						Name      string `json:"name"`
+					}
+					_ = json.Unmarshal(body, &ref)
+					record.Kind, record.Namespace, record.Name = ref.Kind, ref.Namespace, ref.Name
+				} else if name := objectName(body); name != "" {
+					record.Name = name
+				}
+			}
+
+			kind, known := auditedKinds[record.Kind]
+			if kind.namespaced && record.Namespace == "" {
+				record.Namespace = "default"
+			} else if !kind.namespaced {
+				record.Namespace = ""
+			}
+
+			if known && action != audit.ActionCreate && record.Name != "" {
+				if cluster, err := registry.Get(c.QueryParam("cluster")); err == nil && cluster.Err() == nil {
+					if before, err := kind.get(cluster.Clientset, record.Namespace, record.Name); err == nil {
+						record.Before, _ = json.Marshal(before)
+					}
+				}
+			}
+
+			capture := &captureWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = capture
+			err := next(c)
+			c.Response().Writer = capture.ResponseWriter
+
+			record.Code = c.Response().Status
+			if err != nil {
+				record.Code = http.StatusInternalServerError
+				record.Error = err.Error()
+				var httpError *echo.HTTPError
+				if errors.As(err, &httpError) {
+					record.Code = httpError.Code
+				}
+			}
+			record.Outcome = audit.OutcomeSuccess
+			if err != nil || record.Code >= http.StatusBadRequest {
+				record.Outcome = audit.OutcomeFailure
+			}
+			if record.Outcome == audit.OutcomeSuccess && action != audit.ActionDelete {
+				record.After = responseObject(capture.body.Bytes(), record.DryRun)
+				if name := objectName(record.After); name != "" {
+					record.Name = name
+				}
+			}
+
+			writeRecord(c, logger, revisions, record)
+			return err
+		}
+	}
+}
+
+// writeRecord writes an audit record and, if there is a revision history, records the revision
+// it leaves behind. Failures are logged, not returned, so that they do not fail the request.
+func writeRecord(c echo.Context, logger *audit.Logger, revisions *history.History, record audit.Record) {
+	if err := logger.Log(record); err != nil {
+		c.Logger().Error("Failed to write audit record: " + err.Error())
+	}
+	if revisions != nil {
+		if err := recordRevision(revisions, record); err != nil {
+			c.Logger().Error("Failed to record revision: " + err.Error())
+		}
+	}
+}
+
+// changeRecord builds the record of one object changed by a request, from the record of the
+// request.
+func changeRecord(request audit.Record, change utils.Change) audit.Record {
+	record := request
+	record.Action = change.Action
+	record.Kind, record.Namespace, record.Name = change.Kind, change.Namespace, change.Name
+	record.Before, record.After = marshalObject(change.Before), marshalObject(change.After)
+	record.Outcome, record.Code = audit.OutcomeSuccess, http.StatusOK
+	if change.Err != nil {
+		record.Outcome, record.Code, record.Error = audit.OutcomeFailure, http.StatusInternalServerError, change.Err.Error()
+		var apiStatus apierrors.APIStatus
+		if errors.As(change.Err, &apiStatus) && apiStatus.Status().Code != 0 {
+			record.Code = int(apiStatus.Status().Code)
+		}
+	}
+	return record
+}
+
+// marshalObject returns the JSON of an object, or nil for no object.
+func marshalObject(object interface{}) json.RawMessage {
+	if object == nil {
+		return nil
+	}
+	data, err := json.Marshal(object)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+// recordRevision records the object that a successful, applied mutation of an RBAC object
+// left behind: the new object, or the last state of a deleted one.
+func recordRevision(revisions *history.History, record audit.Record) error {
+	if record.Outcome != audit.OutcomeSuccess || record.DryRun || !history.IsKind(record.Kind) {
+		return nil
+	}
+
+	object, deleted := record.After, false
+	if record.Action == audit.ActionDelete {
+		object, deleted = record.Before, true
+	}
+	if len(object) == 0 {
+		return nil
+	}
+
+	revision, err := history.NewRevision(record.Cluster, record.Kind, object)
+	if err != nil {
+		return err
+	}
+	revision.Source = history.SourceKuberus
+	revision.Actor = record.Actor
+	revision.Deleted = deleted
+	_, err = revisions.Record(revision)
+	return err
+}
+
+// requestActor returns the user named by an authenticating proxy or basic auth, or "anonymous".
+func requestActor(c echo.Context) string {
+	for _, header := range actorHeaders {
+		if actor := c.Request().Header.Get(header); actor != "" {
+			return actor
+		}
+	}
+	if user, _, ok := c.Request().BasicAuth(); ok && user != "" {
+		return user
+	}
+	return "anonymous"
+}
+
+// objectName returns metadata.name of a JSON object, or "" if there is none.
+func objectName(data []byte) string {
+	var object struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if json.Unmarshal(data, &object) != nil {
+		return ""
+	}
+	return object.Metadata.Name
+}
+
+// responseObject returns the object in a successful mutation response. Dry-run responses
+// wrap it in their object field.
+func responseObject(body []byte, dryRun bool) json.RawMessage {
+	if len(body) == 0 || !json.Valid(body) {
+		return nil
+	}
+	if dryRun {
+		var response struct {
+			Object json.RawMessage `json:"object"`
+		}
+		if json.Unmarshal(body, &response) != nil {
+			return nil
+		}
+		return response.Object
+	}
+	return json.RawMessage(body)
+}
+
+// captureWriter keeps a copy of the start of the response body.
+type captureWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+// Write writes to the response and keeps a copy, up to maxAuditBody bytes.
+func (w *captureWriter) Write(data []byte) (int, error) {
+	if remaining := maxAuditBody - w.body.Len(); remaining > 0 {
+		w.body.Write(data[:min(len(data), remaining)])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush flushes the underlying response.
+func (w *captureWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hijacks the underlying connection.
+func (w *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the underlying response writer.
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -3,16 +3,37 @@ package server
 import (
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"rbac/pkg/cache"
 	"rbac/pkg/handlers/rbac"
+	"rbac/pkg/kubernetes"
+	"rbac/pkg/utils"
 
 	"github.com/labstack/echo/v4"
-	"k8s.io/client-go/kubernetes"
+	"github.com/labstack/echo/v4/middleware"
+	clientgo "k8s.io/client-go/kubernetes"
 )
 
 // Config holds the configuration for the server.
 type Config struct {
-	Port string
+	Port           string
+	CacheResync    time.Duration
+	WatchHeartbeat time.Duration
+	StorePath      string
+	AuditSinks     []string
+	AuditFile      string
+	// HistoryMaxRevisions bounds the revisions kept per object; zero keeps every revision.
+	HistoryMaxRevisions int
+	// UsageLogDir is the directory that audit logs may be ingested from by path; empty
+	// disables ingestion by path.
+	UsageLogDir string
+	// TemplatesDir is the directory of the YAML files of custom role templates, and
+	// TemplatesConfigMap the namespace/name of a ConfigMap holding more; empty skips either.
+	TemplatesDir       string
+	TemplatesConfigMap string
 }
 
 // NewConfig creates a new configuration with environment variables.
@@ -22,70 +43,320 @@ func NewConfig() *Config {
 		port = "8080"
 	}
 
-	return &Config{Port: port}
+	cacheResync := 10 * time.Minute
+	if value := os.Getenv("CACHE_RESYNC_PERIOD"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			cacheResync = d
+		}
+	}
+
+	watchHeartbeat := 15 * time.Second
+	if value := os.Getenv("WATCH_HEARTBEAT_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			watchHeartbeat = d
+		}
+	}
+
+	storePath := os.Getenv("STORE_PATH")
+	if storePath == "" {
+		storePath = "data/kuberus.db"
+	}
+
+	auditSinks := []string{AuditSinkStore}
+	if value := os.Getenv("AUDIT_SINKS"); value != "" {
+		auditSinks = nil
+		for _, sink := range strings.Split(value, ",") {
+			if sink = strings.TrimSpace(sink); sink != "" {
+				auditSinks = append(auditSinks, sink)
+			}
+		}
+	}
+
+	auditFile := os.Getenv("AUDIT_FILE")
+	if auditFile == "" {
+		auditFile = "data/audit.jsonl"
+	}
+
+	historyMaxRevisions := 100
+	if value := os.Getenv("HISTORY_MAX_REVISIONS"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			historyMaxRevisions = n
+		}
+	}
+
+	return &Config{
+		Port:           port,
+		CacheResync:    cacheResync,
+		WatchHeartbeat: watchHeartbeat,
+		StorePath:      storePath,
+		AuditSinks:     auditSinks,
+		AuditFile:      auditFile,
+
+		HistoryMaxRevisions: historyMaxRevisions,
+		UsageLogDir:         os.Getenv("USAGE_LOG_DIR"),
+		TemplatesDir:        os.Getenv("TEMPLATES_DIR"),
+		TemplatesConfigMap:  os.Getenv("TEMPLATES_CONFIGMAP"),
+	}
 }
 
-// RegisterRoutes registers all the routes for the server.
-func RegisterRoutes(e *echo.Echo, clientset *kubernetes.Clientset, config *Config) {
-	api := e.Group("/api")
+// RegisterMiddleware installs the middleware and error handling shared by every route.
+func RegisterMiddleware(e *echo.Echo) {
+	e.Use(middleware.RequestID())
+	e.HTTPErrorHandler = utils.HTTPErrorHandler
+}
+
+// RegisterRoutes registers all the routes for the server. Mutations of cluster objects are
+// recorded in the audit log and revision history of services.
+func RegisterRoutes(e *echo.Echo, registry *kubernetes.Registry, services *Services, config *Config) {
+	api := e.Group("/api", auditMiddleware(registry, services.Audit, services.History))
+	client := func(newHandler func(clientgo.Interface) echo.HandlerFunc) echo.HandlerFunc {
+		return clientHandler(registry, newHandler)
+	}
+	cached := func(newHandler func(*cache.RBACCache) echo.HandlerFunc) echo.HandlerFunc {
+		return cacheHandler(registry, newHandler)
+	}
+	clustered := func(newHandler func(*kubernetes.Cluster) echo.HandlerFunc) echo.HandlerFunc {
+		return clusterHandler(registry, newHandler)
+	}
+
+	// Cluster routes
+	api.GET("/clusters", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, registry.Infos())
+	})
 
 	// Namespace routes
-	api.GET("/namespaces", rbac.NamespacesHandler(clientset))
-	api.POST("/namespaces", rbac.NamespacesHandler(clientset))
-	api.DELETE("/namespaces", rbac.NamespacesHandler(clientset))
+	api.GET("/namespaces", client(rbac.NamespacesHandler))
+	api.POST("/namespaces", client(rbac.NamespacesHandler))
+	api.PATCH("/namespaces", client(rbac.NamespacesHandler))
+	api.DELETE("/namespaces", client(rbac.NamespacesHandler))
 
 	// Role routes
-	api.GET("/roles", rbac.RolesHandler(clientset))
-	api.POST("/roles", rbac.RolesHandler(clientset))
-	api.PUT("/roles", rbac.RolesHandler(clientset))
-	api.DELETE("/roles", rbac.RolesHandler(clientset))
-	api.GET("/roles/details", rbac.RoleDetailsHandler(clientset))
+	roles := clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.RolesHandler(cluster.Clientset, cluster.Cache)
+	})
+	api.GET("/roles", roles)
+	api.POST("/roles", roles)
+	api.PUT("/roles", roles)
+	api.PATCH("/roles", roles)
+	api.DELETE("/roles", roles)
+	api.GET("/roles/details", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.RoleDetailsHandler(cluster.Clientset, services.Usage, cluster.Name)
+	}))
+	api.GET("/roles/usage", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.RoleUsageHandler(services.Usage, cluster.Name, cluster.Cache)
+	}))
 
 	// Role binding routes
-	api.GET("/rolebindings", rbac.RoleBindingsHandler(clientset))
-	api.POST("/rolebindings", rbac.RoleBindingsHandler(clientset))
-	api.PUT("/rolebindings", rbac.RoleBindingsHandler(clientset))
-	api.DELETE("/rolebindings", rbac.RoleBindingsHandler(clientset))
-	api.GET("/rolebinding/details", rbac.RoleBindingDetailsHandler(clientset))
+	api.GET("/rolebindings", client(rbac.RoleBindingsHandler))
+	api.POST("/rolebindings", client(rbac.RoleBindingsHandler))
+	api.PUT("/rolebindings", client(rbac.RoleBindingsHandler))
+	api.PATCH("/rolebindings", client(rbac.RoleBindingsHandler))
+	api.DELETE("/rolebindings", client(rbac.RoleBindingsHandler))
+	api.GET("/rolebinding/details", client(rbac.RoleBindingDetailsHandler))
 
 	// Cluster role routes
-	api.GET("/clusterroles", rbac.ClusterRolesHandler(clientset))
-	api.POST("/clusterroles", rbac.ClusterRolesHandler(clientset))
-	api.PUT("/clusterroles", rbac.ClusterRolesHandler(clientset))
-	api.DELETE("/clusterroles", rbac.ClusterRolesHandler(clientset))
-	api.GET("/clusterroles/details", rbac.ClusterRoleDetailsHandler(clientset))
+	clusterRoles := clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.ClusterRolesHandler(cluster.Clientset, cluster.Cache)
+	})
+	api.GET("/clusterroles", clusterRoles)
+	api.POST("/clusterroles", clusterRoles)
+	api.PUT("/clusterroles", clusterRoles)
+	api.PATCH("/clusterroles", clusterRoles)
+	api.DELETE("/clusterroles", clusterRoles)
+	api.GET("/clusterroles/details", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.ClusterRoleDetailsHandler(cluster.Clientset, services.Usage, cluster.Name)
+	}))
+	api.POST("/clusterroles/aggregation-preview", cached(rbac.ClusterRoleAggregationPreviewHandler))
 
 	// Cluster role binding routes
-	api.GET("/clusterrolebindings", rbac.ClusterRoleBindingsHandler(clientset))
-	api.POST("/clusterrolebindings", rbac.ClusterRoleBindingsHandler(clientset))
-	api.PUT("/clusterrolebindings", rbac.ClusterRoleBindingsHandler(clientset))
-	api.DELETE("/clusterrolebindings", rbac.ClusterRoleBindingsHandler(clientset))
-	api.GET("/clusterrolebinding/details", rbac.ClusterRoleBindingDetailsHandler(clientset))
+	api.GET("/clusterrolebindings", client(rbac.ClusterRoleBindingsHandler))
+	api.POST("/clusterrolebindings", client(rbac.ClusterRoleBindingsHandler))
+	api.PUT("/clusterrolebindings", client(rbac.ClusterRoleBindingsHandler))
+	api.PATCH("/clusterrolebindings", client(rbac.ClusterRoleBindingsHandler))
+	api.DELETE("/clusterrolebindings", client(rbac.ClusterRoleBindingsHandler))
+	api.GET("/clusterrolebinding/details", client(rbac.ClusterRoleBindingDetailsHandler))
 
 	// Service account routes
-	api.GET("/serviceaccounts", rbac.ServiceAccountsHandler(clientset))
-	api.POST("/serviceaccounts", rbac.ServiceAccountsHandler(clientset))
-	api.DELETE("/serviceaccounts", rbac.ServiceAccountsHandler(clientset))
-	api.GET("/serviceaccount-details", rbac.ServiceAccountDetailsHandler(clientset))
+	api.GET("/serviceaccounts", client(rbac.ServiceAccountsHandler))
+	api.POST("/serviceaccounts", client(rbac.ServiceAccountsHandler))
+	api.PATCH("/serviceaccounts", client(rbac.ServiceAccountsHandler))
+	api.DELETE("/serviceaccounts", client(rbac.ServiceAccountsHandler))
+	api.GET("/serviceaccount-details", cached(rbac.ServiceAccountDetailsHandler))
 
 	// Resource routes
-	api.GET("/resources", rbac.APIResourcesHandler(clientset))
+	api.GET("/resources", client(rbac.APIResourcesHandler))
 
 	// User routes
-	api.GET("/users", rbac.UsersHandler(clientset))
-	api.GET("/userroles", rbac.UserRolesHandler(clientset))
+	api.GET("/users", cached(rbac.UsersHandler))
+	api.GET("/userroles", cached(rbac.UserRolesHandler))
 
 	// Group routes
-	api.GET("/groups", rbac.GroupsHandler(clientset))
-	api.GET("/groupdetails", rbac.GroupDetailsHandler(clientset))
+	api.GET("/groups", cached(rbac.GroupsHandler))
+	api.GET("/groupdetails", cached(rbac.GroupDetailsHandler))
+
+	// Subject routes
+	api.GET("/subjects/effective-permissions", cached(rbac.EffectivePermissionsHandler))
+	api.GET("/whocan", cached(rbac.WhoCanHandler))
+
+	// Risk routes
+	api.GET("/risks", cached(rbac.RisksHandler))
+	api.GET("/escalation-paths", cached(rbac.EscalationPathsHandler))
+
+	// Watch routes
+	api.GET("/watch", client(func(clientset clientgo.Interface) echo.HandlerFunc {
+		return rbac.WatchHandler(clientset, config.WatchHeartbeat)
+	}))
+
+	// Search routes
+	api.GET("/search", cached(rbac.SearchHandler))
+
+	// Import and export routes
+	api.POST("/import", client(rbac.ImportHandler))
+	api.GET("/export", cached(rbac.ExportHandler))
+
+	// Access review routes
+	api.POST("/access-review", client(rbac.AccessReviewHandler))
+
+	// Audit routes
+	api.GET("/audit", rbac.AuditHandler(services.Audit))
+
+	// History routes
+	api.GET("/history", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.HistoryHandler(services.History, cluster.Name)
+	}))
+	api.POST("/history/rollback", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.RollbackHandler(services.History, cluster.Name, cluster.Clientset)
+	}))
+
+	// Snapshot routes
+	api.GET("/snapshots", rbac.SnapshotsHandler(services.Snapshots))
+	api.POST("/snapshots", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.CreateSnapshotHandler(services.Snapshots, cluster.Name, cluster.Cache)
+	}))
+	api.GET("/snapshots/:id", rbac.SnapshotHandler(services.Snapshots))
+	api.DELETE("/snapshots/:id", rbac.DeleteSnapshotHandler(services.Snapshots))
+	api.GET("/snapshots/:id/drift", rbac.SnapshotDriftHandler(services.Snapshots, func(name string) (string, *cache.RBACCache, error) {
+		cluster, err := lookupCluster(registry, name)
+		if err != nil {
+			return "", nil, err
+		}
+		return cluster.Name, cluster.Cache, nil
+	}))
+
+	// Hygiene routes
+	api.GET("/hygiene", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.HygieneHandler(cluster.Clientset, cluster.Cache)
+	}))
+	api.POST("/hygiene/cleanup", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.HygieneCleanupHandler(cluster.Clientset, cluster.Cache)
+	}))
+
+	// Usage routes
+	api.POST("/usage/ingest", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.IngestUsageHandler(services.Usage, cluster.Name, config.UsageLogDir)
+	}))
+	api.GET("/usage", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.UsageHandler(services.Usage, cluster.Name)
+	}))
+	api.GET("/usage/proposal", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.UsageProposalHandler(services.Usage, cluster.Name, cluster.Cache)
+	}))
+	api.POST("/usage/proposal/apply", clustered(func(cluster *kubernetes.Cluster) echo.HandlerFunc {
+		return rbac.ApplyUsageProposalHandler(services.Usage, cluster.Name, cluster.Clientset, cluster.Cache)
+	}))
+
+	// Template routes
+	api.GET("/templates", client(func(clientset clientgo.Interface) echo.HandlerFunc {
+		return rbac.TemplatesHandler(clientset, config.TemplatesDir, config.TemplatesConfigMap)
+	}))
+	api.POST("/templates/:name/render", client(func(clientset clientgo.Interface) echo.HandlerFunc {
+		return rbac.RenderTemplateHandler(clientset, config.TemplatesDir, config.TemplatesConfigMap)
+	}))
+
+	// Cache routes
+	api.GET("/cache/status", func(c echo.Context) error {
+		cluster, err := selectCluster(c, registry)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"synced":    cluster.Cache.HasSynced(),
+			"resources": cluster.Cache.Status(),
+		})
+	})
 
 	// Health check endpoint
 	e.GET("/health", func(c echo.Context) error {
 		return c.String(http.StatusOK, "OK")
 	})
 
+	// Readiness endpoint, gated on the initial RBAC cache sync of every reachable cluster
+	e.GET("/ready", func(c echo.Context) error {
+		if !registry.Ready() {
+			return c.String(http.StatusServiceUnavailable, "RBAC cache not synced")
+		}
+		return c.String(http.StatusOK, "OK")
+	})
+
 	// Root URL handler
 	e.GET("/", func(c echo.Context) error {
 		return c.JSON(http.StatusOK, map[string]string{"message": "Welcome to the Kuberus"})
 	})
 }
+
+// selectCluster returns the cluster named by the request's cluster parameter, or the
+// default cluster if the parameter is empty.
+func selectCluster(c echo.Context, registry *kubernetes.Registry) (*kubernetes.Cluster, error) {
+	return lookupCluster(registry, c.QueryParam("cluster"))
+}
+
+// lookupCluster returns the named cluster, or the default cluster for an empty name, with a
+// 404 if it is unknown and a 503 if it is degraded.
+func lookupCluster(registry *kubernetes.Registry, name string) (*kubernetes.Cluster, error) {
+	cluster, err := registry.Get(name)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Unknown cluster: "+name)
+	}
+	if cluster.Err() != nil {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "Cluster "+cluster.Name+" is degraded: "+cluster.Err().Error())
+	}
+	return cluster, nil
+}
+
+// clusterHandler runs a handler that needs the name of the cluster selected for the request,
+// as well as its clientset.
+func clusterHandler(registry *kubernetes.Registry, newHandler func(*kubernetes.Cluster) echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cluster, err := selectCluster(c, registry)
+		if err != nil {
+			return err
+		}
+		return newHandler(cluster)(c)
+	}
+}
+
+// clientHandler runs a clientset-backed handler against the cluster selected for the request.
+func clientHandler(registry *kubernetes.Registry, newHandler func(clientgo.Interface) echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cluster, err := selectCluster(c, registry)
+		if err != nil {
+			return err
+		}
+		return newHandler(cluster.Clientset)(c)
+	}
+}
+
+// cacheHandler runs a cache-backed handler against the cluster selected for the request.
+// Requests are rejected with 503 until that cluster's RBAC cache has completed its initial sync.
+func cacheHandler(registry *kubernetes.Registry, newHandler func(*cache.RBACCache) echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cluster, err := selectCluster(c, registry)
+		if err != nil {
+			return err
+		}
+		if !cluster.Cache.HasSynced() {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "RBAC cache is not synced yet")
+		}
+		return newHandler(cluster.Cache)(c)
+	}
+}
@@ -0,0 +1,2802 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rbac/pkg/audit"
+	"rbac/pkg/handlers/rbac"
+	"rbac/pkg/history"
+	"rbac/pkg/hygiene"
+	"rbac/pkg/kubernetes"
+	"rbac/pkg/policy"
+	"rbac/pkg/risk"
+	"rbac/pkg/snapshot"
+	"rbac/pkg/usage"
+	"rbac/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// seedObjects returns the objects every test server starts with, all at resourceVersion 1.
+func seedObjects() []runtime.Object {
+	objs := []runtime.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "deployer", Namespace: "team-a"}},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-reader", Namespace: "team-a"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}}},
+		},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "unused", Namespace: "team-a"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "read-pods", Namespace: "team-a"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "pod-reader"},
+			Subjects: []rbacv1.Subject{
+				{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "alice"},
+				{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "alice"},
+				{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "developers"},
+				{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-a"},
+			},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "viewer"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"get"}}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "view-all"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "viewer"},
+			Subjects: []rbacv1.Subject{
+				{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "bob"},
+				{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "developers"},
+				{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "auditors"},
+				{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-a"},
+			},
+		},
+	}
+	for _, obj := range objs {
+		obj.(metav1.Object).SetResourceVersion("1")
+	}
+	return objs
+}
+
+// newTestServer registers all routes against a single fake cluster seeded with objs
+// and waits for its RBAC cache to sync.
+func newTestServer(t *testing.T, objs ...runtime.Object) (*echo.Echo, *fake.Clientset) {
+	t.Helper()
+	return newTestServerWithConfig(t, &Config{Port: "0"}, objs...)
+}
+
+// newTestServerWithConfig is newTestServer with a custom server configuration.
+func newTestServerWithConfig(t *testing.T, config *Config, objs ...runtime.Object) (*echo.Echo, *fake.Clientset) {
+	t.Helper()
+
+	clientset := fake.NewClientset(objs...)
+	// The fake object tracker cannot store SubjectAccessReviews; answer them with no opinion.
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, action.(k8stesting.CreateAction).GetObject(), nil
+	})
+	registry := kubernetes.NewRegistry()
+	registry.Add(newTestCluster(t, "test", clientset))
+
+	services := newTestServices(t, config)
+	if err := services.WatchHistory(registry); err != nil {
+		t.Fatalf("watching history: %v", err)
+	}
+
+	e := echo.New()
+	RegisterMiddleware(e)
+	RegisterRoutes(e, registry, services, config)
+	return e, clientset
+}
+
+// newTestServices opens the store and audit sinks of config in a temporary directory.
+func newTestServices(t *testing.T, config *Config) *Services {
+	t.Helper()
+
+	dir := t.TempDir()
+	config.StorePath = filepath.Join(dir, "kuberus.db")
+	config.AuditFile = filepath.Join(dir, "audit.jsonl")
+	if config.AuditSinks == nil {
+		config.AuditSinks = []string{AuditSinkStore}
+	}
+	services, err := NewServices(config)
+	if err != nil {
+		t.Fatalf("opening services: %v", err)
+	}
+	t.Cleanup(func() { services.Close() })
+	return services
+}
+
+// newTestCluster creates a cluster for the fake clientset and waits for its RBAC cache to sync.
+func newTestCluster(t *testing.T, name string, clientset *fake.Clientset) *kubernetes.Cluster {
+	t.Helper()
+
+	cluster, err := kubernetes.NewCluster(name, "", clientset, 0)
+	if err != nil {
+		t.Fatalf("creating cluster: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	cluster.Cache.Start(ctx)
+
+	syncCtx, syncCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer syncCancel()
+	if !cluster.Cache.WaitForSync(syncCtx) {
+		t.Fatal("RBAC cache did not sync")
+	}
+	return cluster
+}
+
+// doRequest sends a request to the server and returns the recorded response.
+func doRequest(e *echo.Echo, method, target, body string) *httptest.ResponseRecorder {
+	return doRequestWithHeaders(e, method, target, body, nil)
+}
+
+// doRequestWithHeaders sends a request with extra headers to the server and returns the
+// recorded response.
+func doRequestWithHeaders(e *echo.Echo, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode unmarshals a JSON response body.
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+	}{
+		{"health", http.MethodGet, "/health", "", http.StatusOK},
+		{"ready", http.MethodGet, "/ready", "", http.StatusOK},
+		{"root", http.MethodGet, "/", "", http.StatusOK},
+
+		{"list namespaces", http.MethodGet, "/api/namespaces", "", http.StatusOK},
+		{"create namespace", http.MethodPost, "/api/namespaces", `{"metadata":{"name":"team-b"}}`, http.StatusOK},
+		{"delete namespace", http.MethodDelete, "/api/namespaces?name=team-a", "", http.StatusOK},
+		{"delete namespace without name", http.MethodDelete, "/api/namespaces", "", http.StatusBadRequest},
+
+		{"list roles", http.MethodGet, "/api/roles?namespace=team-a", "", http.StatusOK},
+		{"list roles in all namespaces", http.MethodGet, "/api/roles?namespace=all", "", http.StatusOK},
+		{"create role", http.MethodPost, "/api/roles?namespace=team-a", `{"metadata":{"name":"new-role"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`, http.StatusOK},
+		{"create invalid role", http.MethodPost, "/api/roles?namespace=team-a", `{"metadata":{"name":"new-role"}}`, http.StatusBadRequest},
+		{"update role", http.MethodPut, "/api/roles?namespace=team-a", `{"metadata":{"name":"pod-reader","namespace":"team-a"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`, http.StatusOK},
+		{"patch role without a patch content type", http.MethodPatch, "/api/roles?namespace=team-a&name=pod-reader", `{"metadata":{"labels":{"team":"a"}}}`, http.StatusUnsupportedMediaType},
+		{"delete role", http.MethodDelete, "/api/roles?namespace=team-a&name=unused", "", http.StatusOK},
+		{"delete role without name", http.MethodDelete, "/api/roles?namespace=team-a", "", http.StatusBadRequest},
+		{"role details", http.MethodGet, "/api/roles/details?namespace=team-a&roleName=pod-reader", "", http.StatusOK},
+
+		{"list role bindings", http.MethodGet, "/api/rolebindings?namespace=team-a", "", http.StatusOK},
+		{"create role binding", http.MethodPost, "/api/rolebindings?namespace=team-a", `{"metadata":{"name":"new-binding"},"roleRef":{"kind":"Role","name":"unused"},"subjects":[{"kind":"User","name":"carol"}]}`, http.StatusOK},
+		{"update role binding", http.MethodPut, "/api/rolebindings?namespace=team-a", `{"metadata":{"name":"read-pods","namespace":"team-a"},"roleRef":{"kind":"Role","name":"pod-reader"},"subjects":[{"kind":"User","name":"carol"}]}`, http.StatusOK},
+		{"delete role binding", http.MethodDelete, "/api/rolebindings?namespace=team-a&name=read-pods", "", http.StatusOK},
+		{"role binding details", http.MethodGet, "/api/rolebinding/details?namespace=team-a&name=read-pods", "", http.StatusOK},
+
+		{"list cluster roles", http.MethodGet, "/api/clusterroles", "", http.StatusOK},
+		{"create cluster role", http.MethodPost, "/api/clusterroles", `{"metadata":{"name":"new-cluster-role"}}`, http.StatusOK},
+		{"update cluster role", http.MethodPut, "/api/clusterroles", `{"metadata":{"name":"viewer"}}`, http.StatusOK},
+		{"delete cluster role", http.MethodDelete, "/api/clusterroles?name=viewer", "", http.StatusOK},
+		{"cluster role details", http.MethodGet, "/api/clusterroles/details?clusterRoleName=viewer", "", http.StatusOK},
+		{"cluster role details without name", http.MethodGet, "/api/clusterroles/details", "", http.StatusBadRequest},
+		{"cluster role aggregation preview", http.MethodPost, "/api/clusterroles/aggregation-preview", `{"metadata":{"labels":{"aggregate":"true"}}}`, http.StatusOK},
+
+		{"list cluster role bindings", http.MethodGet, "/api/clusterrolebindings", "", http.StatusOK},
+		{"create cluster role binding", http.MethodPost, "/api/clusterrolebindings", `{"metadata":{"name":"new-crb"},"roleRef":{"kind":"ClusterRole","name":"viewer"}}`, http.StatusOK},
+		{"update cluster role binding", http.MethodPut, "/api/clusterrolebindings", `{"metadata":{"name":"view-all"},"roleRef":{"kind":"ClusterRole","name":"viewer"}}`, http.StatusOK},
+		{"delete cluster role binding", http.MethodDelete, "/api/clusterrolebindings?name=view-all", "", http.StatusOK},
+		{"cluster role binding details", http.MethodGet, "/api/clusterrolebinding/details?name=view-all", "", http.StatusOK},
+		{"cluster role binding details without name", http.MethodGet, "/api/clusterrolebinding/details", "", http.StatusBadRequest},
+
+		{"list service accounts", http.MethodGet, "/api/serviceaccounts?namespace=team-a", "", http.StatusOK},
+		{"create service account", http.MethodPost, "/api/serviceaccounts?namespace=team-a", `{"metadata":{"name":"builder"}}`, http.StatusOK},
+		{"delete service account", http.MethodDelete, "/api/serviceaccounts?namespace=team-a&name=deployer", "", http.StatusOK},
+		{"service account details", http.MethodGet, "/api/serviceaccount-details?serviceAccountName=deployer", "", http.StatusOK},
+		{"service account details without name", http.MethodGet, "/api/serviceaccount-details", "", http.StatusBadRequest},
+
+		{"api resources", http.MethodGet, "/api/resources", "", http.StatusOK},
+
+		{"users", http.MethodGet, "/api/users", "", http.StatusOK},
+		{"user roles", http.MethodGet, "/api/userroles?userName=alice", "", http.StatusOK},
+		{"user roles without name", http.MethodGet, "/api/userroles", "", http.StatusBadRequest},
+		{"groups", http.MethodGet, "/api/groups", "", http.StatusOK},
+		{"group details", http.MethodGet, "/api/groupdetails?groupName=developers", "", http.StatusOK},
+		{"group details without name", http.MethodGet, "/api/groupdetails", "", http.StatusBadRequest},
+
+		{"effective permissions", http.MethodGet, "/api/subjects/effective-permissions?kind=User&name=alice", "", http.StatusOK},
+		{"effective permissions of invalid subject", http.MethodGet, "/api/subjects/effective-permissions?kind=ServiceAccount&name=deployer", "", http.StatusBadRequest},
+
+		{"who can", http.MethodGet, "/api/whocan?verb=get&resource=pods&namespace=team-a", "", http.StatusOK},
+		{"who can without verb", http.MethodGet, "/api/whocan?resource=pods", "", http.StatusBadRequest},
+
+		{"search", http.MethodGet, "/api/search?resource=pods", "", http.StatusOK},
+		{"search with unknown kind", http.MethodGet, "/api/search?kind=Pod", "", http.StatusBadRequest},
+		{"search with invalid subject pattern", http.MethodGet, "/api/search?subject=(", "", http.StatusBadRequest},
+
+		{"access review", http.MethodPost, "/api/access-review", `{"subject":{"user":"alice"},"checks":[{"resourceAttributes":{"verb":"get","resource":"pods","namespace":"team-a"}}]}`, http.StatusOK},
+		{"access review without subject", http.MethodPost, "/api/access-review", `{"checks":[{"resourceAttributes":{"verb":"get","resource":"pods"}}]}`, http.StatusBadRequest},
+		{"access review without checks", http.MethodPost, "/api/access-review", `{"subject":{"user":"alice"}}`, http.StatusBadRequest},
+
+		{"audit", http.MethodGet, "/api/audit?actor=alice&kind=Role", "", http.StatusOK},
+		{"audit with invalid time", http.MethodGet, "/api/audit?since=yesterday", "", http.StatusBadRequest},
+
+		{"cache status", http.MethodGet, "/api/cache/status", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := newTestServer(t, seedObjects()...)
+			var headers map[string]string
+			if tt.method == http.MethodPut {
+				// Updates must be based on the current version of the seeded object.
+				headers = map[string]string{"If-Match": utils.ETag("1")}
+			}
+			rec := doRequestWithHeaders(e, tt.method, tt.target, tt.body, headers)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("%s %s: got status %d, want %d, body %s", tt.method, tt.target, rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateRolePersists(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+
+	rec := doRequest(e, http.MethodPost, "/api/roles?namespace=team-a", `{"metadata":{"name":"new-role"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	role, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "new-role", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("role was not created: %v", err)
+	}
+	if len(role.Rules) != 1 || role.Rules[0].Resources[0] != "pods" {
+		t.Errorf("unexpected rules %+v", role.Rules)
+	}
+}
+
+func TestListRolesActiveStatus(t *testing.T) {
+	// A role binding to a cluster role named like a role does not make the role active.
+	sameName := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "same-name", Namespace: "team-a"},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "unused"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "alice"}},
+	}
+	e, _ := newTestServer(t, append(seedObjects(), sameName)...)
+
+	rec := doRequest(e, http.MethodGet, "/api/roles?namespace=team-a", "")
+	var roles struct {
+		Items []struct {
+			Metadata metav1.ObjectMeta `json:"metadata"`
+			Active   bool              `json:"active"`
+		} `json:"items"`
+	}
+	decode(t, rec, &roles)
+
+	got := make(map[string]bool)
+	for _, role := range roles.Items {
+		got[role.Metadata.Name] = role.Active
+	}
+	want := map[string]bool{"pod-reader": true, "unused": false}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got active status %v, want %v", got, want)
+	}
+}
+
+func TestListSelectorsAndPaging(t *testing.T) {
+	labeled := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "labeled", Namespace: "team-a", Labels: map[string]string{"team": "a"}}}
+	e, clientset := newTestServer(t, append(seedObjects(), labeled)...)
+
+	var roles struct {
+		Items []rbacv1.Role `json:"items"`
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/roles?namespace=all&labelSelector=team%3Da", ""), &roles)
+	if len(roles.Items) != 1 || roles.Items[0].Name != "labeled" {
+		t.Errorf("got roles %+v, want only the labeled role", roles.Items)
+	}
+
+	// The fake clientset does not page, so answer the first page of role bindings directly.
+	clientset.PrependReactor("list", "rolebindings", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		remaining := int64(2)
+		return true, &rbacv1.RoleBindingList{
+			ListMeta: metav1.ListMeta{ResourceVersion: "7", Continue: "next-page", RemainingItemCount: &remaining},
+			Items:    []rbacv1.RoleBinding{{ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "team-a"}}},
+		}, nil
+	})
+	var page utils.ListResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/rolebindings?namespace=team-a&limit=1", ""), &page)
+	if page.Continue != "next-page" || page.RemainingItemCount == nil || *page.RemainingItemCount != 2 || page.ResourceVersion != "7" {
+		t.Errorf("got page %+v", page)
+	}
+	if items, ok := page.Items.([]interface{}); !ok || len(items) != 1 {
+		t.Errorf("got items %+v", page.Items)
+	}
+
+	for _, target := range []string{
+		"/api/namespaces?limit=-1",
+		"/api/clusterroles?labelSelector=a%3D%3D%3Db",
+		"/api/serviceaccounts?namespace=team-a&fieldSelector=metadata.name",
+	} {
+		if rec := doRequest(e, http.MethodGet, target, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got status %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	e, _ := newTestServer(t, seedObjects()...)
+
+	var users []string
+	decode(t, doRequest(e, http.MethodGet, "/api/users", ""), &users)
+
+	want := []string{"alice", "bob"}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("got users %v, want %v", users, want)
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	e, _ := newTestServer(t, seedObjects()...)
+
+	tests := []struct {
+		user string
+		want []string
+	}{
+		{"alice", []string{"pod-reader"}},
+		{"bob", []string{"viewer"}},
+		{"nobody", []string{}},
+	}
+	for _, tt := range tests {
+		var roles []string
+		decode(t, doRequest(e, http.MethodGet, "/api/userroles?userName="+tt.user, ""), &roles)
+		if !reflect.DeepEqual(roles, tt.want) {
+			t.Errorf("user %s: got roles %v, want %v", tt.user, roles, tt.want)
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	e, _ := newTestServer(t, seedObjects()...)
+
+	var groups []string
+	decode(t, doRequest(e, http.MethodGet, "/api/groups", ""), &groups)
+
+	want := []string{"auditors", "developers"}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got groups %v, want %v", groups, want)
+	}
+}
+
+func TestGroupDetails(t *testing.T) {
+	e, _ := newTestServer(t, seedObjects()...)
+
+	var details struct {
+		GroupName           string                      `json:"groupName"`
+		RoleBindings        []rbacv1.RoleBinding        `json:"roleBindings"`
+		ClusterRoleBindings []rbacv1.ClusterRoleBinding `json:"clusterRoleBindings"`
+		ClusterRoles        []rbacv1.ClusterRole        `json:"clusterRoles"`
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/groupdetails?groupName=developers", ""), &details)
+
+	if details.GroupName != "developers" {
+		t.Errorf("got group name %q", details.GroupName)
+	}
+	if len(details.RoleBindings) != 1 || details.RoleBindings[0].Name != "read-pods" {
+		t.Errorf("got role bindings %+v", details.RoleBindings)
+	}
+	if len(details.ClusterRoleBindings) != 1 || details.ClusterRoleBindings[0].Name != "view-all" {
+		t.Errorf("got cluster role bindings %+v", details.ClusterRoleBindings)
+	}
+	if len(details.ClusterRoles) != 1 || details.ClusterRoles[0].Name != "viewer" {
+		t.Errorf("got cluster roles %+v", details.ClusterRoles)
+	}
+}
+
+func TestServiceAccountDetails(t *testing.T) {
+	e, _ := newTestServer(t, seedObjects()...)
+
+	var details struct {
+		ServiceAccountName  string                      `json:"serviceAccountName"`
+		RoleBindings        []rbacv1.RoleBinding        `json:"roleBindings"`
+		ClusterRoleBindings []rbacv1.ClusterRoleBinding `json:"clusterRoleBindings"`
+		ClusterRoles        []rbacv1.ClusterRole        `json:"clusterRoles"`
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/serviceaccount-details?serviceAccountName=deployer", ""), &details)
+
+	if len(details.RoleBindings) != 1 || details.RoleBindings[0].Name != "read-pods" {
+		t.Errorf("got role bindings %+v", details.RoleBindings)
+	}
+	if len(details.ClusterRoleBindings) != 1 || details.ClusterRoleBindings[0].Name != "view-all" {
+		t.Errorf("got cluster role bindings %+v", details.ClusterRoleBindings)
+	}
+	if len(details.ClusterRoles) != 1 || details.ClusterRoles[0].Name != "viewer" {
+		t.Errorf("got cluster roles %+v", details.ClusterRoles)
+	}
+}
+
+func TestEffectivePermissions(t *testing.T) {
+	e, _ := newTestServer(t, append(seedObjects(),
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "aggregate-editor"},
+			AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{
+				{MatchLabels: map[string]string{"aggregate-to-editor": "true"}},
+			}},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-editor", Labels: map[string]string{"aggregate-to-editor": "true"}},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"update"}}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "edit-pods", Namespace: "team-a"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "aggregate-editor"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "system:serviceaccounts:team-a"}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "dangling", Namespace: "team-a"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "missing"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-a"}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-namespace", Namespace: "team-a"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "unused"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-b"}},
+		},
+	)...)
+
+	var response struct {
+		Namespaces []struct {
+			Namespace string `json:"namespace"`
+			Rules     []struct {
+				Resources []string `json:"resources"`
+				Verbs     []string `json:"verbs"`
+				Grants    []struct {
+					BindingName string `json:"bindingName"`
+					Source      string `json:"source"`
+				} `json:"grants"`
+			} `json:"rules"`
+		} `json:"namespaces"`
+		Unresolved []struct {
+			BindingName string `json:"bindingName"`
+		} `json:"unresolved"`
+	}
+	rec := doRequest(e, http.MethodGet, "/api/subjects/effective-permissions?kind=ServiceAccount&name=deployer&namespace=team-a", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	decode(t, rec, &response)
+
+	got := make(map[string][]string)
+	sources := make(map[string]string)
+	for _, ns := range response.Namespaces {
+		for _, rule := range ns.Rules {
+			key := ns.Namespace + "/" + strings.Join(rule.Resources, ",")
+			got[key] = rule.Verbs
+			for _, grant := range rule.Grants {
+				if grant.Source != "" {
+					sources[grant.BindingName] = grant.Source
+				}
+			}
+		}
+	}
+	want := map[string][]string{
+		"/*":          {"get"},
+		"team-a/pods": {"get", "list", "update"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got rules %v, want %v", got, want)
+	}
+	if sources["edit-pods"] != "pod-editor" {
+		t.Errorf("expected aggregated rule to come from pod-editor, got sources %v", sources)
+	}
+	if len(response.Unresolved) != 1 || response.Unresolved[0].BindingName != "dangling" {
+		t.Errorf("got unresolved grants %+v", response.Unresolved)
+	}
+}
+
+func TestWhoCan(t *testing.T) {
+	e, _ := newTestServer(t, seedObjects()...)
+
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"/api/whocan?verb=list&resource=pods&namespace=team-a", []string{"Group/developers", "ServiceAccount/deployer", "User/alice"}},
+		{"/api/whocan?verb=get&resource=pods&namespace=team-a", []string{"Group/auditors", "Group/developers", "ServiceAccount/deployer", "User/alice", "User/bob"}},
+		{"/api/whocan?verb=get&resource=pods&namespace=default", []string{"Group/auditors", "Group/developers", "ServiceAccount/deployer", "User/bob"}},
+		{"/api/whocan?verb=list&resource=pods", []string{}},
+		{"/api/whocan?verb=delete&resource=secrets&namespace=team-a", []string{}},
+	}
+	for _, tt := range tests {
+		var response struct {
+			Subjects []struct {
+				Subject rbacv1.Subject `json:"subject"`
+				Grants  []struct {
+					BindingName string `json:"bindingName"`
+				} `json:"grants"`
+			} `json:"subjects"`
+		}
+		decode(t, doRequest(e, http.MethodGet, tt.target, ""), &response)
+
+		got := []string{}
+		for _, entry := range response.Subjects {
+			got = append(got, entry.Subject.Kind+"/"+entry.Subject.Name)
+			if len(entry.Grants) == 0 {
+				t.Errorf("%s: subject %s has no grants", tt.target, entry.Subject.Name)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got subjects %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	created := metav1.NewTime(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	e, _ := newTestServer(t, append(seedObjects(),
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "system:node-reader", CreationTimestamp: created},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"nodes", "pods/log"}, Verbs: []string{"get"}}},
+		},
+	)...)
+
+	type result struct {
+		Kind      string `json:"kind"`
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+		Matches   []struct {
+			Path    string             `json:"path"`
+			Rule    *rbacv1.PolicyRule `json:"rule"`
+			Subject *rbacv1.Subject    `json:"subject"`
+		} `json:"matches"`
+	}
+	type page struct {
+		Items              []result `json:"items"`
+		Continue           string   `json:"continue"`
+		RemainingItemCount *int64   `json:"remainingItemCount"`
+	}
+	names := func(p page) []string {
+		var names []string
+		for _, item := range p.Items {
+			names = append(names, item.Kind+"/"+item.Name)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   []string
+	}{
+		{"rules by resource", "/api/search?resource=pods", []string{"Role/pod-reader", "ClusterRole/system:node-reader", "ClusterRole/viewer"}},
+		{"rules by verb and resource", "/api/search?verb=list&resource=pods", []string{"Role/pod-reader"}},
+		{"bindings by subject pattern", "/api/search?subject=%5Edev", []string{"RoleBinding/read-pods", "ClusterRoleBinding/view-all"}},
+		{"bindings by subject kind", "/api/search?subjectKind=ServiceAccount&namespace=team-a", []string{"RoleBinding/read-pods"}},
+		{"kind", "/api/search?kind=ServiceAccount", []string{"ServiceAccount/deployer"}},
+		{"text", "/api/search?q=READ", []string{"Role/pod-reader", "ClusterRole/system:node-reader", "RoleBinding/read-pods"}},
+		{"exclude system", "/api/search?kind=ClusterRole&excludeSystem=true", []string{"ClusterRole/viewer"}},
+		{"created after", "/api/search?createdAfter=2024-01-01", []string{"ClusterRole/system:node-reader"}},
+		{"sorted by name descending", "/api/search?kind=Role,ClusterRole&sort=-name", []string{"ClusterRole/viewer", "Role/unused", "ClusterRole/system:node-reader", "Role/pod-reader"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got page
+			decode(t, doRequest(e, http.MethodGet, tt.target, ""), &got)
+			if !reflect.DeepEqual(names(got), tt.want) {
+				t.Errorf("got %v, want %v", names(got), tt.want)
+			}
+		})
+	}
+
+	var matched page
+	decode(t, doRequest(e, http.MethodGet, "/api/search?subject=%5Edev&kind=RoleBinding", ""), &matched)
+	if len(matched.Items) != 1 || len(matched.Items[0].Matches) != 1 || matched.Items[0].Matches[0].Path != "subjects[2]" || matched.Items[0].Matches[0].Subject.Name != "developers" {
+		t.Errorf("got matches %+v", matched.Items)
+	}
+
+	var first, second page
+	decode(t, doRequest(e, http.MethodGet, "/api/search?kind=Role,ClusterRole&limit=3", ""), &first)
+	if len(first.Items) != 3 || first.Continue == "" || first.RemainingItemCount == nil || *first.RemainingItemCount != 1 {
+		t.Fatalf("got first page %+v", first)
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/search?kind=Role,ClusterRole&limit=3&continue="+first.Continue, ""), &second)
+	if len(second.Items) != 1 || second.Continue != "" {
+		t.Errorf("got second page %+v", second)
+	}
+}
+
+func TestAccessReview(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+
+	var reviews []authorizationv1.SubjectAccessReviewSpec
+	var mu sync.Mutex
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		mu.Lock()
+		reviews = append(reviews, review.Spec)
+		mu.Unlock()
+
+		result := review.DeepCopy()
+		if attrs := review.Spec.ResourceAttributes; attrs != nil && attrs.Verb == "get" {
+			result.Status = authorizationv1.SubjectAccessReviewStatus{Allowed: true, Reason: "allowed by test"}
+		} else {
+			result.Status = authorizationv1.SubjectAccessReviewStatus{Denied: true, Reason: "denied by test"}
+		}
+		return true, result, nil
+	})
+
+	body := `{
+		"subject": {"serviceAccount": {"name": "deployer", "namespace": "team-a"}},
+		"checks": [{"nonResourceAttributes": {"verb": "get", "path": "/healthz"}}],
+		"matrix": {"namespace": "team-a", "verbs": ["get", "delete"], "resources": [{"resource": "pods"}, {"resource": "secrets"}]}
+	}`
+	rec := doRequest(e, http.MethodPost, "/api/access-review", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	var response struct {
+		Results []struct {
+			Allowed bool   `json:"allowed"`
+			Reason  string `json:"reason"`
+		} `json:"results"`
+		Matrix struct {
+			Decisions [][]struct {
+				Allowed bool `json:"allowed"`
+				Denied  bool `json:"denied"`
+			} `json:"decisions"`
+		} `json:"matrix"`
+	}
+	decode(t, rec, &response)
+
+	if len(response.Results) != 1 || response.Results[0].Allowed || response.Results[0].Reason != "denied by test" {
+		t.Errorf("got results %+v", response.Results)
+	}
+
+	var got [][]bool
+	for _, row := range response.Matrix.Decisions {
+		var cells []bool
+		for _, decision := range row {
+			cells = append(cells, decision.Allowed)
+		}
+		got = append(got, cells)
+	}
+	want := [][]bool{{true, false}, {true, false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got matrix %v, want %v", got, want)
+	}
+
+	if len(reviews) != 5 {
+		t.Fatalf("got %d reviews, want 5", len(reviews))
+	}
+	if reviews[0].User != "system:serviceaccount:team-a:deployer" {
+		t.Errorf("got user %q", reviews[0].User)
+	}
+	wantGroups := []string{"system:serviceaccounts", "system:serviceaccounts:team-a", "system:authenticated"}
+	if !reflect.DeepEqual(reviews[0].Groups, wantGroups) {
+		t.Errorf("got groups %v, want %v", reviews[0].Groups, wantGroups)
+	}
+}
+
+// aggregationObjects returns an aggregated cluster role and the cluster role it aggregates.
+func aggregationObjects() []runtime.Object {
+	return []runtime.Object{
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "monitoring"},
+			AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{
+				{MatchLabels: map[string]string{"aggregate-to-monitoring": "true"}},
+			}},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "metrics-reader", Labels: map[string]string{"aggregate-to-monitoring": "true"}},
+			Rules:      []rbacv1.PolicyRule{{NonResourceURLs: []string{"/metrics"}, Verbs: []string{"get"}}},
+		},
+	}
+}
+
+func TestRisks(t *testing.T) {
+	objs := append(seedObjects(),
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "debugger", Namespace: "team-a"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "debug", Namespace: "team-a"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "debugger"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-a"}},
+		},
+	)
+	e, clientset := newTestServer(t, objs...)
+
+	checks := func(findings []risk.Finding) []string {
+		var ids []string
+		for _, finding := range findings {
+			ids = append(ids, finding.Check)
+		}
+		return ids
+	}
+
+	var response rbac.RisksResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/risks", ""), &response)
+	if len(response.Roles) != 2 || response.Roles[0].Name != "viewer" || response.Roles[0].Severity != risk.SeverityCritical || response.Roles[1].Name != "debugger" {
+		t.Fatalf("got risks %+v", response.Roles)
+	}
+	wantViewer := []string{"nodes-proxy", "wildcard-resources", "secrets-read", "pods-exec", "pods-attach"}
+	if got := checks(response.Roles[0].Findings); !reflect.DeepEqual(got, wantViewer) {
+		t.Errorf("got viewer checks %v, want %v", got, wantViewer)
+	}
+	if subjects := response.Roles[0].Findings[0].Subjects; len(subjects) != 4 || subjects[0].BindingName != "view-all" {
+		t.Errorf("got viewer subjects %+v", subjects)
+	}
+	if response.Summary != (rbac.RiskSummary{Critical: 1, High: 5}) {
+		t.Errorf("got summary %+v", response.Summary)
+	}
+
+	decode(t, doRequest(e, http.MethodGet, "/api/risks?severity=critical", ""), &response)
+	if len(response.Roles) != 1 || len(response.Roles[0].Findings) != 1 || response.Summary != (rbac.RiskSummary{Critical: 1}) {
+		t.Errorf("critical only: got %+v", response)
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/risks?namespace=team-a", ""), &response)
+	if len(response.Roles) != 1 || response.Roles[0].Name != "debugger" {
+		t.Errorf("team-a only: got %+v", response.Roles)
+	}
+
+	// Role lists carry the findings without subjects; details add them.
+	var roles struct {
+		Items []rbac.RoleWithStatus `json:"items"`
+	}
+	// Lists tell whether each role is bound from the RBAC cache, and details from the bindings
+	// they fetch, without listing every binding again.
+	listed := func() map[string]int {
+		counts := make(map[string]int)
+		for _, action := range clientset.Actions() {
+			counts[action.GetVerb()+" "+action.GetResource().Resource]++
+		}
+		clientset.ClearActions()
+		return counts
+	}
+	clientset.ClearActions()
+	decode(t, doRequest(e, http.MethodGet, "/api/roles?namespace=team-a", ""), &roles)
+	if counts := listed(); !reflect.DeepEqual(counts, map[string]int{"list roles": 1}) {
+		t.Errorf("listing roles made requests %v", counts)
+	}
+	for _, role := range roles.Items {
+		want := 0
+		if role.Name == "debugger" {
+			want = 1
+		}
+		if role.Risks == nil || len(role.Risks) != want || (want == 1 && role.Risks[0].Subjects != nil) {
+			t.Errorf("role %s: got risks %+v", role.Name, role.Risks)
+		}
+		if role.Name == "debugger" && !role.Active {
+			t.Errorf("role %s: got inactive, want active", role.Name)
+		}
+	}
+	var details rbac.RoleDetailsResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/roles/details?namespace=team-a&roleName=debugger", ""), &details)
+	if counts := listed(); counts["list rolebindings"] != 1 || !details.Active {
+		t.Errorf("role details: got active %t with requests %v", details.Active, counts)
+	}
+	if len(details.Risks) != 1 || len(details.Risks[0].Subjects) != 1 || details.Risks[0].Subjects[0].Subject.Name != "deployer" {
+		t.Errorf("got role details risks %+v", details.Risks)
+	}
+
+	var clusterRoles struct {
+		Items []rbac.ClusterRoleWithStatus `json:"items"`
+	}
+	clientset.ClearActions()
+	decode(t, doRequest(e, http.MethodGet, "/api/clusterroles", ""), &clusterRoles)
+	if len(clusterRoles.Items) != 1 || !clusterRoles.Items[0].Active || !reflect.DeepEqual(checks(clusterRoles.Items[0].Risks), wantViewer) {
+		t.Errorf("got cluster roles %+v", clusterRoles.Items)
+	}
+	// The active status comes from the RBAC cache, not from listing every binding.
+	for _, action := range clientset.Actions() {
+		if action.GetResource().Resource != "clusterroles" {
+			t.Errorf("listing cluster roles made a %s request for %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+	var clusterDetails rbac.ClusterRoleDetailsResponse
+	clientset.ClearActions()
+	decode(t, doRequest(e, http.MethodGet, "/api/clusterroles/details?clusterRoleName=viewer", ""), &clusterDetails)
+	if counts := listed(); counts["list rolebindings"] != 1 || counts["list clusterrolebindings"] != 1 || !clusterDetails.Active {
+		t.Errorf("cluster role details: got active %t with requests %v", clusterDetails.Active, counts)
+	}
+	if len(clusterDetails.Risks) != len(wantViewer) || len(clusterDetails.Risks[0].Subjects) != 4 {
+		t.Errorf("got cluster role details risks %+v", clusterDetails.Risks)
+	}
+
+	for _, target := range []string{"/api/risks?severity=low", "/api/risks?kind=Pod", "/api/risks?excludeSystem=maybe"} {
+		if rec := doRequest(e, http.MethodGet, target, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got status %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestEscalationPaths(t *testing.T) {
+	objs := append(seedObjects(),
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "admin", Namespace: "team-a"}},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-admin"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-a-admin"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "cluster-admin"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "admin", Namespace: "team-a"}},
+		},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "deployer", Namespace: "team-a"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"create"}}},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "deployers", Namespace: "team-a"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "deployer"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "alice"}},
+		},
+	)
+	e, _ := newTestServer(t, objs...)
+
+	var response rbac.EscalationPathsResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/escalation-paths?subject=User:alice", ""), &response)
+	if response.ClusterAdmin || len(response.Paths) != 1 {
+		t.Fatalf("got %+v", response)
+	}
+	steps := response.Paths[0].Steps
+	if len(steps) != 2 || steps[0].Technique != risk.TechniqueCreatePods || steps[0].To.Name != "admin" ||
+		steps[0].Permission.Resource != "deployments" || steps[1].Technique != risk.TechniqueClusterAdmin || steps[1].To != nil {
+		t.Errorf("got steps %+v", steps)
+	}
+
+	decode(t, doRequest(e, http.MethodGet, "/api/escalation-paths?subject=ServiceAccount:team-a:admin", ""), &response)
+	if !response.ClusterAdmin || len(response.Paths) != 1 || len(response.Paths[0].Steps) != 1 {
+		t.Errorf("got %+v", response)
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/escalation-paths?subject=User:bob", ""), &response)
+	if response.ClusterAdmin || response.Paths == nil || len(response.Paths) != 0 {
+		t.Errorf("got %+v", response)
+	}
+
+	for _, target := range []string{"/api/escalation-paths", "/api/escalation-paths?subject=Robot:r2", "/api/escalation-paths?subject=User:alice&limit=0"} {
+		if rec := doRequest(e, http.MethodGet, target, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got status %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHygiene(t *testing.T) {
+	roleBinding := func(name, kind, role string, subjects ...rbacv1.Subject) *rbacv1.RoleBinding {
+		return &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a", ResourceVersion: "1"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: kind, Name: role},
+			Subjects:   subjects,
+		}
+	}
+	alice := rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"}
+	objs := append(seedObjects(),
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "orphan", ResourceVersion: "1"}},
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "system:orphan", ResourceVersion: "1"}},
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "source", Labels: map[string]string{"aggregate": "true"}, ResourceVersion: "1"}},
+		&rbacv1.ClusterRole{
+			ObjectMeta:      metav1.ObjectMeta{Name: "aggregate", ResourceVersion: "1"},
+			AggregationRule: &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: map[string]string{"aggregate": "true"}}}},
+		},
+		roleBinding("aggregate", "ClusterRole", "aggregate", alice),
+		roleBinding("ghost", "Role", "missing", alice),
+		roleBinding("same-name", "ClusterRole", "unused", alice),
+		roleBinding("empty", "Role", "pod-reader"),
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "stale", ResourceVersion: "1"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "viewer"},
+			Subjects: []rbacv1.Subject{
+				{Kind: rbacv1.ServiceAccountKind, Name: "deleted", Namespace: "team-a"},
+				{Kind: rbacv1.ServiceAccountKind, Name: "builder", Namespace: "gone"},
+				{Kind: rbacv1.UserKind, Name: "carol"},
+			},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "stale-only", ResourceVersion: "1"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "viewer"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "deleted", Namespace: "team-a"}},
+		},
+	)
+	e, clientset := newTestServer(t, objs...)
+	clientset.PrependReactor("*", "*", dryRunReactor)
+
+	ids := func(items []hygiene.Item) []string {
+		var got []string
+		for _, item := range items {
+			got = append(got, item.ID)
+		}
+		return got
+	}
+
+	var report rbac.HygieneResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/hygiene", ""), &report)
+	want := []string{
+		"empty-binding:RoleBinding/team-a/empty",
+		"missing-namespace:ClusterRoleBinding//stale",
+		"missing-role-ref:RoleBinding/team-a/ghost",
+		"missing-role-ref:RoleBinding/team-a/same-name",
+		"missing-service-account:ClusterRoleBinding//stale",
+		"missing-service-account:ClusterRoleBinding//stale-only",
+		"unbound-role:ClusterRole//orphan",
+		"unbound-role:ClusterRole//system:orphan",
+		"unbound-role:Role/team-a/unused",
+	}
+	if got := ids(report.Items); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got items %v, want %v", got, want)
+	}
+	if report.Summary != (rbac.HygieneSummary{UnboundRoles: 3, MissingRoleRefs: 2, MissingServiceAccounts: 2, MissingNamespaces: 1, EmptyBindings: 1}) {
+		t.Errorf("got summary %+v", report.Summary)
+	}
+	if subjects := report.Items[1].Subjects; len(subjects) != 1 || subjects[0].Namespace != "gone" {
+		t.Errorf("got missing namespace subjects %+v", subjects)
+	}
+
+	decode(t, doRequest(e, http.MethodGet, "/api/hygiene?issue=unbound-role&excludeSystem=true", ""), &report)
+	if got := ids(report.Items); !reflect.DeepEqual(got, []string{"unbound-role:ClusterRole//orphan", "unbound-role:Role/team-a/unused"}) {
+		t.Errorf("unbound roles without system roles: got %v", got)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/hygiene?issue=unknown", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown issue: got status %d", rec.Code)
+	}
+
+	// A cluster role bound only through a role binding is active.
+	var clusterRoles struct {
+		Items []rbac.ClusterRoleWithStatus `json:"items"`
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/clusterroles", ""), &clusterRoles)
+	for _, clusterRole := range clusterRoles.Items {
+		if clusterRole.Name == "aggregate" && !clusterRole.Active {
+			t.Error("got inactive aggregate cluster role, want active")
+		}
+	}
+
+	cleanup := func(query string, ids ...string) rbac.HygieneCleanupResponse {
+		t.Helper()
+		body, _ := json.Marshal(rbac.HygieneCleanupRequest{Items: ids})
+		rec := doRequest(e, http.MethodPost, "/api/hygiene/cleanup"+query, string(body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+		}
+		var response rbac.HygieneCleanupResponse
+		decode(t, rec, &response)
+		return response
+	}
+	selected := []string{
+		"missing-namespace:ClusterRoleBinding//stale",
+		"missing-service-account:ClusterRoleBinding//stale",
+		"missing-service-account:ClusterRoleBinding//stale-only",
+		"missing-role-ref:RoleBinding/team-a/ghost",
+		"unbound-role:Role/team-a/unused",
+		"unbound-role:Role/team-a/nothing",
+	}
+	wantResults := []hygiene.Result{
+		{ID: selected[0], Action: hygiene.ActionRemoveSubjects, Applied: true},
+		{ID: selected[1], Action: hygiene.ActionRemoveSubjects, Applied: true},
+		{ID: selected[2], Action: hygiene.ActionDelete, Applied: true},
+		{ID: selected[3], Action: hygiene.ActionDelete, Applied: true},
+		{ID: selected[4], Action: hygiene.ActionDelete, Applied: true},
+		{ID: selected[5], Error: "No such item in the hygiene report"},
+	}
+
+	response := cleanup("?dryRun=true", selected...)
+	if !response.DryRun || !reflect.DeepEqual(response.Results, wantResults) {
+		t.Errorf("dry run: got %+v", response)
+	}
+	if _, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "unused", metav1.GetOptions{}); err != nil {
+		t.Errorf("dry run deleted the role: %v", err)
+	}
+
+	response = cleanup("", selected...)
+	if response.DryRun || !reflect.DeepEqual(response.Results, wantResults) {
+		t.Errorf("cleanup: got %+v", response)
+	}
+	stale, err := clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), "stale", metav1.GetOptions{})
+	if err != nil || len(stale.Subjects) != 1 || stale.Subjects[0].Name != "carol" {
+		t.Errorf("got stale binding %+v, %v", stale, err)
+	}
+	if _, err := clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), "stale-only", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("got %v for the emptied binding, want not found", err)
+	}
+	if _, err := clientset.RbacV1().RoleBindings("team-a").Get(context.TODO(), "ghost", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("got %v for the broken binding, want not found", err)
+	}
+	if _, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "unused", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("got %v for the unbound role, want not found", err)
+	}
+
+	// Every cleaned object is audited with its state before the change.
+	var records []audit.Record
+	decode(t, doRequest(e, http.MethodGet, "/api/audit", ""), &records)
+	var audited []string
+	for i := len(records) - 1; i >= 0; i-- {
+		if record := records[i]; !record.DryRun {
+			audited = append(audited, record.Action+" "+record.Kind+" "+record.Namespace+"/"+record.Name)
+			if record.Outcome != audit.OutcomeSuccess || record.Before == nil || (record.Action == audit.ActionUpdate) != (record.After != nil) {
+				t.Errorf("got cleanup record %+v", record)
+			}
+		}
+	}
+	wantAudited := []string{"update ClusterRoleBinding /stale", "delete ClusterRoleBinding /stale-only", "delete RoleBinding team-a/ghost", "delete Role team-a/unused"}
+	if !reflect.DeepEqual(audited, wantAudited) {
+		t.Errorf("got audit records %v, want %v", audited, wantAudited)
+	}
+	if len(records) != 2*len(wantAudited) {
+		t.Errorf("got %d audit records, want %d with the dry run", len(records), 2*len(wantAudited))
+	}
+
+	if rec := doRequest(e, http.MethodPost, "/api/hygiene/cleanup", `{"items":[]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("no items: got status %d", rec.Code)
+	}
+}
+
+// auditEvent writes a complete audit event of a request as a JSON line.
+func auditEvent(username, verb, namespace, apiGroup, resource, name string, code int) string {
+	event := map[string]interface{}{
+		"kind":           "Event",
+		"apiVersion":     "audit.k8s.io/v1",
+		"stage":          "ResponseComplete",
+		"verb":           verb,
+		"user":           map[string]string{"username": username},
+		"responseStatus": map[string]int{"code": code},
+		"stageTimestamp": "2026-03-01T10:00:00.000000Z",
+	}
+	if resource == "" {
+		event["requestURI"] = name + "?timeout=32s"
+	} else {
+		event["requestURI"] = "/api"
+		event["objectRef"] = map[string]string{"namespace": namespace, "apiGroup": apiGroup, "resource": resource, "name": name}
+	}
+	data, _ := json.Marshal(event)
+	return string(data) + "\n"
+}
+
+func TestUsage(t *testing.T) {
+	logDir := t.TempDir()
+	e, clientset := newTestServerWithConfig(t, &Config{Port: "0", UsageLogDir: logDir}, seedObjects()...)
+	clientset.PrependReactor("*", "*", dryRunReactor)
+
+	deployer := "system:serviceaccount:team-a:deployer"
+	log := auditEvent(deployer, "get", "team-a", "", "pods", "web-1", http.StatusOK) +
+		auditEvent(deployer, "get", "team-a", "", "pods", "web-2", http.StatusNotFound) +
+		auditEvent(deployer, "list", "team-a", "", "pods", "", http.StatusOK) +
+		auditEvent(deployer, "create", "team-a", "apps", "deployments", "", http.StatusCreated) +
+		auditEvent(deployer, "list", "", "", "namespaces", "", http.StatusOK) +
+		auditEvent(deployer, "get", "", "", "", "/healthz", http.StatusOK) +
+		auditEvent(deployer, "delete", "team-a", "", "secrets", "token", http.StatusForbidden) +
+		`{"kind":"Event","stage":"ResponseStarted","verb":"watch","user":{"username":"alice"}}` + "\n" +
+		"not an event\n"
+
+	rec := doRequest(e, http.MethodPost, "/api/usage/ingest", log)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ingest: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var result usage.IngestResult
+	decode(t, rec, &result)
+	if result.Lines != 9 || result.Recorded != 6 || result.Skipped != 2 || result.Invalid != 1 || result.Subjects != 1 || result.Permissions != 6 {
+		t.Errorf("got ingest result %+v", result)
+	}
+
+	// Ingesting by path is limited to the log directory, and adds to the counts.
+	if err := os.WriteFile(filepath.Join(logDir, "audit.log"), []byte(auditEvent(deployer, "list", "team-a", "", "pods", "", http.StatusOK)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/usage/ingest?path=audit.log", ""); rec.Code != http.StatusOK {
+		t.Errorf("ingest by path: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/usage/ingest?path=../kuberus.db", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("ingest outside the log directory: got status %d", rec.Code)
+	}
+
+	var subjects []usage.SubjectUsage
+	decode(t, doRequest(e, http.MethodGet, "/api/usage", ""), &subjects)
+	if len(subjects) != 1 || subjects[0].Subject.Name != "deployer" || subjects[0].Permissions != 6 || subjects[0].Count != 7 {
+		t.Errorf("got subjects %+v", subjects)
+	}
+	var records rbac.SubjectUsageResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/usage?subject=ServiceAccount:team-a:deployer", ""), &records)
+	if len(records.Records) != 6 || records.Records[0].Permission.Resource != "namespaces" {
+		t.Errorf("got records %+v", records.Records)
+	}
+
+	var proposal usage.Proposal
+	decode(t, doRequest(e, http.MethodGet, "/api/usage/proposal?subject=ServiceAccount:team-a:deployer", ""), &proposal)
+	name := "team-a-deployer-least-privilege"
+	wantRoleRules := []rbacv1.PolicyRule{
+		{Verbs: []string{"get", "list"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+		{Verbs: []string{"create"}, APIGroups: []string{"apps"}, Resources: []string{"deployments"}},
+	}
+	wantClusterRoleRules := []rbacv1.PolicyRule{
+		{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"namespaces"}},
+		{Verbs: []string{"get"}, NonResourceURLs: []string{"/healthz"}},
+	}
+	if len(proposal.Roles) != 1 || proposal.Roles[0].Name != name || proposal.Roles[0].Namespace != "team-a" || !reflect.DeepEqual(proposal.Roles[0].Rules, wantRoleRules) {
+		t.Errorf("got roles %+v", proposal.Roles)
+	}
+	if len(proposal.ClusterRoles) != 1 || !reflect.DeepEqual(proposal.ClusterRoles[0].Rules, wantClusterRoleRules) {
+		t.Errorf("got cluster roles %+v", proposal.ClusterRoles)
+	}
+	if len(proposal.RoleBindings) != 1 || len(proposal.ClusterRoleBindings) != 1 || proposal.ClusterRoleBindings[0].Subjects[0].Name != "deployer" {
+		t.Errorf("got bindings %+v %+v", proposal.RoleBindings, proposal.ClusterRoleBindings)
+	}
+	if len(proposal.Rebind) != 2 || proposal.Rebind[0].BindingName != "read-pods" || proposal.Rebind[1].BindingName != "view-all" {
+		t.Errorf("got rebind %+v", proposal.Rebind)
+	}
+	wantGained := []policy.Permission{
+		{Verb: "list", Resource: "namespaces"},
+		{Verb: "get", NonResourceURL: "/healthz"},
+		{Namespace: "team-a", Verb: "create", APIGroup: "apps", Resource: "deployments"},
+	}
+	policy.SortPermissions(wantGained)
+	if !reflect.DeepEqual(proposal.Gained, wantGained) {
+		t.Errorf("got gained %+v, want %+v", proposal.Gained, wantGained)
+	}
+	if want := []policy.Permission{{Verb: "get", APIGroup: "*", Resource: "*"}}; !reflect.DeepEqual(proposal.Lost, want) {
+		t.Errorf("got lost %+v, want %+v", proposal.Lost, want)
+	}
+
+	if rec := doRequest(e, http.MethodGet, "/api/usage/proposal?subject=User:nobody", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("no usage: got status %d", rec.Code)
+	}
+
+	apply := func(query string) rbac.ApplyUsageProposalResponse {
+		t.Helper()
+		rec := doRequest(e, http.MethodPost, "/api/usage/proposal/apply?subject=ServiceAccount:team-a:deployer"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("apply: got status %d, body %s", rec.Code, rec.Body.String())
+		}
+		var response rbac.ApplyUsageProposalResponse
+		decode(t, rec, &response)
+		return response
+	}
+	wantSteps := []usage.Step{
+		{Kind: "Role", Namespace: "team-a", Name: name, Action: usage.ActionCreate, Applied: true},
+		{Kind: "ClusterRole", Name: name, Action: usage.ActionCreate, Applied: true},
+		{Kind: "RoleBinding", Namespace: "team-a", Name: name, Action: usage.ActionCreate, Applied: true},
+		{Kind: "ClusterRoleBinding", Name: name, Action: usage.ActionCreate, Applied: true},
+		{Kind: "RoleBinding", Namespace: "team-a", Name: "read-pods", Action: usage.ActionRemoveSubject, Applied: true},
+		{Kind: "ClusterRoleBinding", Name: "view-all", Action: usage.ActionRemoveSubject, Applied: true},
+	}
+
+	response := apply("&dryRun=true")
+	if !response.DryRun || !reflect.DeepEqual(response.Steps, wantSteps) {
+		t.Errorf("dry run: got steps %+v", response.Steps)
+	}
+	if _, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("dry run created the role: %v", err)
+	}
+
+	response = apply("")
+	if response.DryRun || !reflect.DeepEqual(response.Steps, wantSteps) {
+		t.Errorf("apply: got steps %+v", response.Steps)
+	}
+	if _, err := clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), name, metav1.GetOptions{}); err != nil {
+		t.Errorf("got %v for the proposed cluster role binding", err)
+	}
+	viewAll, err := clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), "view-all", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range viewAll.Subjects {
+		if subject.Kind == rbacv1.ServiceAccountKind {
+			t.Errorf("the service account is still bound to view-all: %+v", viewAll.Subjects)
+		}
+	}
+
+	// Every step is audited, the dry run as such.
+	var auditRecords []audit.Record
+	decode(t, doRequest(e, http.MethodGet, "/api/audit", ""), &auditRecords)
+	var audited []string
+	for i := len(auditRecords) - 1; i >= 0; i-- {
+		record := auditRecords[i]
+		audited = append(audited, strconv.FormatBool(record.DryRun)+" "+record.Action+" "+record.Kind+" "+record.Namespace+"/"+record.Name)
+		if record.Outcome != audit.OutcomeSuccess || (record.Action == audit.ActionUpdate && record.Before == nil) {
+			t.Errorf("got apply record %+v", record)
+		}
+	}
+	var wantAudited []string
+	for _, dryRun := range []string{"true", "false"} {
+		wantAudited = append(wantAudited,
+			dryRun+" create Role team-a/"+name, dryRun+" create ClusterRole /"+name,
+			dryRun+" create RoleBinding team-a/"+name, dryRun+" create ClusterRoleBinding /"+name,
+			dryRun+" update RoleBinding team-a/read-pods", dryRun+" update ClusterRoleBinding /view-all")
+	}
+	if !reflect.DeepEqual(audited, wantAudited) {
+		t.Errorf("got audit records %v, want %v", audited, wantAudited)
+	}
+
+	// Events are only counted once, however often the logs holding them are ingested.
+	withID := func(event, id string) string {
+		return strings.Replace(event, "{", `{"auditID":"`+id+`",`, 1)
+	}
+	first := withID(auditEvent("carol", "get", "team-a", "", "pods", "web-1", http.StatusOK), "a1") +
+		withID(auditEvent("carol", "get", "team-a", "", "pods", "web-1", http.StatusOK), "a2")
+	overlapping := withID(auditEvent("carol", "get", "team-a", "", "pods", "web-1", http.StatusOK), "a2") +
+		withID(auditEvent("carol", "get", "team-a", "", "pods", "web-1", http.StatusOK), "a3") +
+		withID(auditEvent("carol", "get", "team-a", "", "pods", "web-1", http.StatusOK), "a3")
+	for _, tt := range []struct {
+		log                  string
+		recorded, duplicates int
+	}{
+		{first, 2, 0},
+		{first, 0, 2},
+		{overlapping, 1, 2},
+	} {
+		decode(t, doRequest(e, http.MethodPost, "/api/usage/ingest", tt.log), &result)
+		if result.Recorded != tt.recorded || result.Duplicates != tt.duplicates {
+			t.Errorf("got ingest result %+v, want %d recorded and %d duplicates", result, tt.recorded, tt.duplicates)
+		}
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/usage?subject=User:carol", ""), &records)
+	if len(records.Records) != 1 || records.Records[0].Count != 3 {
+		t.Errorf("got records %+v after ingesting overlapping logs", records.Records)
+	}
+}
+
+func TestRoleUsage(t *testing.T) {
+	e, _ := newTestServer(t, seedObjects()...)
+
+	if rec := doRequest(e, http.MethodGet, "/api/roles/usage?namespace=team-a&name=pod-reader", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("before ingestion: got status %d", rec.Code)
+	}
+	var details rbac.RoleDetailsResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/roles/details?namespace=team-a&roleName=pod-reader", ""), &details)
+	if details.Usage != nil {
+		t.Errorf("got usage %+v before ingestion", details.Usage)
+	}
+
+	now := time.Now().UTC()
+	at := func(event string, daysAgo int) string {
+		return strings.Replace(event, "2026-03-01T10:00:00.000000Z", now.AddDate(0, 0, -daysAgo).Format(time.RFC3339Nano), 1)
+	}
+	deployer := "system:serviceaccount:team-a:deployer"
+	log := at(auditEvent("alice", "get", "team-a", "", "pods", "web-1", http.StatusOK), 200) +
+		at(auditEvent(deployer, "list", "team-a", "", "pods", "", http.StatusOK), 1) +
+		at(auditEvent("bob", "get", "default", "", "secrets", "token", http.StatusOK), 100) +
+		at(auditEvent("alice", "get", "default", "", "pods", "web-1", http.StatusOK), 2)
+	if rec := doRequest(e, http.MethodPost, "/api/usage/ingest", log); rec.Code != http.StatusOK {
+		t.Fatalf("ingest: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	// The read-pods binding only grants pods in team-a, to alice and the deployer.
+	var response rbac.RoleUsageResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/roles/usage?namespace=team-a&name=pod-reader&unusedDays=30", ""), &response)
+	if response.Kind != "Role" || response.UnusedDays != 30 || response.Coverage == nil || len(response.Rules) != 1 {
+		t.Fatalf("got response %+v", response)
+	}
+	rule := response.Rules[0]
+	if rule.Count != 2 || len(rule.Subjects) != 2 || rule.LastUsedBy == nil || rule.LastUsedBy.Name != "deployer" || rule.Unused {
+		t.Errorf("got rule usage %+v", rule)
+	}
+
+	var unused rbac.RoleUsageResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/roles/usage?namespace=team-a&name=unused&unusedDays=30", ""), &unused)
+	if len(unused.Rules) != 1 || unused.Rules[0].Count != 0 || unused.Rules[0].LastUsed != nil || !unused.Rules[0].Unused {
+		t.Errorf("got unused role usage %+v", unused.Rules)
+	}
+
+	// The viewer cluster role was last used by bob 100 days ago.
+	decode(t, doRequest(e, http.MethodGet, "/api/roles/usage?name=viewer&unusedDays=30", ""), &response)
+	if response.Kind != "ClusterRole" || len(response.Rules) != 1 || response.Rules[0].LastUsedBy == nil || response.Rules[0].LastUsedBy.Name != "bob" || !response.Rules[0].Unused {
+		t.Errorf("got cluster role usage %+v", response)
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/roles/usage?name=viewer&unusedDays=150", ""), &response)
+	if len(response.Rules) != 1 || response.Rules[0].Unused {
+		t.Errorf("got cluster role usage %+v with 150 days", response.Rules)
+	}
+	// Rules are not flagged when the audit logs do not reach back far enough.
+	decode(t, doRequest(e, http.MethodGet, "/api/roles/usage?namespace=team-a&name=unused&unusedDays=365", ""), &response)
+	if len(response.Rules) != 1 || response.Rules[0].Unused {
+		t.Errorf("got unused role usage %+v beyond the coverage", response.Rules)
+	}
+
+	decode(t, doRequest(e, http.MethodGet, "/api/roles/details?namespace=team-a&roleName=pod-reader", ""), &details)
+	if details.Usage == nil || details.Usage.UnusedDays != 90 || len(details.Usage.Rules) != 1 || details.Usage.Rules[0].Count != 2 {
+		t.Errorf("got role details usage %+v", details.Usage)
+	}
+	var clusterDetails rbac.ClusterRoleDetailsResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/clusterroles/details?clusterRoleName=viewer&unusedDays=30", ""), &clusterDetails)
+	if clusterDetails.Usage == nil || len(clusterDetails.Usage.Rules) != 1 || !clusterDetails.Usage.Rules[0].Unused {
+		t.Errorf("got cluster role details usage %+v", clusterDetails.Usage)
+	}
+
+	for _, query := range []string{"namespace=team-a&name=missing", "name=missing"} {
+		if rec := doRequest(e, http.MethodGet, "/api/roles/usage?"+query, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d", query, rec.Code)
+		}
+	}
+	for _, query := range []string{"namespace=team-a", "name=pod-reader&kind=Role", "name=viewer&kind=Binding", "namespace=team-a&name=pod-reader&unusedDays=0"} {
+		if rec := doRequest(e, http.MethodGet, "/api/roles/usage?"+query, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", query, rec.Code)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	team := "name: log-reader\ndescription: Reads pod logs.\nrules:\n- verbs: [get]\n  apiGroups: ['']\n  resources: [pods/log]\nextraVerbs: [get]\n" +
+		"---\nname: secrets-manager\nrules:\n- verbs: [get]\n  apiGroups: ['']\n  resources: [secrets]\n" +
+		"---\nname: pod-runner\nrules:\n- verbs: [create, get, deletecollection]\n  apiGroups: ['']\n  resources: [pods, pods/exec]\n"
+	if err := os.WriteFile(filepath.Join(dir, "team.yaml"), []byte(team), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("name: broken\nrules: []\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "role-templates", Namespace: "default"},
+		Data: map[string]string{
+			"ops.yaml": "name: node-viewer\nclusterRole: true\nrules:\n- verbs: [get, list]\n  apiGroups: ['']\n  resources: [nodes]\n- verbs: [get]\n  nonResourceURLs: [/healthz]\n",
+		},
+	}
+	e, clientset := newTestServerWithConfig(t, &Config{Port: "0", TemplatesDir: dir, TemplatesConfigMap: "default/role-templates"}, append(seedObjects(), configMap)...)
+
+	var catalog rbac.TemplatesResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/templates", ""), &catalog)
+	sources := make(map[string]string)
+	for _, template := range catalog.Templates {
+		sources[template.Name] = template.Source
+	}
+	wantSources := map[string]string{
+		"ci-deployer": "builtin", "developer": "builtin", "monitoring-reader": "builtin", "namespace-admin": "builtin", "read-only": "builtin",
+		"secrets-manager": "file", "log-reader": "file", "pod-runner": "file", "node-viewer": "configmap",
+	}
+	if !reflect.DeepEqual(sources, wantSources) {
+		t.Errorf("got template sources %v, want %v", sources, wantSources)
+	}
+	if len(catalog.Errors) != 1 || !strings.Contains(catalog.Errors[0], "broken.yaml") {
+		t.Errorf("got errors %v", catalog.Errors)
+	}
+
+	// Preview renders the role without creating it.
+	var preview struct {
+		rbac.RenderTemplateResponse
+		Object rbacv1.Role `json:"object"`
+	}
+	rec := doRequest(e, http.MethodPost, "/api/templates/developer/render", `{"name":"dev","namespace":"team-a","extraResources":["widgets.example.com","gadgets.example.com"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	decode(t, rec, &preview)
+	extra := preview.Object.Rules[len(preview.Object.Rules)-1]
+	if preview.Mode != "preview" || preview.Item.Action != rbac.ImportCreate || preview.Item.Applied || preview.Object.Namespace != "team-a" || preview.Object.Labels["kuberus.io/template"] != "developer" {
+		t.Errorf("got preview %+v", preview)
+	}
+	if !reflect.DeepEqual(extra.APIGroups, []string{"example.com"}) || !reflect.DeepEqual(extra.Resources, []string{"widgets", "gadgets"}) || len(extra.Verbs) != 7 {
+		t.Errorf("got extra rule %+v", extra)
+	}
+	if _, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "dev", metav1.GetOptions{}); err == nil {
+		t.Error("preview created the role")
+	}
+
+	// Resource names restrict every verb but creating resources and deleting collections,
+	// including creating subresources such as pods/exec.
+	var restricted struct {
+		Object rbacv1.Role `json:"object"`
+	}
+	decode(t, doRequest(e, http.MethodPost, "/api/templates/developer/render", `{"namespace":"team-a","resourceNames":["web"]}`), &restricted)
+	core := []string{"pods", "services", "configmaps", "persistentvolumeclaims"}
+	wantRules := []rbacv1.PolicyRule{
+		{Verbs: []string{"get", "list", "watch", "update", "patch", "delete"}, APIGroups: []string{""}, Resources: core, ResourceNames: []string{"web"}},
+		{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: core},
+		{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods/log"}, ResourceNames: []string{"web"}},
+		{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: []string{"pods/exec", "pods/portforward"}, ResourceNames: []string{"web"}},
+	}
+	if len(restricted.Object.Rules) < len(wantRules) || !reflect.DeepEqual(restricted.Object.Rules[:len(wantRules)], wantRules) {
+		t.Errorf("got rules with resource names %+v, want them to start with %+v", restricted.Object.Rules, wantRules)
+	}
+	restricted.Object = rbacv1.Role{}
+	decode(t, doRequest(e, http.MethodPost, "/api/templates/pod-runner/render", `{"namespace":"team-a","resourceNames":["web"]}`), &restricted)
+	wantRules = []rbacv1.PolicyRule{
+		{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, ResourceNames: []string{"web"}},
+		{Verbs: []string{"create", "deletecollection"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+		{Verbs: []string{"create", "get"}, APIGroups: []string{""}, Resources: []string{"pods/exec"}, ResourceNames: []string{"web"}},
+		{Verbs: []string{"deletecollection"}, APIGroups: []string{""}, Resources: []string{"pods/exec"}},
+	}
+	if !reflect.DeepEqual(restricted.Object.Rules, wantRules) {
+		t.Errorf("got rules with resource names %+v, want %+v", restricted.Object.Rules, wantRules)
+	}
+
+	// Apply creates the role, and applying it again changes nothing.
+	body := `{"name":"db-secrets","namespace":"team-a","resourceNames":["db-password"]}`
+	for _, want := range []string{rbac.ImportCreate, rbac.ImportUnchanged} {
+		rec := doRequest(e, http.MethodPost, "/api/templates/secrets-manager/render?mode=apply", body)
+		var applied rbac.ImportItem
+		decode(t, rec, &struct {
+			Item *rbac.ImportItem `json:"item"`
+		}{&applied})
+		if applied.Action != want || (want == rbac.ImportCreate && !applied.Applied) || applied.Error != "" {
+			t.Errorf("apply: got item %+v, want action %s", applied, want)
+		}
+	}
+	role, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "db-secrets", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting applied role: %v", err)
+	}
+	// The file template replaces the built-in one of the same name.
+	want := []rbacv1.PolicyRule{{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"db-password"}}}
+	if !reflect.DeepEqual(role.Rules, want) {
+		t.Errorf("got rules %+v, want %+v", role.Rules, want)
+	}
+
+	// A role rendered from the same template is updated.
+	rec = doRequest(e, http.MethodPost, "/api/templates/secrets-manager/render?mode=apply", `{"name":"db-secrets","namespace":"team-a","resourceNames":["db-password","db-user"]}`)
+	decode(t, rec, &preview)
+	if rec.Code != http.StatusOK || preview.Item.Action != rbac.ImportUpdate || !preview.Item.Applied {
+		t.Errorf("update: got status %d, item %+v", rec.Code, preview.Item)
+	}
+
+	// Rendering over an existing role previews an update, but applying it is refused unless
+	// the role was rendered from the same template.
+	decode(t, doRequest(e, http.MethodPost, "/api/templates/read-only/render", `{"name":"pod-reader","namespace":"team-a"}`), &preview)
+	if preview.Item.Action != rbac.ImportUpdate || len(preview.Item.Diff) == 0 {
+		t.Errorf("got preview over an existing role %+v", preview.Item)
+	}
+	before, _ := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{})
+	if rec := doRequest(e, http.MethodPost, "/api/templates/read-only/render?mode=apply", `{"name":"pod-reader","namespace":"team-a"}`); rec.Code != http.StatusConflict {
+		t.Errorf("apply over an unrelated role: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	if after, _ := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{}); !reflect.DeepEqual(after, before) {
+		t.Errorf("apply over an unrelated role changed it to %+v", after)
+	}
+
+	// A dry-run apply leaves the cluster unchanged.
+	clientset.PrependReactor("*", "*", dryRunReactor)
+	rec = doRequest(e, http.MethodPost, "/api/templates/read-only/render?mode=apply&dryRun=true", `{"name":"viewer","namespace":"team-a"}`)
+	decode(t, rec, &preview)
+	if rec.Code != http.StatusOK || !preview.DryRun || preview.Item.Action != rbac.ImportCreate || !preview.Item.Applied {
+		t.Errorf("dry run: got status %d, response %+v", rec.Code, preview.RenderTemplateResponse)
+	}
+	if _, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "viewer", metav1.GetOptions{}); err == nil {
+		t.Error("dry run created the role")
+	}
+
+	// Without a namespace, templates render cluster roles.
+	rec = doRequest(e, http.MethodPost, "/api/templates/node-viewer/render?mode=apply", `{}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply cluster role: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	if _, err := clientset.RbacV1().ClusterRoles().Get(context.TODO(), "node-viewer", metav1.GetOptions{}); err != nil {
+		t.Errorf("getting applied cluster role: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		code   int
+	}{
+		{"unknown template", "/api/templates/missing/render", `{}`, http.StatusNotFound},
+		{"invalid mode", "/api/templates/developer/render?mode=print", `{}`, http.StatusBadRequest},
+		{"cluster role template in a namespace", "/api/templates/monitoring-reader/render", `{"namespace":"team-a"}`, http.StatusBadRequest},
+		{"extra resources without extra verbs", "/api/templates/namespace-admin/render", `{"namespace":"team-a","extraResources":["widgets"]}`, http.StatusBadRequest},
+		{"invalid extra resource", "/api/templates/developer/render", `{"namespace":"team-a","extraResources":[".apps"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := doRequest(e, http.MethodPost, tt.target, tt.body); rec.Code != tt.code {
+				t.Errorf("got status %d, want %d, body %s", rec.Code, tt.code, rec.Body.String())
+			}
+		})
+	}
+
+	// Applies are audited, the dry run as such; previews and unchanged roles are not.
+	var records []audit.Record
+	decode(t, doRequest(e, http.MethodGet, "/api/audit", ""), &records)
+	var audited []string
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		audited = append(audited, strconv.FormatBool(record.DryRun)+" "+record.Action+" "+record.Kind+" "+record.Namespace+"/"+record.Name)
+		if record.Outcome != audit.OutcomeSuccess || record.After == nil || (record.Action == audit.ActionUpdate && record.Before == nil) {
+			t.Errorf("got template record %+v", record)
+		}
+	}
+	wantAudited := []string{"false create Role team-a/db-secrets", "false update Role team-a/db-secrets", "true create Role team-a/viewer", "false create ClusterRole /node-viewer"}
+	if !reflect.DeepEqual(audited, wantAudited) {
+		t.Errorf("got audit records %v, want %v", audited, wantAudited)
+	}
+}
+
+func TestClusterRoleDetailsAggregation(t *testing.T) {
+	e, _ := newTestServer(t, append(seedObjects(), aggregationObjects()...)...)
+
+	var response struct {
+		Aggregation *struct {
+			Selectors           []metav1.LabelSelector `json:"selectors"`
+			MatchedClusterRoles []string               `json:"matchedClusterRoles"`
+			Rules               []struct {
+				Source string `json:"source"`
+			} `json:"rules"`
+		} `json:"aggregation"`
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/clusterroles/details?clusterRoleName=monitoring", ""), &response)
+
+	if response.Aggregation == nil {
+		t.Fatal("expected aggregation details")
+	}
+	if len(response.Aggregation.Selectors) != 1 {
+		t.Errorf("got selectors %+v", response.Aggregation.Selectors)
+	}
+	if !reflect.DeepEqual(response.Aggregation.MatchedClusterRoles, []string{"metrics-reader"}) {
+		t.Errorf("got matched cluster roles %v", response.Aggregation.MatchedClusterRoles)
+	}
+	if len(response.Aggregation.Rules) != 1 || response.Aggregation.Rules[0].Source != "metrics-reader" {
+		t.Errorf("got rules %+v", response.Aggregation.Rules)
+	}
+
+	var plain struct {
+		Aggregation *json.RawMessage `json:"aggregation"`
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/clusterroles/details?clusterRoleName=viewer", ""), &plain)
+	if plain.Aggregation != nil {
+		t.Errorf("expected no aggregation for a plain cluster role, got %s", *plain.Aggregation)
+	}
+}
+
+func TestClusterRoleAggregationPreview(t *testing.T) {
+	e, _ := newTestServer(t, append(seedObjects(), aggregationObjects()...)...)
+
+	body := `{"metadata":{"labels":{"aggregate-to-monitoring":"true"}},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["list"]}]}`
+	var previews []struct {
+		ClusterRole string `json:"clusterRole"`
+		Preview     struct {
+			MatchedClusterRoles []string `json:"matchedClusterRoles"`
+		} `json:"preview"`
+		AddedRules []rbacv1.PolicyRule `json:"addedRules"`
+	}
+	decode(t, doRequest(e, http.MethodPost, "/api/clusterroles/aggregation-preview", body), &previews)
+
+	if len(previews) != 1 || previews[0].ClusterRole != "monitoring" {
+		t.Fatalf("got previews %+v", previews)
+	}
+	if !reflect.DeepEqual(previews[0].Preview.MatchedClusterRoles, []string{"kuberus-preview", "metrics-reader"}) {
+		t.Errorf("got matched cluster roles %v", previews[0].Preview.MatchedClusterRoles)
+	}
+	if len(previews[0].AddedRules) != 1 || previews[0].AddedRules[0].Resources[0] != "pods" {
+		t.Errorf("got added rules %+v", previews[0].AddedRules)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+	clientset.PrependReactor("update", "clusterroles", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewInvalid(
+			schema.GroupKind{Group: rbacv1.GroupName, Kind: "ClusterRole"}, "viewer",
+			field.ErrorList{field.Required(field.NewPath("rules").Index(0).Child("verbs"), "verbs must contain at least one value")},
+		)
+	})
+	clientset.PrependReactor("update", "roles", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(rbacv1.Resource("roles"), "pod-reader", errors.New("the object has been modified"))
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantCode   int
+		wantReason string
+		wantField  string
+	}{
+		{"not found", http.MethodGet, "/api/roles/details?namespace=team-a&roleName=missing", "", http.StatusNotFound, "NotFound", ""},
+		{"already exists", http.MethodPost, "/api/clusterroles", `{"metadata":{"name":"viewer"}}`, http.StatusConflict, "AlreadyExists", ""},
+		{"conflict", http.MethodPut, "/api/roles?namespace=team-a", `{"metadata":{"name":"pod-reader"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`, http.StatusPreconditionFailed, "PreconditionFailed", ""},
+		{"invalid", http.MethodPut, "/api/clusterroles", `{"metadata":{"name":"viewer"}}`, http.StatusUnprocessableEntity, "Invalid", "rules[0].verbs"},
+		{"bad request", http.MethodGet, "/api/userroles", "", http.StatusBadRequest, "BadRequest", ""},
+		{"unknown route", http.MethodGet, "/api/unknown", "", http.StatusNotFound, "NotFound", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequestWithHeaders(e, tt.method, tt.target, tt.body, map[string]string{"If-Match": utils.ETag("1")})
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d, body %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+
+			var response utils.ErrorResponse
+			decode(t, rec, &response)
+			if response.Code != tt.wantCode || response.Reason != tt.wantReason || response.Message == "" {
+				t.Errorf("got error response %+v", response)
+			}
+			if response.RequestID == "" || response.RequestID != rec.Header().Get(echo.HeaderXRequestID) {
+				t.Errorf("got request ID %q, header %q", response.RequestID, rec.Header().Get(echo.HeaderXRequestID))
+			}
+			if tt.wantField != "" && (len(response.Causes) != 1 || response.Causes[0].Field != tt.wantField) {
+				t.Errorf("got causes %+v, want a cause for %s", response.Causes, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestUpdatePreconditions(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+	body := `{"metadata":{"name":"pod-reader","namespace":"team-a"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get","watch"]}]}`
+
+	rec := doRequest(e, http.MethodGet, "/api/roles/details?namespace=team-a&roleName=pod-reader", "")
+	etag := rec.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("got ETag %q, want %q", etag, `"1"`)
+	}
+
+	rec = doRequest(e, http.MethodPut, "/api/roles?namespace=team-a", body)
+	if rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("update without If-Match: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	// Someone else changes the role after it was read.
+	role, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	role.ResourceVersion = "2"
+	role.Rules[0].Verbs = []string{"get", "list", "delete"}
+	if _, err := clientset.RbacV1().Roles("team-a").Update(context.TODO(), role, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = doRequestWithHeaders(e, http.MethodPut, "/api/roles?namespace=team-a", body, map[string]string{"If-Match": etag})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale update: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var response struct {
+		utils.ErrorResponse
+		Current rbacv1.Role `json:"current"`
+	}
+	decode(t, rec, &response)
+	if response.Reason != "PreconditionFailed" || response.ETag != `"2"` || response.Current.ResourceVersion != "2" {
+		t.Errorf("got error response %+v", response)
+	}
+	wantDiff := []utils.FieldDiff{
+		{Path: "rules[0].verbs[1]", Op: utils.DiffChanged, From: "list", To: "watch"},
+		{Path: "rules[0].verbs[2]", Op: utils.DiffRemoved, From: "delete"},
+	}
+	if !reflect.DeepEqual(response.Diff, wantDiff) {
+		t.Errorf("got diff %+v, want %+v", response.Diff, wantDiff)
+	}
+
+	rec = doRequestWithHeaders(e, http.MethodPut, "/api/roles?namespace=team-a", body, map[string]string{"If-Match": response.ETag})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update with current ETag: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") == "" {
+		t.Error("update response has no ETag")
+	}
+}
+
+func TestPatch(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"json patch role", "/api/roles?namespace=team-a&name=pod-reader", "application/json-patch+json", `[{"op":"add","path":"/rules/0/verbs/-","value":"watch"}]`, http.StatusOK},
+		{"merge patch namespace", "/api/namespaces?name=team-a", "application/merge-patch+json", `{"metadata":{"labels":{"team":"a"}}}`, http.StatusOK},
+		{"merge patch service account", "/api/serviceaccounts?namespace=team-a&name=deployer", "application/merge-patch+json", `{"automountServiceAccountToken":false}`, http.StatusOK},
+		{"merge patch role binding", "/api/rolebindings?namespace=team-a&name=read-pods", "application/merge-patch+json", `{"metadata":{"labels":{"team":"a"}}}`, http.StatusOK},
+		{"merge patch cluster role binding", "/api/clusterrolebindings?name=view-all", "application/merge-patch+json", `{"metadata":{"labels":{"team":"a"}}}`, http.StatusOK},
+		{"patch without name", "/api/clusterroles", "application/merge-patch+json", `{}`, http.StatusBadRequest},
+		{"force without apply", "/api/clusterroles?name=viewer&force=true", "application/merge-patch+json", `{}`, http.StatusBadRequest},
+		{"patch missing role", "/api/roles?namespace=team-a&name=missing", "application/merge-patch+json", `{}`, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequestWithHeaders(e, http.MethodPatch, tt.target, tt.body, map[string]string{echo.HeaderContentType: tt.contentType})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	role, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(role.Rules[0].Verbs, []string{"get", "list", "watch"}) {
+		t.Errorf("got verbs %v after JSON patch", role.Rules[0].Verbs)
+	}
+	namespace, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "team-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace.Labels["team"] != "a" {
+		t.Errorf("got labels %v after merge patch", namespace.Labels)
+	}
+}
+
+func TestServerSideApply(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+	applyHeaders := map[string]string{echo.HeaderContentType: "application/apply-patch+yaml"}
+
+	// Another manager owns the verbs of the monitoring cluster role.
+	owned := `{"apiVersion":"rbac.authorization.k8s.io/v1","kind":"ClusterRole","metadata":{"name":"monitoring"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`
+	if _, err := clientset.RbacV1().ClusterRoles().Patch(context.TODO(), "monitoring", "application/apply-patch+yaml", []byte(owned), metav1.PatchOptions{FieldManager: "helm"}); err != nil {
+		t.Fatalf("applying as another manager: %v", err)
+	}
+
+	body := "apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: monitoring\nrules:\n- apiGroups: [\"\"]\n  resources: [pods]\n  verbs: [get, list]\n"
+	rec := doRequestWithHeaders(e, http.MethodPatch, "/api/clusterroles?name=monitoring", body, applyHeaders)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("conflicting apply: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var response utils.ErrorResponse
+	decode(t, rec, &response)
+	if len(response.Conflicts) == 0 || response.Conflicts[0].Manager != "helm" || !strings.Contains(response.Message, "force=true") {
+		t.Errorf("got error response %+v", response)
+	}
+
+	rec = doRequestWithHeaders(e, http.MethodPatch, "/api/clusterroles?name=monitoring&force=true", body, applyHeaders)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("forced apply: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	clusterRole, err := clientset.RbacV1().ClusterRoles().Get(context.TODO(), "monitoring", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(clusterRole.Rules[0].Verbs, []string{"get", "list"}) {
+		t.Errorf("got verbs %v after forced apply", clusterRole.Rules[0].Verbs)
+	}
+	managers := map[string]bool{}
+	for _, entry := range clusterRole.ManagedFields {
+		managers[entry.Manager] = true
+	}
+	if !managers[utils.FieldManager] {
+		t.Errorf("got managed fields %+v, want an entry for %s", clusterRole.ManagedFields, utils.FieldManager)
+	}
+}
+
+// dryRunReactor answers dry-run creates, updates and deletes without persisting anything,
+// which the fake object tracker does not do on its own.
+func dryRunReactor(action k8stesting.Action) (bool, runtime.Object, error) {
+	switch action := action.(type) {
+	case k8stesting.CreateActionImpl:
+		if len(action.CreateOptions.DryRun) > 0 {
+			return true, action.GetObject(), nil
+		}
+	case k8stesting.UpdateActionImpl:
+		if len(action.UpdateOptions.DryRun) > 0 {
+			return true, action.GetObject(), nil
+		}
+	case k8stesting.DeleteActionImpl:
+		if len(action.DeleteOptions.DryRun) > 0 {
+			return true, nil, nil
+		}
+	}
+	return false, nil, nil
+}
+
+func TestDryRun(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+	clientset.PrependReactor("*", "*", dryRunReactor)
+
+	t.Run("create", func(t *testing.T) {
+		rec := doRequest(e, http.MethodPost, "/api/roles?namespace=team-a&dryRun=true", `{"metadata":{"name":"new-role"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+		}
+		var response struct {
+			utils.DryRunResponse
+			Object rbacv1.Role `json:"object"`
+		}
+		decode(t, rec, &response)
+		if !response.DryRun || response.Object.Name != "new-role" || response.Current != nil {
+			t.Errorf("got response %+v", response)
+		}
+		if len(response.Diff) == 0 || response.Diff[0].Op != utils.DiffAdded {
+			t.Errorf("got diff %+v", response.Diff)
+		}
+		if _, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "new-role", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("dry-run create persisted the role: %v", err)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		body := `{"metadata":{"name":"read-pods","namespace":"team-a"},"roleRef":{"kind":"Role","name":"pod-reader"},"subjects":[{"kind":"User","name":"carol"}]}`
+		rec := doRequestWithHeaders(e, http.MethodPut, "/api/rolebindings?namespace=team-a&dryRun=true", body, map[string]string{"If-Match": utils.ETag("1")})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+		}
+		var response utils.DryRunResponse
+		decode(t, rec, &response)
+		if response.Current == nil || response.Object == nil {
+			t.Errorf("got response %+v", response)
+		}
+		found := false
+		for _, diff := range response.Diff {
+			if diff.Path == "subjects[0].name" && diff.From == "alice" && diff.To == "carol" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("got diff %+v, want subjects[0].name changed from alice to carol", response.Diff)
+		}
+		roleBinding, err := clientset.RbacV1().RoleBindings("team-a").Get(context.TODO(), "read-pods", metav1.GetOptions{})
+		if err != nil || len(roleBinding.Subjects) != 4 {
+			t.Errorf("dry-run update changed the role binding: %+v, %v", roleBinding, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		rec := doRequest(e, http.MethodDelete, "/api/clusterroles?name=viewer&dryRun=true", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+		}
+		var response utils.DryRunResponse
+		decode(t, rec, &response)
+		if response.Current == nil || response.Object != nil || len(response.Diff) != 1 || response.Diff[0].Op != utils.DiffRemoved {
+			t.Errorf("got response %+v", response)
+		}
+		if _, err := clientset.RbacV1().ClusterRoles().Get(context.TODO(), "viewer", metav1.GetOptions{}); err != nil {
+			t.Errorf("dry-run delete removed the cluster role: %v", err)
+		}
+	})
+
+	t.Run("patch", func(t *testing.T) {
+		clientset.ClearActions()
+		rec := doRequestWithHeaders(e, http.MethodPatch, "/api/serviceaccounts?namespace=team-a&name=deployer&dryRun=true", `{"automountServiceAccountToken":false}`,
+			map[string]string{echo.HeaderContentType: "application/merge-patch+json"})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+		}
+		var response utils.DryRunResponse
+		decode(t, rec, &response)
+		if len(response.Diff) != 1 || response.Diff[0].Path != "automountServiceAccountToken" {
+			t.Errorf("got diff %+v", response.Diff)
+		}
+		for _, action := range clientset.Actions() {
+			if patch, ok := action.(k8stesting.PatchActionImpl); ok && !reflect.DeepEqual(patch.PatchOptions.DryRun, []string{metav1.DryRunAll}) {
+				t.Errorf("got patch dry run %v, want All", patch.PatchOptions.DryRun)
+			}
+		}
+	})
+
+	t.Run("invalid parameter", func(t *testing.T) {
+		rec := doRequest(e, http.MethodDelete, "/api/clusterroles?name=viewer&dryRun=maybe", "")
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestAdmissionDenied(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+	clientset.PrependReactor("create", "rolebindings", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, &apierrors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Message: `admission webhook "rbac-policy.example.com" denied the request: bindings to system:anonymous are not allowed`,
+		}}
+	})
+
+	rec := doRequest(e, http.MethodPost, "/api/rolebindings?namespace=team-a&dryRun=true", `{"metadata":{"name":"anonymous"},"roleRef":{"kind":"Role","name":"pod-reader"},"subjects":[{"kind":"User","name":"system:anonymous"}]}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var response utils.ErrorResponse
+	decode(t, rec, &response)
+	if response.Reason != "Invalid" || len(response.Causes) != 1 || response.Causes[0].Type != utils.CauseTypeAdmissionDenied {
+		t.Errorf("got error response %+v", response)
+	}
+}
+
+// sseEvent is one event read from a Server-Sent Events stream.
+type sseEvent struct {
+	id, event, data string
+	comments        []string
+}
+
+// readSSEEvent reads the next event or comment block from the stream.
+func readSSEEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+	var event sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event
+		case strings.HasPrefix(line, ":"):
+			event.comments = append(event.comments, strings.TrimSpace(line[1:]))
+		case strings.HasPrefix(line, "id: "):
+			event.id = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			event.event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			event.data = line[len("data: "):]
+		}
+	}
+}
+
+// openWatch opens the watch stream and waits until every watch is established.
+func openWatch(t *testing.T, server *httptest.Server, query string, headers map[string]string) *bufio.Reader {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/watch"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(echo.HeaderContentType) != "text/event-stream" {
+		t.Fatalf("got status %d, content type %q", resp.StatusCode, resp.Header.Get(echo.HeaderContentType))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readSSEEvent(t, reader)
+	return reader
+}
+
+func TestWatch(t *testing.T) {
+	e, clientset := newTestServerWithConfig(t, &Config{Port: "0", WatchHeartbeat: 50 * time.Millisecond}, seedObjects()...)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	reader := openWatch(t, server, "?kind=Role,RoleBinding&namespace=team-a", nil)
+
+	// Changes in other namespaces and to other kinds are filtered out.
+	if _, err := clientset.RbacV1().Roles("default").Create(context.TODO(), &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "elsewhere"}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().ServiceAccounts("team-a").Create(context.TODO(), &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "builder"}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "watched", ResourceVersion: "5"}}
+	if _, err := clientset.RbacV1().Roles("team-a").Create(context.TODO(), role, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var event sseEvent
+	heartbeats := 0
+	for event.event == "" {
+		event = readSSEEvent(t, reader)
+		for _, comment := range event.comments {
+			if comment == "heartbeat" {
+				heartbeats++
+			}
+		}
+	}
+	var data struct {
+		Type            string      `json:"type"`
+		Kind            string      `json:"kind"`
+		Namespace       string      `json:"namespace"`
+		Name            string      `json:"name"`
+		ResourceVersion string      `json:"resourceVersion"`
+		Object          rbacv1.Role `json:"object"`
+	}
+	if err := json.Unmarshal([]byte(event.data), &data); err != nil {
+		t.Fatal(err)
+	}
+	if event.event != "ADDED" || data.Kind != "Role" || data.Namespace != "team-a" || data.Name != "watched" || data.Object.Name != "watched" {
+		t.Fatalf("got event %q with data %s", event.event, event.data)
+	}
+	if event.id == "" {
+		t.Error("event has no resume id")
+	}
+
+	// Heartbeats keep arriving while nothing changes.
+	for heartbeats == 0 {
+		for _, comment := range readSSEEvent(t, reader).comments {
+			if comment == "heartbeat" {
+				heartbeats++
+			}
+		}
+	}
+
+	// A reconnect with the last event id resumes from the recorded resourceVersion.
+	clientset.ClearActions()
+	openWatch(t, server, "?kind=Role&namespace=team-a", map[string]string{"Last-Event-ID": event.id})
+	resumed := false
+	for _, action := range clientset.Actions() {
+		if watchAction, ok := action.(k8stesting.WatchActionImpl); ok && watchAction.GetResource().Resource == "roles" {
+			resumed = watchAction.WatchRestrictions.ResourceVersion == "5"
+		}
+	}
+	if !resumed {
+		t.Errorf("reconnect did not resume the role watch from resourceVersion 5: %+v", clientset.Actions())
+	}
+
+	if rec := doRequest(e, http.MethodGet, "/api/watch?kind=Pod", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown kind: got status %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/watch?since=not-a-token", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid token: got status %d", rec.Code)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	config := &Config{Port: "0", AuditSinks: []string{AuditSinkStore, AuditSinkFile}}
+	e, _ := newTestServerWithConfig(t, config, seedObjects()...)
+
+	rec := doRequestWithHeaders(e, http.MethodPost, "/api/roles?namespace=team-a", `{"metadata":{"name":"new-role"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`,
+		map[string]string{"X-Forwarded-User": "alice"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequestWithHeaders(e, http.MethodPut, "/api/clusterroles", `{"metadata":{"name":"viewer"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`,
+		map[string]string{"X-Forwarded-User": "bob", "If-Match": utils.ETag("1")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	doRequestWithHeaders(e, http.MethodDelete, "/api/roles?namespace=team-a&name=missing", "", map[string]string{"X-Forwarded-User": "alice"})
+	doRequest(e, http.MethodGet, "/api/roles?namespace=team-a", "")
+
+	var records []audit.Record
+	decode(t, doRequest(e, http.MethodGet, "/api/audit", ""), &records)
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3: %+v", len(records), records)
+	}
+
+	deleted, updated, created := records[0], records[1], records[2]
+	if created.Actor != "alice" || created.Action != audit.ActionCreate || created.Kind != "Role" || created.Namespace != "team-a" || created.Name != "new-role" ||
+		created.Outcome != audit.OutcomeSuccess || created.Before != nil || created.After == nil || created.RequestID == "" || created.Cluster != "test" {
+		t.Errorf("got create record %+v", created)
+	}
+	if updated.Actor != "bob" || updated.Action != audit.ActionUpdate || updated.Kind != "ClusterRole" || updated.Before == nil || updated.After == nil {
+		t.Errorf("got update record %+v", updated)
+	}
+	if deleted.Action != audit.ActionDelete || deleted.Outcome != audit.OutcomeFailure || deleted.Code != http.StatusNotFound || deleted.Error == "" {
+		t.Errorf("got delete record %+v", deleted)
+	}
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/api/audit?actor=alice", 2},
+		{"/api/audit?kind=ClusterRole", 1},
+		{"/api/audit?namespace=team-a", 2},
+		{"/api/audit?since=" + created.Time.Add(time.Nanosecond).Format(time.RFC3339Nano), 2},
+		{"/api/audit?until=" + updated.Time.Format(time.RFC3339Nano), 1},
+		{"/api/audit?limit=1", 1},
+	}
+	for _, tt := range tests {
+		var got []audit.Record
+		decode(t, doRequest(e, http.MethodGet, tt.target, ""), &got)
+		if len(got) != tt.want {
+			t.Errorf("GET %s: got %d records, want %d", tt.target, len(got), tt.want)
+		}
+	}
+
+	// The JSONL file sink received the same records.
+	data, err := os.ReadFile(config.AuditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("got %d lines in the audit file, want 3", lines)
+	}
+}
+
+// bumpResourceVersion makes the fake clientset advance the resourceVersion of updated objects,
+// as the API server does.
+func bumpResourceVersion(action k8stesting.Action) (bool, runtime.Object, error) {
+	obj := action.(k8stesting.UpdateAction).GetObject().(metav1.Object)
+	version, _ := strconv.Atoi(obj.GetResourceVersion())
+	obj.SetResourceVersion(strconv.Itoa(version + 1))
+	return false, nil, nil
+}
+
+// waitForRevisions polls the history of an object until it has n revisions.
+func waitForRevisions(t *testing.T, e *echo.Echo, query string, n int) []history.Revision {
+	t.Helper()
+	var response rbac.HistoryResponse
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		decode(t, doRequest(e, http.MethodGet, "/api/history?"+query, ""), &response)
+		if len(response.Revisions) >= n {
+			return response.Revisions
+		}
+	}
+	t.Fatalf("history %s: got %d revisions, want %d", query, len(response.Revisions), n)
+	return nil
+}
+
+func TestHistory(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+	clientset.PrependReactor("update", "roles", bumpResourceVersion)
+	const query = "kind=Role&namespace=team-a&name=pod-reader"
+
+	// The object found at startup is the first revision.
+	revisions := waitForRevisions(t, e, query, 1)
+	if revisions[0].Revision != 1 || revisions[0].Source != history.SourceWatch || revisions[0].ResourceVersion != "1" {
+		t.Errorf("got first revision %+v", revisions[0])
+	}
+
+	// A change through Kuberus is attributed to its actor, and not recorded again by the watch.
+	rec := doRequestWithHeaders(e, http.MethodPut, "/api/roles?namespace=team-a", `{"metadata":{"name":"pod-reader"},"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["get"]}]}`,
+		map[string]string{"X-Forwarded-User": "alice", "If-Match": utils.ETag("1")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	revisions = waitForRevisions(t, e, query, 2)
+	if revisions[1].Source != history.SourceKuberus || revisions[1].Actor != "alice" || revisions[1].ResourceVersion != "2" {
+		t.Errorf("got Kuberus revision %+v", revisions[1])
+	}
+
+	// A change made by another client is recorded from the watch.
+	role, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	role.Rules[0].Verbs = []string{"get", "list", "watch"}
+	if _, err := clientset.RbacV1().Roles("team-a").Update(context.TODO(), role, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	revisions = waitForRevisions(t, e, query, 3)
+	if len(revisions) != 3 || revisions[2].Source != history.SourceWatch || revisions[2].ResourceVersion != "3" {
+		t.Fatalf("got revisions %+v", revisions)
+	}
+
+	var response rbac.HistoryResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/history?"+query+"&from=1&to=2", ""), &response)
+	want := []utils.FieldDiff{{Path: "rules[0].verbs[1]", Op: utils.DiffRemoved, From: "list"}}
+	if response.Diff == nil || !reflect.DeepEqual(response.Diff.Changes, want) {
+		t.Errorf("got diff %+v, want %+v", response.Diff, want)
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/history?"+query+"&from=2", ""), &response)
+	if response.Diff == nil || response.Diff.To != 3 || len(response.Diff.Changes) != 2 {
+		t.Errorf("got diff to the latest revision %+v", response.Diff)
+	}
+
+	errorTests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers map[string]string
+		want    int
+	}{
+		{"invalid kind", http.MethodGet, "/api/history?kind=Pod&name=x", "", nil, http.StatusBadRequest},
+		{"missing revision in diff", http.MethodGet, "/api/history?" + query + "&from=1&to=9", "", nil, http.StatusNotFound},
+		{"missing revision", http.MethodPost, "/api/history/rollback", `{"kind":"Role","namespace":"team-a","name":"pod-reader","revision":9}`, map[string]string{"If-Match": utils.ETag("3")}, http.StatusNotFound},
+		{"no If-Match", http.MethodPost, "/api/history/rollback", `{"kind":"Role","namespace":"team-a","name":"pod-reader","revision":1}`, nil, http.StatusPreconditionRequired},
+		{"stale If-Match", http.MethodPost, "/api/history/rollback", `{"kind":"Role","namespace":"team-a","name":"pod-reader","revision":1}`, map[string]string{"If-Match": utils.ETag("2")}, http.StatusPreconditionFailed},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := doRequestWithHeaders(e, tt.method, tt.target, tt.body, tt.headers); rec.Code != tt.want {
+				t.Errorf("got status %d, want %d, body %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+
+	// Rolling back restores the rules of the revision.
+	rec = doRequestWithHeaders(e, http.MethodPost, "/api/history/rollback", `{"kind":"Role","namespace":"team-a","name":"pod-reader","revision":1}`,
+		map[string]string{"X-Forwarded-User": "bob", "If-Match": utils.ETag("3")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rollback: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	role, err = clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(role.Rules[0].Verbs, []string{"get", "list"}) {
+		t.Errorf("got verbs %v after rollback", role.Rules[0].Verbs)
+	}
+	revisions = waitForRevisions(t, e, query, 4)
+	if revisions[3].Actor != "bob" {
+		t.Errorf("got rollback revision %+v", revisions[3])
+	}
+
+	var records []audit.Record
+	decode(t, doRequest(e, http.MethodGet, "/api/audit?actor=bob", ""), &records)
+	if len(records) != 1 || records[0].Action != audit.ActionRollback || records[0].Kind != "Role" || records[0].Name != "pod-reader" || records[0].Before == nil {
+		t.Errorf("got rollback audit records %+v", records)
+	}
+
+	// A deleted object is recreated from its revision.
+	if rec := doRequest(e, http.MethodDelete, "/api/roles?namespace=team-a&name=pod-reader", ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	revisions = waitForRevisions(t, e, query, 5)
+	if !revisions[4].Deleted {
+		t.Errorf("got deletion revision %+v", revisions[4])
+	}
+	rec = doRequest(e, http.MethodPost, "/api/history/rollback", `{"kind":"Role","namespace":"team-a","name":"pod-reader","revision":3}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	role, err = clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(role.Rules[0].Verbs, []string{"get", "list", "watch"}) {
+		t.Errorf("got verbs %v after restore", role.Rules[0].Verbs)
+	}
+}
+
+// importBundle is a bundle with an object of every plan action, with a binding listed before
+// the namespace and role it needs.
+const importBundle = `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: deployers
+  namespace: team-b
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: deployer
+subjects:
+- kind: User
+  apiGroup: rbac.authorization.k8s.io
+  name: carol
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: deployer
+  namespace: team-b
+rules:
+- apiGroups: ["apps"]
+  resources: ["deployments"]
+  verbs: ["get", "update"]
+---
+# The pod reader gains watch.
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: pod-reader
+  namespace: team-a
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["get", "list", "watch"]
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team-b
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: viewer
+rules:
+- apiGroups: ["*"]
+  resources: ["*"]
+  verbs: ["get"]
+`
+
+func TestImport(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+	clientset.PrependReactor("*", "*", dryRunReactor)
+
+	rec := doRequest(e, http.MethodPost, "/api/import", importBundle)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("plan: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var plan rbac.ImportResponse
+	decode(t, rec, &plan)
+	var got []string
+	for _, item := range plan.Items {
+		got = append(got, item.Action+" "+item.Kind+" "+item.Namespace+"/"+item.Name)
+	}
+	want := []string{
+		"create Namespace /team-b",
+		"create Role team-b/deployer",
+		"update Role team-a/pod-reader",
+		"unchanged ClusterRole /viewer",
+		"create RoleBinding team-b/deployers",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got plan %v, want %v", got, want)
+	}
+	wantDiff := []utils.FieldDiff{{Path: "rules[0].verbs[2]", Op: utils.DiffAdded, To: "watch"}}
+	if !reflect.DeepEqual(plan.Items[2].Diff, wantDiff) {
+		t.Errorf("got update diff %+v, want %+v", plan.Items[2].Diff, wantDiff)
+	}
+	if plan.Confirmed || plan.Summary != (rbac.ImportSummary{Create: 3, Update: 1, Unchanged: 1}) {
+		t.Errorf("got plan summary %+v, confirmed %v", plan.Summary, plan.Confirmed)
+	}
+	if _, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "team-b", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("planning created the namespace: %v", err)
+	}
+
+	// A dry-run apply goes through the API server without changing anything.
+	rec = doRequest(e, http.MethodPost, "/api/import?confirm=true&dryRun=true", importBundle)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dry-run apply: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var dryRun rbac.ImportResponse
+	decode(t, rec, &dryRun)
+	if !dryRun.Confirmed || !dryRun.DryRun || dryRun.Summary != plan.Summary {
+		t.Errorf("got dry-run response %+v", dryRun)
+	}
+	if _, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "team-b", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("dry-run apply created the namespace: %v", err)
+	}
+	if role, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{}); err != nil || len(role.Rules[0].Verbs) != 2 {
+		t.Errorf("dry-run apply updated pod-reader: %+v, %v", role, err)
+	}
+
+	clientset.ClearActions()
+	rec = doRequestWithHeaders(e, http.MethodPost, "/api/import?confirm=true", importBundle, map[string]string{"X-Forwarded-User": "alice"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var applied rbac.ImportResponse
+	decode(t, rec, &applied)
+	for _, item := range applied.Items {
+		if item.Applied != (item.Action != rbac.ImportUnchanged) || item.Error != "" {
+			t.Errorf("got result %+v", item)
+		}
+	}
+	var writes []string
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "create" || action.GetVerb() == "update" {
+			writes = append(writes, action.GetVerb()+" "+action.GetResource().Resource)
+		}
+	}
+	if want := []string{"create namespaces", "create roles", "update roles", "create rolebindings"}; !reflect.DeepEqual(writes, want) {
+		t.Errorf("got writes %v, want %v", writes, want)
+	}
+	role, err := clientset.RbacV1().Roles("team-a").Get(context.TODO(), "pod-reader", metav1.GetOptions{})
+	if err != nil || len(role.Rules[0].Verbs) != 3 {
+		t.Errorf("got pod-reader %+v, %v", role, err)
+	}
+
+	// Every applied object is audited on its own, and the dry run is marked as such.
+	var records []audit.Record
+	decode(t, doRequest(e, http.MethodGet, "/api/audit", ""), &records)
+	var audited []string
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		audited = append(audited, strconv.FormatBool(record.DryRun)+" "+record.Action+" "+record.Kind+" "+record.Namespace+"/"+record.Name)
+		if !record.DryRun && (record.Actor != "alice" || record.Outcome != audit.OutcomeSuccess || record.After == nil) {
+			t.Errorf("got import record %+v", record)
+		}
+		if record.Action == audit.ActionUpdate && record.Before == nil {
+			t.Errorf("got update record without the object before it: %+v", record)
+		}
+	}
+	wantAudited := []string{
+		"true create Namespace /team-b", "true create Role team-b/deployer", "true update Role team-a/pod-reader", "true create RoleBinding team-b/deployers",
+		"false create Namespace /team-b", "false create Role team-b/deployer", "false update Role team-a/pod-reader", "false create RoleBinding team-b/deployers",
+	}
+	if !reflect.DeepEqual(audited, wantAudited) {
+		t.Errorf("got audit records %v, want %v", audited, wantAudited)
+	}
+	if revisions := waitForRevisions(t, e, "kind=Role&namespace=team-b&name=deployer", 1); revisions[0].Source != history.SourceKuberus || revisions[0].Actor != "alice" {
+		t.Errorf("got imported revision %+v", revisions[0])
+	}
+
+	// Importing again changes nothing.
+	decode(t, doRequest(e, http.MethodPost, "/api/import", importBundle), &plan)
+	if plan.Summary != (rbac.ImportSummary{Unchanged: 5}) {
+		t.Errorf("got summary %+v after apply", plan.Summary)
+	}
+
+	// JSON lists and List objects are read too; namespaced objects default to the namespace parameter.
+	rec = doRequest(e, http.MethodPost, "/api/import?namespace=team-a", `[{"apiVersion":"v1","kind":"List","items":[{"apiVersion":"v1","kind":"ServiceAccount","metadata":{"name":"builder"}}]}]`)
+	decode(t, rec, &plan)
+	if len(plan.Items) != 1 || plan.Items[0].Action != rbac.ImportCreate || plan.Items[0].Namespace != "team-a" {
+		t.Errorf("got JSON list plan %+v", plan.Items)
+	}
+
+	invalid := `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: empty
+  namespace: team-a
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: read-pods
+  namespace: team-a
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: viewer
+subjects:
+- kind: User
+  apiGroup: rbac.authorization.k8s.io
+  name: alice
+`
+	decode(t, doRequest(e, http.MethodPost, "/api/import", invalid), &plan)
+	if plan.Summary.Invalid != 2 || plan.Items[0].Error == "" || plan.Items[1].Error == "" {
+		t.Errorf("got invalid plan %+v", plan.Items)
+	}
+	rec = doRequest(e, http.MethodPost, "/api/import?confirm=true", invalid)
+	var errorResponse utils.ErrorResponse
+	decode(t, rec, &errorResponse)
+	if rec.Code != http.StatusUnprocessableEntity || len(errorResponse.Causes) != 2 {
+		t.Errorf("confirming an invalid bundle: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	rec = doRequest(e, http.MethodPost, "/api/import", "apiVersion: v1\nkind: Pod\nmetadata:\n  name: p\n---\nkind: [\n")
+	decode(t, rec, &errorResponse)
+	if rec.Code != http.StatusBadRequest || len(errorResponse.Causes) != 2 || errorResponse.Causes[0].Field != "document 1" {
+		t.Errorf("unreadable bundle: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestExport(t *testing.T) {
+	objs := append(seedObjects(),
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "system:node",
+				UID:               "0a1b",
+				CreationTimestamp: metav1.Now(),
+				Labels:            map[string]string{"kubernetes.io/bootstrapping": "rbac-defaults"},
+				ManagedFields:     []metav1.ManagedFieldsEntry{{Manager: "kube-apiserver"}},
+			},
+			Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get"}}},
+		},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "labelled", Namespace: "default", Labels: map[string]string{"team": "b"}},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}}},
+		},
+	)
+	e, _ := newTestServer(t, objs...)
+
+	rec := doRequest(e, http.MethodGet, "/api/export", "")
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "application/yaml" {
+		t.Fatalf("got status %d, content type %q", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+	body := rec.Body.String()
+	for _, field := range []string{"resourceVersion", "uid:", "creationTimestamp", "managedFields"} {
+		if strings.Contains(body, field) {
+			t.Errorf("export contains %s:\n%s", field, body)
+		}
+	}
+	if documents := strings.Count(body, "\n---\n") + 1; documents != 7 || !strings.Contains(body, "apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\n") {
+		t.Errorf("got %d documents:\n%s", documents, body)
+	}
+
+	// The export applies cleanly to the cluster it came from.
+	var plan rbac.ImportResponse
+	decode(t, doRequest(e, http.MethodPost, "/api/import", body), &plan)
+	if plan.Summary != (rbac.ImportSummary{Unchanged: 7}) {
+		t.Errorf("importing the export: got summary %+v, items %+v", plan.Summary, plan.Items)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"excludeSystem=true", []string{"ClusterRole/viewer.yaml", "Role/default/labelled.yaml", "Role/team-a/pod-reader.yaml", "Role/team-a/unused.yaml", "ClusterRoleBinding/view-all.yaml", "RoleBinding/team-a/read-pods.yaml"}},
+		{"namespace=team-a", []string{"Role/team-a/pod-reader.yaml", "Role/team-a/unused.yaml", "RoleBinding/team-a/read-pods.yaml"}},
+		{"labelSelector=team%3Db", []string{"Role/default/labelled.yaml"}},
+	}
+	for _, tt := range tests {
+		rec := doRequest(e, http.MethodGet, "/api/export?format=tar.gz&"+tt.query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, body %s", tt.query, rec.Code, rec.Body.String())
+		}
+		gzipReader, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		tarReader := tar.NewReader(gzipReader)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, header.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got files %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	if rec := doRequest(e, http.MethodGet, "/api/export?format=zip", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid format: got status %d", rec.Code)
+	}
+}
+
+// waitForDrift polls the drift of a snapshot until its summary is want.
+func waitForDrift(t *testing.T, e *echo.Echo, id string, want snapshot.Summary) rbac.SnapshotDriftResponse {
+	t.Helper()
+	var response rbac.SnapshotDriftResponse
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		response = rbac.SnapshotDriftResponse{}
+		decode(t, doRequest(e, http.MethodGet, "/api/snapshots/"+id+"/drift", ""), &response)
+		if response.Report != nil && response.Summary == want {
+			return response
+		}
+	}
+	t.Fatalf("got drift %+v, want summary %+v", response.Report, want)
+	return response
+}
+
+func TestSnapshots(t *testing.T) {
+	e, clientset := newTestServer(t, seedObjects()...)
+
+	rec := doRequest(e, http.MethodPost, "/api/snapshots?description=before", "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var snap snapshot.Snapshot
+	decode(t, rec, &snap)
+	if snap.ID != "1" || snap.Source != snapshot.SourceCluster || snap.Count != 5 || snap.Description != "before" || snap.Objects != nil {
+		t.Errorf("got snapshot %+v", snap)
+	}
+	waitForDrift(t, e, "1", snapshot.Summary{})
+
+	// A label edit is cosmetic; a new subject is semantic and gains the role's permissions.
+	viewer, err := clientset.RbacV1().ClusterRoles().Get(context.TODO(), "viewer", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer.Labels = map[string]string{"team": "platform"}
+	if _, err := clientset.RbacV1().ClusterRoles().Update(context.TODO(), viewer, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	binding, err := clientset.RbacV1().RoleBindings("team-a").Get(context.TODO(), "read-pods", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binding.Subjects = append(binding.Subjects, rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "carol"})
+	if _, err := clientset.RbacV1().RoleBindings("team-a").Update(context.TODO(), binding, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.RbacV1().Roles("team-a").Create(context.TODO(), &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "team-a"}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientset.RbacV1().Roles("team-a").Delete(context.TODO(), "unused", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	drift := waitForDrift(t, e, "1", snapshot.Summary{Added: 1, Removed: 1, Modified: 2, Semantic: 1, Cosmetic: 1})
+	if !drift.Drifted || drift.Added[0].Name != "new" || drift.Removed[0].Name != "unused" {
+		t.Errorf("got added %+v, removed %+v", drift.Added, drift.Removed)
+	}
+	for _, change := range drift.Modified {
+		switch change.Name {
+		case "viewer":
+			if len(change.Semantic) != 0 || len(change.Cosmetic) != 1 || change.Cosmetic[0].Path != "metadata.labels" {
+				t.Errorf("got viewer change %+v", change)
+			}
+		case "read-pods":
+			if len(change.Semantic) != 1 || change.Semantic[0].Path != "subjects[4]" || len(change.Cosmetic) != 0 {
+				t.Errorf("got read-pods change %+v", change)
+			}
+		default:
+			t.Errorf("unexpected change %+v", change)
+		}
+	}
+	wantPermissions := []snapshot.PermissionChange{{
+		Subject: rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "carol"},
+		Gained: []policy.Permission{
+			{Namespace: "team-a", Verb: "get", Resource: "pods"},
+			{Namespace: "team-a", Verb: "list", Resource: "pods"},
+		},
+	}}
+	if !reflect.DeepEqual(drift.PermissionChanges, wantPermissions) {
+		t.Errorf("got permission changes %+v, want %+v", drift.PermissionChanges, wantPermissions)
+	}
+
+	// An uploaded baseline is compared with the live objects in its scope; the objects it holds
+	// outside that scope are dropped rather than reported as removed.
+	baseline := `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: pod-reader
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["get"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: pod-reader
+  namespace: team-b
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: system:leader-locking
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: team-a-viewer
+`
+	rec = doRequest(e, http.MethodPost, "/api/snapshots?namespace=team-a&excludeSystem=true", baseline)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	decode(t, rec, &snap)
+	if snap.ID != "2" || snap.Source != snapshot.SourceUpload || snap.Scope.Namespace != "team-a" {
+		t.Errorf("got uploaded snapshot %+v", snap)
+	}
+	drift = waitForDrift(t, e, "2", snapshot.Summary{Added: 2, Modified: 1, Semantic: 1})
+	if drift.Modified[0].Name != "pod-reader" || drift.Modified[0].Semantic[0].Path != "rules[0].verbs[1]" {
+		t.Errorf("got modified %+v", drift.Modified)
+	}
+
+	var list []snapshot.Snapshot
+	decode(t, doRequest(e, http.MethodGet, "/api/snapshots", ""), &list)
+	if len(list) != 2 || list[0].ID != "2" || list[1].ID != "1" {
+		t.Errorf("got snapshots %+v", list)
+	}
+	rec = doRequest(e, http.MethodGet, "/api/snapshots/1?format=yaml", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "name: unused\n") {
+		t.Errorf("got status %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	errorTests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{"unsupported kind", http.MethodPost, "/api/snapshots", "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: x\n", http.StatusBadRequest},
+		{"invalid baseline", http.MethodPost, "/api/snapshots", "kind: [", http.StatusBadRequest},
+		{"missing snapshot", http.MethodGet, "/api/snapshots/9/drift", "", http.StatusNotFound},
+		{"invalid id", http.MethodGet, "/api/snapshots/x", "", http.StatusNotFound},
+	}
+	for _, tt := range errorTests {
+		if rec := doRequest(e, tt.method, tt.target, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d, body %s", tt.name, rec.Code, tt.want, rec.Body.String())
+		}
+	}
+
+	if rec := doRequest(e, http.MethodDelete, "/api/snapshots/1", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("delete: got status %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/snapshots/1", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted snapshot: got status %d", rec.Code)
+	}
+}
+
+func TestReadyBeforeSync(t *testing.T) {
+	cluster, err := kubernetes.NewCluster("test", "", fake.NewClientset(seedObjects()...), 0)
+	if err != nil {
+		t.Fatalf("creating cluster: %v", err)
+	}
+	registry := kubernetes.NewRegistry()
+	registry.Add(cluster)
+
+	e := echo.New()
+	RegisterMiddleware(e)
+	config := &Config{Port: "0"}
+	RegisterRoutes(e, registry, newTestServices(t, config), config)
+
+	if rec := doRequest(e, http.MethodGet, "/ready", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready: got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/users", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/api/users: got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestClusterSelection(t *testing.T) {
+	registry := kubernetes.NewRegistry()
+	registry.Add(newTestCluster(t, "dev", fake.NewClientset(seedObjects()...)))
+	registry.Add(newTestCluster(t, "prod", fake.NewClientset(
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "admins"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "cluster-admin"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "root"}},
+		},
+	)))
+	registry.Add(kubernetes.NewDegradedCluster("broken", "", errors.New("no credentials")))
+
+	e := echo.New()
+	RegisterMiddleware(e)
+	config := &Config{Port: "0"}
+	RegisterRoutes(e, registry, newTestServices(t, config), config)
+
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"/api/users", []string{"alice", "bob"}},
+		{"/api/users?cluster=dev", []string{"alice", "bob"}},
+		{"/api/users?cluster=prod", []string{"root"}},
+	}
+	for _, tt := range tests {
+		var users []string
+		decode(t, doRequest(e, http.MethodGet, tt.target, ""), &users)
+		if !reflect.DeepEqual(users, tt.want) {
+			t.Errorf("%s: got users %v, want %v", tt.target, users, tt.want)
+		}
+	}
+
+	if rec := doRequest(e, http.MethodGet, "/api/roles?namespace=team-a&cluster=unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown cluster: got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// Drift is computed against the cluster the snapshot was taken in, unless another is named.
+	if rec := doRequest(e, http.MethodPost, "/api/snapshots?cluster=prod", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("snapshot of prod: got status %d, body %s", rec.Code, rec.Body.String())
+	}
+	var drift rbac.SnapshotDriftResponse
+	decode(t, doRequest(e, http.MethodGet, "/api/snapshots/1/drift", ""), &drift)
+	if drift.Cluster != "prod" || drift.CrossCluster || drift.Drifted {
+		t.Errorf("got drift of the snapshot cluster %+v", drift)
+	}
+	decode(t, doRequest(e, http.MethodGet, "/api/snapshots/1/drift?cluster=dev", ""), &drift)
+	if drift.Cluster != "dev" || !drift.CrossCluster || !drift.Drifted {
+		t.Errorf("got cross-cluster drift %+v", drift)
+	}
+
+	var clusters []kubernetes.ClusterInfo
+	decode(t, doRequest(e, http.MethodGet, "/api/clusters", ""), &clusters)
+	statuses := make(map[string]string)
+	for _, info := range clusters {
+		statuses[info.Name] = info.Status
+	}
+	want := map[string]string{"dev": kubernetes.StatusReady, "prod": kubernetes.StatusReady, "broken": kubernetes.StatusDegraded}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("got cluster statuses %v, want %v", statuses, want)
+	}
+	if !clusters[0].Default {
+		t.Errorf("expected %s to be the default cluster", clusters[0].Name)
+	}
+
+	if rec := doRequest(e, http.MethodGet, "/ready", ""); rec.Code != http.StatusOK {
+		t.Errorf("/ready with a degraded cluster: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"rbac/pkg/audit"
+	"rbac/pkg/history"
+	"rbac/pkg/kubernetes"
+	"rbac/pkg/snapshot"
+	"rbac/pkg/store"
+	"rbac/pkg/usage"
+)
+
+// Audit sink names accepted in AUDIT_SINKS.
+const (
+	AuditSinkStdout = "stdout"
+	AuditSinkFile   = "file"
+	AuditSinkStore  = "store"
+)
+
+// Services holds the local subsystems that the routes of every cluster share.
+type Services struct {
+	Store     *store.Store
+	Audit     *audit.Logger
+	History   *history.History
+	Snapshots *snapshot.Store
+	Usage     *usage.Store
+
+	closers []io.Closer
+}
+
+// NewServices opens the embedded store, the configured audit sinks, the revision history, the
+// snapshot store and the usage store.
+func NewServices(config *Config) (*Services, error) {
+	st, err := store.Open(config.StorePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening store %s: %w", config.StorePath, err)
+	}
+	services := &Services{Store: st, History: history.New(st, config.HistoryMaxRevisions), Snapshots: snapshot.NewStore(st), Usage: usage.NewStore(st), closers: []io.Closer{st}}
+
+	var sinks []audit.Sink
+	for _, name := range config.AuditSinks {
+		switch name {
+		case AuditSinkStdout:
+			sinks = append(sinks, audit.NewWriterSink(os.Stdout))
+		case AuditSinkFile:
+			sink, err := audit.NewFileSink(config.AuditFile)
+			if err != nil {
+				services.Close()
+				return nil, fmt.Errorf("opening audit file %s: %w", config.AuditFile, err)
+			}
+			sinks = append(sinks, sink)
+			services.closers = append(services.closers, sink)
+		case AuditSinkStore:
+			sinks = append(sinks, audit.NewStoreSink(st))
+		default:
+			services.Close()
+			return nil, fmt.Errorf("unknown audit sink %q, must be one of %s", name, strings.Join([]string{AuditSinkStdout, AuditSinkFile, AuditSinkStore}, ", "))
+		}
+	}
+	services.Audit = audit.NewLogger(sinks...)
+
+	return services, nil
+}
+
+// WatchHistory records the revisions of the RBAC objects of every cluster with a cache.
+func (s *Services) WatchHistory(registry *kubernetes.Registry) error {
+	for _, cluster := range registry.List() {
+		if cluster.Cache == nil {
+			continue
+		}
+		if err := s.History.Watch(cluster.Name, cluster.Cache); err != nil {
+			return fmt.Errorf("watching history of cluster %s: %w", cluster.Name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the audit sinks and the store.
+func (s *Services) Close() error {
+	var errs []error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,214 @@
+package snapshot
+
+import (
+	"sort"
+	"strings"
+
+	"rbac/pkg/manifest"
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// Kinds of object changes.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// cosmeticPrefix is the path prefix of the fields whose changes do not affect access: labels,
+// annotations and the rest of the object metadata.
+const cosmeticPrefix = "metadata."
+
+// Change is an object that was added, removed or modified since the baseline. Field changes of
+// a modified object are split between semantic ones, which can change who may do what, and
+// cosmetic ones.
+type Change struct {
+	Kind      string            `json:"kind"`
+	Namespace string            `json:"namespace,omitempty"`
+	Name      string            `json:"name"`
+	Change    string            `json:"change"`
+	Semantic  []utils.FieldDiff `json:"semantic,omitempty"`
+	Cosmetic  []utils.FieldDiff `json:"cosmetic,omitempty"`
+}
+
+// PermissionChange lists the permissions a subject gained and lost since the baseline.
+type PermissionChange struct {
+	Subject rbacv1.Subject      `json:"subject"`
+	Gained  []policy.Permission `json:"gained,omitempty"`
+	Lost    []policy.Permission `json:"lost,omitempty"`
+}
+
+// Summary counts the changes of a drift report. Semantic and Cosmetic count the modified
+// objects with changes of each sort.
+type Summary struct {
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Modified int `json:"modified"`
+	Semantic int `json:"semantic"`
+	Cosmetic int `json:"cosmetic"`
+}
+
+// Report is the drift of live objects from a baseline.
+type Report struct {
+	Drifted           bool               `json:"drifted"`
+	Added             []Change           `json:"added"`
+	Removed           []Change           `json:"removed"`
+	Modified          []Change           `json:"modified"`
+	PermissionChanges []PermissionChange `json:"permissionChanges"`
+	Summary           Summary            `json:"summary"`
+}
+
+// Drift compares the live objects with the baseline. Besides the objects that changed, the
+// report lists every subject whose bound permissions grew or shrank, so that access gained
+// through a new binding or a broader rule stands out from label and annotation edits.
+func Drift(baseline, live []manifest.Object) (*Report, error) {
+	report := &Report{Added: []Change{}, Removed: []Change{}, Modified: []Change{}, PermissionChanges: []PermissionChange{}}
+
+	baselineObjects := keyObjects(baseline)
+	liveObjects := keyObjects(live)
+
+	for _, key := range sortedKeys(liveObjects) {
+		obj := liveObjects[key]
+		baselineObj, ok := baselineObjects[key]
+		if !ok {
+			report.Added = append(report.Added, newChange(obj, ChangeAdded))
+			continue
+		}
+
+		from, err := manifest.Clean(baselineObj)
+		if err != nil {
+			return nil, err
+		}
+		to, err := manifest.Clean(obj)
+		if err != nil {
+			return nil, err
+		}
+		diffs, err := utils.DiffObjects(from, to)
+		if err != nil {
+			return nil, err
+		}
+		if len(diffs) == 0 {
+			continue
+		}
+
+		change := newChange(obj, ChangeModified)
+		for _, diff := range diffs {
+			if strings.HasPrefix(diff.Path, cosmeticPrefix) {
+				change.Cosmetic = append(change.Cosmetic, diff)
+			} else {
+				change.Semantic = append(change.Semantic, diff)
+			}
+		}
+		if len(change.Semantic) > 0 {
+			report.Summary.Semantic++
+		}
+		if len(change.Cosmetic) > 0 {
+			report.Summary.Cosmetic++
+		}
+		report.Modified = append(report.Modified, change)
+	}
+	for _, key := range sortedKeys(baselineObjects) {
+		if _, ok := liveObjects[key]; !ok {
+			report.Removed = append(report.Removed, newChange(baselineObjects[key], ChangeRemoved))
+		}
+	}
+
+	report.PermissionChanges = permissionChanges(policy.BoundPermissions(objectSet(baseline)), policy.BoundPermissions(objectSet(live)))
+
+	report.Summary.Added = len(report.Added)
+	report.Summary.Removed = len(report.Removed)
+	report.Summary.Modified = len(report.Modified)
+	report.Drifted = report.Summary.Added > 0 || report.Summary.Removed > 0 || report.Summary.Modified > 0
+	return report, nil
+}
+
+// permissionChanges compares the permissions bound to every subject. A permission counts as
+// gained only if no baseline permission of the subject already covered it, and as lost only if
+// no live permission still covers it.
+func permissionChanges(baseline, live map[string]*policy.SubjectPermissions) []PermissionChange {
+	keys := make(map[string]struct{}, len(baseline)+len(live))
+	for key := range baseline {
+		keys[key] = struct{}{}
+	}
+	for key := range live {
+		keys[key] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	changes := []PermissionChange{}
+	for _, key := range sorted {
+		var change PermissionChange
+		var baselinePermissions, livePermissions []policy.Permission
+		if subject, ok := baseline[key]; ok {
+			change.Subject, baselinePermissions = subject.Subject, subject.Permissions
+		}
+		if subject, ok := live[key]; ok {
+			change.Subject, livePermissions = subject.Subject, subject.Permissions
+		}
+
+		for _, permission := range livePermissions {
+			if !policy.Covered(permission, baselinePermissions) {
+				change.Gained = append(change.Gained, permission)
+			}
+		}
+		for _, permission := range baselinePermissions {
+			if !policy.Covered(permission, livePermissions) {
+				change.Lost = append(change.Lost, permission)
+			}
+		}
+		if len(change.Gained) > 0 || len(change.Lost) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// objectSet sorts the roles, cluster roles and bindings among objs into a set for policy
+// evaluation.
+func objectSet(objs []manifest.Object) policy.ObjectSet {
+	var objects policy.ObjectSet
+	for _, obj := range objs {
+		switch obj := obj.(type) {
+		case *rbacv1.Role:
+			objects.Roles = append(objects.Roles, obj)
+		case *rbacv1.ClusterRole:
+			objects.ClusterRoles = append(objects.ClusterRoles, obj)
+		case *rbacv1.RoleBinding:
+			objects.RoleBindings = append(objects.RoleBindings, obj)
+		case *rbacv1.ClusterRoleBinding:
+			objects.ClusterRoleBindings = append(objects.ClusterRoleBindings, obj)
+		}
+	}
+	return objects
+}
+
+// keyObjects indexes objects by kind, namespace and name.
+func keyObjects(objs []manifest.Object) map[string]manifest.Object {
+	keyed := make(map[string]manifest.Object, len(objs))
+	for _, obj := range objs {
+		keyed[manifest.KindOf(obj).Name+"/"+obj.GetNamespace()+"/"+obj.GetName()] = obj
+	}
+	return keyed
+}
+
+// sortedKeys returns the keys of an object index in order.
+func sortedKeys(objs map[string]manifest.Object) []string {
+	keys := make([]string, 0, len(objs))
+	for key := range objs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newChange describes a change to obj.
+func newChange(obj manifest.Object, change string) Change {
+	return Change{Kind: manifest.KindOf(obj).Name, Namespace: obj.GetNamespace(), Name: obj.GetName(), Change: change}
+}
@@ -0,0 +1,155 @@
+// Package snapshot keeps copies of the RBAC state in the embedded store and compares them
+// with a live cluster.
+package snapshot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"rbac/pkg/manifest"
+	"rbac/pkg/store"
+)
+
+// Sources of a snapshot.
+const (
+	// SourceCluster marks snapshots captured from a cluster.
+	SourceCluster = "cluster"
+	// SourceUpload marks baselines uploaded as YAML or JSON.
+	SourceUpload = "upload"
+)
+
+// storeBucket is the store bucket that snapshots are kept in.
+const storeBucket = "snapshots"
+
+// ErrNotFound is returned when a snapshot does not exist.
+var ErrNotFound = errors.New("snapshot not found")
+
+// Scope records the filter a snapshot was taken with, so that the live objects it is compared
+// with are selected the same way.
+type Scope struct {
+	Namespace     string `json:"namespace,omitempty"`
+	LabelSelector string `json:"labelSelector,omitempty"`
+	ExcludeSystem bool   `json:"excludeSystem,omitempty"`
+}
+
+// Snapshot is a saved set of roles, cluster roles and bindings, without their server-managed
+// fields. Objects is left out when snapshots are listed.
+type Snapshot struct {
+	ID          string            `json:"id"`
+	Cluster     string            `json:"cluster"`
+	Time        time.Time         `json:"time"`
+	Description string            `json:"description,omitempty"`
+	Source      string            `json:"source"`
+	Scope       Scope             `json:"scope"`
+	Count       int               `json:"count"`
+	Objects     []json.RawMessage `json:"objects,omitempty"`
+}
+
+// New builds an unsaved snapshot of the objects.
+func New(cluster, source string, scope Scope, objs []manifest.Object) (*Snapshot, error) {
+	snapshot := &Snapshot{Cluster: cluster, Source: source, Scope: scope, Count: len(objs), Objects: make([]json.RawMessage, 0, len(objs))}
+	for _, obj := range objs {
+		manifest.SetTypeMeta(obj)
+		object, err := manifest.Clean(obj)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(object)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Objects = append(snapshot.Objects, data)
+	}
+	return snapshot, nil
+}
+
+// Decode returns the typed objects of the snapshot.
+func (s *Snapshot) Decode() ([]manifest.Object, error) {
+	data, err := json.Marshal(s.Objects)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Decode(data)
+}
+
+// Store saves and reads snapshots.
+type Store struct {
+	store *store.Store
+}
+
+// NewStore creates a snapshot store kept in st.
+func NewStore(st *store.Store) *Store {
+	return &Store{store: st}
+}
+
+// Save assigns the snapshot an ID and the current time, and stores it.
+func (s *Store) Save(snapshot *Snapshot) error {
+	sequence, err := s.store.NextSequence(storeBucket)
+	if err != nil {
+		return err
+	}
+	snapshot.ID = strconv.FormatUint(sequence, 10)
+	snapshot.Time = time.Now().UTC()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(storeBucket, snapshotKey(sequence), data)
+}
+
+// List returns every snapshot without its objects, newest first.
+func (s *Store) List() ([]Snapshot, error) {
+	snapshots := []Snapshot{}
+	err := s.store.Scan(storeBucket, nil, func(_, value []byte) error {
+		var snapshot Snapshot
+		if err := json.Unmarshal(value, &snapshot); err != nil {
+			return err
+		}
+		snapshot.Objects = nil
+		snapshots = append(snapshots, snapshot)
+		return nil
+	})
+	for i, j := 0, len(snapshots)-1; i < j; i, j = i+1, j-1 {
+		snapshots[i], snapshots[j] = snapshots[j], snapshots[i]
+	}
+	return snapshots, err
+}
+
+// Get returns a snapshot with its objects.
+func (s *Store) Get(id string) (*Snapshot, error) {
+	sequence, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	data, err := s.store.Get(storeBucket, snapshotKey(sequence))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// Delete removes a snapshot.
+func (s *Store) Delete(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	sequence, _ := strconv.ParseUint(id, 10, 64)
+	return s.store.Delete(storeBucket, snapshotKey(sequence))
+}
+
+// snapshotKey is the key of a snapshot. Sequences are big-endian so that keys sort in the
+// order snapshots were saved.
+func snapshotKey(sequence uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, sequence)
+}
@@ -0,0 +1,166 @@
+// Package store is the embedded key/value store that Kuberus keeps its local state in.
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTimeout bounds the wait for the file lock held by another process.
+const openTimeout = 5 * time.Second
+
+// ErrStop can be returned by a scan function to end the scan without an error.
+var ErrStop = errors.New("stop scan")
+
+// Store is a bucketed key/value store backed by a single bbolt file. Keys are kept sorted
+// within a bucket.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the store at path, creating the file and its directory if needed.
+func Open(path string) (*Store, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Put stores value under key in bucket.
+func (s *Store) Put(bucket string, key, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	})
+}
+
+// MergeAll stores every value of values under its key in bucket, in one transaction. merge
+// combines the value already stored under a key, or nil, with the new value.
+func (s *Store) MergeAll(bucket string, values map[string][]byte, merge func(stored, value []byte) ([]byte, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			merged, err := merge(b.Get([]byte(key)), value)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), merged); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get returns the value stored under key in bucket, or nil if there is none.
+func (s *Store) Get(bucket string, key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(key); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Existing returns which of keys are stored in bucket, in one transaction.
+func (s *Store) Existing(bucket string, keys []string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		for _, key := range keys {
+			if b.Get([]byte(key)) != nil {
+				existing[key] = true
+			}
+		}
+		return nil
+	})
+	return existing, err
+}
+
+// Delete removes key from bucket.
+func (s *Store) Delete(bucket string, key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(key)
+	})
+}
+
+// NextSequence returns the next value of the bucket's sequence.
+func (s *Store) NextSequence(bucket string) (uint64, error) {
+	var sequence uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		sequence, err = b.NextSequence()
+		return err
+	})
+	return sequence, err
+}
+
+// Scan calls fn for every key in bucket from start onwards, in key order. The key and value
+// are only valid during the call. Returning ErrStop from fn ends the scan.
+func (s *Store) Scan(bucket string, start []byte, fn func(key, value []byte) error) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrStop) {
+		return nil
+	}
+	return err
+}
+
+// ScanPrefix calls fn for every key in bucket that starts with prefix, in key order.
+func (s *Store) ScanPrefix(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	return s.Scan(bucket, prefix, func(key, value []byte) error {
+		if !bytes.HasPrefix(key, prefix) {
+			return ErrStop
+		}
+		return fn(key, value)
+	})
+}
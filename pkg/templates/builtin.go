@@ -0,0 +1,94 @@
+package templates
+
+import (
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// Verb sets of the built-in templates.
+var (
+	readVerbs  = []string{"get", "list", "watch"}
+	writeVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+	applyVerbs = []string{"get", "list", "watch", "create", "update", "patch"}
+)
+
+// Builtin returns the built-in templates, sorted by name.
+func Builtin() []Template {
+	return []Template{
+		{
+			Name:        "ci-deployer",
+			Description: "Deploys workloads from a CI pipeline: creates and updates workloads, services, config and secrets, without reading secrets back.",
+			Rules: []rbacv1.PolicyRule{
+				{Verbs: applyVerbs, APIGroups: []string{"apps"}, Resources: []string{"deployments", "statefulsets", "daemonsets"}},
+				{Verbs: readVerbs, APIGroups: []string{"apps"}, Resources: []string{"replicasets"}},
+				{Verbs: applyVerbs, APIGroups: []string{""}, Resources: []string{"services", "configmaps", "serviceaccounts"}},
+				{Verbs: []string{"create", "update", "patch"}, APIGroups: []string{""}, Resources: []string{"secrets"}},
+				{Verbs: readVerbs, APIGroups: []string{""}, Resources: []string{"pods"}},
+				{Verbs: applyVerbs, APIGroups: []string{"networking.k8s.io"}, Resources: []string{"ingresses"}},
+				{Verbs: writeVerbs, APIGroups: []string{"batch"}, Resources: []string{"jobs"}},
+				{Verbs: applyVerbs, APIGroups: []string{"autoscaling"}, Resources: []string{"horizontalpodautoscalers"}},
+			},
+			ExtraVerbs: applyVerbs,
+			Source:     SourceBuiltin,
+		},
+		{
+			Name:        "developer",
+			Description: "Develops and debugs applications: manages workloads, services and config, reads logs, and execs into and port-forwards to pods. Secrets are not readable.",
+			Rules: []rbacv1.PolicyRule{
+				{Verbs: writeVerbs, APIGroups: []string{""}, Resources: []string{"pods", "services", "configmaps", "persistentvolumeclaims"}},
+				{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods/log"}},
+				{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: []string{"pods/exec", "pods/portforward"}},
+				{Verbs: readVerbs, APIGroups: []string{""}, Resources: []string{"events", "endpoints", "serviceaccounts"}},
+				{Verbs: writeVerbs, APIGroups: []string{"apps"}, Resources: []string{"deployments", "statefulsets", "daemonsets", "replicasets"}},
+				{Verbs: writeVerbs, APIGroups: []string{"batch"}, Resources: []string{"jobs", "cronjobs"}},
+				{Verbs: writeVerbs, APIGroups: []string{"networking.k8s.io"}, Resources: []string{"ingresses"}},
+				{Verbs: writeVerbs, APIGroups: []string{"autoscaling"}, Resources: []string{"horizontalpodautoscalers"}},
+			},
+			ExtraVerbs: writeVerbs,
+			Source:     SourceBuiltin,
+		},
+		{
+			Name:        "monitoring-reader",
+			Description: "Scrapes and reads metrics: lists pods, nodes, services and endpoints across the cluster, reads resource metrics and the /metrics endpoints.",
+			ClusterRole: true,
+			Rules: []rbacv1.PolicyRule{
+				{Verbs: readVerbs, APIGroups: []string{""}, Resources: []string{"pods", "nodes", "services", "endpoints", "namespaces"}},
+				{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"nodes/metrics"}},
+				{Verbs: readVerbs, APIGroups: []string{"discovery.k8s.io"}, Resources: []string{"endpointslices"}},
+				{Verbs: []string{"get", "list"}, APIGroups: []string{"metrics.k8s.io"}, Resources: []string{"pods", "nodes"}},
+				{Verbs: []string{"get"}, NonResourceURLs: []string{"/metrics", "/metrics/*"}},
+			},
+			ExtraVerbs: readVerbs,
+			Source:     SourceBuiltin,
+		},
+		{
+			Name:        "namespace-admin",
+			Description: "Administers a namespace: every verb on every resource, including roles and bindings. Bind it in a namespace rather than cluster-wide.",
+			Rules: []rbacv1.PolicyRule{
+				{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+			},
+			Source: SourceBuiltin,
+		},
+		{
+			Name:        "read-only",
+			Description: "Views workloads, services, config and events, without secrets.",
+			Rules: []rbacv1.PolicyRule{
+				{Verbs: readVerbs, APIGroups: []string{""}, Resources: []string{"pods", "pods/log", "services", "endpoints", "configmaps", "persistentvolumeclaims", "events", "serviceaccounts"}},
+				{Verbs: readVerbs, APIGroups: []string{"apps"}, Resources: []string{"deployments", "statefulsets", "daemonsets", "replicasets"}},
+				{Verbs: readVerbs, APIGroups: []string{"batch"}, Resources: []string{"jobs", "cronjobs"}},
+				{Verbs: readVerbs, APIGroups: []string{"networking.k8s.io"}, Resources: []string{"ingresses", "networkpolicies"}},
+				{Verbs: readVerbs, APIGroups: []string{"autoscaling"}, Resources: []string{"horizontalpodautoscalers"}},
+			},
+			ExtraVerbs: readVerbs,
+			Source:     SourceBuiltin,
+		},
+		{
+			Name:        "secrets-manager",
+			Description: "Manages secrets: every verb on secrets, and nothing else.",
+			Rules: []rbacv1.PolicyRule{
+				{Verbs: writeVerbs, APIGroups: []string{""}, Resources: []string{"secrets"}},
+			},
+			ExtraVerbs: writeVerbs,
+			Source:     SourceBuiltin,
+		},
+	}
+}
@@ -0,0 +1,345 @@
+// Package templates holds the catalog of role templates: the built-in personas and the custom
+// templates read from YAML files or a ConfigMap, and renders them into roles.
+package templates
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rbac/pkg/manifest"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Template sources.
+const (
+	SourceBuiltin   = "builtin"
+	SourceFile      = "file"
+	SourceConfigMap = "configmap"
+)
+
+// TemplateLabel is the label that records the template a role was rendered from.
+const TemplateLabel = "kuberus.io/template"
+
+// Template is a named set of rules to start a role from. A cluster role template has
+// cluster-scoped resources or non-resource URLs and always renders a ClusterRole; the others
+// render a Role in a namespace, or a ClusterRole without one. ExtraVerbs are the verbs granted
+// on the extra resources of the parameters; a template without them takes no extra resources.
+type Template struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	ClusterRole bool                `json:"clusterRole,omitempty"`
+	Rules       []rbacv1.PolicyRule `json:"rules"`
+	ExtraVerbs  []string            `json:"extraVerbs,omitempty"`
+	Source      string              `json:"source"`
+}
+
+// Params are the parameters a template is rendered with. Name defaults to the template name.
+// ExtraResources are written as resource or resource.group, such as deployments.apps, and are
+// granted the extra verbs of the template. ResourceNames restrict every resource rule to the
+// named objects, except for creating resources and deleting collections, which requests do
+// not name an object for and which are kept apart without the names.
+type Params struct {
+	Name           string   `json:"name,omitempty"`
+	Namespace      string   `json:"namespace,omitempty"`
+	ExtraResources []string `json:"extraResources,omitempty"`
+	ResourceNames  []string `json:"resourceNames,omitempty"`
+}
+
+// Load returns the catalog: the built-in templates, then the templates of the YAML files in
+// dir, then the ones of the ConfigMap named namespace/name, sorted by name. A template
+// replaces an earlier one of the same name, so built-in templates can be customized. Empty
+// dir or configMap skip that source. The templates of every readable source are returned
+// along with the errors of the others.
+func Load(clientset kubernetes.Interface, dir, configMap string) ([]Template, error) {
+	byName := make(map[string]Template)
+	for _, template := range Builtin() {
+		byName[template.Name] = template
+	}
+
+	var errs []error
+	add := func(templates []Template, sourceErrs []error) {
+		for _, template := range templates {
+			byName[template.Name] = template
+		}
+		errs = append(errs, sourceErrs...)
+	}
+	if dir != "" {
+		add(loadDir(dir))
+	}
+	if configMap != "" {
+		add(loadConfigMap(clientset, configMap))
+	}
+
+	templates := make([]Template, 0, len(byName))
+	for _, template := range byName {
+		templates = append(templates, template)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, errors.Join(errs...)
+}
+
+// Find returns the template of the catalog with the given name, or nil.
+func Find(templates []Template, name string) *Template {
+	for i := range templates {
+		if templates[i].Name == name {
+			return &templates[i]
+		}
+	}
+	return nil
+}
+
+// Render builds the role of a template with the given parameters: a Role in the namespace of
+// the parameters, or a ClusterRole. The role is labeled with the template name.
+func Render(template *Template, params Params) (manifest.Object, error) {
+	if template.ClusterRole && params.Namespace != "" {
+		return nil, fmt.Errorf("template %s renders a cluster role and takes no namespace", template.Name)
+	}
+	if len(params.ExtraResources) > 0 && len(template.ExtraVerbs) == 0 {
+		return nil, fmt.Errorf("template %s takes no extra resources", template.Name)
+	}
+	name := params.Name
+	if name == "" {
+		name = template.Name
+	}
+
+	rules := make([]rbacv1.PolicyRule, 0, len(template.Rules)+len(params.ExtraResources))
+	for _, rule := range template.Rules {
+		rules = append(rules, *rule.DeepCopy())
+	}
+	extra, err := extraRules(params.ExtraResources, template.ExtraVerbs)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, extra...)
+	if len(params.ResourceNames) > 0 {
+		rules = restrictRules(rules, params.ResourceNames)
+	}
+
+	meta := metav1.ObjectMeta{Name: name, Labels: map[string]string{TemplateLabel: template.Name}}
+	if params.Namespace == "" {
+		return &rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: manifest.KindClusterRole},
+			ObjectMeta: meta,
+			Rules:      rules,
+		}, nil
+	}
+	meta.Namespace = params.Namespace
+	return &rbacv1.Role{
+		TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: manifest.KindRole},
+		ObjectMeta: meta,
+		Rules:      rules,
+	}, nil
+}
+
+// restrictRules restricts the resource rules to the given names. Creating a resource and
+// deleting a collection cannot be restricted by name and stay in a rule of their own; creating
+// a subresource, such as pods/exec, names its object and is restricted.
+func restrictRules(rules []rbacv1.PolicyRule, names []string) []rbacv1.PolicyRule {
+	restricted := make([]rbacv1.PolicyRule, 0, len(rules))
+	for _, rule := range rules {
+		if len(rule.Resources) == 0 {
+			restricted = append(restricted, rule)
+			continue
+		}
+		// Creating resources and creating subresources are restricted differently.
+		var resources, subresources []string
+		for _, resource := range rule.Resources {
+			if strings.Contains(resource, "/") {
+				subresources = append(subresources, resource)
+			} else {
+				resources = append(resources, resource)
+			}
+		}
+		groups := [][]string{rule.Resources}
+		if containsVerb(rule.Verbs, "create") && len(resources) > 0 && len(subresources) > 0 {
+			groups = [][]string{resources, subresources}
+		}
+
+		for _, group := range groups {
+			var named, others []string
+			for _, verb := range rule.Verbs {
+				if verb == "deletecollection" || (verb == "create" && !strings.Contains(group[0], "/")) {
+					others = append(others, verb)
+				} else {
+					named = append(named, verb)
+				}
+			}
+			if len(named) > 0 {
+				namedRule := *rule.DeepCopy()
+				namedRule.Verbs, namedRule.Resources, namedRule.ResourceNames = named, group, append([]string(nil), names...)
+				restricted = append(restricted, namedRule)
+			}
+			if len(others) > 0 {
+				otherRule := *rule.DeepCopy()
+				otherRule.Verbs, otherRule.Resources = others, group
+				restricted = append(restricted, otherRule)
+			}
+		}
+	}
+	return restricted
+}
+
+// containsVerb reports whether verbs holds verb.
+func containsVerb(verbs []string, verb string) bool {
+	for _, v := range verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// extraRules grants verbs on the extra resources, with one rule per API group in the order
+// the groups first appear.
+func extraRules(resources []string, verbs []string) ([]rbacv1.PolicyRule, error) {
+	var rules []rbacv1.PolicyRule
+	byGroup := make(map[string]int)
+	for _, resource := range resources {
+		name, group, _ := strings.Cut(strings.TrimSpace(resource), ".")
+		if name == "" {
+			return nil, fmt.Errorf("invalid extra resource %q, must be resource or resource.group", resource)
+		}
+		i, ok := byGroup[group]
+		if !ok {
+			i = len(rules)
+			byGroup[group] = i
+			rules = append(rules, rbacv1.PolicyRule{Verbs: append([]string(nil), verbs...), APIGroups: []string{group}})
+		}
+		rules[i].Resources = append(rules[i].Resources, name)
+	}
+	return rules, nil
+}
+
+// Validate checks that a template has a valid name and rules that fit its scope.
+func Validate(template Template) error {
+	if template.Name == "" {
+		return errors.New("template name is required")
+	}
+	if errs := validation.IsDNS1123Subdomain(template.Name); len(errs) > 0 {
+		return fmt.Errorf("invalid template name %s: %s", template.Name, strings.Join(errs, ", "))
+	}
+	if len(template.Rules) == 0 {
+		return fmt.Errorf("template %s: at least one rule is required", template.Name)
+	}
+	for i, rule := range template.Rules {
+		if len(rule.Verbs) == 0 {
+			return fmt.Errorf("template %s: rule %d has no verbs", template.Name, i)
+		}
+		if len(rule.NonResourceURLs) > 0 && !template.ClusterRole {
+			return fmt.Errorf("template %s: rule %d has non-resource URLs, which only cluster role templates can grant", template.Name, i)
+		}
+		if len(rule.NonResourceURLs) == 0 && len(rule.Resources) == 0 {
+			return fmt.Errorf("template %s: rule %d has neither resources nor non-resource URLs", template.Name, i)
+		}
+	}
+	return nil
+}
+
+// Decode reads the templates of a YAML or JSON document stream, one template per document,
+// rejecting unknown fields and invalid templates.
+func Decode(data []byte, source string) ([]Template, error) {
+	var templates []Template
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for i := 1; ; i++ {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return templates, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+		if trimmed := bytes.TrimSpace(document); len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+			continue
+		}
+		var template Template
+		if err := yaml.UnmarshalStrict(document, &template); err != nil {
+			return nil, &manifest.DocumentError{Document: i, Err: err}
+		}
+		template.Source = source
+		if err := Validate(template); err != nil {
+			return nil, &manifest.DocumentError{Document: i, Err: err}
+		}
+		templates = append(templates, template)
+	}
+}
+
+// loadDir reads the templates of every .yaml, .yml and .json file in dir, in name order.
+func loadDir(dir string) ([]Template, []error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, []error{fmt.Errorf("reading template directory %s: %w", dir, err)}
+	}
+	var templates []Template
+	var errs []error
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading template file %s: %w", path, err))
+			continue
+		}
+		decoded, err := Decode(data, SourceFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("template file %s: %w", path, err))
+			continue
+		}
+		templates = append(templates, decoded...)
+	}
+	return templates, errs
+}
+
+// loadConfigMap reads the templates of every key of the ConfigMap named namespace/name, in key
+// order. A missing ConfigMap holds no templates.
+func loadConfigMap(clientset kubernetes.Interface, ref string) ([]Template, []error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, []error{fmt.Errorf("invalid template ConfigMap %s, must be namespace/name", ref)}
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, []error{fmt.Errorf("reading template ConfigMap %s: %w", ref, err)}
+	}
+
+	keys := make([]string, 0, len(configMap.Data))
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var templates []Template
+	var errs []error
+	for _, key := range keys {
+		decoded, err := Decode([]byte(configMap.Data[key]), SourceConfigMap)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("template ConfigMap %s key %s: %w", ref, key, err))
+			continue
+		}
+		templates = append(templates, decoded...)
+	}
+	return templates, errs
+}
@@ -0,0 +1,379 @@
+package usage
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"rbac/pkg/audit"
+	"rbac/pkg/manifest"
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// proposalSuffix ends the names of proposed roles and bindings.
+const proposalSuffix = "-least-privilege"
+
+// Actions of the steps of an applied proposal.
+const (
+	ActionCreate        = "create"
+	ActionUpdate        = "update"
+	ActionRemoveSubject = "remove-subject"
+	ActionDelete        = "delete"
+)
+
+// Proposal is the smallest set of roles that grants a subject every permission it used and
+// does not already hold through its groups: a Role per namespace it used, and a ClusterRole
+// for cluster-wide and non-resource requests, each with a binding to the subject. Resource
+// names are not restricted.
+//
+// Rebind lists the direct bindings of the subject that the proposal replaces. Gained and Lost
+// compare the permissions of the subject with the proposal applied to its current ones.
+type Proposal struct {
+	Subject             rbacv1.Subject               `json:"subject"`
+	Roles               []*rbacv1.Role               `json:"roles"`
+	ClusterRoles        []*rbacv1.ClusterRole        `json:"clusterRoles"`
+	RoleBindings        []*rbacv1.RoleBinding        `json:"roleBindings"`
+	ClusterRoleBindings []*rbacv1.ClusterRoleBinding `json:"clusterRoleBindings"`
+	Rebind              []policy.Grant               `json:"rebind"`
+	Gained              []policy.Permission          `json:"gained"`
+	Lost                []policy.Permission          `json:"lost"`
+}
+
+// Step is the plan, and once applied the result, for one object of an applied proposal.
+type Step struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	Applied   bool   `json:"applied"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Propose builds the least-privilege proposal for a subject from its usage records and the
+// roles and bindings of the cluster.
+func Propose(objects policy.ObjectSet, subject rbacv1.Subject, records []Record) *Proposal {
+	bound := policy.BoundPermissions(objects)
+	var direct, inherited []policy.Permission
+	if permissions, ok := bound[policy.SubjectKey(subject)]; ok {
+		direct = permissions.Permissions
+	}
+	for _, implied := range policy.ImpliedSubjects(subject)[1:] {
+		if permissions, ok := bound[policy.SubjectKey(implied)]; ok {
+			inherited = append(inherited, permissions.Permissions...)
+		}
+	}
+
+	// Keep the permissions used that the groups of the subject do not already grant.
+	byNamespace := make(map[string][]policy.Permission)
+	seen := make(map[policy.Permission]bool)
+	for _, record := range records {
+		if policy.Covered(record.Permission, inherited) {
+			continue
+		}
+		permission := record.Permission
+		permission.ResourceName = ""
+		if !seen[permission] {
+			seen[permission] = true
+			byNamespace[permission.Namespace] = append(byNamespace[permission.Namespace], permission)
+		}
+	}
+
+	name := ProposalName(subject)
+	proposal := &Proposal{
+		Subject:             subject,
+		Roles:               []*rbacv1.Role{},
+		ClusterRoles:        []*rbacv1.ClusterRole{},
+		RoleBindings:        []*rbacv1.RoleBinding{},
+		ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{},
+		Rebind:              []policy.Grant{},
+	}
+	namespaces := make([]string, 0, len(byNamespace))
+	for namespace := range byNamespace {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	var proposed []policy.Permission
+	for _, namespace := range namespaces {
+		rules := compactRules(byNamespace[namespace])
+		for _, rule := range rules {
+			proposed = append(proposed, policy.RulePermissions(namespace, rule)...)
+		}
+		roleRef := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name}
+		if namespace == "" {
+			roleRef.Kind = "ClusterRole"
+			proposal.ClusterRoles = append(proposal.ClusterRoles, &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: name}, Rules: rules})
+			proposal.ClusterRoleBindings = append(proposal.ClusterRoleBindings, &rbacv1.ClusterRoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				RoleRef:    roleRef,
+				Subjects:   []rbacv1.Subject{subject},
+			})
+			continue
+		}
+		proposal.Roles = append(proposal.Roles, &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}, Rules: rules})
+		proposal.RoleBindings = append(proposal.RoleBindings, &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			RoleRef:    roleRef,
+			Subjects:   []rbacv1.Subject{subject},
+		})
+	}
+
+	for _, rb := range objects.RoleBindings {
+		if rb.Name != name && bindsSubject(rb.Subjects, subject, rb.Namespace) {
+			proposal.Rebind = append(proposal.Rebind, policy.Grant{BindingKind: policy.RoleBindingKind, BindingName: rb.Name, BindingNamespace: rb.Namespace, RoleKind: rb.RoleRef.Kind, RoleName: rb.RoleRef.Name, Subject: subject})
+		}
+	}
+	for _, crb := range objects.ClusterRoleBindings {
+		if crb.Name != name && bindsSubject(crb.Subjects, subject, "") {
+			proposal.Rebind = append(proposal.Rebind, policy.Grant{BindingKind: policy.ClusterRoleBindingKind, BindingName: crb.Name, RoleKind: crb.RoleRef.Kind, RoleName: crb.RoleRef.Name, Subject: subject})
+		}
+	}
+
+	current := append(append([]policy.Permission{}, direct...), inherited...)
+	after := append(append([]policy.Permission{}, proposed...), inherited...)
+	proposal.Gained = uncovered(proposed, current)
+	proposal.Lost = uncovered(direct, after)
+	return proposal
+}
+
+// Apply creates or updates the roles and bindings of the proposal, then removes the subject
+// from the bindings it replaces, deleting those left without subjects, and reports the change
+// of every object to record. The subject is only removed once every new object was applied,
+// so that it never loses access it used. Nothing is changed with a dry-run mode.
+func Apply(clientset kubernetes.Interface, proposal *Proposal, dryRun []string, record utils.ChangeRecorder) []Step {
+	var objs []manifest.Object
+	for _, role := range proposal.Roles {
+		objs = append(objs, role.DeepCopy())
+	}
+	for _, clusterRole := range proposal.ClusterRoles {
+		objs = append(objs, clusterRole.DeepCopy())
+	}
+	for _, rb := range proposal.RoleBindings {
+		objs = append(objs, rb.DeepCopy())
+	}
+	for _, crb := range proposal.ClusterRoleBindings {
+		objs = append(objs, crb.DeepCopy())
+	}
+
+	steps := []Step{}
+	failed := false
+	for _, obj := range objs {
+		kind := manifest.KindOf(obj)
+		step := Step{Kind: kind.Name, Namespace: obj.GetNamespace(), Name: obj.GetName(), Action: ActionCreate}
+		change := utils.Change{Action: audit.ActionCreate, Kind: kind.Name, Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		existing, err := kind.Get(clientset, obj.GetNamespace(), obj.GetName())
+		var applied manifest.Object
+		switch {
+		case apierrors.IsNotFound(err):
+			applied, err = kind.Create(clientset, obj, metav1.CreateOptions{DryRun: dryRun, FieldManager: utils.FieldManager})
+		case err == nil:
+			step.Action = ActionUpdate
+			change.Action, change.Before = audit.ActionUpdate, existing
+			var merged manifest.Object
+			if merged, err = kind.Merge(existing, obj); err == nil {
+				applied, err = kind.Update(clientset, merged, metav1.UpdateOptions{DryRun: dryRun, FieldManager: utils.FieldManager})
+			}
+		}
+		if err == nil {
+			change.After = applied
+		}
+		change.Err = err
+		record(change)
+		if !setResult(&step, err) {
+			failed = true
+		}
+		steps = append(steps, step)
+	}
+
+	for _, grant := range proposal.Rebind {
+		kindName := manifest.KindRoleBinding
+		if grant.BindingKind == policy.ClusterRoleBindingKind {
+			kindName = manifest.KindClusterRoleBinding
+		}
+		step := Step{Kind: kindName, Namespace: grant.BindingNamespace, Name: grant.BindingName, Action: ActionRemoveSubject}
+		if failed {
+			step.Error = "Skipped because the proposed roles and bindings were not all applied"
+			steps = append(steps, step)
+			continue
+		}
+		var err error
+		step.Action, err = removeSubject(clientset, manifest.LookupKind(kindName), grant, dryRun, record)
+		setResult(&step, err)
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// ProposalName returns the name of the roles and bindings proposed for a subject.
+func ProposalName(subject rbacv1.Subject) string {
+	name := subject.Name
+	if subject.Kind == rbacv1.ServiceAccountKind {
+		name = subject.Namespace + "-" + subject.Name
+	}
+	// Object names may not contain "/" or "%".
+	return strings.NewReplacer("/", "-", "%", "-").Replace(name) + proposalSuffix
+}
+
+// removeSubject removes the subject of a grant from its binding, or deletes the binding if it
+// has no other subject, reports the change to record and returns the action taken.
+func removeSubject(clientset kubernetes.Interface, kind *manifest.Kind, grant policy.Grant, dryRun []string, record utils.ChangeRecorder) (string, error) {
+	change := utils.Change{Action: audit.ActionUpdate, Kind: kind.Name, Namespace: grant.BindingNamespace, Name: grant.BindingName}
+	current, err := kind.Get(clientset, grant.BindingNamespace, grant.BindingName)
+	if err != nil {
+		change.Err = err
+		record(change)
+		return ActionRemoveSubject, err
+	}
+	change.Before = current
+	obj := current.DeepCopyObject().(manifest.Object)
+	var subjects *[]rbacv1.Subject
+	switch binding := obj.(type) {
+	case *rbacv1.RoleBinding:
+		subjects = &binding.Subjects
+	case *rbacv1.ClusterRoleBinding:
+		subjects = &binding.Subjects
+	default:
+		return ActionRemoveSubject, errors.New(kind.Name + " has no subjects")
+	}
+
+	kept := []rbacv1.Subject{}
+	for _, s := range *subjects {
+		if !bindsSubject([]rbacv1.Subject{s}, grant.Subject, grant.BindingNamespace) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		change.Action = audit.ActionDelete
+		change.Err = kind.Delete(clientset, grant.BindingNamespace, grant.BindingName, metav1.DeleteOptions{DryRun: dryRun})
+		record(change)
+		return ActionDelete, change.Err
+	}
+	*subjects = kept
+	updated, err := kind.Update(clientset, obj, metav1.UpdateOptions{DryRun: dryRun, FieldManager: utils.FieldManager})
+	if err == nil {
+		change.After = updated
+	}
+	change.Err = err
+	record(change)
+	return ActionRemoveSubject, err
+}
+
+// setResult records the outcome of a step and reports whether it succeeded.
+func setResult(step *Step, err error) bool {
+	if err == nil {
+		step.Applied = true
+		return true
+	}
+	var apiStatus apierrors.APIStatus
+	if errors.As(err, &apiStatus) && apiStatus.Status().Message != "" {
+		step.Error = apiStatus.Status().Message
+	} else {
+		step.Error = err.Error()
+	}
+	return false
+}
+
+// bindsSubject reports whether the subjects of a binding in namespace name the subject.
+// Service account subjects without a namespace are in that of the binding.
+func bindsSubject(subjects []rbacv1.Subject, subject rbacv1.Subject, namespace string) bool {
+	for _, s := range subjects {
+		if s.Kind == rbacv1.ServiceAccountKind && s.Namespace == "" {
+			s.Namespace = namespace
+		}
+		if policy.SubjectMatches(s, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// compactRules turns permissions of one namespace into as few rules as possible: the
+// resources of an API group used with the same verbs share a rule, and so do non-resource
+// URLs used with the same verbs.
+func compactRules(permissions []policy.Permission) []rbacv1.PolicyRule {
+	type target struct{ apiGroup, resource, url string }
+	verbs := make(map[target][]string)
+	var targets []target
+	for _, permission := range permissions {
+		t := target{apiGroup: permission.APIGroup, resource: permission.Resource, url: permission.NonResourceURL}
+		if _, ok := verbs[t]; !ok {
+			targets = append(targets, t)
+		}
+		if !contains(verbs[t], permission.Verb) {
+			verbs[t] = append(verbs[t], permission.Verb)
+		}
+	}
+
+	type group struct {
+		apiGroup    string
+		nonResource bool
+		verbs       string
+	}
+	rules := make(map[group]*rbacv1.PolicyRule)
+	var groups []group
+	for _, t := range targets {
+		sort.Strings(verbs[t])
+		g := group{apiGroup: t.apiGroup, nonResource: t.url != "", verbs: strings.Join(verbs[t], ",")}
+		rule, ok := rules[g]
+		if !ok {
+			rule = &rbacv1.PolicyRule{Verbs: verbs[t]}
+			if !g.nonResource {
+				rule.APIGroups = []string{t.apiGroup}
+			}
+			rules[g] = rule
+			groups = append(groups, g)
+		}
+		if g.nonResource {
+			rule.NonResourceURLs = append(rule.NonResourceURLs, t.url)
+		} else {
+			rule.Resources = append(rule.Resources, t.resource)
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if a.nonResource != b.nonResource {
+			return !a.nonResource
+		}
+		if a.apiGroup != b.apiGroup {
+			return a.apiGroup < b.apiGroup
+		}
+		return a.verbs < b.verbs
+	})
+	compacted := make([]rbacv1.PolicyRule, 0, len(groups))
+	for _, g := range groups {
+		rule := rules[g]
+		sort.Strings(rule.Resources)
+		sort.Strings(rule.NonResourceURLs)
+		compacted = append(compacted, *rule)
+	}
+	return compacted
+}
+
+// uncovered returns the permissions that none of others covers, sorted.
+func uncovered(permissions, others []policy.Permission) []policy.Permission {
+	result := []policy.Permission{}
+	for _, permission := range permissions {
+		if !policy.Covered(permission, others) {
+			result = append(result, permission)
+		}
+	}
+	policy.SortPermissions(result)
+	return result
+}
+
+// contains reports whether values holds value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,318 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"rbac/pkg/policy"
+	"rbac/pkg/utils"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	alice    = rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "alice"}
+	deployer = rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-a"}
+)
+
+func clusterRole(name string, rules ...rbacv1.PolicyRule) *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: name}, Rules: rules}
+}
+
+func clusterRoleBinding(name, roleName string, subjects ...rbacv1.Subject) *rbacv1.ClusterRoleBinding {
+	return &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: roleName},
+		Subjects:   subjects,
+	}
+}
+
+func roleBinding(namespace, name, roleName string, subjects ...rbacv1.Subject) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: roleName},
+		Subjects:   subjects,
+	}
+}
+
+func used(subject rbacv1.Subject, permissions ...policy.Permission) []Record {
+	records := make([]Record, 0, len(permissions))
+	for _, permission := range permissions {
+		records = append(records, Record{Subject: subject, Permission: permission, Count: 1})
+	}
+	return records
+}
+
+func TestPropose(t *testing.T) {
+	getPods := rbacv1.PolicyRule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}}
+	listConfigMaps := rbacv1.PolicyRule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"configmaps"}}
+	system := rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "system:authenticated"}
+	serviceAccounts := rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "system:serviceaccounts"}
+
+	tests := []struct {
+		name    string
+		objects policy.ObjectSet
+		subject rbacv1.Subject
+		records []Record
+		rules   map[string][]rbacv1.PolicyRule
+		rebind  []string
+		gained  []policy.Permission
+		lost    []policy.Permission
+	}{
+		{
+			name: "permissions granted to the groups of a user are left out",
+			objects: policy.ObjectSet{
+				ClusterRoles:        []*rbacv1.ClusterRole{clusterRole("viewer", getPods)},
+				ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{clusterRoleBinding("viewers", "viewer", system)},
+			},
+			subject: alice,
+			records: used(alice,
+				policy.Permission{Namespace: "team-a", Verb: "get", Resource: "pods"},
+				policy.Permission{Namespace: "team-a", Verb: "list", Resource: "pods"},
+			),
+			rules: map[string][]rbacv1.PolicyRule{
+				"Role/team-a": {{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}}},
+			},
+			gained: []policy.Permission{{Namespace: "team-a", Verb: "list", Resource: "pods"}},
+		},
+		{
+			name: "permissions granted to the groups of a service account are left out",
+			objects: policy.ObjectSet{
+				ClusterRoles:        []*rbacv1.ClusterRole{clusterRole("configs", listConfigMaps)},
+				ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{clusterRoleBinding("configs", "configs", serviceAccounts)},
+			},
+			subject: deployer,
+			records: used(deployer,
+				policy.Permission{Namespace: "team-a", Verb: "list", Resource: "configmaps"},
+				policy.Permission{Verb: "get", NonResourceURL: "/healthz"},
+			),
+			rules: map[string][]rbacv1.PolicyRule{
+				"ClusterRole/": {{Verbs: []string{"get"}, NonResourceURLs: []string{"/healthz"}}},
+			},
+			gained: []policy.Permission{{Verb: "get", NonResourceURL: "/healthz"}},
+		},
+		{
+			name: "service account subjects without a namespace are in the binding's namespace",
+			objects: policy.ObjectSet{
+				ClusterRoles: []*rbacv1.ClusterRole{clusterRole("admin", getPods, listConfigMaps)},
+				RoleBindings: []*rbacv1.RoleBinding{
+					roleBinding("team-a", "deploy", "admin", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"}),
+					roleBinding("team-b", "deploy", "admin", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"}),
+				},
+			},
+			subject: deployer,
+			records: used(deployer, policy.Permission{Namespace: "team-a", Verb: "get", Resource: "pods", ResourceName: "web"}),
+			rules: map[string][]rbacv1.PolicyRule{
+				"Role/team-a": {getPods},
+			},
+			rebind: []string{"RoleBinding/team-a/deploy"},
+			lost:   []policy.Permission{{Namespace: "team-a", Verb: "list", Resource: "configmaps"}},
+		},
+		{
+			name: "the proposed bindings are not rebound",
+			objects: policy.ObjectSet{
+				ClusterRoles:        []*rbacv1.ClusterRole{clusterRole("alice-least-privilege", getPods)},
+				ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{clusterRoleBinding("alice-least-privilege", "alice-least-privilege", alice), clusterRoleBinding("old", "alice-least-privilege", alice)},
+			},
+			subject: alice,
+			records: used(alice, policy.Permission{Verb: "get", Resource: "pods"}),
+			rules: map[string][]rbacv1.PolicyRule{
+				"ClusterRole/": {getPods},
+			},
+			rebind: []string{"ClusterRoleBinding//old"},
+		},
+	}
+	for _, tt := range tests {
+		proposal := Propose(tt.objects, tt.subject, tt.records)
+
+		rules := make(map[string][]rbacv1.PolicyRule)
+		for _, role := range proposal.Roles {
+			rules["Role/"+role.Namespace] = role.Rules
+		}
+		for _, clusterRole := range proposal.ClusterRoles {
+			rules["ClusterRole/"] = clusterRole.Rules
+		}
+		if !reflect.DeepEqual(rules, tt.rules) {
+			t.Errorf("%s: got rules %+v, want %+v", tt.name, rules, tt.rules)
+		}
+		if len(proposal.RoleBindings)+len(proposal.ClusterRoleBindings) != len(tt.rules) {
+			t.Errorf("%s: got %d role bindings and %d cluster role bindings for %d roles", tt.name, len(proposal.RoleBindings), len(proposal.ClusterRoleBindings), len(tt.rules))
+		}
+		var rebind []string
+		for _, grant := range proposal.Rebind {
+			rebind = append(rebind, grant.BindingKind+"/"+grant.BindingNamespace+"/"+grant.BindingName)
+		}
+		if !reflect.DeepEqual(rebind, tt.rebind) {
+			t.Errorf("%s: got rebind %v, want %v", tt.name, rebind, tt.rebind)
+		}
+		if len(proposal.Gained) != len(tt.gained) || (len(tt.gained) > 0 && !reflect.DeepEqual(proposal.Gained, tt.gained)) {
+			t.Errorf("%s: got gained %+v, want %+v", tt.name, proposal.Gained, tt.gained)
+		}
+		if len(proposal.Lost) != len(tt.lost) || (len(tt.lost) > 0 && !reflect.DeepEqual(proposal.Lost, tt.lost)) {
+			t.Errorf("%s: got lost %+v, want %+v", tt.name, proposal.Lost, tt.lost)
+		}
+	}
+}
+
+func TestCompactRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []policy.Permission
+		want        []rbacv1.PolicyRule
+	}{
+		{
+			name: "resources used with the same verbs share a rule",
+			permissions: []policy.Permission{
+				{Verb: "get", Resource: "services"},
+				{Verb: "get", Resource: "pods"},
+				{Verb: "get", Resource: "pods"},
+			},
+			want: []rbacv1.PolicyRule{{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods", "services"}}},
+		},
+		{
+			name: "resources used with different verbs do not",
+			permissions: []policy.Permission{
+				{Verb: "list", Resource: "pods"},
+				{Verb: "get", Resource: "configmaps"},
+				{Verb: "get", Resource: "pods"},
+			},
+			want: []rbacv1.PolicyRule{
+				{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"configmaps"}},
+				{Verbs: []string{"get", "list"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			},
+		},
+		{
+			name: "API groups and non-resource URLs are separate",
+			permissions: []policy.Permission{
+				{Verb: "get", NonResourceURL: "/metrics"},
+				{Verb: "get", APIGroup: "apps", Resource: "deployments"},
+				{Verb: "get", NonResourceURL: "/healthz"},
+				{Verb: "get", Resource: "pods"},
+			},
+			want: []rbacv1.PolicyRule{
+				{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+				{Verbs: []string{"get"}, APIGroups: []string{"apps"}, Resources: []string{"deployments"}},
+				{Verbs: []string{"get"}, NonResourceURLs: []string{"/healthz", "/metrics"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := compactRules(tt.permissions); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a-deployer-least-privilege", Namespace: "team-a"},
+		Rules:      []rbacv1.PolicyRule{{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}}},
+	}
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a-deployer-least-privilege", Namespace: "team-a"},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: role.Name},
+		Subjects:   []rbacv1.Subject{deployer},
+	}
+	proposal := &Proposal{
+		Subject:      deployer,
+		Roles:        []*rbacv1.Role{role},
+		RoleBindings: []*rbacv1.RoleBinding{binding},
+		Rebind: []policy.Grant{
+			{BindingKind: policy.RoleBindingKind, BindingName: "deploy", BindingNamespace: "team-a", RoleKind: "ClusterRole", RoleName: "admin", Subject: deployer},
+			{BindingKind: policy.ClusterRoleBindingKind, BindingName: "old", RoleKind: "ClusterRole", RoleName: "admin", Subject: deployer},
+		},
+	}
+	// The service account is named without a namespace in the role binding.
+	bindings := func() []runtime.Object {
+		return []runtime.Object{
+			roleBinding("team-a", "deploy", "admin", rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"}, alice),
+			clusterRoleBinding("old", "admin", deployer),
+		}
+	}
+	skipped := "Skipped because the proposed roles and bindings were not all applied"
+
+	tests := []struct {
+		name     string
+		objects  []runtime.Object
+		fail     string
+		want     []Step
+		changes  []string
+		subjects []rbacv1.Subject
+	}{
+		{
+			name:    "the subject is removed once the proposal is applied",
+			objects: bindings(),
+			want: []Step{
+				{Kind: "Role", Namespace: "team-a", Name: role.Name, Action: ActionCreate, Applied: true},
+				{Kind: "RoleBinding", Namespace: "team-a", Name: binding.Name, Action: ActionCreate, Applied: true},
+				{Kind: "RoleBinding", Namespace: "team-a", Name: "deploy", Action: ActionRemoveSubject, Applied: true},
+				{Kind: "ClusterRoleBinding", Name: "old", Action: ActionDelete, Applied: true},
+			},
+			changes:  []string{"create Role team-a/" + role.Name, "create RoleBinding team-a/" + binding.Name, "update RoleBinding team-a/deploy", "delete ClusterRoleBinding /old"},
+			subjects: []rbacv1.Subject{alice},
+		},
+		{
+			name:    "existing proposed roles are updated",
+			objects: append(bindings(), &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: role.Name, Namespace: "team-a"}}),
+			want: []Step{
+				{Kind: "Role", Namespace: "team-a", Name: role.Name, Action: ActionUpdate, Applied: true},
+				{Kind: "RoleBinding", Namespace: "team-a", Name: binding.Name, Action: ActionCreate, Applied: true},
+				{Kind: "RoleBinding", Namespace: "team-a", Name: "deploy", Action: ActionRemoveSubject, Applied: true},
+				{Kind: "ClusterRoleBinding", Name: "old", Action: ActionDelete, Applied: true},
+			},
+			changes:  []string{"update Role team-a/" + role.Name, "create RoleBinding team-a/" + binding.Name, "update RoleBinding team-a/deploy", "delete ClusterRoleBinding /old"},
+			subjects: []rbacv1.Subject{alice},
+		},
+		{
+			name:    "a partial failure skips the rebinds",
+			objects: bindings(),
+			fail:    "roles",
+			want: []Step{
+				{Kind: "Role", Namespace: "team-a", Name: role.Name, Action: ActionCreate, Error: "quota exceeded"},
+				{Kind: "RoleBinding", Namespace: "team-a", Name: binding.Name, Action: ActionCreate, Applied: true},
+				{Kind: "RoleBinding", Namespace: "team-a", Name: "deploy", Action: ActionRemoveSubject, Error: skipped},
+				{Kind: "ClusterRoleBinding", Name: "old", Action: ActionRemoveSubject, Error: skipped},
+			},
+			changes:  []string{"create Role team-a/" + role.Name + " failed", "create RoleBinding team-a/" + binding.Name},
+			subjects: []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "deployer"}, alice},
+		},
+	}
+	for _, tt := range tests {
+		clientset := fake.NewClientset(tt.objects...)
+		if tt.fail != "" {
+			clientset.PrependReactor("create", tt.fail, func(k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.New("quota exceeded")
+			})
+		}
+		var changes []string
+		record := func(change utils.Change) {
+			summary := change.Action + " " + change.Kind + " " + change.Namespace + "/" + change.Name
+			if change.Err != nil {
+				summary += " failed"
+			}
+			changes = append(changes, summary)
+		}
+
+		if got := Apply(clientset, proposal, nil, record); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got steps %+v, want %+v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(changes, tt.changes) {
+			t.Errorf("%s: got changes %v, want %v", tt.name, changes, tt.changes)
+		}
+		rb, err := clientset.RbacV1().RoleBindings("team-a").Get(context.TODO(), "deploy", metav1.GetOptions{})
+		if err != nil || !reflect.DeepEqual(rb.Subjects, tt.subjects) {
+			t.Errorf("%s: got role binding %+v, %v, want subjects %+v", tt.name, rb, err, tt.subjects)
+		}
+		_, err = clientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), "old", metav1.GetOptions{})
+		if deleted := apierrors.IsNotFound(err); deleted != (tt.fail == "") {
+			t.Errorf("%s: got cluster role binding deleted %t, want %t", tt.name, deleted, tt.fail == "")
+		}
+	}
+}
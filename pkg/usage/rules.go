@@ -0,0 +1,147 @@
+package usage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"rbac/pkg/policy"
+	"rbac/pkg/risk"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// Coverage is the time span of the ingested audit events of a cluster.
+type Coverage struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// RuleSubject is the use of a rule by one subject.
+type RuleSubject struct {
+	Subject  rbacv1.Subject `json:"subject"`
+	Count    int64          `json:"count"`
+	LastUsed time.Time      `json:"lastUsed"`
+}
+
+// RuleUsage is when a rule of a role was last exercised, and by whom. Source names the
+// cluster role that the rule was aggregated from, if any. Unused flags rules not exercised
+// since the cutoff, only when the ingested audit events reach back that far.
+type RuleUsage struct {
+	Rule       rbacv1.PolicyRule `json:"rule"`
+	Source     string            `json:"source,omitempty"`
+	Count      int64             `json:"count"`
+	LastUsed   *time.Time        `json:"lastUsed,omitempty"`
+	LastUsedBy *rbacv1.Subject   `json:"lastUsedBy,omitempty"`
+	Subjects   []RuleSubject     `json:"subjects"`
+	Unused     bool              `json:"unused"`
+}
+
+// RoleUsage is the use of every rule of a role over the coverage of the audit events, with
+// rules unused for UnusedDays flagged.
+type RoleUsage struct {
+	Coverage   *Coverage   `json:"coverage"`
+	UnusedDays int         `json:"unusedDays"`
+	Rules      []RuleUsage `json:"rules"`
+}
+
+// Usage returns the use of every rule of a role or cluster role of the set, expanding
+// aggregated cluster roles. A request counts for a rule when the rule allows it and the
+// subject that made it is bound to the role, directly or through its groups, in the namespace
+// of the request. The API server does not record which binding authorized a request, so a
+// request allowed by several roles counts for each of them.
+func Usage(objects policy.ObjectSet, kind, namespace, name string, records []Record, coverage *Coverage, unusedDays int, now time.Time) *RoleUsage {
+	var rules []policy.SourcedRule
+	switch kind {
+	case "Role":
+		for _, role := range objects.Roles {
+			if role.Namespace == namespace && role.Name == name {
+				for _, rule := range role.Rules {
+					rules = append(rules, policy.SourcedRule{Rule: rule, Source: name})
+				}
+			}
+		}
+	case "ClusterRole":
+		for _, clusterRole := range objects.ClusterRoles {
+			if clusterRole.Name == name {
+				rules = policy.AggregatedRules(clusterRole, objects.ClusterRoles)
+			}
+		}
+	}
+
+	// Index records by every subject they were made as, including the implied groups.
+	bySubject := make(map[string][]*Record)
+	for i := range records {
+		for _, implied := range policy.ImpliedSubjects(records[i].Subject) {
+			key := policy.SubjectKey(implied)
+			bySubject[key] = append(bySubject[key], &records[i])
+		}
+	}
+	grants := risk.Grants(objects, kind, namespace, name)
+
+	cutoff := now.AddDate(0, 0, -unusedDays)
+	usage := &RoleUsage{Coverage: coverage, UnusedDays: unusedDays, Rules: make([]RuleUsage, 0, len(rules))}
+	for _, sourced := range rules {
+		ruleUsage := RuleUsage{Rule: sourced.Rule, Subjects: []RuleSubject{}}
+		if sourced.Source != name {
+			ruleUsage.Source = sourced.Source
+		}
+
+		counted := make(map[*Record]bool)
+		bySubjectKey := make(map[string]int)
+		for _, grant := range grants {
+			for _, record := range bySubject[policy.SubjectKey(grant.Subject)] {
+				if counted[record] || !grantAllows(grant, sourced.Rule, record.Permission) {
+					continue
+				}
+				counted[record] = true
+
+				key := policy.SubjectKey(record.Subject)
+				i, ok := bySubjectKey[key]
+				if !ok {
+					i = len(ruleUsage.Subjects)
+					bySubjectKey[key] = i
+					ruleUsage.Subjects = append(ruleUsage.Subjects, RuleSubject{Subject: record.Subject})
+				}
+				subject := &ruleUsage.Subjects[i]
+				subject.Count += record.Count
+				if record.LastUsed.After(subject.LastUsed) {
+					subject.LastUsed = record.LastUsed
+				}
+				ruleUsage.Count += record.Count
+			}
+		}
+
+		sort.SliceStable(ruleUsage.Subjects, func(i, j int) bool {
+			return ruleUsage.Subjects[i].LastUsed.After(ruleUsage.Subjects[j].LastUsed)
+		})
+		if len(ruleUsage.Subjects) > 0 {
+			last := ruleUsage.Subjects[0]
+			ruleUsage.LastUsed, ruleUsage.LastUsedBy = &last.LastUsed, &last.Subject
+		}
+		ruleUsage.Unused = coverage != nil && !coverage.From.After(cutoff) && (ruleUsage.LastUsed == nil || ruleUsage.LastUsed.Before(cutoff))
+		usage.Rules = append(usage.Rules, ruleUsage)
+	}
+	return usage
+}
+
+// grantAllows reports whether a rule held through a grant allows a used permission: role
+// bindings only grant requests in their namespace, and only cluster role bindings grant
+// non-resource URLs.
+func grantAllows(grant policy.Grant, rule rbacv1.PolicyRule, permission policy.Permission) bool {
+	if grant.BindingKind == policy.RoleBindingKind && (permission.Namespace != grant.BindingNamespace || permission.NonResourceURL != "") {
+		return false
+	}
+	if permission.NonResourceURL != "" {
+		return policy.NonResourceRuleAllows(permission.Verb, permission.NonResourceURL, rule)
+	}
+	resource, subresource, _ := strings.Cut(permission.Resource, "/")
+	return policy.RuleAllows(policy.ResourceAttributes{
+		Verb:        permission.Verb,
+		APIGroup:    permission.APIGroup,
+		Resource:    resource,
+		Subresource: subresource,
+		Namespace:   permission.Namespace,
+		Name:        permission.ResourceName,
+	}, rule)
+}
@@ -0,0 +1,437 @@
+// Package usage records which permissions each subject actually exercised, read from
+// Kubernetes API server audit logs, and proposes least-privilege roles from it.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"rbac/pkg/policy"
+	"rbac/pkg/store"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// storeBucket is the store bucket that usage records are kept in.
+const storeBucket = "usage"
+
+// coverageBucket is the store bucket that the coverage of every cluster is kept in.
+const coverageBucket = "usage-coverage"
+
+// eventBucket is the store bucket that the IDs of the ingested audit events are kept in.
+const eventBucket = "usage-events"
+
+// stageResponseComplete is the audit stage recorded once a request is answered.
+const stageResponseComplete = "ResponseComplete"
+
+// serviceAccountUsernamePrefix starts the usernames of service accounts.
+const serviceAccountUsernamePrefix = "system:serviceaccount:"
+
+// Record is one permission that a subject exercised, with how often and when. The permission
+// holds the namespace, verb, API group, resource with its subresource and object name of the
+// requests, or their non-resource URL.
+type Record struct {
+	Subject    rbacv1.Subject    `json:"subject"`
+	Permission policy.Permission `json:"permission"`
+	Count      int64             `json:"count"`
+	FirstUsed  time.Time         `json:"firstUsed"`
+	LastUsed   time.Time         `json:"lastUsed"`
+}
+
+// SubjectUsage summarizes the records of a subject.
+type SubjectUsage struct {
+	Subject     rbacv1.Subject `json:"subject"`
+	Permissions int            `json:"permissions"`
+	Count       int64          `json:"count"`
+	LastUsed    time.Time      `json:"lastUsed"`
+}
+
+// IngestResult counts the lines of an ingested audit log. Recorded events were authorized
+// and complete; duplicate events were too, but their audit ID was already ingested; skipped
+// events are other stages or denied requests; invalid lines are not audit events. From and To
+// bound the times of the recorded events.
+type IngestResult struct {
+	Lines       int       `json:"lines"`
+	Recorded    int       `json:"recorded"`
+	Duplicates  int       `json:"duplicates"`
+	Skipped     int       `json:"skipped"`
+	Invalid     int       `json:"invalid"`
+	Subjects    int       `json:"subjects"`
+	Permissions int       `json:"permissions"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+}
+
+// event holds the fields of an audit.k8s.io/v1 Event that usage is computed from.
+type event struct {
+	Kind                     string           `json:"kind"`
+	AuditID                  string           `json:"auditID"`
+	Stage                    string           `json:"stage"`
+	Verb                     string           `json:"verb"`
+	RequestURI               string           `json:"requestURI"`
+	User                     userInfo         `json:"user"`
+	ImpersonatedUser         *userInfo        `json:"impersonatedUser"`
+	ObjectRef                *objectReference `json:"objectRef"`
+	ResponseStatus           *responseStatus  `json:"responseStatus"`
+	RequestReceivedTimestamp time.Time        `json:"requestReceivedTimestamp"`
+	StageTimestamp           time.Time        `json:"stageTimestamp"`
+}
+
+// userInfo is the identity of an audit event.
+type userInfo struct {
+	Username string `json:"username"`
+}
+
+// objectReference is the object of an audit event.
+type objectReference struct {
+	Resource    string `json:"resource"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	APIGroup    string `json:"apiGroup"`
+	Subresource string `json:"subresource"`
+}
+
+// responseStatus is the status an audit event was answered with.
+type responseStatus struct {
+	Code int `json:"code"`
+}
+
+// usedPermission is the permission used by one authorized, complete audit event.
+type usedPermission struct {
+	auditID    string
+	subject    rbacv1.Subject
+	permission policy.Permission
+	used       time.Time
+}
+
+// Store saves and reads the usage records of every cluster.
+type Store struct {
+	store *store.Store
+}
+
+// NewStore creates a usage store kept in st.
+func NewStore(st *store.Store) *Store {
+	return &Store{store: st}
+}
+
+// Ingest reads an audit log of cluster, one JSON event per line, and adds the permissions
+// used by its authorized requests to the records. Requests made by impersonation are recorded
+// for the impersonated user. Lines that are not audit events are counted and skipped. Events
+// whose audit ID was already ingested, from this log or an earlier one, are counted as
+// duplicates and skipped, so that the same log or overlapping logs can be ingested again.
+func (s *Store) Ingest(cluster string, r io.Reader) (*IngestResult, error) {
+	result := &IngestResult{}
+	var used []usedPermission
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			result.Lines++
+			if permission := parseLine(line, result); permission != nil {
+				used = append(used, *permission)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]string, 0, len(used))
+	for _, u := range used {
+		if u.auditID != "" {
+			keys = append(keys, eventKey(cluster, u.auditID))
+		}
+	}
+	ingested, err := s.store.Existing(eventBucket, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]*Record)
+	subjects := make(map[string]struct{})
+	events := make(map[string][]byte)
+	for _, u := range used {
+		if u.auditID != "" {
+			key := eventKey(cluster, u.auditID)
+			if _, ok := events[key]; ok || ingested[key] {
+				result.Duplicates++
+				continue
+			}
+			events[key] = []byte(u.used.Format(time.RFC3339Nano))
+		}
+		addUse(cluster, u, result, records, subjects)
+	}
+	result.Subjects, result.Permissions = len(subjects), len(records)
+
+	values := make(map[string][]byte, len(records))
+	for key, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = data
+	}
+	err = s.store.MergeAll(storeBucket, values, func(stored, value []byte) ([]byte, error) {
+		if stored == nil {
+			return value, nil
+		}
+		var old, record Record
+		if err := json.Unmarshal(stored, &old); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(value, &record); err != nil {
+			return nil, err
+		}
+		record.Count += old.Count
+		if old.FirstUsed.Before(record.FirstUsed) {
+			record.FirstUsed = old.FirstUsed
+		}
+		if old.LastUsed.After(record.LastUsed) {
+			record.LastUsed = old.LastUsed
+		}
+		return json.Marshal(record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.MergeAll(eventBucket, events, func(_, value []byte) ([]byte, error) { return value, nil }); err != nil {
+		return nil, err
+	}
+	if result.Recorded > 0 {
+		if err := s.extendCoverage(cluster, Coverage{From: result.From, To: result.To}); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Coverage returns the time span of the audit events ingested for cluster, or nil if none were.
+func (s *Store) Coverage(cluster string) (*Coverage, error) {
+	data, err := s.store.Get(coverageBucket, []byte(cluster))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var coverage Coverage
+	if err := json.Unmarshal(data, &coverage); err != nil {
+		return nil, err
+	}
+	return &coverage, nil
+}
+
+// extendCoverage widens the coverage of cluster to include span.
+func (s *Store) extendCoverage(cluster string, span Coverage) error {
+	coverage, err := s.Coverage(cluster)
+	if err != nil {
+		return err
+	}
+	if coverage != nil {
+		if coverage.From.Before(span.From) {
+			span.From = coverage.From
+		}
+		if coverage.To.After(span.To) {
+			span.To = coverage.To
+		}
+	}
+	data, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(coverageBucket, []byte(cluster), data)
+}
+
+// parseLine returns the permission used by the event on line, or nil if it is not an
+// authorized, complete audit event, counting it as invalid or skipped.
+func parseLine(line []byte, result *IngestResult) *usedPermission {
+	var e event
+	if err := json.Unmarshal(line, &e); err != nil || (e.Kind != "" && e.Kind != "Event") || e.Verb == "" {
+		result.Invalid++
+		return nil
+	}
+	if e.Stage != "" && e.Stage != stageResponseComplete {
+		result.Skipped++
+		return nil
+	}
+	if e.ResponseStatus != nil && (e.ResponseStatus.Code == http.StatusUnauthorized || e.ResponseStatus.Code == http.StatusForbidden) {
+		result.Skipped++
+		return nil
+	}
+	user := e.User
+	if e.ImpersonatedUser != nil {
+		user = *e.ImpersonatedUser
+	}
+	if user.Username == "" {
+		result.Skipped++
+		return nil
+	}
+
+	used := e.StageTimestamp
+	if used.IsZero() {
+		used = e.RequestReceivedTimestamp
+	}
+	return &usedPermission{auditID: e.AuditID, subject: UsernameSubject(user.Username), permission: eventPermission(e), used: used.UTC()}
+}
+
+// addUse adds a used permission to records.
+func addUse(cluster string, u usedPermission, result *IngestResult, records map[string]*Record, subjects map[string]struct{}) {
+	subject, permission, used := u.subject, u.permission, u.used
+
+	result.Recorded++
+	if result.From.IsZero() || used.Before(result.From) {
+		result.From = used
+	}
+	if used.After(result.To) {
+		result.To = used
+	}
+
+	subjects[policy.SubjectKey(subject)] = struct{}{}
+	key := recordKey(cluster, subject, permission)
+	record, ok := records[key]
+	if !ok {
+		record = &Record{Subject: subject, Permission: permission, FirstUsed: used, LastUsed: used}
+		records[key] = record
+	}
+	record.Count++
+	if used.Before(record.FirstUsed) {
+		record.FirstUsed = used
+	}
+	if used.After(record.LastUsed) {
+		record.LastUsed = used
+	}
+}
+
+// Records returns the records of a subject in cluster, sorted by permission.
+func (s *Store) Records(cluster string, subject rbacv1.Subject) ([]Record, error) {
+	return s.scan(subjectPrefix(cluster, subject))
+}
+
+// All returns the records of every subject in cluster.
+func (s *Store) All(cluster string) ([]Record, error) {
+	return s.scan(clusterPrefix(cluster))
+}
+
+// Subjects summarizes the records of every subject in cluster, most recently active first.
+func (s *Store) Subjects(cluster string) ([]SubjectUsage, error) {
+	records, err := s.All(cluster)
+	if err != nil {
+		return nil, err
+	}
+	subjects := []SubjectUsage{}
+	index := make(map[string]int)
+	for _, record := range records {
+		key := policy.SubjectKey(record.Subject)
+		i, ok := index[key]
+		if !ok {
+			i = len(subjects)
+			index[key] = i
+			subjects = append(subjects, SubjectUsage{Subject: record.Subject})
+		}
+		subjects[i].Permissions++
+		subjects[i].Count += record.Count
+		if record.LastUsed.After(subjects[i].LastUsed) {
+			subjects[i].LastUsed = record.LastUsed
+		}
+	}
+	sort.SliceStable(subjects, func(i, j int) bool {
+		return subjects[i].LastUsed.After(subjects[j].LastUsed)
+	})
+	return subjects, nil
+}
+
+// scan returns the records whose keys start with prefix.
+func (s *Store) scan(prefix []byte) ([]Record, error) {
+	records := []Record{}
+	err := s.store.ScanPrefix(storeBucket, prefix, func(_, value []byte) error {
+		var record Record
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		if a, b := policy.SubjectKey(records[i].Subject), policy.SubjectKey(records[j].Subject); a != b {
+			return a < b
+		}
+		return permissionLess(records[i].Permission, records[j].Permission)
+	})
+	return records, err
+}
+
+// UsernameSubject returns the subject that authenticates as username: a service account for
+// system:serviceaccount:<namespace>:<name>, otherwise a user.
+func UsernameSubject(username string) rbacv1.Subject {
+	if rest, ok := strings.CutPrefix(username, serviceAccountUsernamePrefix); ok {
+		if namespace, name, ok := strings.Cut(rest, ":"); ok && namespace != "" && name != "" {
+			return rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: namespace, Name: name}
+		}
+	}
+	return rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: username}
+}
+
+// eventPermission returns the permission used by an event: its object, or the path of its
+// request URI for non-resource requests.
+func eventPermission(e event) policy.Permission {
+	if e.ObjectRef == nil || e.ObjectRef.Resource == "" {
+		path, _, _ := strings.Cut(e.RequestURI, "?")
+		return policy.Permission{Verb: e.Verb, NonResourceURL: path}
+	}
+	resource := e.ObjectRef.Resource
+	if e.ObjectRef.Subresource != "" {
+		resource += "/" + e.ObjectRef.Subresource
+	}
+	return policy.Permission{
+		Namespace:    e.ObjectRef.Namespace,
+		Verb:         e.Verb,
+		APIGroup:     e.ObjectRef.APIGroup,
+		Resource:     resource,
+		ResourceName: e.ObjectRef.Name,
+	}
+}
+
+// permissionLess orders permissions by namespace, then what they apply to, then verb.
+func permissionLess(a, b policy.Permission) bool {
+	for _, pair := range [][2]string{
+		{a.Namespace, b.Namespace},
+		{a.NonResourceURL, b.NonResourceURL},
+		{a.APIGroup, b.APIGroup},
+		{a.Resource, b.Resource},
+		{a.ResourceName, b.ResourceName},
+	} {
+		if pair[0] != pair[1] {
+			return pair[0] < pair[1]
+		}
+	}
+	return a.Verb < b.Verb
+}
+
+// clusterPrefix is the key prefix of the records of cluster.
+func clusterPrefix(cluster string) []byte {
+	return []byte(cluster + "\x00")
+}
+
+// subjectPrefix is the key prefix of the records of a subject in cluster.
+func subjectPrefix(cluster string, subject rbacv1.Subject) []byte {
+	return []byte(cluster + "\x00" + policy.SubjectKey(subject) + "\x00")
+}
+
+// eventKey is the key of the ID of an audit event ingested for cluster.
+func eventKey(cluster, auditID string) string {
+	return cluster + "\x00" + auditID
+}
+
+// recordKey is the key of the record of a permission used by a subject in cluster.
+func recordKey(cluster string, subject rbacv1.Subject, permission policy.Permission) string {
+	return string(subjectPrefix(cluster, subject)) + strings.Join([]string{
+		permission.Namespace, permission.Verb, permission.APIGroup, permission.Resource, permission.ResourceName, permission.NonResourceURL,
+	}, "\x00")
+}
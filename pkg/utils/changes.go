@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// changeRecorderKey is the context key of the recorder of the objects a request changes.
+const changeRecorderKey = "changeRecorder"
+
+// Change is one object created, updated or deleted by a request that changes several. Before
+// and After are the object before and after the change, nil for a creation or a deletion; Err
+// is the error of a failed change.
+type Change struct {
+	Action    string
+	Kind      string
+	Namespace string
+	Name      string
+	Before    interface{}
+	After     interface{}
+	Err       error
+}
+
+// ChangeRecorder records the changes of a request, one object at a time.
+type ChangeRecorder func(change Change)
+
+// SetChangeRecorder installs the recorder of the changes of a request.
+func SetChangeRecorder(c echo.Context, recorder ChangeRecorder) {
+	c.Set(changeRecorderKey, recorder)
+}
+
+// Changes returns the recorder of the changes of a request, which discards them when none was
+// installed.
+func Changes(c echo.Context) ChangeRecorder {
+	if recorder, ok := c.Get(changeRecorderKey).(ChangeRecorder); ok {
+		return recorder
+	}
+	return func(Change) {}
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Field diff operations.
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// serverManagedFields are metadata fields set by the API server, which are left out of diffs.
+var serverManagedFields = []string{"managedFields", "resourceVersion", "uid", "creationTimestamp", "generation", "selfLink"}
+
+// FieldDiff describes one field that differs between two objects.
+type FieldDiff struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// DiffObjects compares two objects field by field through their JSON form and returns the
+// differences, sorted by path. Server-managed metadata fields are ignored.
+func DiffObjects(from, to interface{}) ([]FieldDiff, error) {
+	fromValue, err := toJSONValue(from)
+	if err != nil {
+		return nil, err
+	}
+	toValue, err := toJSONValue(to)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []FieldDiff{}
+	diffValues("", fromValue, toValue, &diffs)
+	sort.SliceStable(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs, nil
+}
+
+// toJSONValue converts an object to its generic JSON form, without server-managed metadata.
+func toJSONValue(obj interface{}) (interface{}, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	if object, ok := value.(map[string]interface{}); ok {
+		if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+			for _, field := range serverManagedFields {
+				delete(metadata, field)
+			}
+		}
+	}
+	return value, nil
+}
+
+// diffValues appends the differences between two JSON values at path.
+func diffValues(path string, from, to interface{}, diffs *[]FieldDiff) {
+	switch {
+	case from == nil && to == nil:
+		return
+	case from == nil:
+		*diffs = append(*diffs, FieldDiff{Path: path, Op: DiffAdded, To: to})
+		return
+	case to == nil:
+		*diffs = append(*diffs, FieldDiff{Path: path, Op: DiffRemoved, From: from})
+		return
+	}
+
+	switch fromValue := from.(type) {
+	case map[string]interface{}:
+		toValue, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]struct{}, len(fromValue)+len(toValue))
+		for key := range fromValue {
+			keys[key] = struct{}{}
+		}
+		for key := range toValue {
+			keys[key] = struct{}{}
+		}
+		for key := range keys {
+			diffValues(joinPath(path, key), fromValue[key], toValue[key], diffs)
+		}
+		return
+	case []interface{}:
+		toValue, ok := to.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(fromValue) || i < len(toValue); i++ {
+			var fromItem, toItem interface{}
+			if i < len(fromValue) {
+				fromItem = fromValue[i]
+			}
+			if i < len(toValue) {
+				toItem = toValue[i]
+			}
+			diffValues(path+"["+strconv.Itoa(i)+"]", fromItem, toItem, diffs)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		*diffs = append(*diffs, FieldDiff{Path: path, Op: DiffChanged, From: from, To: to})
+	}
+}
+
+// joinPath appends a field name to a dotted path.
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
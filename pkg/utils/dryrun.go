@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DryRunResponse is returned instead of the stored object when a mutation is a dry run. Object
+// is the object as the API server would persist it, or nil for a deletion.
+type DryRunResponse struct {
+	DryRun  bool        `json:"dryRun"`
+	Object  interface{} `json:"object,omitempty"`
+	Current interface{} `json:"current,omitempty"`
+	Diff    []FieldDiff `json:"diff"`
+}
+
+// DryRun returns the DryRun option for the request's dryRun query parameter: All when it is
+// true, and nil otherwise.
+func DryRun(c echo.Context) ([]string, error) {
+	value := c.QueryParam("dryRun")
+	if value == "" {
+		return nil, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid dryRun parameter: "+value)
+	}
+	if !dryRun {
+		return nil, nil
+	}
+	return []string{metav1.DryRunAll}, nil
+}
+
+// DryRunResult writes the response for a dry run that would change current into object.
+// Either may be nil, for a creation or a deletion.
+func DryRunResult(c echo.Context, current, object interface{}) error {
+	diff, err := DiffObjects(current, object)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to diff resource: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, DryRunResponse{DryRun: true, Object: object, Current: current, Diff: diff})
+}
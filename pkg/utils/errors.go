@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CauseTypeAdmissionDenied is the cause type of a request rejected by admission control.
+const CauseTypeAdmissionDenied = "AdmissionDenied"
+
+// admissionDeniedPattern matches the messages of admission webhook and ValidatingAdmissionPolicy rejections.
+var admissionDeniedPattern = regexp.MustCompile(`admission webhook "[^"]*" denied the request|ValidatingAdmissionPolicy '[^']*' .*denied request`)
+
+// ErrorResponse is the JSON body returned for every failed request.
+type ErrorResponse struct {
+	Code      int          `json:"code"`
+	Reason    string       `json:"reason"`
+	Message   string       `json:"message"`
+	Causes    []ErrorCause `json:"causes,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+
+	// Current, ETag and Diff describe the stored object when an update fails a precondition.
+	Current interface{} `json:"current,omitempty"`
+	ETag    string      `json:"etag,omitempty"`
+	Diff    []FieldDiff `json:"diff,omitempty"`
+
+	// Conflicts lists the fields owned by other managers when a server-side apply conflicts.
+	Conflicts []FieldConflict `json:"conflicts,omitempty"`
+}
+
+// ErrorCause describes one field-level reason for a failed request.
+type ErrorCause struct {
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+// KubernetesError converts an error returned by the Kubernetes API into an HTTP error with the
+// matching status code, such as 404 for NotFound, 409 for AlreadyExists and Conflict, 403 for
+// Forbidden and 422 for Invalid. Admission rejections are reported as 422 validation errors too.
+// Errors that do not carry an API status become 500 errors.
+func KubernetesError(err error, message string) *echo.HTTPError {
+	response := ErrorResponse{
+		Code:    http.StatusInternalServerError,
+		Reason:  string(metav1.StatusReasonInternalError),
+		Message: message + ": " + err.Error(),
+	}
+
+	var apiStatus apierrors.APIStatus
+	if errors.As(err, &apiStatus) {
+		status := apiStatus.Status()
+		if status.Code != 0 {
+			response.Code = int(status.Code)
+		}
+		if status.Reason != "" {
+			response.Reason = string(status.Reason)
+		}
+		if status.Message != "" {
+			response.Message = message + ": " + status.Message
+		}
+		if status.Details != nil {
+			for _, cause := range status.Details.Causes {
+				response.Causes = append(response.Causes, ErrorCause{
+					Type:    string(cause.Type),
+					Message: cause.Message,
+					Field:   cause.Field,
+				})
+			}
+		}
+		if response.Reason != string(metav1.StatusReasonInvalid) && admissionDeniedPattern.MatchString(status.Message) {
+			response.Code = http.StatusUnprocessableEntity
+			response.Reason = string(metav1.StatusReasonInvalid)
+			response.Causes = append(response.Causes, ErrorCause{Type: CauseTypeAdmissionDenied, Message: status.Message})
+		}
+	}
+
+	return echo.NewHTTPError(response.Code, response).SetInternal(err)
+}
+
+// HTTPErrorHandler writes every error as an ErrorResponse, tagged with the request ID.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	response := ErrorResponse{
+		Code:    http.StatusInternalServerError,
+		Reason:  string(metav1.StatusReasonInternalError),
+		Message: http.StatusText(http.StatusInternalServerError),
+	}
+
+	var httpError *echo.HTTPError
+	if errors.As(err, &httpError) {
+		switch message := httpError.Message.(type) {
+		case ErrorResponse:
+			response = message
+		case string:
+			response = ErrorResponse{Code: httpError.Code, Reason: reasonForCode(httpError.Code), Message: message}
+		default:
+			response = ErrorResponse{Code: httpError.Code, Reason: reasonForCode(httpError.Code), Message: http.StatusText(httpError.Code)}
+		}
+	}
+
+	response.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	if response.RequestID == "" {
+		response.RequestID = c.Request().Header.Get(echo.HeaderXRequestID)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(response.Code)
+	} else {
+		err = c.JSON(response.Code, response)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// reasonForCode returns the Kubernetes status reason that corresponds to an HTTP status code.
+func reasonForCode(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return string(metav1.StatusReasonBadRequest)
+	case http.StatusUnauthorized:
+		return string(metav1.StatusReasonUnauthorized)
+	case http.StatusForbidden:
+		return string(metav1.StatusReasonForbidden)
+	case http.StatusNotFound:
+		return string(metav1.StatusReasonNotFound)
+	case http.StatusMethodNotAllowed:
+		return string(metav1.StatusReasonMethodNotAllowed)
+	case http.StatusConflict:
+		return string(metav1.StatusReasonConflict)
+	case http.StatusPreconditionFailed:
+		return "PreconditionFailed"
+	case http.StatusPreconditionRequired:
+		return "PreconditionRequired"
+	case http.StatusUnprocessableEntity:
+		return string(metav1.StatusReasonInvalid)
+	case http.StatusTooManyRequests:
+		return string(metav1.StatusReasonTooManyRequests)
+	case http.StatusServiceUnavailable:
+		return string(metav1.StatusReasonServiceUnavailable)
+	case http.StatusInternalServerError:
+		return string(metav1.StatusReasonInternalError)
+	default:
+		return strings.ReplaceAll(http.StatusText(code), " ", "")
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ETag returns the entity tag for a resourceVersion.
+func ETag(resourceVersion string) string {
+	return `"` + resourceVersion + `"`
+}
+
+// SetETag sets the ETag response header from an object's resourceVersion.
+func SetETag(c echo.Context, obj metav1.Object) {
+	if resourceVersion := obj.GetResourceVersion(); resourceVersion != "" {
+		c.Response().Header().Set("ETag", ETag(resourceVersion))
+	}
+}
+
+// IfMatch returns the resourceVersion carried by the If-Match request header. Updates
+// without the header are rejected with 428 Precondition Required.
+func IfMatch(c echo.Context) (string, error) {
+	value := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	value = strings.Trim(strings.TrimPrefix(value, "W/"), `"`)
+	if value == "" || value == "*" {
+		return "", echo.NewHTTPError(http.StatusPreconditionRequired, "If-Match header with the object's ETag is required")
+	}
+	return value, nil
+}
+
+// UpdateIfMatch updates resource only if its current resourceVersion matches the If-Match
+// header. When it does not, or the API server reports a conflict, it responds with 412
+// Precondition Failed, the current object and a field-level diff from the current object to
+// the submitted one. getFunc fetches the current object by name.
+func UpdateIfMatch(c echo.Context, namespace string, resource interface{}, getFunc func(string, string) (interface{}, error), updateFunc func(string, interface{}, metav1.UpdateOptions) (interface{}, error)) error {
+	ifMatch, err := IfMatch(c)
+	if err != nil {
+		return err
+	}
+
+	obj, err := meta.Accessor(resource)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid resource: "+err.Error())
+	}
+
+	current, err := getFunc(namespace, obj.GetName())
+	if err != nil {
+		return KubernetesError(err, "Failed to fetch current resource")
+	}
+	currentObj, err := meta.Accessor(current)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Invalid current resource: "+err.Error())
+	}
+	if currentObj.GetResourceVersion() != ifMatch {
+		return preconditionFailed(current, resource)
+	}
+
+	dryRun, err := DryRun(c)
+	if err != nil {
+		return err
+	}
+
+	obj.SetResourceVersion(ifMatch)
+	updatedResource, err := updateFunc(namespace, resource, metav1.UpdateOptions{DryRun: dryRun})
+	if apierrors.IsConflict(err) {
+		if current, getErr := getFunc(namespace, obj.GetName()); getErr == nil {
+			return preconditionFailed(current, resource)
+		}
+	}
+	if err != nil {
+		return KubernetesError(err, "Failed to update resource")
+	}
+
+	if dryRun != nil {
+		return DryRunResult(c, current, updatedResource)
+	}
+	if updatedObj, err := meta.Accessor(updatedResource); err == nil {
+		SetETag(c, updatedObj)
+	}
+	return c.JSON(http.StatusOK, updatedResource)
+}
+
+// preconditionFailed builds the 412 response for a stale update.
+func preconditionFailed(current, submitted interface{}) error {
+	diff, err := DiffObjects(current, submitted)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to diff resource: "+err.Error())
+	}
+
+	response := ErrorResponse{
+		Code:    http.StatusPreconditionFailed,
+		Reason:  reasonForCode(http.StatusPreconditionFailed),
+		Message: "The resource has been modified since it was read; review the current object and retry",
+		Current: current,
+		Diff:    diff,
+	}
+	if currentObj, err := meta.Accessor(current); err == nil {
+		response.ETag = ETag(currentObj.GetResourceVersion())
+	}
+	return echo.NewHTTPError(http.StatusPreconditionFailed, response)
+}
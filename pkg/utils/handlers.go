@@ -9,60 +9,91 @@ import (
 )
 
 // HandleHTTPMethod handles different HTTP methods for a given handler function.
-func HandleHTTPMethod(c echo.Context, clientset *kubernetes.Clientset, namespace string, handlers map[string]func(echo.Context, *kubernetes.Clientset, string) error) error {
+func HandleHTTPMethod(c echo.Context, clientset kubernetes.Interface, namespace string, handlers map[string]func(echo.Context, kubernetes.Interface, string) error) error {
 	if handler, exists := handlers[c.Request().Method]; exists {
 		return handler(c, clientset, namespace)
 	}
 	return echo.NewHTTPError(http.StatusMethodNotAllowed, "Method not allowed")
 }
 
-// ListResources lists resources in a specific namespace.
-func ListResources(c echo.Context, clientset *kubernetes.Clientset, namespace string, listFunc func(string, metav1.ListOptions) (interface{}, error)) error {
-	resources, err := listFunc(namespace, metav1.ListOptions{})
+// ListResources lists resources in a specific namespace, one page at a time, filtered by the
+// request's label and field selectors. The response is a ListResponse.
+func ListResources(c echo.Context, clientset kubernetes.Interface, namespace string, listFunc func(string, metav1.ListOptions) (interface{}, error)) error {
+	opts, err := ListOptions(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error listing resources: "+err.Error())
+		return err
 	}
-	return c.JSON(http.StatusOK, resources)
+
+	resources, err := listFunc(namespace, opts)
+	if err != nil {
+		return KubernetesError(err, "Error listing resources")
+	}
+
+	response, err := listResponse(resources)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error reading list: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, response)
 }
 
 // CreateResource creates a new resource in a specific namespace.
-func CreateResource(c echo.Context, clientset *kubernetes.Clientset, namespace string, resource interface{}, createFunc func(string, interface{}, metav1.CreateOptions) (interface{}, error)) error {
+func CreateResource(c echo.Context, clientset kubernetes.Interface, namespace string, resource interface{}, createFunc func(string, interface{}, metav1.CreateOptions) (interface{}, error)) error {
 	if err := c.Bind(resource); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Failed to decode request body: "+err.Error())
 	}
 
-	createdResource, err := createFunc(namespace, resource, metav1.CreateOptions{})
+	dryRun, err := DryRun(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create resource: "+err.Error())
+		return err
 	}
 
+	createdResource, err := createFunc(namespace, resource, metav1.CreateOptions{DryRun: dryRun})
+	if err != nil {
+		return KubernetesError(err, "Failed to create resource")
+	}
+
+	if dryRun != nil {
+		return DryRunResult(c, nil, createdResource)
+	}
 	return c.JSON(http.StatusOK, createdResource)
 }
 
-// UpdateResource updates an existing resource in a specific namespace.
-func UpdateResource(c echo.Context, clientset *kubernetes.Clientset, namespace string, resource interface{}, updateFunc func(string, interface{}, metav1.UpdateOptions) (interface{}, error)) error {
+// UpdateResource updates an existing resource in a specific namespace. The update must carry
+// an If-Match header with the ETag of the object it was based on; see UpdateIfMatch.
+func UpdateResource(c echo.Context, clientset kubernetes.Interface, namespace string, resource interface{}, getFunc func(string, string) (interface{}, error), updateFunc func(string, interface{}, metav1.UpdateOptions) (interface{}, error)) error {
 	if err := c.Bind(resource); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Failed to decode request body: "+err.Error())
 	}
 
-	updatedResource, err := updateFunc(namespace, resource, metav1.UpdateOptions{})
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update resource: "+err.Error())
-	}
-
-	return c.JSON(http.StatusOK, updatedResource)
+	return UpdateIfMatch(c, namespace, resource, getFunc, updateFunc)
 }
 
-// DeleteResource deletes a resource by name in a specific namespace.
-func DeleteResource(c echo.Context, clientset *kubernetes.Clientset, namespace, name string, deleteFunc func(string, string, metav1.DeleteOptions) error) error {
+// DeleteResource deletes a resource by name in a specific namespace. getFunc fetches the
+// current object, which a dry run reports as the object that would be removed.
+func DeleteResource(c echo.Context, clientset kubernetes.Interface, namespace, name string, getFunc func(string, string) (interface{}, error), deleteFunc func(string, string, metav1.DeleteOptions) error) error {
 	if name == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "Resource name is required")
 	}
 
-	err := deleteFunc(namespace, name, metav1.DeleteOptions{})
+	dryRun, err := DryRun(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete resource: "+err.Error())
+		return err
+	}
+
+	var current interface{}
+	if dryRun != nil {
+		if current, err = getFunc(namespace, name); err != nil {
+			return KubernetesError(err, "Failed to fetch current resource")
+		}
 	}
 
+	err = deleteFunc(namespace, name, metav1.DeleteOptions{DryRun: dryRun})
+	if err != nil {
+		return KubernetesError(err, "Failed to delete resource")
+	}
+
+	if dryRun != nil {
+		return DryRunResult(c, current, nil)
+	}
 	return c.JSON(http.StatusOK, map[string]string{"message": "Resource deleted successfully"})
 }
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ListResponse is the envelope returned by list routes. Continue is set when more items are
+// available and is passed back as the continue parameter to fetch the next page.
+type ListResponse struct {
+	Items              interface{} `json:"items"`
+	Continue           string      `json:"continue,omitempty"`
+	RemainingItemCount *int64      `json:"remainingItemCount,omitempty"`
+	ResourceVersion    string      `json:"resourceVersion,omitempty"`
+}
+
+// ListOptions builds list options from the limit, continue, labelSelector and fieldSelector
+// query parameters.
+func ListOptions(c echo.Context) (metav1.ListOptions, error) {
+	opts := metav1.ListOptions{
+		Continue:      c.QueryParam("continue"),
+		LabelSelector: c.QueryParam("labelSelector"),
+		FieldSelector: c.QueryParam("fieldSelector"),
+	}
+
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 0 {
+			return opts, echo.NewHTTPError(http.StatusBadRequest, "Invalid limit parameter: "+value)
+		}
+		opts.Limit = limit
+	}
+	if _, err := labels.Parse(opts.LabelSelector); err != nil {
+		return opts, echo.NewHTTPError(http.StatusBadRequest, "Invalid labelSelector parameter: "+err.Error())
+	}
+	if _, err := fields.ParseSelector(opts.FieldSelector); err != nil {
+		return opts, echo.NewHTTPError(http.StatusBadRequest, "Invalid fieldSelector parameter: "+err.Error())
+	}
+
+	return opts, nil
+}
+
+// NewListResponse wraps items in the list envelope, with the paging state of list.
+func NewListResponse(list metav1.ListInterface, items interface{}) ListResponse {
+	return ListResponse{
+		Items:              items,
+		Continue:           list.GetContinue(),
+		RemainingItemCount: list.GetRemainingItemCount(),
+		ResourceVersion:    list.GetResourceVersion(),
+	}
+}
+
+// listResponse wraps a list object returned by the Kubernetes API in the list envelope.
+func listResponse(resources interface{}) (ListResponse, error) {
+	object, ok := resources.(runtime.Object)
+	if !ok {
+		return ListResponse{}, fmt.Errorf("%T is not a list object", resources)
+	}
+	list, err := meta.ListAccessor(object)
+	if err != nil {
+		return ListResponse{}, err
+	}
+	items, err := meta.ExtractList(object)
+	if err != nil {
+		return ListResponse{}, err
+	}
+	return NewListResponse(list, items), nil
+}
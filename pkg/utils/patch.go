@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// FieldManager is the field manager Kuberus uses for server-side apply and patches.
+const FieldManager = "kuberus"
+
+// patchTypes maps the accepted PATCH content types to Kubernetes patch types.
+var patchTypes = map[string]types.PatchType{
+	string(types.JSONPatchType):    types.JSONPatchType,
+	string(types.MergePatchType):   types.MergePatchType,
+	string(types.ApplyPatchType):   types.ApplyPatchType,
+	"application/apply-patch+json": types.ApplyPatchType,
+}
+
+// managerPattern extracts the manager name from a field manager conflict message.
+var managerPattern = regexp.MustCompile(`conflict with "([^"]*)"`)
+
+// FieldConflict is a field owned by another field manager that a server-side apply tried to change.
+type FieldConflict struct {
+	Field   string `json:"field"`
+	Manager string `json:"manager"`
+	Message string `json:"message"`
+}
+
+// PatchType returns the patch type for the request's Content-Type header: JSON patch, merge
+// patch or server-side apply.
+func PatchType(c echo.Context) (types.PatchType, error) {
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		mediaType = ""
+	}
+	patchType, ok := patchTypes[mediaType]
+	if !ok {
+		return "", echo.NewHTTPError(http.StatusUnsupportedMediaType,
+			"Content-Type must be one of application/json-patch+json, application/merge-patch+json or application/apply-patch+yaml")
+	}
+	return patchType, nil
+}
+
+// PatchResource patches a resource by name in a specific namespace. The patch type follows the
+// Content-Type header. Server-side apply uses the kuberus field manager and takes ownership of
+// conflicting fields only when the force query parameter is true. getFunc fetches the current
+// object, which a dry run compares with the patched one.
+func PatchResource(c echo.Context, namespace, name string, getFunc func(string, string) (interface{}, error), patchFunc func(string, string, types.PatchType, []byte, metav1.PatchOptions) (interface{}, error)) error {
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Resource name is required")
+	}
+
+	patchType, err := PatchType(c)
+	if err != nil {
+		return err
+	}
+
+	force := false
+	if value := c.QueryParam("force"); value != "" {
+		if force, err = strconv.ParseBool(value); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid force parameter: "+value)
+		}
+	}
+	if force && patchType != types.ApplyPatchType {
+		return echo.NewHTTPError(http.StatusBadRequest, "force is only supported for server-side apply")
+	}
+
+	data, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read request body: "+err.Error())
+	}
+	if len(data) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Patch body is required")
+	}
+
+	dryRun, err := DryRun(c)
+	if err != nil {
+		return err
+	}
+
+	// A server-side apply may create the object, so a missing one is not an error.
+	var current interface{}
+	if dryRun != nil {
+		current, err = getFunc(namespace, name)
+		if err != nil && !(apierrors.IsNotFound(err) && patchType == types.ApplyPatchType) {
+			return KubernetesError(err, "Failed to fetch current resource")
+		}
+		if err != nil {
+			current = nil
+		}
+	}
+
+	opts := metav1.PatchOptions{FieldManager: FieldManager, DryRun: dryRun}
+	if patchType == types.ApplyPatchType {
+		opts.Force = &force
+	}
+
+	patchedResource, err := patchFunc(namespace, name, patchType, data, opts)
+	if err != nil {
+		if conflicts := applyConflicts(err); len(conflicts) > 0 {
+			return applyConflictError(err, conflicts)
+		}
+		return KubernetesError(err, "Failed to patch resource")
+	}
+
+	if dryRun != nil {
+		return DryRunResult(c, current, patchedResource)
+	}
+	if patchedObj, err := meta.Accessor(patchedResource); err == nil {
+		SetETag(c, patchedObj)
+	}
+	return c.JSON(http.StatusOK, patchedResource)
+}
+
+// applyConflicts returns the field manager conflicts reported by a failed server-side apply.
+func applyConflicts(err error) []FieldConflict {
+	var apiStatus apierrors.APIStatus
+	if !apierrors.IsConflict(err) || !errors.As(err, &apiStatus) || apiStatus.Status().Details == nil {
+		return nil
+	}
+
+	var conflicts []FieldConflict
+	for _, cause := range apiStatus.Status().Details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		conflict := FieldConflict{Field: cause.Field, Message: cause.Message}
+		if match := managerPattern.FindStringSubmatch(cause.Message); match != nil {
+			conflict.Manager = match[1]
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts
+}
+
+// applyConflictError describes field manager conflicts as a 409 listing each field and its owner.
+func applyConflictError(err error, conflicts []FieldConflict) *echo.HTTPError {
+	fields := make([]string, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		fields = append(fields, fmt.Sprintf("%s is owned by %q", conflict.Field, conflict.Manager))
+	}
+
+	response := ErrorResponse{
+		Code:      http.StatusConflict,
+		Reason:    string(metav1.StatusReasonConflict),
+		Message:   "Apply conflicts with fields managed by others: " + strings.Join(fields, "; ") + ". Retry with force=true to take ownership of them",
+		Conflicts: conflicts,
+	}
+	return echo.NewHTTPError(response.Code, response).SetInternal(err)
+}
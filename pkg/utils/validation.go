@@ -3,6 +3,7 @@ package utils
 import (
 	"errors"
 
+	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 )
 
@@ -17,6 +18,18 @@ func ValidateRole(role *rbacv1.Role) error {
 	return nil
 }
 
+// ValidateClusterRole ensures that the cluster role is valid. An aggregated cluster role may
+// have no rules of its own.
+func ValidateClusterRole(clusterRole *rbacv1.ClusterRole) error {
+	if clusterRole.Name == "" {
+		return errors.New("cluster role name is required")
+	}
+	if len(clusterRole.Rules) == 0 && clusterRole.AggregationRule == nil {
+		return errors.New("at least one rule or an aggregation rule is required")
+	}
+	return nil
+}
+
 // ValidateRoleBinding ensures that the role binding is valid.
 func ValidateRoleBinding(roleBinding *rbacv1.RoleBinding) error {
 	if roleBinding.Name == "" {
@@ -44,3 +57,19 @@ func ValidateClusterRoleBinding(clusterRoleBinding *rbacv1.ClusterRoleBinding) e
 	}
 	return nil
 }
+
+// ValidateServiceAccount ensures that the service account is valid.
+func ValidateServiceAccount(serviceAccount *corev1.ServiceAccount) error {
+	if serviceAccount.Name == "" {
+		return errors.New("service account name is required")
+	}
+	return nil
+}
+
+// ValidateNamespace ensures that the namespace is valid.
+func ValidateNamespace(namespace *corev1.Namespace) error {
+	if namespace.Name == "" {
+		return errors.New("namespace name is required")
+	}
+	return nil
+}
@@ -13,6 +13,7 @@ import { motion } from "framer-motion";
 import { useEffect, useState } from "react";
 import { usePathname, useRouter } from "next/navigation";
 import { Toggle } from "@/components/ui/toggle";
+import { useRBACWatch } from "@/hooks/useRBACWatch";
 
 export const pageVariants = {
   initial: { opacity: 0, y: 20 },
@@ -28,6 +29,7 @@ const Layout = ({
   const [isSideNavExpanded, setIsSideNavExpanded] = useState(false);
   const pathname = usePathname();
   const router = useRouter();
+  useRBACWatch();
 
   useEffect(() => {
     if (pathname === "/dashboard") {
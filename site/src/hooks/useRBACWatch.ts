@@ -0,0 +1,41 @@
+import { useEffect } from "react";
+import { useQueryClient } from "@tanstack/react-query";
+import { API_BASE_URL } from "@/lib/apiClient";
+import { ENDPOINTS } from "@/lib/endpoints";
+
+// Query keys to refresh when an object of each kind changes
+const QUERY_KEYS_BY_KIND: Record<string, string[]> = {
+  Namespace: ["Namespaces"],
+  Role: ["Roles", "RoleDetails"],
+  ClusterRole: ["ClusterRoles"],
+  RoleBinding: ["RoleBindings", "RoleDetails"],
+  ClusterRoleBinding: ["ClusterRoleBindings", "Groups"],
+  ServiceAccount: ["ServiceAccounts"],
+};
+
+const WATCH_EVENTS = ["ADDED", "MODIFIED", "DELETED", "RESYNC"];
+
+/**
+ * Subscribes to the RBAC change stream and refreshes the affected queries,
+ * so that tables stay current when RBAC is changed outside the dashboard.
+ */
+export function useRBACWatch() {
+  const queryClient = useQueryClient();
+
+  useEffect(() => {
+    // EventSource reconnects on its own and resumes from the last event id
+    const source = new EventSource(
+      `${API_BASE_URL}${ENDPOINTS.K8S_RESOURCES.WATCH}`
+    );
+
+    const handleEvent = (event: MessageEvent) => {
+      const { kind } = JSON.parse(event.data);
+      for (const queryKey of QUERY_KEYS_BY_KIND[kind] ?? []) {
+        queryClient.invalidateQueries({ queryKey: [queryKey] });
+      }
+    };
+
+    WATCH_EVENTS.forEach((type) => source.addEventListener(type, handleEvent));
+    return () => source.close();
+  }, [queryClient]);
+}
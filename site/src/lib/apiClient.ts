@@ -1,6 +1,6 @@
 import { ENDPOINTS } from "./endpoints";
 
-const API_BASE_URL = process.env.NODE_ENV === 'development'
+export const API_BASE_URL = process.env.NODE_ENV === 'development'
   ? 'http://localhost:8080'
   : `${typeof window !== 'undefined' ? window.location.origin : ''}`;
 
@@ -42,7 +42,8 @@ class ApiClient {
 
   // Role-related methods
   async getRoles() {
-    return this.fetch(ENDPOINTS.RBAC.ROLES.BASE);
+    const response = await this.fetch(ENDPOINTS.RBAC.ROLES.BASE);
+    return response.items;
   }
 
   async deleteRoles(namespace: string, name: string) {
@@ -70,6 +71,9 @@ class ApiClient {
   async updateRole(namespace: string, name: string, roleData: any) {
     return this.fetch(ENDPOINTS.RBAC.ROLES.UPDATE(namespace, name), {
       method: "PUT",
+      headers: {
+        "If-Match": `"${roleData?.metadata?.resourceVersion ?? ""}"`,
+      },
       body: JSON.stringify(roleData),
     });
   }
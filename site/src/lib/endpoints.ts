@@ -12,6 +12,7 @@ export const ENDPOINTS = {
     RESOURCES: "/api/resources",
     NAMESPACES: "/api/namespaces",
     DELETENAMESPACE: (namespace: string) => `/api/namespaces?name=${namespace}`,
+    WATCH: "/api/watch",
   },
 
   // RBAC-related endpoints